@@ -3,20 +3,26 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math"
+	"mime"
 	"net"
 	"net/http"
-	"reflect"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	mod "vaibhavyadav-dev/healthcareServer/databases"
+	"vaibhavyadav-dev/healthcareServer/events"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/go-redis/redis/v8"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"golang.org/x/crypto/bcrypt"
 
@@ -34,22 +40,55 @@ const (
 	contextKeyHealthCareID      = contextKey("healthcareID")
 	contextKeyEmailHealthCareID = contextKey("healthcare_email")
 	contextKeyHealthCareName    = contextKey("healthcare_name")
+	contextKeyTokenClaims       = contextKey("token_claims")
+	contextKeyPatientHealthID   = contextKey("patient_health_id")
+	contextKeyCorrelationID     = contextKey("correlation_id")
 )
 
 type Store interface {
 	// PostgreSQL Methods goes here...
-	SignUpAccount(*mod.HIPInfo) (int64, error)
+	SignUpAccount(*mod.HIPInfo, ...*mod.OutboxEvent) (int64, error)
 	LoginUser(*mod.Login) (*mod.HIPInfo, error)
-	ChangePreferance(string, map[string]interface{}) error
+	ChangePreferance(string, map[string]interface{}, ...*mod.OutboxEvent) error
 	GetPreferance(string) (*mod.Preferance, error)
 	GetTotalRequestCount(string) (int, error)
+	UpdatePassword(healthcare_id, passwordHash string) error
+	SetAccountLocked(healthcare_id string, locked bool) error
+	IsAccountLocked(healthcare_id string) (bool, error)
 	CreateClient_stats(string) error
-	GetAppointments_postgres(health_id string, offset, limit int64) ([]*mod.Appointments, error)
-	SetAppointments_postgres(healthcare_id, health_id, status string, id int64) (int64, error)
-	Create_ClientProfile(*mod.PatientDetails) error
+	GetAppointments_postgres(healthcare_id string, filter *mod.AppointmentFilter) ([]*mod.Appointments, int64, error)
+	CreateAppointment(appointment *mod.Appointments, actor string) error
+	GetAppointment(healthcare_id string, id int64) (*mod.Appointments, error)
+	TransitionAppointment(healthcare_id string, id int64, status, actor, reason string, events ...*mod.OutboxEvent) (*mod.Appointments, error)
+	GetAppointmentHistory(appointmentID int64) ([]*mod.AppointmentStatusChange, error)
+	BookedSlots(healthcare_id, department, date string) ([]string, error)
+	SetAvailability(healthcare_id, department string, windows []*mod.Availability) error
+	GetAvailability(healthcare_id, department string) ([]*mod.Availability, error)
+	Create_ClientProfile(*mod.PatientDetails, ...*mod.OutboxEvent) error
 	Get_ClientProfile(string) (*mod.PatientDetails, error)
-	Update_clientProfile(string, map[string]interface{}) (*mod.PatientDetails, error)
+	FindClientsByAadhaar(healthcareID, aadhaar string) ([]string, error)
+	SearchClients(q mod.ClientSearch) ([]*mod.ClientSearchResult, bool, error)
+	Update_clientProfile(health_id, actor string, patch *mod.ProfilePatch, events ...*mod.OutboxEvent) (*mod.PatientDetails, error)
+	ListProfileVersions(health_id string) ([]*mod.ProfileVersion, error)
+	ClientProfileAt(health_id string, at time.Time) (*mod.PatientDetails, error)
+	RevertClientProfile(health_id string, version int, actor string, events ...*mod.OutboxEvent) (*mod.PatientDetails, int, error)
 	GetHealthcare_details_postgres(string) (*mod.HIPInfo, error)
+	RequestConsent(consent *mod.Consent, token, tokenHash, healthcareName, correlationID string) error
+	DecideConsent(tokenHash string, approve bool) (*mod.Consent, error)
+	RevokeConsentByToken(tokenHash string) (*mod.Consent, error)
+	RevokeConsent(healthcare_id string, id int64) (*mod.Consent, error)
+	ListConsents(healthcare_id, health_id string) ([]*mod.Consent, error)
+	HasConsent(healthcare_id, health_id, scope string, breakGlass bool) (bool, error)
+	OpenBreakGlass(access *mod.BreakGlass, healthcareName, correlationID string) error
+	ListBreakGlass(healthcare_id string, pending bool) ([]*mod.BreakGlass, error)
+	ReviewBreakGlass(healthcare_id string, id int64, reviewer, note string) (*mod.BreakGlass, error)
+	AppendAudit(entries ...*mod.AuditEntry) error
+	QueryAuditLog(q mod.AuditQuery) ([]*mod.AuditEntry, error)
+	PatientAccessReport(health_id string, beforeID int64, limit int) ([]*mod.AccessReportEntry, error)
+	FindDuplicates(healthcare_id, health_id string, minScore float64, limit int) ([]*mod.DuplicateCandidate, error)
+	DismissDuplicate(healthcare_id, health_id, other_health_id, actor string) error
+	MergePatients(healthcare_id, health_id, duplicate, actor, reason string) (*mod.PatientMerge, error)
+	ResolveHealthID(health_id string) (string, error)
 
 	/////////////////////////////////////////////////////////////////////////////
 	/////////////////////////////////////////////////////////////////////////////
@@ -71,32 +110,65 @@ type Store interface {
 	/////////////////////////////////////////////////////////////////////////////
 	/////////////////////////////////////////////////////////////////////////////
 	// Rabbitmq methods goes here...
-	Push_logs(interface{}, interface{}, interface{}, interface{}, interface{}, interface{}) error
-	Push_update_appointment(appointment map[string]interface{}) error
-	Push_patient_records(map[string]interface{}) error
-	Push_patientbiodata(map[string]interface{}) error
-	Push_counters(string, string) error
+	// nothing is published directly, every message is written to the outbox first
+	EnqueueEvents(events ...*mod.OutboxEvent) error
+	Push_event(correlationID string, event events.Event) error
 
 	/////////////////////////////////////////////////////////////////////////////
 	/////////////////////////////////////////////////////////////////////////////
 	// Redis Implementation Goes here
 	Set(string, interface{}) error
 	Get(string) (interface{}, error)
+	SetNX(key string, value interface{}, ttl time.Duration) (bool, error)
+	GetDel(key string) (string, error)
+	SetWithTTL(key, value string, ttl time.Duration) error
 	Close() error
 	// rate limiter goes here...
 	IsAllowed(string) (bool, error)
 	IsAllowed_leaky_bucket(string) (bool, error)
+	// login brute force protection
+	LoginBackoff(healthcare_id, ip string) (time.Duration, error)
+	RegisterLoginFailure(healthcare_id, ip string) (int64, int64, error)
+	ResetLoginFailures(healthcare_id string) error
+	// sessions, refresh tokens and revocation
+	CreateSession(sessionID, owner, refreshHash string, data interface{}, ttl time.Duration) error
+	RotateSession(sessionID, refreshHash, newRefreshHash string, ttl time.Duration) (string, error)
+	RevokeSession(sessionID string) error
+	RevokeAllSessions(owner string) error
+	RevokeToken(jti string, ttl time.Duration) error
+	IsTokenRevoked(jti, sessionID string) (bool, error)
+
+	// staff accounts and roles
+	CreateStaff(*mod.Staff) error
+	GetStaff(staffID string) (*mod.Staff, error)
+	ListStaff(healthcare_id string) ([]*mod.Staff, error)
+	UpdateStaffRole(healthcare_id, staffID, role string) error
+	UpdateStaffPassword(staffID, passwordHash string) error
+	SetStaffLocked(staffID string, locked bool) error
+	DeleteStaff(healthcare_id, staffID string) error
+
+	// two factor authentication
+	SaveTwoFactorSecret(healthcare_id, secret string) error
+	GetTwoFactor(healthcare_id string) (*mod.TwoFactor, error)
+	EnableTwoFactor(healthcare_id string, recoveryCodeHashes []string) error
+	DisableTwoFactor(healthcare_id string) error
+	UseRecoveryCode(healthcare_id, code string) (bool, error)
 }
 
 type APIServer struct {
 	listenAddr string
 	store      Store
+	keys       *KeyRegistry
+	// proxies allowed to tell us the client address in X-Forwarded-For
+	trustedProxies []*net.IPNet
 }
 
-func NewAPIServer(listen string, store Store) *APIServer {
+func NewAPIServer(listen string, store Store, keys *KeyRegistry, trustedProxies []*net.IPNet) *APIServer {
 	return &APIServer{
-		listenAddr: listen,
-		store:      store,
+		listenAddr:     listen,
+		store:          store,
+		keys:           keys,
+		trustedProxies: trustedProxies,
 	}
 }
 
@@ -104,27 +176,87 @@ func (s *APIServer) Run() {
 	router := mux.NewRouter()
 	// Add Prometheus middleware to all routes
 	router.Use(PrometheusMiddleware)
+	router.Use(CorrelationMiddleware)
 	router.Path("/metrics").Handler(promhttp.Handler())
+	router.HandleFunc("/.well-known/jwks.json", makeHTTPHandlerFunc(s.GetJWKS))
 
 	router.HandleFunc("/api/v1/healthcare/auth/register", (makeHTTPHandlerFunc(s.SignUp)))
 	router.HandleFunc("/api/v1/healthcare/auth/login", (makeHTTPHandlerFunc(s.LoginUser)))
-
+	router.HandleFunc("/api/v1/healthcare/auth/unlock", (makeHTTPHandlerFunc(s.UnlockAccount)))
+	router.HandleFunc("/api/v1/healthcare/auth/password/forgot", (makeHTTPHandlerFunc(s.ForgotPassword)))
+	router.HandleFunc("/api/v1/healthcare/auth/password/reset", (makeHTTPHandlerFunc(s.ResetPassword)))
+	router.HandleFunc("/api/v1/healthcare/auth/password/change", s.withJWTAuth(s.RateLimiter(makeHTTPHandlerFunc(s.ChangePassword))))
+	router.HandleFunc("/api/v1/healthcare/auth/refresh", (makeHTTPHandlerFunc(s.RefreshToken)))
+	router.HandleFunc("/api/v1/healthcare/auth/logout", s.withJWTAuth(makeHTTPHandlerFunc(s.Logout)))
+	router.HandleFunc("/api/v1/healthcare/auth/logout-all", s.withJWTAuth(makeHTTPHandlerFunc(s.LogoutAll)))
+	router.HandleFunc("/api/v1/healthcare/auth/2fa/challenge", (makeHTTPHandlerFunc(s.TwoFactorChallenge)))
+	router.HandleFunc("/api/v1/healthcare/auth/2fa/enroll", s.withJWTAuth(s.RateLimiter(makeHTTPHandlerFunc(s.TwoFactorEnroll))))
+	router.HandleFunc("/api/v1/healthcare/auth/2fa/verify", s.withJWTAuth(s.RateLimiter(makeHTTPHandlerFunc(s.TwoFactorVerify))))
+	router.HandleFunc("/api/v1/healthcare/auth/2fa/disable", s.withJWTAuth(s.RateLimiter(makeHTTPHandlerFunc(s.TwoFactorDisable))))
+
+	router.HandleFunc("/api/v1/healthcare/staff/login", (makeHTTPHandlerFunc(s.StaffLogin)))
+
+	// every route below declares the permission its caller's role must have
 	// this one will serve from postgres
-	router.HandleFunc("/api/v1/healthcare/preferance/get", withJWTAuth(s.RateLimiter(makeHTTPHandlerFunc(s.GetPreferance))))
-	router.HandleFunc("/api/v1/healthcare/preferance/change", withJWTAuth(s.RateLimiter(makeHTTPHandlerFunc(s.Update_Preferance))))
-	router.HandleFunc("/api/v1/healthcare/delete/account", withJWTAuth(s.RateLimiter(makeHTTPHandlerFunc(s.DeleteAccount))))
+	router.HandleFunc("/api/v1/healthcare/preferance/get", s.withJWTAuth(s.Authorize(PermPreferanceRead, s.RateLimiter(makeHTTPHandlerFunc(s.GetPreferance)))))
+	router.HandleFunc("/api/v1/healthcare/preferance/change", s.withJWTAuth(s.Authorize(PermPreferanceWrite, s.RateLimiter(makeHTTPHandlerFunc(s.Update_Preferance)))))
+	router.HandleFunc("/api/v1/healthcare/delete/account", s.withJWTAuth(s.Authorize(PermAccountDelete, s.RateLimiter(makeHTTPHandlerFunc(s.DeleteAccount)))))
 
 	// this is will server from mongodb
-	router.HandleFunc("/api/v1/healthcare/appointments/get", withJWTAuth(s.RateLimiter(makeHTTPHandlerFunc(s.GetAppointments))))
-	router.HandleFunc("/api/v1/healthcare/appointments/set", withJWTAuth(s.RateLimiter(makeHTTPHandlerFunc(s.SetAppointments))))
-	router.HandleFunc("/api/v1/healthcare/details", withJWTAuth(s.RateLimiter(makeHTTPHandlerFunc(s.GetHealthcare_details))))
-
-	router.HandleFunc("/api/v1/healthcare/client/records/create", withJWTAuth(s.RateLimiter(makeHTTPHandlerFunc(s.CreatepatientRecords))))
-	router.HandleFunc("/api/v1/healthcare/client/records/fetch", withJWTAuth(s.RateLimiter(makeHTTPHandlerFunc(s.GetPatientRecords))))
-
-	router.HandleFunc("/api/v1/healthcare/client/profile/create", withJWTAuth(s.RateLimiter(makeHTTPHandlerFunc(s.Create_ClientProfile))))
-	router.HandleFunc("/api/v1/healthcare/client/profile/get", withJWTAuth(s.RateLimiter(makeHTTPHandlerFunc(s.Get_clientProfile))))
-	router.HandleFunc("/api/v1/healthcare/client/profile/update", withJWTAuth(s.RateLimiter(makeHTTPHandlerFunc(s.UpdateClientProfile))))
+	router.HandleFunc("/api/v1/healthcare/appointments/get", s.withJWTAuth(s.Authorize(PermAppointmentsRead, s.RateLimiter(makeHTTPHandlerFunc(s.GetAppointments)))))
+	router.HandleFunc("/api/v1/healthcare/appointments/set", s.withJWTAuth(s.Authorize(PermAppointmentsWrite, s.RateLimiter(makeHTTPHandlerFunc(s.SetAppointments)))))
+	router.HandleFunc("/api/v1/healthcare/appointments/create", s.withJWTAuth(s.Authorize(PermAppointmentsWrite, s.RateLimiter(makeHTTPHandlerFunc(s.CreateAppointment)))))
+	router.HandleFunc("/api/v1/healthcare/appointments/history", s.withJWTAuth(s.Authorize(PermAppointmentsRead, s.RateLimiter(makeHTTPHandlerFunc(s.GetAppointmentHistory)))))
+	router.HandleFunc("/api/v1/healthcare/appointments/slots", s.withJWTAuth(s.Authorize(PermAppointmentsRead, s.RateLimiter(makeHTTPHandlerFunc(s.GetFreeSlots)))))
+	router.HandleFunc("/api/v1/healthcare/appointments/availability/get", s.withJWTAuth(s.Authorize(PermAppointmentsRead, s.RateLimiter(makeHTTPHandlerFunc(s.GetAvailability)))))
+	router.HandleFunc("/api/v1/healthcare/appointments/availability/set", s.withJWTAuth(s.Authorize(PermScheduleManage, s.RateLimiter(makeHTTPHandlerFunc(s.SetAvailability)))))
+	router.HandleFunc("/api/v1/healthcare/details", s.withJWTAuth(s.Authorize(PermHealthcareRead, s.RateLimiter(makeHTTPHandlerFunc(s.GetHealthcare_details)))))
+
+	router.HandleFunc("/api/v1/healthcare/client/records/create", s.withJWTAuth(s.Authorize(PermRecordsWrite, s.RateLimiter(makeHTTPHandlerFunc(s.CreatepatientRecords)))))
+	router.HandleFunc("/api/v1/healthcare/client/records/fetch", s.withJWTAuth(s.Authorize(PermRecordsRead, s.RateLimiter(makeHTTPHandlerFunc(s.GetPatientRecords)))))
+
+	router.HandleFunc("/api/v1/healthcare/client/profile/create", s.withJWTAuth(s.Authorize(PermProfileWrite, s.RateLimiter(makeHTTPHandlerFunc(s.Create_ClientProfile)))))
+	router.HandleFunc("/api/v1/healthcare/client/profile/get", s.withJWTAuth(s.Authorize(PermProfileRead, s.RateLimiter(makeHTTPHandlerFunc(s.Get_clientProfile)))))
+	router.HandleFunc("/api/v1/healthcare/client/profile/update", s.withJWTAuth(s.Authorize(PermProfileWrite, s.RateLimiter(makeHTTPHandlerFunc(s.UpdateClientProfile)))))
+	router.HandleFunc("/api/v1/healthcare/client/profile/versions", s.withJWTAuth(s.Authorize(PermProfileRead, s.RateLimiter(makeHTTPHandlerFunc(s.ListProfileVersions)))))
+	router.HandleFunc("/api/v1/healthcare/client/profile/at", s.withJWTAuth(s.Authorize(PermProfileRead, s.RateLimiter(makeHTTPHandlerFunc(s.GetClientProfileAt)))))
+	router.HandleFunc("/api/v1/healthcare/client/profile/revert", s.withJWTAuth(s.Authorize(PermProfileWrite, s.RateLimiter(makeHTTPHandlerFunc(s.RevertClientProfile)))))
+	router.HandleFunc("/api/v1/healthcare/client/profile/lookup", s.withJWTAuth(s.Authorize(PermProfileRead, s.RateLimiter(makeHTTPHandlerFunc(s.LookupClientByAadhaar)))))
+	router.HandleFunc("/api/v1/healthcare/client/search", s.withJWTAuth(s.Authorize(PermProfileRead, s.RateLimiter(makeHTTPHandlerFunc(s.SearchClients)))))
+
+	// patients registered twice, a merged health id keeps resolving to the one it was merged into
+	router.HandleFunc("/api/v1/healthcare/client/duplicates", s.withJWTAuth(s.Authorize(PermProfileRead, s.RateLimiter(makeHTTPHandlerFunc(s.ListDuplicates)))))
+	router.HandleFunc("/api/v1/healthcare/client/duplicates/dismiss", s.withJWTAuth(s.Authorize(PermPatientMerge, s.RateLimiter(makeHTTPHandlerFunc(s.DismissDuplicate)))))
+	router.HandleFunc("/api/v1/healthcare/client/merge", s.withJWTAuth(s.Authorize(PermPatientMerge, s.RateLimiter(makeHTTPHandlerFunc(s.MergePatients)))))
+
+	// patient consent, the healthcare asks and the patient answers with the token from the email
+	router.HandleFunc("/api/v1/healthcare/consents/request", s.withJWTAuth(s.Authorize(PermConsentRequest, s.RateLimiter(makeHTTPHandlerFunc(s.RequestConsent)))))
+	router.HandleFunc("/api/v1/healthcare/consents/list", s.withJWTAuth(s.Authorize(PermConsentRead, s.RateLimiter(makeHTTPHandlerFunc(s.ListConsents)))))
+	router.HandleFunc("/api/v1/healthcare/consents/revoke", s.withJWTAuth(s.Authorize(PermConsentRequest, s.RateLimiter(makeHTTPHandlerFunc(s.RevokeConsent)))))
+	router.HandleFunc("/api/v1/client/consents/approve", (makeHTTPHandlerFunc(s.ApproveConsent)))
+	router.HandleFunc("/api/v1/client/consents/reject", (makeHTTPHandlerFunc(s.RejectConsent)))
+	router.HandleFunc("/api/v1/client/consents/revoke", (makeHTTPHandlerFunc(s.RevokeConsentAsPatient)))
+
+	// emergency access without consent, reviewed by an admin afterwards
+	router.HandleFunc("/api/v1/healthcare/breakglass/records", s.withJWTAuth(s.Authorize(PermBreakGlass, s.RateLimiter(makeHTTPHandlerFunc(s.BreakGlassRecords)))))
+	router.HandleFunc("/api/v1/healthcare/breakglass/profile", s.withJWTAuth(s.Authorize(PermBreakGlass, s.RateLimiter(makeHTTPHandlerFunc(s.BreakGlassProfile)))))
+	router.HandleFunc("/api/v1/healthcare/breakglass/reviews", s.withJWTAuth(s.Authorize(PermBreakGlassReview, s.RateLimiter(makeHTTPHandlerFunc(s.ListBreakGlass)))))
+	router.HandleFunc("/api/v1/healthcare/breakglass/signoff", s.withJWTAuth(s.Authorize(PermBreakGlassReview, s.RateLimiter(makeHTTPHandlerFunc(s.SignOffBreakGlass)))))
+
+	// who accessed which patient, the log itself is append-only
+	router.HandleFunc("/api/v1/healthcare/audit", s.withJWTAuth(s.Authorize(PermAuditRead, s.RateLimiter(makeHTTPHandlerFunc(s.GetAuditLog)))))
+
+	// patients sign in with an emailed token and read who accessed their data
+	router.HandleFunc("/api/v1/client/auth/link", (makeHTTPHandlerFunc(s.PatientSignInLink)))
+	router.HandleFunc("/api/v1/client/auth/token", (makeHTTPHandlerFunc(s.PatientSignIn)))
+	router.HandleFunc("/api/v1/client/access-report", s.withPatientAuth(makeHTTPHandlerFunc(s.GetAccessReport)))
+	router.HandleFunc("/api/v1/client/access-report/export", s.withPatientAuth(makeHTTPHandlerFunc(s.ExportAccessReport)))
+
+	// staff accounts
+	router.HandleFunc("/api/v1/healthcare/staff/create", s.withJWTAuth(s.Authorize(PermStaffManage, s.RateLimiter(makeHTTPHandlerFunc(s.CreateStaff)))))
+	router.HandleFunc("/api/v1/healthcare/staff/list", s.withJWTAuth(s.Authorize(PermStaffRead, s.RateLimiter(makeHTTPHandlerFunc(s.ListStaff)))))
+	router.HandleFunc("/api/v1/healthcare/staff/role", s.withJWTAuth(s.Authorize(PermStaffManage, s.RateLimiter(makeHTTPHandlerFunc(s.UpdateStaffRole)))))
+	router.HandleFunc("/api/v1/healthcare/staff/delete", s.withJWTAuth(s.Authorize(PermStaffManage, s.RateLimiter(makeHTTPHandlerFunc(s.DeleteStaff)))))
 
 	c := cors.New(cors.Options{
 		AllowedOrigins:   []string{"*"},
@@ -165,8 +297,23 @@ func (s *APIServer) SignUp(w http.ResponseWriter, r *http.Request) error {
 		})
 	}
 
+	// GET IP Addrress of user
+	// for logging and monitering purpose only, this will help to
+	// moniter account
+	ip := s.clientIP(r)
+	// send Email to healthcare that his account has been created now,
+	// the email is queued in the same transaction that creates the account
+	created, err := mod.NewEvent(correlationID(r), events.AccountCreated{
+		Healthcare: events.Healthcare{HealthcareID: user.HealthcareID, HealthcareName: user.HealthcareName},
+		Email:      user.Email,
+		IPAddress:  ip,
+	})
+	if err != nil {
+		return err
+	}
+
 	// store in postgres !!
-	_, err = s.store.SignUpAccount(user)
+	_, err = s.store.SignUpAccount(user, created)
 	if err != nil {
 		return writeJSON(w, http.StatusNotAcceptable, map[string]interface{}{
 			"message": "User already exists",
@@ -183,27 +330,6 @@ func (s *APIServer) SignUp(w http.ResponseWriter, r *http.Request) error {
 	// 	})
 	// }
 
-	// GET IP Addrress of user
-	// for logging and monitering purpose only, this will help to
-	// moniter account
-	ip := r.Header.Get("X-Forwarded-For")
-	// get from header if empty
-	if ip == "" {
-		ip = r.Header.Get("X-Real-IP")
-	}
-	// get from rmote address
-	if ip == "" {
-		ip, _, _ = net.SplitHostPort(r.RemoteAddr)
-	}
-	// send Email to healthcare that his account has been created now
-	err = s.store.Push_logs("hip_accountCreated", user.HealthcareName, user.Email, ip, user.HealthcareName, user.HealthcareID)
-	if err != nil {
-		return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
-			"message": "Something mishappened from our side :)",
-			"error":   err.Error(),
-		})
-	}
-
 	return writeJSON(w, http.StatusCreated, map[string]interface{}{
 		"status": "Successfully Created",
 		"Healthcare_details": map[string]interface{}{
@@ -229,6 +355,25 @@ func (s *APIServer) LoginUser(w http.ResponseWriter, r *http.Request) error {
 		})
 	}
 
+	// GET IP Addrress of user
+	// for logging and monitering purpose, failed attempts are also counted per ip
+	ip := s.clientIP(r)
+
+	// every failed attempt pushes the next allowed one further away
+	wait, err := s.store.LoginBackoff(login.HealthcareID, ip)
+	if err != nil {
+		return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"message": "Something went wrong from our side",
+		})
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		return writeJSON(w, http.StatusTooManyRequests, map[string]interface{}{
+			"status":  "Too many failed attempts",
+			"message": fmt.Sprintf("try again in %s", wait.Round(time.Second)),
+		})
+	}
+
 	// check for total_request
 	ok, err := s.store.IsAllowed(login.HealthcareID)
 	if err != nil {
@@ -247,29 +392,26 @@ func (s *APIServer) LoginUser(w http.ResponseWriter, r *http.Request) error {
 
 	hip, err := s.store.LoginUser(login)
 	if err != nil {
+		if _, _, err := s.store.RegisterLoginFailure(login.HealthcareID, ip); err != nil {
+			log.Println("failed to register login failure:", err)
+		}
 		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
 			"message": "No user Found!",
 		})
 	}
-	// GET IP Addrress of user
-	// for logging and monitering purpose only, this will help you to
-	// moniter your account
-	ip := r.Header.Get("X-Forwarded-For")
-	// get from header if empty
-	if ip == "" {
-		ip = r.Header.Get("X-Real-IP")
-	}
-	// get from rmote address
-	if ip == "" {
-		ip, _, _ = net.SplitHostPort(r.RemoteAddr)
-	}
-	// Notify user everytime user login !
-	err = s.store.Push_logs("hip_accountLogin", hip.HealthcareName, hip.Email, ip, hip.HealthcareName, hip.HealthcareID)
+	// a locked account stays locked until the unlock link from the email is used
+	locked, err := s.store.IsAccountLocked(hip.HealthcareID)
 	if err != nil {
 		return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
 			"message": "Something went wrong from our side",
 		})
 	}
+	if locked {
+		return writeJSON(w, http.StatusLocked, map[string]interface{}{
+			"status":  "Account Locked",
+			"message": "Too many failed login attempts, use the unlock link sent to your email",
+		})
+	}
 	// check quota limit
 	// from sql database first
 	count, err := s.store.GetTotalRequestCount(login.HealthcareID)
@@ -289,20 +431,62 @@ func (s *APIServer) LoginUser(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	if err := bcrypt.CompareHashAndPassword([]byte(hip.Password), []byte(login.Password)); err != nil {
-		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
-			"message": "password mismatched",
+		return s.loginFailed(w, r, healthcareLockout(s, hip), ip)
+	}
+	if err := s.store.ResetLoginFailures(hip.HealthcareID); err != nil {
+		return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"message": "Something went wrong from our side",
+		})
+	}
+
+	// Notify user everytime user login !
+	err = s.store.Push_event(correlationID(r), events.AccountLogin{
+		Healthcare: events.Healthcare{HealthcareID: hip.HealthcareID, HealthcareName: hip.HealthcareName},
+		Email:      hip.Email,
+		IPAddress:  ip,
+	})
+	if err != nil {
+		return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"message": "Something went wrong from our side",
+		})
+	}
+
+	// with 2FA on the password alone only buys a short lived challenge,
+	// the real tokens come from /auth/2fa/challenge
+	twoFactor, err := s.store.GetTwoFactor(hip.HealthcareID)
+	if err != nil {
+		return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"message": "Something went wrong from our side",
+		})
+	}
+	if twoFactor.Enabled {
+		challenge, err := s.createChallengeToken(hip.HealthcareID)
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusOK, map[string]interface{}{
+			"2fa_required":    true,
+			"challenge_token": challenge,
+			"Expires In":      challengeTokenLifetime.String(),
+			"healthcare_id":   hip.HealthcareID,
 		})
 	}
 
-	// create token everytime user login !!
-	tokenString, err := createJWT(hip)
+	// start a new session everytime user login !!
+	tokens, err := s.startSession(&sessionIdentity{
+		HealthcareID: hip.HealthcareID,
+		Email:        hip.Email,
+		Name:         hip.HealthcareName,
+		Role:         RoleAdmin,
+	})
 	if err != nil {
 		return err
 	}
 
 	return writeJSON(w, http.StatusOK, map[string]interface{}{
-		"Expires In":      "5d",
-		"token":           tokenString,
+		"Expires In":      tokens.ExpiresIn,
+		"token":           tokens.AccessToken,
+		"refresh_token":   tokens.RefreshToken,
 		"healthcare_id":   hip.HealthcareID,
 		"healthcare_name": hip.HealthcareName,
 	})
@@ -352,6 +536,13 @@ func (s *APIServer) Update_Preferance(w http.ResponseWriter, r *http.Request) er
 			}
 			return nil
 		},
+		"email_notifications": func(value interface{}) error {
+			_, ok := value.(bool)
+			if !ok {
+				return fmt.Errorf("email_notifications must be a boolean")
+			}
+			return nil
+		},
 	}
 
 	// Validate and filter the request fields
@@ -488,15 +679,15 @@ func (s *APIServer) DeleteAccount(w http.ResponseWriter, r *http.Request) error
 	if !ok {
 		return writeJSON(w, http.StatusUnauthorized, map[string]string{"HealthID": "HealthID not found in token"})
 	}
-	err := s.store.ChangePreferance(healthcareID, req)
+	// Send email to user once the deletion is scheduled
+	scheduled, err := mod.NewEvent(correlationID(r), events.AccountDeletionScheduled{
+		Healthcare: events.Healthcare{HealthcareID: healthcareID, HealthcareName: healthcare_name},
+		Email:      email_healthcareID,
+	})
 	if err != nil {
-		return writeJSON(w, http.StatusNotImplemented, map[string]interface{}{
-			"error": err.Error(),
-		})
+		return err
 	}
-
-	// Send email to user
-	err = s.store.Push_logs("hip_deleteAccount", healthcare_name, email_healthcareID, nil, healthcare_name, healthcareID)
+	err = s.store.ChangePreferance(healthcareID, req, scheduled)
 	if err != nil {
 		return writeJSON(w, http.StatusNotImplemented, map[string]interface{}{
 			"error": err.Error(),
@@ -511,6 +702,8 @@ func (s *APIServer) DeleteAccount(w http.ResponseWriter, r *http.Request) error
 
 /////////////////////////////// MONGODB METHODS GOES HERE //////////////////////////////////
 
+// GetAppointments pages through the appointments of the caller, pass next_cursor
+// back as cursor to get the following page
 func (s *APIServer) GetAppointments(w http.ResponseWriter, r *http.Request) error {
 	if r.Method != "GET" {
 		return fmt.Errorf("%s method is not allowed", r.Method)
@@ -519,19 +712,23 @@ func (s *APIServer) GetAppointments(w http.ResponseWriter, r *http.Request) erro
 	if !ok {
 		return writeJSON(w, http.StatusUnauthorized, map[string]string{"HealthID": "HealthID not found in token"})
 	}
-	query := r.URL.Query()
-	listStr := query.Get("limit")
-	list := 5
-	if listStr != "" {
-		var err error
-		list, err = strconv.Atoi(listStr)
-		if err != nil {
-			return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
-				"message": "Server error: " + err.Error(),
-			})
+	filter, err := parseAppointmentFilter(r.URL.Query())
+	if err != nil {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"message": err.Error(),
+		})
+	}
+	// a patient's own list of appointments here needs their consent unless the healthcare registered them
+	if filter.HealthID != "" {
+		if allowed, err := s.requireConsent(w, healthcareID, filter.HealthID, mod.ConsentAppointments); !allowed {
+			return err
 		}
 	}
-	appointments, err := s.store.GetAppointments_postgres(healthcareID, 0, int64(list))
+
+	// one extra row tells whether there is a next page
+	limit := filter.Limit
+	filter.Limit++
+	appointments, total, err := s.store.GetAppointments_postgres(healthcareID, filter)
 	if err != nil {
 		return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
 			"status": "Something went wrong from our side",
@@ -539,13 +736,16 @@ func (s *APIServer) GetAppointments(w http.ResponseWriter, r *http.Request) erro
 		})
 	}
 
-	// print [] array always if appointis empty
-	if appointments == nil {
-		appointments = []*mod.Appointments{}
+	nextCursor := ""
+	if int64(len(appointments)) > limit {
+		appointments = appointments[:limit]
+		nextCursor = encodeAppointmentCursor(filter.SortBy, appointments[len(appointments)-1])
 	}
 	return writeJSON(w, http.StatusOK, map[string]interface{}{
 		"appointments": appointments,
 		"fetched":      len(appointments),
+		"total":        total,
+		"next_cursor":  nextCursor,
 	})
 }
 
@@ -570,9 +770,10 @@ func (s *APIServer) SetAppointments(w http.ResponseWriter, r *http.Request) erro
 		})
 	}
 
-	if update.Status != "Confirmed" && update.Status != "Rejected" && update.Status != "Pending" && update.Status != "Not Available" {
+	update.Actor = requestActor(r)
+	if !mod.IsAppointmentStatus(update.Status) {
 		return writeJSON(w, http.StatusNotAcceptable, map[string]interface{}{
-			"message": "Invalid status. Status must be one of [\"Pending\", \"Confirmed\", \"Rejected\", \"Not Available\"]",
+			"message": "Invalid status. Status must be one of [\"Pending\", \"Confirmed\", \"Rejected\", \"Not Available\", \"Cancelled\", \"Completed\", \"NoShow\"]",
 		})
 	}
 
@@ -586,42 +787,65 @@ func (s *APIServer) SetAppointments(w http.ResponseWriter, r *http.Request) erro
 		})
 	}
 
-	// Check if struct fields are populated (non-zero values)
-	val := reflect.ValueOf(update).Elem()
-	for i := 0; i < val.NumField(); i++ {
-		field := val.Type().Field(i)
-		value := val.Field(i)
-		if value.IsZero() {
-			return writeJSON(w, http.StatusNotAcceptable, map[string]interface{}{
-				"message": fmt.Errorf("field %s is required but not provided", field.Name),
+	// reject impossible changes now, the consumer checks again when it applies the update
+	current, err := s.store.GetAppointment(healthcareID, update.ID)
+	if err != nil || current.HealthID != update.HealthID {
+		return writeJSON(w, http.StatusNotFound, map[string]interface{}{
+			"message": mod.ErrAppointmentNotFound.Error(),
+		})
+	}
+	if err := mod.CheckTransition(current.Status, update.Status); err != nil {
+		return writeJSON(w, http.StatusConflict, map[string]interface{}{
+			"message": err.Error(),
+		})
+	}
+
+	// mode=sync commits the change in postgres before answering, the notification
+	// goes through the outbox so it is only published once the change is committed
+	if r.URL.Query().Get("mode") == "sync" {
+		healthcareName, _ := r.Context().Value(contextKeyHealthCareName).(string)
+		event, err := mod.NewEvent(correlationID(r), events.AppointmentUpdated{
+			Healthcare:    events.Healthcare{HealthcareID: healthcareID, HealthcareName: healthcareName},
+			AppointmentID: update.ID,
+			HealthID:      current.HealthID,
+			Name:          current.FullName,
+			Status:        update.Status,
+		})
+		if err != nil {
+			return err
+		}
+		appointment, err := s.store.TransitionAppointment(healthcareID, update.ID, update.Status, update.Actor, update.Reason, event)
+		switch {
+		case errors.Is(err, mod.ErrAppointmentNotFound):
+			return writeJSON(w, http.StatusNotFound, map[string]interface{}{
+				"message": err.Error(),
+			})
+		case errors.Is(err, mod.ErrInvalidTransition), errors.Is(err, mod.ErrSlotTaken):
+			return writeJSON(w, http.StatusConflict, map[string]interface{}{
+				"message": err.Error(),
+			})
+		case err != nil:
+			return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+				"message": "Server error: " + err.Error(),
 			})
 		}
+		return writeJSON(w, http.StatusOK, map[string]interface{}{
+			"status":       "Updated",
+			"message":      "appointment updated",
+			"appointments": appointment,
+		})
 	}
 
-	// list := 5
-	// if update.ID != "" {
-	// 	var err error
-	// 	list, err = strconv.Atoi(update.ID)
-	// 	if err != nil {
-	// 		return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
-	// 			"message": "Server error: " + err.Error(),
-	// 		})
-	// 	}
-	// }
-
-	// Set Appointment directly into posgres database, but it is time consuming...
-	// appointments, err := s.store.SetAppointments_postgres(healthcareID, update.HealthID, update.Status, int64(list))
-	// if err != nil {
-	// 	return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
-	// 		"error": err.Error(),
-	// 	})
-	// }
-
 	//push into queue for processing
-	notify_appointment := map[string]interface{}{
-		"update": update,
-	}
-	err = s.store.Push_update_appointment(notify_appointment)
+	healthcareName, _ := r.Context().Value(contextKeyHealthCareName).(string)
+	err = s.store.Push_event(correlationID(r), events.AppointmentUpdateRequested{
+		Healthcare:    events.Healthcare{HealthcareID: healthcareID, HealthcareName: healthcareName},
+		AppointmentID: update.ID,
+		HealthID:      update.HealthID,
+		Status:        update.Status,
+		Reason:        update.Reason,
+		Actor:         update.Actor,
+	})
 	if err != nil {
 		return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
 			"message": "Server error: " + err.Error(),
@@ -662,9 +886,22 @@ func (s *APIServer) Create_ClientProfile(w http.ResponseWriter, r *http.Request)
 	if err != nil {
 		return err
 	}
+	if audited, err := s.auditAccess(w, r, mod.AuditProfileCreate, mod.AuditNormal, client_profile.HealthID); !audited {
+		return err
+	}
+
+	created, err := mod.NewEvent(correlationID(r), events.ProfileCreated{
+		Healthcare:  events.Healthcare{HealthcareID: healthcareID, HealthcareName: healthcare_name},
+		HealthID:    client_profile.HealthID,
+		PatientName: client_profile.FirstName,
+		Email:       client_profile.Email,
+	})
+	if err != nil {
+		return err
+	}
 
 	// store into posgres directly
-	err = s.store.Create_ClientProfile(client_profile)
+	err = s.store.Create_ClientProfile(client_profile, created)
 	if err != nil {
 		return writeJSON(w, http.StatusNotAcceptable, map[string]interface{}{
 			"err":     err.Error(),
@@ -681,14 +918,6 @@ func (s *APIServer) Create_ClientProfile(w http.ResponseWriter, r *http.Request)
 		})
 	}
 
-	err = s.store.Push_logs("profile_updated", client_profile.FirstName, client_profile.Email, client_profile.HealthID, healthcare_name, healthcareID)
-	if err != nil {
-		return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
-			"message": "Something Went Wrong from our side :(",
-			"err":     err.Error(),
-		})
-	}
-
 	return writeJSON(w, http.StatusCreated, map[string]interface{}{
 		"message":   "data has been successfully created!",
 		"status":    "created",
@@ -715,11 +944,18 @@ func (s *APIServer) Get_clientProfile(w http.ResponseWriter, r *http.Request) er
 		http.Error(w, "Missing healthID in URL", http.StatusBadRequest)
 		return fmt.Errorf("missing healthID in URL")
 	}
+	healthID, resolved, err := s.resolveHealthID(w, healthID)
+	if !resolved {
+		return err
+	}
 	// healthcare_name
 	healthcare_name, ok := r.Context().Value(contextKeyHealthCareName).(string)
 	if !ok {
 		return writeJSON(w, http.StatusUnauthorized, map[string]string{"HealthID": "healthcare_name not found in token"})
 	}
+	if allowed, err := s.requireConsent(w, healthcareID, healthID, mod.ConsentProfile); !allowed {
+		return err
+	}
 
 	patientDetails, err := s.store.Get_ClientProfile(healthID)
 	if err != nil {
@@ -727,9 +963,17 @@ func (s *APIServer) Get_clientProfile(w http.ResponseWriter, r *http.Request) er
 			"message": "No Patient Found :(",
 		})
 	}
+	if audited, err := s.auditAccess(w, r, mod.AuditProfileView, mod.AuditNormal, healthID); !audited {
+		return err
+	}
 
 	// Notify user via email
-	err = s.store.Push_logs("profile_viewed", patientDetails.FirstName, patientDetails.Email, patientDetails.HealthID, healthcare_name, healthcareID)
+	err = s.store.Push_event(correlationID(r), events.ProfileViewed{
+		Healthcare:  events.Healthcare{HealthcareID: healthcareID, HealthcareName: healthcare_name},
+		HealthID:    patientDetails.HealthID,
+		PatientName: patientDetails.FirstName,
+		Email:       patientDetails.Email,
+	})
 	if err != nil {
 		return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
 			"err":     err.Error(),
@@ -843,6 +1087,15 @@ func (s *APIServer) CreatepatientRecords(w http.ResponseWriter, r *http.Request)
 		return writeJSON(w, http.StatusUnauthorized, map[string]string{"HealthID": "healthcare_name not found in token"})
 	}
 
+	healthID, resolved, err := s.resolveHealthID(w, patientrecords.HealthID)
+	if !resolved {
+		return err
+	}
+	patientrecords.HealthID = healthID
+	if allowed, err := s.requireWriteConsent(w, healthcareId, healthID, mod.ConsentRecords); !allowed {
+		return err
+	}
+
 	// assign healthcareId
 	patientrecords.Createdby_ = healthcareId
 	patientrecords.HealthcareName = healthcare_name
@@ -863,13 +1116,19 @@ func (s *APIServer) CreatepatientRecords(w http.ResponseWriter, r *http.Request)
 			"message": "Wrong Payload provided by User!",
 		})
 	}
-
-	// Convert into body format
-	body := map[string]interface{}{
-		"record": patientrecords,
+	if audited, err := s.auditAccess(w, r, mod.AuditRecordsCreate, mod.AuditNormal, patientrecords.HealthID); !audited {
+		return err
 	}
+
 	// Push it intoRabbitMq
-	err = s.store.Push_patient_records(body)
+	err = s.store.Push_event(correlationID(r), events.PatientRecordSubmitted{
+		Healthcare:      events.Healthcare{HealthcareID: healthcareId, HealthcareName: healthcare_name},
+		HealthID:        patientrecords.HealthID,
+		Issue:           patientrecords.Issue,
+		Description:     patientrecords.Description,
+		MedicalSeverity: patientrecords.MedicalSeverity,
+		CreatedAt:       time.Now(),
+	})
 	if err != nil {
 		return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
 			"message": "Something bad (Please Mail 21vaibhav11@gmail.com for this issue)",
@@ -879,7 +1138,10 @@ func (s *APIServer) CreatepatientRecords(w http.ResponseWriter, r *http.Request)
 	}
 
 	// Notify user via email
-	err = s.store.Push_logs("records_created", nil, nil, patientrecords.HealthID, healthcare_name, healthcareId)
+	err = s.store.Push_event(correlationID(r), events.RecordsCreated{
+		Healthcare: events.Healthcare{HealthcareID: healthcareId, HealthcareName: healthcare_name},
+		HealthID:   patientrecords.HealthID,
+	})
 	if err != nil {
 		return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
 			"message": "Something Mishappened (Please Mail 21vaibhav11@gmail.com for this issue)",
@@ -888,7 +1150,7 @@ func (s *APIServer) CreatepatientRecords(w http.ResponseWriter, r *http.Request)
 		})
 	}
 	// counters
-	// err = s.store.Push_counters("hip:recordscreated_counter", healthcareId)
+	// err = s.store.Push_event(correlationID(r), events.CounterIncremented{HealthcareID: healthcareId, Counter: events.RecordsCreatedCounter})
 	// if err != nil {
 	// 	return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
 	// 		"message": "Something Mishappened (Please Mail 21vaibhav11@gmail.com for this issue)",
@@ -916,6 +1178,17 @@ func (s *APIServer) GetPatientRecords(w http.ResponseWriter, r *http.Request) er
 			"message": "Health Id not Provided",
 		})
 	}
+	health_id, resolved, err := s.resolveHealthID(w, health_id)
+	if !resolved {
+		return err
+	}
+	healthcareId, ok := r.Context().Value(contextKeyHealthCareID).(string)
+	if !ok {
+		return writeJSON(w, http.StatusUnauthorized, map[string]string{"message": "StatusUnauthorized"})
+	}
+	if allowed, err := s.requireConsent(w, healthcareId, health_id, mod.ConsentRecords); !allowed {
+		return err
+	}
 	listStr := query.Get("list")
 	list := 5
 	if listStr != "" {
@@ -937,9 +1210,8 @@ func (s *APIServer) GetPatientRecords(w http.ResponseWriter, r *http.Request) er
 			"message": "patient not found :(",
 		})
 	}
-	healthcareId, ok := r.Context().Value(contextKeyHealthCareID).(string)
-	if !ok {
-		return writeJSON(w, http.StatusUnauthorized, map[string]string{"message": "StatusUnauthorized"})
+	if audited, err := s.auditAccess(w, r, mod.AuditRecordsView, mod.AuditNormal, health_id); !audited {
+		return err
 	}
 	// healthcare_name
 	healthcare_name, ok := r.Context().Value(contextKeyHealthCareName).(string)
@@ -948,7 +1220,10 @@ func (s *APIServer) GetPatientRecords(w http.ResponseWriter, r *http.Request) er
 	}
 
 	// push logs that your records_has been viewed and send notifications
-	err = s.store.Push_logs("records_viewed", nil, nil, health_id, healthcare_name, healthcareId)
+	err = s.store.Push_event(correlationID(r), events.RecordsViewed{
+		Healthcare: events.Healthcare{HealthcareID: healthcareId, HealthcareName: healthcare_name},
+		HealthID:   health_id,
+	})
 	if err != nil {
 		return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
 			"message": "Internal Server Error: could not process data",
@@ -956,7 +1231,7 @@ func (s *APIServer) GetPatientRecords(w http.ResponseWriter, r *http.Request) er
 	}
 
 	// counters (Will be removed soon)
-	// err = s.store.Push_counters("hip:recordsviewed_counter", healthcareId)
+	// err = s.store.Push_event(correlationID(r), events.CounterIncremented{HealthcareID: healthcareId, Counter: events.RecordsViewedCounter})
 	// if err != nil {
 	// 	return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
 	// 		"message": "Something Mishappened (Please Mail 21vaibhav11@gmail.com for this issue)",
@@ -975,12 +1250,23 @@ func (s *APIServer) GetPatientRecords(w http.ResponseWriter, r *http.Request) er
 	})
 }
 
+// a whole profile is well under this, larger bodies are cut off and fail to parse
+const maxProfilePatchSize = 64 << 10
+
+// UpdateClientProfile takes a JSON Merge Patch (RFC 7396) of the profile: fields
+// left out stay as they are and null clears a field. Fields that fail validation
+// come back under "errors" with their JSON name.
 func (s *APIServer) UpdateClientProfile(w http.ResponseWriter, r *http.Request) error {
 	if r.Method != "PATCH" {
 		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
 			"error": r.Method + " method not allowed",
 		})
 	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/merge-patch+json" && mediaType != "application/json" {
+		return writeJSON(w, http.StatusUnsupportedMediaType, map[string]interface{}{
+			"message": "send the patch as application/merge-patch+json",
+		})
+	}
 	// healthcare_name
 	healthcareId, ok := r.Context().Value(contextKeyHealthCareID).(string)
 	if !ok {
@@ -997,29 +1283,67 @@ func (s *APIServer) UpdateClientProfile(w http.ResponseWriter, r *http.Request)
 			"message": "Provide health Id",
 		})
 	}
+	healthID, resolved, err := s.resolveHealthID(w, healthID)
+	if !resolved {
+		return err
+	}
+	if allowed, err := s.requireWriteConsent(w, healthcareId, healthID, mod.ConsentProfile); !allowed {
+		return err
+	}
 
-	updates := make(map[string]interface{})
-	err := json.NewDecoder(r.Body).Decode(&updates)
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxProfilePatchSize))
 	if err != nil {
-		return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
-			"message": "Internal Server Error: could not process data",
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"message": "could not process your request please check your schema",
 		})
 	}
 
-	// Update client directly in postgres database
-	updatedPatient, err := s.store.Update_clientProfile(healthID, updates)
+	// the notification goes to the details on file before this update
+	current, err := s.store.Get_ClientProfile(healthID)
 	if err != nil {
-		return writeJSON(w, http.StatusNotAcceptable, map[string]interface{}{
-			"err":     err.Error(),
-			"message": "Wrong Payload Provided by User",
+		return writeJSON(w, http.StatusNotFound, map[string]interface{}{
+			"message": "No Patient Found :(",
 		})
 	}
+	patch, err := mod.ApplyProfilePatch(current, body)
+	var fieldErrors mod.FieldErrors
+	switch {
+	case errors.As(err, &fieldErrors):
+		return writeJSON(w, http.StatusUnprocessableEntity, map[string]interface{}{
+			"status":  "Constraints Violeted",
+			"message": "some fields could not be updated",
+			"errors":  fieldErrors,
+		})
+	case err != nil:
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"message": "could not process your request please check your schema",
+		})
+	}
+	if len(patch.Columns) == 0 {
+		return writeJSON(w, http.StatusAccepted, map[string]interface{}{
+			"updated_details": current,
+		})
+	}
+	updated, err := mod.NewEvent(correlationID(r), events.ProfileUpdated{
+		Healthcare:  events.Healthcare{HealthcareID: healthcareId, HealthcareName: healthcare_name},
+		HealthID:    current.HealthID,
+		PatientName: current.FirstName,
+		Email:       current.Email,
+	})
+	if err != nil {
+		return err
+	}
 
-	// push the logs into queue
-	err = s.store.Push_logs("profile_updated", updatedPatient.FirstName, updatedPatient.Email, updatedPatient.HealthID, healthcare_name, healthcareId)
+	if audited, err := s.auditAccess(w, r, mod.AuditProfileUpdate, mod.AuditNormal, healthID); !audited {
+		return err
+	}
+
+	// Update client directly in postgres database
+	updatedPatient, err := s.store.Update_clientProfile(healthID, requestActor(r), patch, updated)
 	if err != nil {
+		log.Printf("updating the profile of %s failed: %v", healthID, err)
 		return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
-			"message": "Internal Server Error: could not process data",
+			"message": "Something went wrong from our side",
 		})
 	}
 
@@ -1028,6 +1352,135 @@ func (s *APIServer) UpdateClientProfile(w http.ResponseWriter, r *http.Request)
 	})
 }
 
+// LookupClientByAadhaar finds the health ids registered with an Aadhaar number
+// among the patients the healthcare registered or holds a profile consent for,
+// it is a POST so the number never ends up in a URL or access log.
+func (s *APIServer) LookupClientByAadhaar(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error": r.Method + " method not allowed",
+		})
+	}
+	healthcareID, ok := r.Context().Value(contextKeyHealthCareID).(string)
+	if !ok {
+		return writeJSON(w, http.StatusUnauthorized, map[string]string{"message": "StatusUnauthorized"})
+	}
+
+	req := struct {
+		AadhaarNumber string `json:"aadhar_number"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.AadhaarNumber == "" {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"message": "could not process your request please check your schema",
+		})
+	}
+
+	healthIDs, err := s.store.FindClientsByAadhaar(healthcareID, req.AadhaarNumber)
+	if err != nil {
+		return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"message": "Something went wrong from our side",
+		})
+	}
+	if len(healthIDs) == 0 {
+		return writeJSON(w, http.StatusNotFound, map[string]interface{}{
+			"message": "No Patient Found :(",
+		})
+	}
+	if audited, err := s.auditAccess(w, r, mod.AuditProfileLookup, mod.AuditNormal, healthIDs...); !audited {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, map[string]interface{}{
+		"health_ids": healthIDs,
+	})
+}
+
+// SearchClients is the front desk search over the patients the healthcare can see.
+// Sex and blood group only narrow a search by name, DOB, mobile or Aadhaar.
+func (s *APIServer) SearchClients(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error": r.Method + " method not allowed",
+		})
+	}
+	healthcareID, ok := r.Context().Value(contextKeyHealthCareID).(string)
+	if !ok {
+		return writeJSON(w, http.StatusUnauthorized, map[string]string{"message": "StatusUnauthorized"})
+	}
+
+	req := struct {
+		Name          string `json:"name"`
+		DOB           string `json:"dob"`
+		MobileNumber  string `json:"mobilenumber"`
+		AadhaarNumber string `json:"aadhar_number"`
+		Sex           string `json:"sex"`
+		BloodGroup    string `json:"bloodgrp"`
+		Page          int    `json:"page"`
+		PageSize      int    `json:"page_size"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"message": "could not process your request please check your schema",
+		})
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" && req.DOB == "" && req.MobileNumber == "" && req.AadhaarNumber == "" {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"message": "search by at least one of name, dob, mobilenumber or aadhar_number",
+		})
+	}
+	if name != "" && len(name) < 3 {
+		return writeJSON(w, http.StatusNotAcceptable, map[string]interface{}{
+			"status":  "Constraints Violeted",
+			"message": "name must have at least 3 characters",
+		})
+	}
+	if req.Page < 0 || req.PageSize < 0 || req.PageSize > 50 {
+		return writeJSON(w, http.StatusNotAcceptable, map[string]interface{}{
+			"status":  "Constraints Violeted",
+			"message": "page must be positive and page_size at most 50",
+		})
+	}
+	if req.Page == 0 {
+		req.Page = 1
+	}
+	if req.PageSize == 0 {
+		req.PageSize = 20
+	}
+
+	results, more, err := s.store.SearchClients(mod.ClientSearch{
+		HealthcareID:  healthcareID,
+		Name:          name,
+		DOB:           req.DOB,
+		MobileNumber:  req.MobileNumber,
+		AadhaarNumber: req.AadhaarNumber,
+		Sex:           req.Sex,
+		BloodGroup:    req.BloodGroup,
+		Page:          req.Page,
+		PageSize:      req.PageSize,
+	})
+	if err != nil {
+		return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"message": "Something went wrong from our side",
+		})
+	}
+
+	healthIDs := make([]string, 0, len(results))
+	for _, result := range results {
+		healthIDs = append(healthIDs, result.HealthID)
+	}
+	if audited, err := s.auditAccess(w, r, mod.AuditProfileSearch, mod.AuditNormal, healthIDs...); !audited {
+		return err
+	}
+
+	response := map[string]interface{}{
+		"results":   results,
+		"page":      req.Page,
+		"page_size": req.PageSize,
+		"has_more":  more,
+	}
+	return writeJSON(w, http.StatusOK, response)
+}
+
 // ///////////////////////////// ///////////////////// ///////////////// //////////// /////////////// ////////////// /
 /////////////////////////// ///  	 Utility Functions  	///////////////////////// ////////////////// ///////////// ///////
 
@@ -1069,7 +1522,7 @@ func (s *APIServer) RateLimiter(handlerFunc http.HandlerFunc) http.HandlerFunc {
 		// request counters
 		/////////////////////////////////////////////////////////////////////////////
 		/////////////////////////////////////////////////////////////////////////////
-		// err = s.store.Push_counters("hip:requestcounter", healthcareID)
+		// err = s.store.Push_event(correlationID(r), events.CounterIncremented{HealthcareID: healthcareID, Counter: events.RequestCounter})
 		// if err != nil {
 		// 	writeJSON(w, http.StatusInternalServerError, apiError{Error: "Something bad happened from our side :("})
 		// 	return
@@ -1081,19 +1534,28 @@ func (s *APIServer) RateLimiter(handlerFunc http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
-func createJWT(account *mod.HIPInfo) (string, error) {
-	claims := jwt.MapClaims{
-		"expiresAt":        time.Now().Add(5 * 24 * time.Hour).Unix(), //setting it to 5days from now
-		"healthcareID":     account.HealthcareID,
-		"healthcare_email": account.Email,
-		"healthcare_name":  account.HealthcareName,
+func (s *APIServer) createJWT(identity *sessionIdentity, sessionID string) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(accessTokenLifetime)
+	claims := &accessClaims{
+		HealthcareID: identity.HealthcareID,
+		Email:        identity.Email,
+		Name:         identity.Name,
+		Role:         identity.Role,
+		StaffID:      identity.StaffID,
+		SessionID:    sessionID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
+			Subject:   identity.subject(),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
 	}
-	signKey := "PASSWORD"
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(signKey))
+	token, err := s.keys.Sign(claims)
+	return token, expiresAt, err
 }
 
-func withJWTAuth(handlerFunc http.HandlerFunc) http.HandlerFunc {
+func (s *APIServer) withJWTAuth(handlerFunc http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		tokenString := r.Header.Get("Authorization")
 		// this will extract token from Bearer keyword
@@ -1102,7 +1564,8 @@ func withJWTAuth(handlerFunc http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 		tokenString = tokenString[7:]
-		token, err := validateJWT(tokenString)
+		claims := &accessClaims{}
+		token, err := s.keys.Parse(tokenString, claims)
 		if err != nil {
 			writeJSON(w, http.StatusNotAcceptable, apiError{Error: fmt.Sprintf("Token Not Valid: %v", err)})
 			return
@@ -1113,47 +1576,144 @@ func withJWTAuth(handlerFunc http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
-		if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-			healthcareID, _ := claims["healthcareID"].(string)
-			emailHealthcareID, _ := claims["healthcare_email"].(string)
-			nameHealthcare, _ := claims["healthcare_name"].(string)
+		// Block the request if healthcareID is missing or invalid
+		if claims.HealthcareID == "" {
+			writeJSON(w, http.StatusForbidden, apiError{Error: "Invalid Token: healthcareID missing"})
+			return
+		}
+		// Block the request if emailHealthcareID is missing or invalid
+		if claims.Email == "" {
+			writeJSON(w, http.StatusForbidden, apiError{Error: "Invalid Token: healthcare_email missing"})
+			return
+		}
+		if claims.Name == "" {
+			writeJSON(w, http.StatusForbidden, apiError{Error: "Invalid Token: healthcare name missing"})
+			return
+		}
+		if claims.ID == "" || claims.SessionID == "" || claims.ExpiresAt == nil || !isValidRole(claims.Role) {
+			writeJSON(w, http.StatusForbidden, apiError{Error: "Invalid token claims"})
+			return
+		}
+
+		// logout, logout-all and refresh token reuse all end up here
+		revoked, err := s.store.IsTokenRevoked(claims.ID, claims.SessionID)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, apiError{Error: "Something bad happened from our side :("})
+			return
+		}
+		if revoked {
+			writeJSON(w, http.StatusUnauthorized, apiError{Error: "Token has been revoked, please login again"})
+			return
+		}
 
-			// Block the request if healthcareID is missing or invalid
-			if healthcareID == "" {
-				writeJSON(w, http.StatusForbidden, apiError{Error: "Invalid Token: healthcareID missing"})
-				return
+		ctx := context.WithValue(r.Context(), contextKeyHealthCareID, claims.HealthcareID)
+		ctx = context.WithValue(ctx, contextKeyEmailHealthCareID, claims.Email)
+		ctx = context.WithValue(ctx, contextKeyHealthCareName, claims.Name)
+		ctx = context.WithValue(ctx, contextKeyTokenClaims, claims)
+
+		handlerFunc(w, r.WithContext(ctx))
+	}
+}
+
+// CorrelationMiddleware resolves the correlation id of the request once, a caller
+// can pass its own id in X-Correlation-ID (or X-Request-ID from the proxy). It is
+// echoed back so the caller can find the events of its request.
+func CorrelationMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := ""
+		for _, header := range []string{"X-Correlation-ID", "X-Request-ID"} {
+			if value := r.Header.Get(header); value != "" && len(value) <= 128 {
+				id = value
+				break
 			}
+		}
+		if id == "" {
+			id = uuid.NewString()
+		}
+		w.Header().Set("X-Correlation-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKeyCorrelationID, id)))
+	})
+}
+
+// correlationID ties the events of one request together, it is the id
+// CorrelationMiddleware put in the request context
+func correlationID(r *http.Request) string {
+	if id, ok := r.Context().Value(contextKeyCorrelationID).(string); ok {
+		return id
+	}
+	// handlers called without the router still get an id of their own
+	return uuid.NewString()
+}
 
-			// Block the request if emailHealthcareID is missing or invalid
-			if emailHealthcareID == "" {
-				writeJSON(w, http.StatusForbidden, apiError{Error: "Invalid Token: healthcare_email missing"})
-				return
+// ParseTrustedProxies reads a comma separated list of addresses and CIDR ranges
+func ParseTrustedProxies(value string) ([]*net.IPNet, error) {
+	proxies := []*net.IPNet{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", entry)
 			}
-			if nameHealthcare == "" {
-				writeJSON(w, http.StatusForbidden, apiError{Error: "Invalid Token: healthcare name missing"})
-				return
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
 			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
 
-			ctx := context.WithValue(r.Context(), contextKeyHealthCareID, healthcareID)
-			ctx = context.WithValue(ctx, contextKeyEmailHealthCareID, emailHealthcareID)
-			ctx = context.WithValue(ctx, contextKeyHealthCareName, nameHealthcare)
-
-			handlerFunc(w, r.WithContext(ctx))
-		} else {
-			writeJSON(w, http.StatusForbidden, apiError{Error: "Invalid token claims"})
-			return
+func (s *APIServer) isTrustedProxy(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, network := range s.trustedProxies {
+		if network.Contains(ip) {
+			return true
 		}
 	}
+	return false
 }
 
-func validateJWT(tokenString string) (*jwt.Token, error) {
-	secret := "PASSWORD"
-	return jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+// clientIP is the remote address, unless it is one of the trusted proxies (nginx
+// sits in front of us). Then it is the right-most X-Forwarded-For hop that isn't a
+// trusted proxy, the hops left of it were written by the client and can be forged.
+func (s *APIServer) clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !s.isTrustedProxy(ip) {
+		return ip
+	}
+	hops := []string{}
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			// a proxy we trust wouldn't write this, stop at the last hop we could check
+			return ip
 		}
-		return []byte(secret), nil
-	})
+		ip = hop
+		if !s.isTrustedProxy(hop) {
+			return ip
+		}
+	}
+	return ip
 }
 
 // Helper One
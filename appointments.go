@@ -0,0 +1,432 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	mod "vaibhavyadav-dev/healthcareServer/databases"
+
+	"github.com/go-playground/validator/v10"
+)
+
+const (
+	appointmentDateLayout = "2006-01-02"
+	appointmentTimeLayout = "15:04"
+
+	defaultAppointmentPage = 5
+	maxAppointmentPage     = 100
+)
+
+// cursors are opaque to clients, they only carry the sort key of the last row
+func encodeAppointmentCursor(sortBy string, last *mod.Appointments) string {
+	cursor := mod.AppointmentCursor{SortBy: sortBy, Date: last.AppointmentDate, ID: last.ID}
+	if sortBy == "time" {
+		cursor.Time = last.AppointmentTime
+	}
+	raw, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeAppointmentCursor(value, sortBy string) (*mod.AppointmentCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	cursor := &mod.AppointmentCursor{}
+	if err := json.Unmarshal(raw, cursor); err != nil || cursor.ID <= 0 {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	if cursor.SortBy != sortBy {
+		return nil, fmt.Errorf("cursor was issued for a different sort")
+	}
+	if _, err := time.Parse(appointmentDateLayout, cursor.Date); err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	if sortBy == "time" {
+		if _, err := time.Parse(appointmentTimeLayout, cursor.Time); err != nil {
+			return nil, fmt.Errorf("invalid cursor")
+		}
+	}
+	return cursor, nil
+}
+
+// parseAppointmentFilter reads limit, cursor, status, department, health_id,
+// from, to (YYYY-MM-DD), sort (date|time) and order (asc|desc)
+func parseAppointmentFilter(query url.Values) (*mod.AppointmentFilter, error) {
+	filter := &mod.AppointmentFilter{
+		Status:     query.Get("status"),
+		Department: strings.TrimSpace(query.Get("department")),
+		HealthID:   query.Get("health_id"),
+		From:       query.Get("from"),
+		To:         query.Get("to"),
+		SortBy:     "date",
+		Limit:      defaultAppointmentPage,
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.ParseInt(limit, 10, 64)
+		if err != nil || n < 1 || n > maxAppointmentPage {
+			return nil, fmt.Errorf("limit must be between 1 and %d", maxAppointmentPage)
+		}
+		filter.Limit = n
+	}
+	if filter.Status != "" && !mod.IsAppointmentStatus(filter.Status) {
+		return nil, fmt.Errorf("unknown status %q", filter.Status)
+	}
+	for _, date := range []string{filter.From, filter.To} {
+		if date == "" {
+			continue
+		}
+		if _, err := time.Parse(appointmentDateLayout, date); err != nil {
+			return nil, fmt.Errorf("from and to must be YYYY-MM-DD")
+		}
+	}
+	switch query.Get("sort") {
+	case "", "date":
+	case "time":
+		filter.SortBy = "time"
+	default:
+		return nil, fmt.Errorf("sort must be date or time")
+	}
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		filter.Descending = true
+	default:
+		return nil, fmt.Errorf("order must be asc or desc")
+	}
+	if cursor := query.Get("cursor"); cursor != "" {
+		after, err := decodeAppointmentCursor(cursor, filter.SortBy)
+		if err != nil {
+			return nil, err
+		}
+		filter.After = after
+	}
+	return filter, nil
+}
+
+// validateSchedule checks every window on its own and refuses overlapping
+// windows on the same weekday, they would hand out the same slot twice
+func validateSchedule(windows []*mod.Availability) error {
+	validate := validator.New()
+	type span struct{ start, end time.Time }
+	byDay := map[int][]span{}
+	for _, window := range windows {
+		if err := validate.Struct(window); err != nil {
+			return fmt.Errorf("invalid window: %w", err)
+		}
+		start, err := time.Parse(appointmentTimeLayout, window.StartTime)
+		if err != nil {
+			return fmt.Errorf("start_time %q must be HH:MM", window.StartTime)
+		}
+		end, err := time.Parse(appointmentTimeLayout, window.EndTime)
+		if err != nil {
+			return fmt.Errorf("end_time %q must be HH:MM", window.EndTime)
+		}
+		if start.Add(time.Duration(window.SlotMinutes) * time.Minute).After(end) {
+			return fmt.Errorf("window %s-%s is shorter than one %d minute slot", window.StartTime, window.EndTime, window.SlotMinutes)
+		}
+		for _, other := range byDay[window.Weekday] {
+			if start.Before(other.end) && other.start.Before(end) {
+				return fmt.Errorf("window %s-%s overlaps another window on weekday %d", window.StartTime, window.EndTime, window.Weekday)
+			}
+		}
+		byDay[window.Weekday] = append(byDay[window.Weekday], span{start, end})
+	}
+	return nil
+}
+
+// slotsFor expands the windows of one weekday into sorted slot start times,
+// a trailing piece shorter than a slot is dropped
+func slotsFor(windows []*mod.Availability, weekday time.Weekday) []string {
+	slots := []string{}
+	for _, window := range windows {
+		if window.Weekday != int(weekday) || window.SlotMinutes <= 0 {
+			continue
+		}
+		start, err := time.Parse(appointmentTimeLayout, window.StartTime)
+		if err != nil {
+			continue
+		}
+		end, err := time.Parse(appointmentTimeLayout, window.EndTime)
+		if err != nil {
+			continue
+		}
+		step := time.Duration(window.SlotMinutes) * time.Minute
+		for slot := start; !slot.Add(step).After(end); slot = slot.Add(step) {
+			slots = append(slots, slot.Format(appointmentTimeLayout))
+		}
+	}
+	sort.Strings(slots)
+	return slots
+}
+
+func freeSlots(windows []*mod.Availability, weekday time.Weekday, booked []string) []string {
+	taken := make(map[string]bool, len(booked))
+	for _, slot := range booked {
+		taken[slot] = true
+	}
+	free := []string{}
+	for _, slot := range slotsFor(windows, weekday) {
+		if !taken[slot] {
+			free = append(free, slot)
+		}
+	}
+	return free
+}
+
+// requestActor names who made the request in appointment history, the staff id or the healthcare id
+func requestActor(r *http.Request) string {
+	if claims, ok := r.Context().Value(contextKeyTokenClaims).(*accessClaims); ok {
+		return claims.Subject
+	}
+	healthcareID, _ := r.Context().Value(contextKeyHealthCareID).(string)
+	return healthcareID
+}
+
+func (s *APIServer) SetAvailability(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPut {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error": r.Method + " method not allowed",
+		})
+	}
+	healthcareID, ok := r.Context().Value(contextKeyHealthCareID).(string)
+	if !ok {
+		return writeJSON(w, http.StatusUnauthorized, map[string]string{"HealthID": "HealthID not found in token"})
+	}
+
+	req := struct {
+		Department string              `json:"department"`
+		Windows    []*mod.Availability `json:"windows"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"message": "could not process your request please check your schema",
+		})
+	}
+	req.Department = strings.TrimSpace(req.Department)
+	if len(req.Department) < 2 || len(req.Department) > 60 {
+		return writeJSON(w, http.StatusNotAcceptable, map[string]interface{}{
+			"message": "department must be between 2 and 60 characters",
+		})
+	}
+	if err := validateSchedule(req.Windows); err != nil {
+		return writeJSON(w, http.StatusNotAcceptable, map[string]interface{}{
+			"status":  "Constraints Violeted",
+			"message": err.Error(),
+		})
+	}
+
+	if err := s.store.SetAvailability(healthcareID, req.Department, req.Windows); err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":     "Availability updated",
+		"department": req.Department,
+		"windows":    len(req.Windows),
+	})
+}
+
+func (s *APIServer) GetAvailability(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return fmt.Errorf("%s method is not allowed", r.Method)
+	}
+	healthcareID, ok := r.Context().Value(contextKeyHealthCareID).(string)
+	if !ok {
+		return writeJSON(w, http.StatusUnauthorized, map[string]string{"HealthID": "HealthID not found in token"})
+	}
+	department := strings.TrimSpace(r.URL.Query().Get("department"))
+	if department == "" {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"message": "department is required",
+		})
+	}
+
+	windows, err := s.store.GetAvailability(healthcareID, department)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, map[string]interface{}{
+		"department": department,
+		"windows":    windows,
+	})
+}
+
+// GetFreeSlots lists the slots of a department on a date that nobody holds yet
+func (s *APIServer) GetFreeSlots(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return fmt.Errorf("%s method is not allowed", r.Method)
+	}
+	healthcareID, ok := r.Context().Value(contextKeyHealthCareID).(string)
+	if !ok {
+		return writeJSON(w, http.StatusUnauthorized, map[string]string{"HealthID": "HealthID not found in token"})
+	}
+	query := r.URL.Query()
+	department := strings.TrimSpace(query.Get("department"))
+	date, err := time.ParseInLocation(appointmentDateLayout, query.Get("date"), time.Local)
+	if department == "" || err != nil {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"message": "department and date (YYYY-MM-DD) are required",
+		})
+	}
+
+	windows, err := s.store.GetAvailability(healthcareID, department)
+	if err != nil {
+		return err
+	}
+	booked, err := s.store.BookedSlots(healthcareID, department, date.Format(appointmentDateLayout))
+	if err != nil {
+		return err
+	}
+
+	slots := []string{}
+	now := time.Now()
+	for _, slot := range freeSlots(windows, date.Weekday(), booked) {
+		at, _ := time.ParseInLocation(appointmentDateLayout+" "+appointmentTimeLayout, date.Format(appointmentDateLayout)+" "+slot, time.Local)
+		if at.After(now) {
+			slots = append(slots, slot)
+		}
+	}
+	return writeJSON(w, http.StatusOK, map[string]interface{}{
+		"department": department,
+		"date":       date.Format(appointmentDateLayout),
+		"slots":      slots,
+		"available":  len(slots),
+	})
+}
+
+// CreateAppointment books a free slot, the appointment starts as Pending
+func (s *APIServer) CreateAppointment(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error": r.Method + " method not allowed",
+		})
+	}
+	healthcareID, ok := r.Context().Value(contextKeyHealthCareID).(string)
+	if !ok {
+		return writeJSON(w, http.StatusUnauthorized, map[string]string{"HealthID": "HealthID not found in token"})
+	}
+	healthcareName, ok := r.Context().Value(contextKeyHealthCareName).(string)
+	if !ok {
+		return writeJSON(w, http.StatusUnauthorized, map[string]string{"HealthID": "HealthID not found in token"})
+	}
+
+	appointment := &mod.Appointments{}
+	if err := json.NewDecoder(r.Body).Decode(appointment); err != nil {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"message": "could not process your request please check your schema",
+		})
+	}
+	healthID, resolved, err := s.resolveHealthID(w, appointment.HealthID)
+	if !resolved {
+		return err
+	}
+	if allowed, err := s.requireWriteConsent(w, healthcareID, healthID, mod.ConsentAppointments); !allowed {
+		return err
+	}
+	if _, err := s.store.Get_ClientProfile(healthID); err != nil {
+		return writeJSON(w, http.StatusNotFound, map[string]interface{}{
+			"message": "No Patient Found :(",
+		})
+	}
+	appointment.ID = 0
+	appointment.HealthID = healthID
+	appointment.HealthcareID = healthcareID
+	appointment.HealthcareName = healthcareName
+	appointment.Status = mod.StatusPending
+	appointment.Department = strings.TrimSpace(appointment.Department)
+
+	validate := validator.New()
+	if err := validate.Struct(appointment); err != nil || appointment.Department == "" {
+		return writeJSON(w, http.StatusNotAcceptable, map[string]interface{}{
+			"status":  "Constraints Violeted",
+			"message": "Invalid data provided, please check your payload",
+		})
+	}
+	at, err := time.ParseInLocation(appointmentDateLayout+" "+appointmentTimeLayout, appointment.AppointmentDate+" "+appointment.AppointmentTime, time.Local)
+	if err != nil {
+		return writeJSON(w, http.StatusNotAcceptable, map[string]interface{}{
+			"message": "appointment_date must be YYYY-MM-DD and appointment_time HH:MM",
+		})
+	}
+	if !at.After(time.Now()) {
+		return writeJSON(w, http.StatusNotAcceptable, map[string]interface{}{
+			"message": "appointment must be in the future",
+		})
+	}
+
+	windows, err := s.store.GetAvailability(healthcareID, appointment.Department)
+	if err != nil {
+		return err
+	}
+	offered := false
+	for _, slot := range slotsFor(windows, at.Weekday()) {
+		if slot == at.Format(appointmentTimeLayout) {
+			offered = true
+			break
+		}
+	}
+	if !offered {
+		return writeJSON(w, http.StatusNotAcceptable, map[string]interface{}{
+			"message": "the department does not offer this slot",
+		})
+	}
+
+	appointment.AppointmentDate = at.Format(appointmentDateLayout)
+	appointment.AppointmentTime = at.Format(appointmentTimeLayout)
+	if err := s.store.CreateAppointment(appointment, requestActor(r)); err != nil {
+		if err == mod.ErrSlotTaken {
+			return writeJSON(w, http.StatusConflict, map[string]interface{}{
+				"message": err.Error(),
+			})
+		}
+		return err
+	}
+
+	return writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"status":      "Appointment booked",
+		"appointment": appointment,
+	})
+}
+
+// GetAppointmentHistory returns every status change of one appointment of the caller
+func (s *APIServer) GetAppointmentHistory(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return fmt.Errorf("%s method is not allowed", r.Method)
+	}
+	healthcareID, ok := r.Context().Value(contextKeyHealthCareID).(string)
+	if !ok {
+		return writeJSON(w, http.StatusUnauthorized, map[string]string{"HealthID": "HealthID not found in token"})
+	}
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"message": "id is required",
+		})
+	}
+
+	appointment, err := s.store.GetAppointment(healthcareID, id)
+	if err == mod.ErrAppointmentNotFound {
+		return writeJSON(w, http.StatusNotFound, map[string]interface{}{
+			"message": err.Error(),
+		})
+	}
+	if err != nil {
+		return err
+	}
+	history, err := s.store.GetAppointmentHistory(id)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, map[string]interface{}{
+		"appointment": appointment,
+		"history":     history,
+	})
+}
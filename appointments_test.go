@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	mod "vaibhavyadav-dev/healthcareServer/databases"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlotsFor(t *testing.T) {
+	windows := []*mod.Availability{
+		{Weekday: int(time.Monday), StartTime: "14:00", EndTime: "15:00", SlotMinutes: 20},
+		{Weekday: int(time.Monday), StartTime: "09:00", EndTime: "10:10", SlotMinutes: 30},
+		{Weekday: int(time.Tuesday), StartTime: "09:00", EndTime: "10:00", SlotMinutes: 30},
+	}
+
+	// the 10:00-10:10 leftover is too short for a slot
+	assert.Equal(t, []string{"09:00", "09:30", "14:00", "14:20", "14:40"}, slotsFor(windows, time.Monday))
+	assert.Empty(t, slotsFor(windows, time.Sunday))
+
+	assert.Equal(t, []string{"09:30", "14:00", "14:40"}, freeSlots(windows, time.Monday, []string{"09:00", "14:20", "18:00"}))
+}
+
+func TestValidateSchedule(t *testing.T) {
+	ok := []*mod.Availability{
+		{Weekday: 1, StartTime: "09:00", EndTime: "12:00", SlotMinutes: 15},
+		{Weekday: 1, StartTime: "12:00", EndTime: "13:00", SlotMinutes: 15},
+		{Weekday: 2, StartTime: "09:00", EndTime: "12:00", SlotMinutes: 15},
+	}
+	assert.NoError(t, validateSchedule(ok))
+
+	tests := map[string]*mod.Availability{
+		"overlap":     {Weekday: 1, StartTime: "11:30", EndTime: "12:30", SlotMinutes: 15},
+		"bad weekday": {Weekday: 7, StartTime: "09:00", EndTime: "10:00", SlotMinutes: 15},
+		"bad time":    {Weekday: 3, StartTime: "9am", EndTime: "10:00", SlotMinutes: 15},
+		"too short":   {Weekday: 3, StartTime: "09:00", EndTime: "09:10", SlotMinutes: 15},
+		"reversed":    {Weekday: 3, StartTime: "10:00", EndTime: "09:00", SlotMinutes: 15},
+	}
+	for name, window := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Error(t, validateSchedule(append(ok[:len(ok):len(ok)], window)))
+		})
+	}
+}
+
+func TestAppointmentCursor(t *testing.T) {
+	last := &mod.Appointments{ID: 42, AppointmentDate: "2024-03-01", AppointmentTime: "09:30"}
+
+	cursor, err := decodeAppointmentCursor(encodeAppointmentCursor("time", last), "time")
+	assert.NoError(t, err)
+	assert.Equal(t, &mod.AppointmentCursor{SortBy: "time", Date: "2024-03-01", Time: "09:30", ID: 42}, cursor)
+
+	// a cursor can't be replayed against another sort
+	_, err = decodeAppointmentCursor(encodeAppointmentCursor("date", last), "time")
+	assert.Error(t, err)
+	_, err = decodeAppointmentCursor("not-a-cursor", "date")
+	assert.Error(t, err)
+}
+
+func TestParseAppointmentFilter(t *testing.T) {
+	filter, err := parseAppointmentFilter(url.Values{})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(defaultAppointmentPage), filter.Limit)
+	assert.Equal(t, "date", filter.SortBy)
+	assert.Nil(t, filter.After)
+
+	filter, err = parseAppointmentFilter(url.Values{
+		"limit": {"20"}, "status": {"Confirmed"}, "department": {" Cardiology "},
+		"from": {"2024-01-01"}, "to": {"2024-01-31"}, "sort": {"time"}, "order": {"desc"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(20), filter.Limit)
+	assert.Equal(t, "Cardiology", filter.Department)
+	assert.True(t, filter.Descending)
+
+	for _, bad := range []url.Values{
+		{"limit": {"0"}},
+		{"limit": {"500"}},
+		{"status": {"Done"}},
+		{"from": {"01-01-2024"}},
+		{"sort": {"name"}},
+		{"order": {"up"}},
+	} {
+		_, err := parseAppointmentFilter(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+// bookingStore is the part of the store CreateAppointment uses, anything else panics
+type bookingStore struct {
+	Store
+	profiles map[string]*mod.PatientDetails
+	consents map[string]bool
+	booked   []*mod.Appointments
+}
+
+func (b *bookingStore) HasConsent(healthcare_id, health_id, scope string, breakGlass bool) (bool, error) {
+	return scope == mod.ConsentAppointments && b.consents[health_id], nil
+}
+
+func (b *bookingStore) ResolveHealthID(healthID string) (string, error) { return healthID, nil }
+
+func (b *bookingStore) Get_ClientProfile(healthID string) (*mod.PatientDetails, error) {
+	if profile, ok := b.profiles[healthID]; ok {
+		return profile, nil
+	}
+	return nil, fmt.Errorf("no patient with health ID %s", healthID)
+}
+
+func (b *bookingStore) GetAvailability(healthcare_id, department string) ([]*mod.Availability, error) {
+	windows := []*mod.Availability{}
+	for day := 0; day < 7; day++ {
+		windows = append(windows, &mod.Availability{Weekday: day, StartTime: "09:00", EndTime: "10:00", SlotMinutes: 30})
+	}
+	return windows, nil
+}
+
+func (b *bookingStore) CreateAppointment(appointment *mod.Appointments, actor string) error {
+	b.booked = append(b.booked, appointment)
+	return nil
+}
+
+func TestCreateAppointment(t *testing.T) {
+	patient, err := mod.Create_clientProfile("hip-00001", &mod.PatientDetails{
+		FirstName: "Asha", LastName: "Rao", Sex: "F", DOB: "1990-04-12", BloodGroup: "O+", BMI: "22",
+		MarriageStatus: "Single", Weight: "55", Email: "asha@example.com", MobileNumber: "9876543210",
+		AadhaarNumber: "123456789012", PrimaryLocation: "Pune", Sibling: "1", Twin: "No",
+		FatherName: "Ravi Rao", MotherName: "Meera Rao", EmergencyNumber: "9876500000",
+		Address: mod.Address{Country: "India", State: "MH", City: "Pune", Landmark: "Near the station"},
+	})
+	assert.NoError(t, err)
+
+	store := &bookingStore{
+		profiles: map[string]*mod.PatientDetails{patient.HealthID: patient, "HIDnoconsent0000000": patient},
+		consents: map[string]bool{patient.HealthID: true, "HIDdoesnotexist00000": true},
+	}
+	s := &APIServer{store: store}
+	tomorrow := time.Now().AddDate(0, 0, 1).Format(appointmentDateLayout)
+
+	tests := []struct {
+		name           string
+		healthID       string
+		expectedStatus int
+	}{
+		{name: "registered patient", healthID: patient.HealthID, expectedStatus: http.StatusCreated},
+		{name: "unknown patient", healthID: "HIDdoesnotexist00000", expectedStatus: http.StatusNotFound},
+		{name: "no appointments consent", healthID: "HIDnoconsent0000000", expectedStatus: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, _ := json.Marshal(map[string]string{
+				"health_id": tt.healthID, "fullname": "Asha Rao", "department": "Cardiology",
+				"appointment_date": tomorrow, "appointment_time": "09:30",
+			})
+			req := httptest.NewRequest("POST", "/api/v1/healthcare/appointments/create", bytes.NewReader(body))
+			ctx := context.WithValue(req.Context(), contextKeyHealthCareID, "hip-00001")
+			// a short name is fine, it comes from the token
+			ctx = context.WithValue(ctx, contextKeyHealthCareName, "Apex")
+			rr := httptest.NewRecorder()
+
+			assert.NoError(t, s.CreateAppointment(rr, req.WithContext(ctx)))
+			assert.Equal(t, tt.expectedStatus, rr.Code, rr.Body.String())
+		})
+	}
+	if assert.Len(t, store.booked, 1) {
+		assert.Equal(t, patient.HealthID, store.booked[0].HealthID)
+		assert.Equal(t, mod.StatusPending, store.booked[0].Status)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	mod "vaibhavyadav-dev/healthcareServer/databases"
+)
+
+// auditAccess writes the audit entry of an access to a patient's data, one per
+// health id. Handlers call it before answering: data that couldn't be audited
+// isn't handed out.
+func (s *APIServer) auditAccess(w http.ResponseWriter, r *http.Request, action, severity string, healthIDs ...string) (bool, error) {
+	healthcareID, _ := r.Context().Value(contextKeyHealthCareID).(string)
+	entries := make([]*mod.AuditEntry, 0, len(healthIDs))
+	for _, healthID := range healthIDs {
+		entries = append(entries, &mod.AuditEntry{
+			Actor:        requestActor(r),
+			HealthcareID: healthcareID,
+			HealthID:     healthID,
+			Action:       action,
+			Endpoint:     r.Method + " " + r.URL.Path,
+			IP:           s.clientIP(r),
+			Severity:     severity,
+		})
+	}
+	if err := s.store.AppendAudit(entries...); err != nil {
+		log.Printf("audit log write failed for %s on %v: %v", action, healthIDs, err)
+		return false, writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"message": "Something went wrong from our side",
+		})
+	}
+	return true, nil
+}
+
+// GetAuditLog lists the audit log of the healthcare newest first. Filters:
+// ?health_id=, ?actor=, ?from= and ?to= (RFC 3339), pages with ?before_id= and ?limit=
+func (s *APIServer) GetAuditLog(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error": r.Method + " method not allowed",
+		})
+	}
+	healthcareID, ok := r.Context().Value(contextKeyHealthCareID).(string)
+	if !ok {
+		return writeJSON(w, http.StatusUnauthorized, map[string]string{"message": "StatusUnauthorized"})
+	}
+
+	query := r.URL.Query()
+	q := mod.AuditQuery{
+		HealthcareID: healthcareID,
+		HealthID:     query.Get("health_id"),
+		Actor:        query.Get("actor"),
+	}
+	var err error
+	for _, bound := range []struct {
+		name  string
+		field *time.Time
+	}{{"from", &q.From}, {"to", &q.To}} {
+		if value := query.Get(bound.name); value != "" {
+			if *bound.field, err = time.Parse(time.RFC3339, value); err != nil {
+				return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+					"message": bound.name + " must be an RFC 3339 time like 2024-05-01T00:00:00Z",
+				})
+			}
+		}
+	}
+	if value := query.Get("before_id"); value != "" {
+		if q.BeforeID, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"message": "before_id must be a number",
+			})
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		if q.Limit, err = strconv.Atoi(value); err != nil {
+			return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"message": "limit must be a number",
+			})
+		}
+	}
+
+	entries, err := s.store.QueryAuditLog(q)
+	if err != nil {
+		return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"message": "Something went wrong from our side",
+		})
+	}
+	response := map[string]interface{}{"entries": entries}
+	if len(entries) > 0 {
+		response["next_before_id"] = entries[len(entries)-1].ID
+	}
+	return writeJSON(w, http.StatusOK, response)
+}
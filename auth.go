@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	rd "vaibhavyadav-dev/healthcareServer/redis"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+const (
+	accessTokenLifetime  = 15 * time.Minute
+	refreshTokenLifetime = 7 * 24 * time.Hour
+)
+
+// sessionIdentity is what a session remembers about who logged in,
+// every access token minted for that session carries it.
+// StaffID is empty when the healthcare itself logged in.
+type sessionIdentity struct {
+	HealthcareID string `json:"healthcare_id"`
+	Email        string `json:"email"`
+	Name         string `json:"name"`
+	Role         string `json:"role"`
+	StaffID      string `json:"staff_id,omitempty"`
+}
+
+// subject is who is acting: the staff member, or the healthcare itself
+func (i *sessionIdentity) subject() string {
+	if i.StaffID != "" {
+		return i.StaffID
+	}
+	return i.HealthcareID
+}
+
+type accessClaims struct {
+	HealthcareID string `json:"healthcareID"`
+	Email        string `json:"healthcare_email"`
+	Name         string `json:"healthcare_name"`
+	Role         string `json:"role"`
+	StaffID      string `json:"staff_id,omitempty"`
+	SessionID    string `json:"sid"`
+	jwt.RegisteredClaims
+}
+
+type tokenPair struct {
+	AccessToken  string
+	RefreshToken string
+	ExpiresIn    string
+}
+
+// refresh tokens look like <session_id>.<secret>, only the sha256 of the
+// secret is kept in redis
+func newRefreshToken(sessionID string) (token string, hash string, err error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(secret)
+	return sessionID + "." + encoded, hashToken(encoded), nil
+}
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *APIServer) startSession(identity *sessionIdentity) (*tokenPair, error) {
+	sessionID := uuid.New().String()
+	refreshToken, refreshHash, err := newRefreshToken(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.store.CreateSession(sessionID, identity.subject(), refreshHash, identity, refreshTokenLifetime); err != nil {
+		return nil, err
+	}
+	accessToken, _, err := s.createJWT(identity, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	return &tokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    accessTokenLifetime.String(),
+	}, nil
+}
+
+func (s *APIServer) RefreshToken(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return writeJSON(w, http.StatusNotAcceptable, map[string]interface{}{
+			"message": "Method Not Allowed",
+		})
+	}
+
+	req := struct {
+		RefreshToken string `json:"refresh_token"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"message": "could not process your request please check your schema",
+		})
+	}
+
+	sessionID, secret, found := strings.Cut(req.RefreshToken, ".")
+	if !found || sessionID == "" || secret == "" {
+		return writeJSON(w, http.StatusUnauthorized, map[string]interface{}{
+			"message": "Invalid refresh token",
+		})
+	}
+
+	newRefresh, newHash, err := newRefreshToken(sessionID)
+	if err != nil {
+		return err
+	}
+	data, err := s.store.RotateSession(sessionID, hashToken(secret), newHash, refreshTokenLifetime)
+	if errors.Is(err, rd.ErrRefreshTokenReused) {
+		return writeJSON(w, http.StatusUnauthorized, map[string]interface{}{
+			"message": "Refresh token was already used, session has been revoked. Please login again",
+		})
+	}
+	if errors.Is(err, rd.ErrSessionNotFound) {
+		return writeJSON(w, http.StatusUnauthorized, map[string]interface{}{
+			"message": "Session expired or logged out, please login again",
+		})
+	}
+	if err != nil {
+		return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"message": "Something went wrong from our side",
+		})
+	}
+
+	identity := &sessionIdentity{}
+	if err := json.Unmarshal([]byte(data), identity); err != nil {
+		return err
+	}
+	// sessions started before roles existed were always the healthcare itself
+	if identity.Role == "" {
+		identity.Role = RoleAdmin
+	}
+	accessToken, _, err := s.createJWT(identity, sessionID)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, map[string]interface{}{
+		"Expires In":    accessTokenLifetime.String(),
+		"token":         accessToken,
+		"refresh_token": newRefresh,
+	})
+}
+
+// Logout ends the session the current token belongs to
+func (s *APIServer) Logout(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return writeJSON(w, http.StatusNotAcceptable, map[string]interface{}{
+			"message": "Method Not Allowed",
+		})
+	}
+	claims, ok := r.Context().Value(contextKeyTokenClaims).(*accessClaims)
+	if !ok {
+		return writeJSON(w, http.StatusUnauthorized, map[string]string{"message": "StatusUnauthorized"})
+	}
+
+	if err := s.store.RevokeToken(claims.ID, time.Until(claims.ExpiresAt.Time)); err != nil {
+		return err
+	}
+	if err := s.store.RevokeSession(claims.SessionID); err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status": "Logged out",
+	})
+}
+
+// LogoutAll ends every session of the caller (the healthcare or the staff member), on every device
+func (s *APIServer) LogoutAll(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return writeJSON(w, http.StatusNotAcceptable, map[string]interface{}{
+			"message": "Method Not Allowed",
+		})
+	}
+	claims, ok := r.Context().Value(contextKeyTokenClaims).(*accessClaims)
+	if !ok {
+		return writeJSON(w, http.StatusUnauthorized, map[string]string{"message": "StatusUnauthorized"})
+	}
+
+	if err := s.store.RevokeToken(claims.ID, time.Until(claims.ExpiresAt.Time)); err != nil {
+		return err
+	}
+	if err := s.store.RevokeAllSessions(claims.Subject); err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status": "Logged out from all sessions",
+	})
+}
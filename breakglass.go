@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	mod "vaibhavyadav-dev/healthcareServer/databases"
+)
+
+// breakGlass opens emergency access to the patient for the caller, the reason is
+// mandatory and the access is announced to the patient and the compliance reviewer.
+// It writes the response itself and returns a nil access when the request was refused.
+func (s *APIServer) breakGlass(w http.ResponseWriter, r *http.Request, scope string) (*mod.BreakGlass, error) {
+	if r.Method != "POST" {
+		return nil, writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error": r.Method + " method not allowed",
+		})
+	}
+	healthcareID, ok := r.Context().Value(contextKeyHealthCareID).(string)
+	if !ok {
+		return nil, writeJSON(w, http.StatusUnauthorized, map[string]string{"message": "StatusUnauthorized"})
+	}
+	healthcareName, _ := r.Context().Value(contextKeyHealthCareName).(string)
+
+	req := struct {
+		HealthID string `json:"health_id"`
+		Reason   string `json:"reason"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.HealthID == "" {
+		return nil, writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"message": "could not process your request please check your schema",
+		})
+	}
+	if len(req.Reason) < 20 || len(req.Reason) > 500 {
+		return nil, writeJSON(w, http.StatusNotAcceptable, map[string]interface{}{
+			"status":  "Constraints Violeted",
+			"message": "a reason of 20 to 500 characters is required to break the glass",
+		})
+	}
+	healthID, resolved, err := s.resolveHealthID(w, req.HealthID)
+	if !resolved {
+		return nil, err
+	}
+	req.HealthID = healthID
+	if _, err := s.store.Get_ClientProfile(req.HealthID); err != nil {
+		return nil, writeJSON(w, http.StatusNotFound, map[string]interface{}{
+			"message": "No Patient Found :(",
+		})
+	}
+
+	access := &mod.BreakGlass{
+		HealthID:     req.HealthID,
+		HealthcareID: healthcareID,
+		Actor:        requestActor(r),
+		Scope:        scope,
+		Reason:       req.Reason,
+	}
+	if err := s.store.OpenBreakGlass(access, healthcareName, correlationID(r)); err != nil {
+		return nil, writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"message": "Something went wrong from our side",
+		})
+	}
+	log.Printf("BREAK-GLASS severity=high access=%d healthcare=%s actor=%s patient=%s scope=%s",
+		access.ID, healthcareID, access.Actor, access.HealthID, scope)
+	return access, nil
+}
+
+// BreakGlassRecords is GetPatientRecords for an emergency, ?severity= and ?list= work the same
+func (s *APIServer) BreakGlassRecords(w http.ResponseWriter, r *http.Request) error {
+	list := 5
+	if listStr := r.URL.Query().Get("list"); listStr != "" {
+		var err error
+		if list, err = strconv.Atoi(listStr); err != nil {
+			return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"message": "list must be a number",
+			})
+		}
+	}
+	access, err := s.breakGlass(w, r, mod.ConsentRecords)
+	if access == nil {
+		return err
+	}
+
+	patientRecords, err := s.store.GetPatientRecords(access.HealthID, r.URL.Query().Get("severity"), list)
+	if err != nil {
+		return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"message": "patient not found :(",
+		})
+	}
+	if audited, err := s.auditAccess(w, r, mod.AuditBreakGlassRecords, mod.AuditHigh, access.HealthID); !audited {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, map[string]interface{}{
+		"break_glass":     access,
+		"patient_records": patientRecords,
+	})
+}
+
+// BreakGlassProfile is Get_clientProfile for an emergency
+func (s *APIServer) BreakGlassProfile(w http.ResponseWriter, r *http.Request) error {
+	access, err := s.breakGlass(w, r, mod.ConsentProfile)
+	if access == nil {
+		return err
+	}
+
+	patientDetails, err := s.store.Get_ClientProfile(access.HealthID)
+	if err != nil {
+		return writeJSON(w, http.StatusNotFound, map[string]interface{}{
+			"message": "No Patient Found :(",
+		})
+	}
+	if audited, err := s.auditAccess(w, r, mod.AuditBreakGlassProfile, mod.AuditHigh, access.HealthID); !audited {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, map[string]interface{}{
+		"break_glass":    access,
+		"client_profile": patientDetails,
+	})
+}
+
+// ListBreakGlass is the review list, ?all=true includes the accesses already signed off
+func (s *APIServer) ListBreakGlass(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error": r.Method + " method not allowed",
+		})
+	}
+	healthcareID, ok := r.Context().Value(contextKeyHealthCareID).(string)
+	if !ok {
+		return writeJSON(w, http.StatusUnauthorized, map[string]string{"message": "StatusUnauthorized"})
+	}
+
+	accesses, err := s.store.ListBreakGlass(healthcareID, r.URL.Query().Get("all") != "true")
+	if err != nil {
+		return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"message": "Something went wrong from our side",
+		})
+	}
+	return writeJSON(w, http.StatusOK, map[string]interface{}{
+		"break_glass": accesses,
+	})
+}
+
+// SignOffBreakGlass marks an emergency access as reviewed by the caller
+func (s *APIServer) SignOffBreakGlass(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error": r.Method + " method not allowed",
+		})
+	}
+	healthcareID, ok := r.Context().Value(contextKeyHealthCareID).(string)
+	if !ok {
+		return writeJSON(w, http.StatusUnauthorized, map[string]string{"message": "StatusUnauthorized"})
+	}
+
+	req := struct {
+		ID   int64  `json:"id"`
+		Note string `json:"note"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ID == 0 || len(req.Note) > 500 {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"message": "could not process your request please check your schema",
+		})
+	}
+
+	access, err := s.store.ReviewBreakGlass(healthcareID, req.ID, requestActor(r), req.Note)
+	switch {
+	case errors.Is(err, mod.ErrBreakGlassNotFound):
+		return writeJSON(w, http.StatusNotFound, map[string]interface{}{
+			"message": err.Error(),
+		})
+	case errors.Is(err, mod.ErrBreakGlassReviewed):
+		return writeJSON(w, http.StatusConflict, map[string]interface{}{
+			"message": err.Error(),
+		})
+	case errors.Is(err, mod.ErrBreakGlassOwnAccess):
+		return writeJSON(w, http.StatusForbidden, map[string]interface{}{
+			"message": err.Error(),
+		})
+	case err != nil:
+		return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"message": "Something went wrong from our side",
+		})
+	}
+	return writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":      "Signed Off",
+		"break_glass": access,
+	})
+}
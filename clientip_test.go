@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies, err := ParseTrustedProxies("10.0.0.0/8, 192.168.1.5")
+	assert.NoError(t, err)
+	s := &APIServer{trustedProxies: proxies}
+
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor []string
+		expectedIP   string
+	}{
+		{name: "direct client", remoteAddr: "203.0.113.7:4000", expectedIP: "203.0.113.7"},
+		{name: "header from an untrusted peer is ignored", remoteAddr: "203.0.113.7:4000", forwardedFor: []string{"1.2.3.4"}, expectedIP: "203.0.113.7"},
+		{name: "trusted proxy", remoteAddr: "10.0.0.2:4000", forwardedFor: []string{"198.51.100.9"}, expectedIP: "198.51.100.9"},
+		{name: "forged hop left of the client", remoteAddr: "10.0.0.2:4000", forwardedFor: []string{"1.2.3.4, 198.51.100.9"}, expectedIP: "198.51.100.9"},
+		{name: "chain of trusted proxies", remoteAddr: "10.0.0.2:4000", forwardedFor: []string{"1.2.3.4, 198.51.100.9", "192.168.1.5, 10.1.1.1"}, expectedIP: "198.51.100.9"},
+		{name: "garbage hop", remoteAddr: "10.0.0.2:4000", forwardedFor: []string{"198.51.100.9, not-an-ip"}, expectedIP: "10.0.0.2"},
+		{name: "trusted proxy without header", remoteAddr: "192.168.1.5:4000", expectedIP: "192.168.1.5"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for _, header := range tt.forwardedFor {
+				req.Header.Add("X-Forwarded-For", header)
+			}
+			assert.Equal(t, tt.expectedIP, s.clientIP(req))
+		})
+	}
+
+	_, err = ParseTrustedProxies("10.0.0.0/33")
+	assert.Error(t, err)
+}
@@ -0,0 +1,31 @@
+// eventschema writes the JSON Schema document of every event to a directory,
+// run it through go generate ./events after changing an event
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+
+	"vaibhavyadav-dev/healthcareServer/events"
+)
+
+func main() {
+	out := flag.String("out", "events/schemas", "directory the schema documents are written to")
+	flag.Parse()
+
+	if err := os.MkdirAll(*out, 0o755); err != nil {
+		log.Fatal(err)
+	}
+	for _, event := range events.All {
+		doc, err := events.MarshalSchema(event)
+		if err != nil {
+			log.Fatalf("%s: %v", event.Type(), err)
+		}
+		if err := os.WriteFile(filepath.Join(*out, events.SchemaFile(event)), doc, 0o644); err != nil {
+			log.Fatal(err)
+		}
+	}
+	log.Printf("wrote %d schemas to %s", len(events.All), *out)
+}
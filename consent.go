@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	mod "vaibhavyadav-dev/healthcareServer/databases"
+)
+
+const maxConsentDays = 365
+
+// requireConsent refuses the request unless the healthcare created the patient,
+// holds a valid consent for scope or broke the glass for it, handlers return
+// right away when it reports false
+func (s *APIServer) requireConsent(w http.ResponseWriter, healthcareID, healthID, scope string) (bool, error) {
+	return s.checkConsent(w, healthcareID, healthID, scope, true)
+}
+
+// requireWriteConsent is requireConsent for handlers that change the patient's
+// data, break-glass access doesn't count there
+func (s *APIServer) requireWriteConsent(w http.ResponseWriter, healthcareID, healthID, scope string) (bool, error) {
+	return s.checkConsent(w, healthcareID, healthID, scope, false)
+}
+
+func (s *APIServer) checkConsent(w http.ResponseWriter, healthcareID, healthID, scope string, breakGlass bool) (bool, error) {
+	allowed, err := s.store.HasConsent(healthcareID, healthID, scope, breakGlass)
+	if err != nil {
+		return false, writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"message": "Something went wrong from our side",
+		})
+	}
+	if !allowed {
+		return false, writeJSON(w, http.StatusForbidden, map[string]interface{}{
+			"status":  "Consent Required",
+			"message": "the patient has not given you access to their " + scope + ", request it at /api/v1/healthcare/consents/request",
+		})
+	}
+	return true, nil
+}
+
+// RequestConsent mails the patient a token to approve access to one scope of their data
+func (s *APIServer) RequestConsent(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error": r.Method + " method not allowed",
+		})
+	}
+	healthcareID, ok := r.Context().Value(contextKeyHealthCareID).(string)
+	if !ok {
+		return writeJSON(w, http.StatusUnauthorized, map[string]string{"message": "StatusUnauthorized"})
+	}
+	healthcareName, _ := r.Context().Value(contextKeyHealthCareName).(string)
+
+	req := struct {
+		HealthID     string `json:"health_id"`
+		Scope        string `json:"scope"`
+		DurationDays int    `json:"duration_days"`
+		Reason       string `json:"reason"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.HealthID == "" {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"message": "could not process your request please check your schema",
+		})
+	}
+	if !mod.IsConsentScope(req.Scope) || req.DurationDays < 1 || req.DurationDays > maxConsentDays || len(req.Reason) > 300 {
+		return writeJSON(w, http.StatusNotAcceptable, map[string]interface{}{
+			"status":  "Constraints Violeted",
+			"message": "scope must be one of [\"profile\", \"records\", \"appointments\"], duration_days between 1 and 365 and reason at most 300 characters",
+		})
+	}
+	healthID, resolved, err := s.resolveHealthID(w, req.HealthID)
+	if !resolved {
+		return err
+	}
+	req.HealthID = healthID
+	if _, err := s.store.Get_ClientProfile(req.HealthID); err != nil {
+		return writeJSON(w, http.StatusNotFound, map[string]interface{}{
+			"message": "No Patient Found :(",
+		})
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	consent := &mod.Consent{
+		HealthID:     req.HealthID,
+		HealthcareID: healthcareID,
+		Scope:        req.Scope,
+		DurationDays: req.DurationDays,
+		Reason:       req.Reason,
+		RequestedBy:  requestActor(r),
+	}
+	if err := s.store.RequestConsent(consent, token, hashToken(token), healthcareName, correlationID(r)); err != nil {
+		return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"message": "Something went wrong from our side",
+		})
+	}
+
+	return writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"status":  "Requested",
+		"message": "the patient got an email to approve the request",
+		"consent": consent,
+	})
+}
+
+// ListConsents lists the consents the healthcare asked for, ?health_id= narrows them to one patient
+func (s *APIServer) ListConsents(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error": r.Method + " method not allowed",
+		})
+	}
+	healthcareID, ok := r.Context().Value(contextKeyHealthCareID).(string)
+	if !ok {
+		return writeJSON(w, http.StatusUnauthorized, map[string]string{"message": "StatusUnauthorized"})
+	}
+
+	consents, err := s.store.ListConsents(healthcareID, r.URL.Query().Get("health_id"))
+	if err != nil {
+		return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"message": "Something went wrong from our side",
+		})
+	}
+	return writeJSON(w, http.StatusOK, map[string]interface{}{
+		"consents": consents,
+	})
+}
+
+// RevokeConsent gives up a consent (or a pending request) of the healthcare
+func (s *APIServer) RevokeConsent(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error": r.Method + " method not allowed",
+		})
+	}
+	healthcareID, ok := r.Context().Value(contextKeyHealthCareID).(string)
+	if !ok {
+		return writeJSON(w, http.StatusUnauthorized, map[string]string{"message": "StatusUnauthorized"})
+	}
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"message": "provide the consent id",
+		})
+	}
+
+	consent, err := s.store.RevokeConsent(healthcareID, id)
+	return writeConsentChange(w, consent, err)
+}
+
+// patientConsentToken reads the token the patient got with the consent request
+func patientConsentToken(w http.ResponseWriter, r *http.Request) (string, error) {
+	if r.Method != "POST" {
+		return "", writeJSON(w, http.StatusNotAcceptable, map[string]interface{}{
+			"message": "Method Not Allowed",
+		})
+	}
+	req := struct {
+		Token string `json:"token"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		return "", writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"message": "could not process your request please check your schema",
+		})
+	}
+	return req.Token, nil
+}
+
+// ApproveConsent is called by the patient with the token from the request email
+func (s *APIServer) ApproveConsent(w http.ResponseWriter, r *http.Request) error {
+	token, err := patientConsentToken(w, r)
+	if token == "" {
+		return err
+	}
+	consent, err := s.store.DecideConsent(hashToken(token), true)
+	return writeConsentChange(w, consent, err)
+}
+
+func (s *APIServer) RejectConsent(w http.ResponseWriter, r *http.Request) error {
+	token, err := patientConsentToken(w, r)
+	if token == "" {
+		return err
+	}
+	consent, err := s.store.DecideConsent(hashToken(token), false)
+	return writeConsentChange(w, consent, err)
+}
+
+// RevokeConsentAsPatient withdraws a granted consent, the token stays valid for this
+func (s *APIServer) RevokeConsentAsPatient(w http.ResponseWriter, r *http.Request) error {
+	token, err := patientConsentToken(w, r)
+	if token == "" {
+		return err
+	}
+	consent, err := s.store.RevokeConsentByToken(hashToken(token))
+	return writeConsentChange(w, consent, err)
+}
+
+func writeConsentChange(w http.ResponseWriter, consent *mod.Consent, err error) error {
+	switch {
+	case errors.Is(err, mod.ErrConsentNotFound):
+		return writeJSON(w, http.StatusNotFound, map[string]interface{}{
+			"message": err.Error(),
+		})
+	case errors.Is(err, mod.ErrConsentNotPending), errors.Is(err, mod.ErrConsentClosed):
+		return writeJSON(w, http.StatusConflict, map[string]interface{}{
+			"message": err.Error(),
+		})
+	case err != nil:
+		return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"message": "Something went wrong from our side",
+		})
+	}
+	return writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":  consent.Status,
+		"consent": consent,
+	})
+}
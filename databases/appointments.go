@@ -0,0 +1,209 @@
+package databases
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+var (
+	// ErrSlotTaken is returned when another active appointment already holds the slot
+	ErrSlotTaken           = errors.New("slot is already booked")
+	ErrAppointmentNotFound = errors.New("appointment not found")
+)
+
+const appointmentColumns = `id, health_id, status, to_char(appointment_date, 'YYYY-MM-DD'), to_char(appointment_time, 'HH24:MI'),
+	healthcare_id, department, note, fullname, healthcare_name`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanAppointment(row rowScanner) (*Appointments, error) {
+	var appointment Appointments
+	err := row.Scan(
+		&appointment.ID,
+		&appointment.HealthID,
+		&appointment.Status,
+		&appointment.AppointmentDate,
+		&appointment.AppointmentTime,
+		&appointment.HealthcareID,
+		&appointment.Department,
+		&appointment.Note,
+		&appointment.FullName,
+		&appointment.HealthcareName,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &appointment, nil
+}
+
+// SetAvailability replaces the whole weekly schedule of one department
+func (s *PostgresStore) SetAvailability(healthcare_id, department string, windows []*Availability) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM department_availability WHERE healthcare_id = $1 AND department = $2`, healthcare_id, department); err != nil {
+		return fmt.Errorf("failed to clear availability: %w", err)
+	}
+	for _, window := range windows {
+		_, err := tx.Exec(`INSERT INTO department_availability (healthcare_id, department, weekday, start_time, end_time, slot_minutes)
+		VALUES ($1, $2, $3, $4, $5, $6)`, healthcare_id, department, window.Weekday, window.StartTime, window.EndTime, window.SlotMinutes)
+		if err != nil {
+			return fmt.Errorf("failed to store availability: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *PostgresStore) GetAvailability(healthcare_id, department string) ([]*Availability, error) {
+	query := `SELECT department, weekday, to_char(start_time, 'HH24:MI'), to_char(end_time, 'HH24:MI'), slot_minutes
+	FROM department_availability WHERE healthcare_id = $1 AND department = $2 ORDER BY weekday, start_time`
+	rows, err := s.db.Query(query, healthcare_id, department)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	windows := []*Availability{}
+	for rows.Next() {
+		var window Availability
+		if err := rows.Scan(&window.Department, &window.Weekday, &window.StartTime, &window.EndTime, &window.SlotMinutes); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		windows = append(windows, &window)
+	}
+	return windows, rows.Err()
+}
+
+// BookedSlots returns the start times (HH:MM) held by active appointments on a date
+func (s *PostgresStore) BookedSlots(healthcare_id, department, date string) ([]string, error) {
+	query := `SELECT to_char(appointment_time, 'HH24:MI') FROM appointments
+	WHERE healthcare_id = $1 AND department = $2 AND appointment_date = $3 AND status IN ('Pending', 'Confirmed')`
+	rows, err := s.db.Query(query, healthcare_id, department, date)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	booked := []string{}
+	for rows.Next() {
+		var slot string
+		if err := rows.Scan(&slot); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		booked = append(booked, slot)
+	}
+	return booked, rows.Err()
+}
+
+// CreateAppointment inserts the appointment with its first history entry and fills in its id,
+// two concurrent bookings of the same slot are settled by the appointments_active_slot index
+func (s *PostgresStore) CreateAppointment(appointment *Appointments, actor string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO appointments (health_id, healthcare_id, healthcare_name, fullname, department,
+		appointment_date, appointment_time, status, note)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id`
+	err = tx.QueryRow(query, appointment.HealthID, appointment.HealthcareID, appointment.HealthcareName, appointment.FullName,
+		appointment.Department, appointment.AppointmentDate, appointment.AppointmentTime, appointment.Status, appointment.Note).Scan(&appointment.ID)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return ErrSlotTaken
+		}
+		return fmt.Errorf("failed to create appointment: %w", err)
+	}
+	if _, err := tx.Exec(`INSERT INTO appointment_status_history (appointment_id, from_status, to_status, actor)
+	VALUES ($1, NULL, $2, $3)`, appointment.ID, appointment.Status, actor); err != nil {
+		return fmt.Errorf("failed to record appointment history: %w", err)
+	}
+	return tx.Commit()
+}
+
+func (s *PostgresStore) GetAppointment(healthcare_id string, id int64) (*Appointments, error) {
+	row := s.db.QueryRow(`SELECT `+appointmentColumns+` FROM appointments WHERE id = $1 AND healthcare_id = $2`, id, healthcare_id)
+	appointment, err := scanAppointment(row)
+	if err == sql.ErrNoRows {
+		return nil, ErrAppointmentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return appointment, nil
+}
+
+// TransitionAppointment moves an appointment of the healthcare to a new status and
+// queues the events in the outbox, all in one transaction. The row is locked so two
+// concurrent changes can't both pass the transition check
+func (s *PostgresStore) TransitionAppointment(healthcare_id string, id int64, status, actor, reason string, events ...*OutboxEvent) (*Appointments, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRow(`SELECT `+appointmentColumns+` FROM appointments WHERE id = $1 AND healthcare_id = $2 FOR UPDATE`, id, healthcare_id)
+	appointment, err := scanAppointment(row)
+	if err == sql.ErrNoRows {
+		return nil, ErrAppointmentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckTransition(appointment.Status, status); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(`UPDATE appointments SET status = $1 WHERE id = $2`, status, id); err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return nil, ErrSlotTaken
+		}
+		return nil, fmt.Errorf("failed to update appointment: %w", err)
+	}
+	if _, err := tx.Exec(`INSERT INTO appointment_status_history (appointment_id, from_status, to_status, actor, reason)
+	VALUES ($1, $2, $3, $4, $5)`, id, appointment.Status, status, actor, reason); err != nil {
+		return nil, fmt.Errorf("failed to record appointment history: %w", err)
+	}
+	if err := insertOutbox(tx, events); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	appointment.Status = status
+	return appointment, nil
+}
+
+// GetAppointmentHistory returns the timeline oldest first
+func (s *PostgresStore) GetAppointmentHistory(appointmentID int64) ([]*AppointmentStatusChange, error) {
+	query := `SELECT COALESCE(from_status, ''), to_status, actor, reason, changed_at
+	FROM appointment_status_history WHERE appointment_id = $1 ORDER BY changed_at, id`
+	rows, err := s.db.Query(query, appointmentID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	history := []*AppointmentStatusChange{}
+	for rows.Next() {
+		var change AppointmentStatusChange
+		if err := rows.Scan(&change.FromStatus, &change.ToStatus, &change.Actor, &change.Reason, &change.ChangedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		history = append(history, &change)
+	}
+	return history, rows.Err()
+}
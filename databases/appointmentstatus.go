@@ -0,0 +1,44 @@
+package databases
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	StatusPending      = "Pending"
+	StatusConfirmed    = "Confirmed"
+	StatusRejected     = "Rejected"
+	StatusNotAvailable = "Not Available"
+	StatusCancelled    = "Cancelled"
+	StatusCompleted    = "Completed"
+	StatusNoShow       = "NoShow"
+)
+
+var ErrInvalidTransition = errors.New("status change not allowed")
+
+// appointmentTransitions lists where each status may go next, statuses
+// without an entry are terminal
+var appointmentTransitions = map[string][]string{
+	StatusPending:   {StatusConfirmed, StatusRejected, StatusNotAvailable, StatusCancelled},
+	StatusConfirmed: {StatusCompleted, StatusNoShow, StatusCancelled, StatusNotAvailable},
+}
+
+var appointmentStatuses = map[string]bool{
+	StatusPending: true, StatusConfirmed: true, StatusRejected: true, StatusNotAvailable: true,
+	StatusCancelled: true, StatusCompleted: true, StatusNoShow: true,
+}
+
+func IsAppointmentStatus(status string) bool {
+	return appointmentStatuses[status]
+}
+
+// CheckTransition returns an error wrapping ErrInvalidTransition when from can't move to to
+func CheckTransition(from, to string) error {
+	for _, next := range appointmentTransitions[from] {
+		if next == to {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s -> %s", ErrInvalidTransition, from, to)
+}
@@ -0,0 +1,33 @@
+package databases
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckTransition(t *testing.T) {
+	tests := []struct {
+		from, to string
+		allowed  bool
+	}{
+		{StatusPending, StatusConfirmed, true},
+		{StatusPending, StatusRejected, true},
+		{StatusConfirmed, StatusCompleted, true},
+		{StatusConfirmed, StatusNoShow, true},
+		{StatusConfirmed, StatusPending, false},
+		{StatusRejected, StatusConfirmed, false},
+		{StatusCompleted, StatusCancelled, false},
+		{StatusNoShow, StatusConfirmed, false},
+		{StatusPending, StatusPending, false},
+		{"Unknown", StatusConfirmed, false},
+	}
+	for _, tt := range tests {
+		err := CheckTransition(tt.from, tt.to)
+		if tt.allowed && err != nil {
+			t.Errorf("%s -> %s: unexpected error %v", tt.from, tt.to, err)
+		}
+		if !tt.allowed && !errors.Is(err, ErrInvalidTransition) {
+			t.Errorf("%s -> %s: expected ErrInvalidTransition, got %v", tt.from, tt.to, err)
+		}
+	}
+}
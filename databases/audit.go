@@ -0,0 +1,243 @@
+package databases
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// what was done with the patient's data
+const (
+	AuditProfileCreate     = "profile.create"
+	AuditProfileView       = "profile.view"
+	AuditProfileUpdate     = "profile.update"
+	AuditRecordsCreate     = "records.create"
+	AuditRecordsView       = "records.view"
+	AuditBreakGlassProfile = "breakglass.profile"
+	AuditBreakGlassRecords = "breakglass.records"
+	AuditProfileSearch     = "profile.search"
+	AuditDuplicateReview   = "duplicates.review"
+	AuditProfileMerge      = "profile.merge"
+	AuditProfileHistory    = "profile.history"
+	AuditProfileRevert     = "profile.revert"
+	AuditProfileLookup     = "profile.lookup"
+)
+
+const (
+	AuditNormal = "normal"
+	AuditHigh   = "high"
+)
+
+// prev_hash of the first entry
+var auditGenesis = fmt.Sprintf("%064d", 0)
+
+// every append takes this transaction lock so the chain never forks
+const auditChainLock = 0x61756469
+
+const (
+	maxAuditPage     = 500
+	auditVerifyBatch = 1000
+)
+
+// AuditTamperedError is the first entry that doesn't match the chain
+type AuditTamperedError struct {
+	ID     int64
+	Reason string
+}
+
+func (e *AuditTamperedError) Error() string {
+	return fmt.Sprintf("audit log entry %d: %s", e.ID, e.Reason)
+}
+
+// auditHash hashes the entry's fields after the previous hash, every field is
+// length prefixed so moving characters between fields changes the hash
+func auditHash(entry *AuditEntry) string {
+	h := sha256.New()
+	for _, field := range []string{
+		entry.PrevHash,
+		strconv.FormatInt(entry.ID, 10),
+		entry.Actor,
+		entry.HealthcareID,
+		entry.HealthID,
+		entry.Action,
+		entry.Endpoint,
+		entry.IP,
+		entry.Severity,
+		entry.CreatedAt.UTC().Format(time.RFC3339Nano),
+	} {
+		io.WriteString(h, strconv.Itoa(len(field))+":"+field+";")
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+const auditColumns = `id, actor, healthcare_id, health_id, action, endpoint, ip, severity, created_at, prev_hash, hash`
+
+func scanAudit(row rowScanner) (*AuditEntry, error) {
+	var entry AuditEntry
+	err := row.Scan(&entry.ID, &entry.Actor, &entry.HealthcareID, &entry.HealthID, &entry.Action, &entry.Endpoint,
+		&entry.IP, &entry.Severity, &entry.CreatedAt, &entry.PrevHash, &entry.Hash)
+	if err != nil {
+		return nil, err
+	}
+	entry.CreatedAt = entry.CreatedAt.UTC()
+	return &entry, nil
+}
+
+// AppendAudit chains the entries to the last one and stores them together, ID,
+// CreatedAt and the hashes are filled in
+func (s *PostgresStore) AppendAudit(entries ...*AuditEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, auditChainLock); err != nil {
+		return fmt.Errorf("failed to lock audit log: %w", err)
+	}
+	prev := auditGenesis
+	err = tx.QueryRow(`SELECT hash FROM phi_audit_log ORDER BY id DESC LIMIT 1`).Scan(&prev)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	// postgres keeps microseconds, the hash must see what is read back
+	createdAt := time.Now().UTC().Truncate(time.Microsecond)
+	for _, entry := range entries {
+		if err := tx.QueryRow(`SELECT nextval(pg_get_serial_sequence('phi_audit_log', 'id'))`).Scan(&entry.ID); err != nil {
+			return err
+		}
+		entry.CreatedAt = createdAt
+		entry.PrevHash = prev
+		entry.Hash = auditHash(entry)
+		prev = entry.Hash
+
+		_, err = tx.Exec(`INSERT INTO phi_audit_log (`+auditColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`,
+			entry.ID, entry.Actor, entry.HealthcareID, entry.HealthID, entry.Action, entry.Endpoint, entry.IP, entry.Severity,
+			entry.CreatedAt, entry.PrevHash, entry.Hash)
+		if err != nil {
+			return fmt.Errorf("failed to write audit log: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// QueryAuditLog returns the entries of a healthcare matching q, newest first
+func (s *PostgresStore) QueryAuditLog(q AuditQuery) ([]*AuditEntry, error) {
+	if q.Limit <= 0 || q.Limit > maxAuditPage {
+		q.Limit = maxAuditPage
+	}
+	var from, to sql.NullTime
+	if !q.From.IsZero() {
+		from = sql.NullTime{Time: q.From.UTC(), Valid: true}
+	}
+	if !q.To.IsZero() {
+		to = sql.NullTime{Time: q.To.UTC(), Valid: true}
+	}
+	rows, err := s.db.Query(`SELECT `+auditColumns+` FROM phi_audit_log
+	WHERE healthcare_id = $1 AND ($2 = '' OR health_id = $2) AND ($3 = '' OR actor = $3)
+		AND ($4::timestamp IS NULL OR created_at >= $4) AND ($5::timestamp IS NULL OR created_at < $5)
+		AND ($6 = 0 OR id < $6)
+	ORDER BY id DESC LIMIT $7`, q.HealthcareID, q.HealthID, q.Actor, from, to, q.BeforeID, q.Limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []*AuditEntry{}
+	for rows.Next() {
+		entry, err := scanAudit(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// PatientAccessReport returns who accessed the patient's data newest first, the
+// accesses under health ids merged into it included. beforeID continues after the
+// last entry of a page
+func (s *PostgresStore) PatientAccessReport(health_id string, beforeID int64, limit int) ([]*AccessReportEntry, error) {
+	if limit <= 0 || limit > maxAuditPage {
+		limit = maxAuditPage
+	}
+	// the name of a deleted healthcare is gone, its id stays in the log
+	rows, err := s.db.Query(`SELECT a.id, a.healthcare_id, COALESCE(h.healthcare_name, ''), a.action, a.created_at
+	FROM phi_audit_log a LEFT JOIN HIP_TABLE h ON h.healthcare_id = a.healthcare_id
+	WHERE (a.health_id = $1 OR a.health_id IN (SELECT alias_health_id FROM patient_aliases WHERE health_id = $1))
+		AND ($2 = 0 OR a.id < $2) ORDER BY a.id DESC LIMIT $3`, health_id, beforeID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []*AccessReportEntry{}
+	for rows.Next() {
+		var entry AccessReportEntry
+		if err := rows.Scan(&entry.ID, &entry.HealthcareID, &entry.HealthcareName, &entry.Action, &entry.AccessedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		entry.AccessedAt = entry.AccessedAt.UTC()
+		entries = append(entries, &entry)
+	}
+	return entries, rows.Err()
+}
+
+// verifyAuditChain checks entries against the hash that came before them and
+// returns the hash of the last one
+func verifyAuditChain(prev string, entries []*AuditEntry) (string, error) {
+	for _, entry := range entries {
+		if entry.PrevHash != prev {
+			return prev, &AuditTamperedError{ID: entry.ID, Reason: "previous hash doesn't match, an entry before it was changed or removed"}
+		}
+		if auditHash(entry) != entry.Hash {
+			return prev, &AuditTamperedError{ID: entry.ID, Reason: "hash doesn't match its content"}
+		}
+		prev = entry.Hash
+	}
+	return prev, nil
+}
+
+// VerifyAuditLog walks the whole chain oldest first. It returns how many entries
+// were checked and the hash of the last one; removing entries from the end can
+// only be noticed by comparing that hash with one kept outside the database.
+func (s *PostgresStore) VerifyAuditLog() (int64, string, error) {
+	var checked, lastID int64
+	head := auditGenesis
+	for {
+		rows, err := s.db.Query(`SELECT `+auditColumns+` FROM phi_audit_log WHERE id > $1 ORDER BY id LIMIT $2`,
+			lastID, auditVerifyBatch)
+		if err != nil {
+			return checked, head, fmt.Errorf("failed to execute query: %w", err)
+		}
+		batch := []*AuditEntry{}
+		for rows.Next() {
+			entry, err := scanAudit(rows)
+			if err != nil {
+				rows.Close()
+				return checked, head, fmt.Errorf("failed to scan row: %w", err)
+			}
+			batch = append(batch, entry)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return checked, head, err
+		}
+		if len(batch) == 0 {
+			return checked, head, nil
+		}
+
+		if head, err = verifyAuditChain(head, batch); err != nil {
+			return checked, head, err
+		}
+		checked += int64(len(batch))
+		lastID = batch[len(batch)-1].ID
+	}
+}
@@ -0,0 +1,53 @@
+package databases
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func auditChain(n int) []*AuditEntry {
+	entries := []*AuditEntry{}
+	prev := auditGenesis
+	for i := 1; i <= n; i++ {
+		entry := &AuditEntry{
+			ID: int64(i), Actor: "dr.rao", HealthcareID: "hip-1", HealthID: "patient-1",
+			Action: AuditRecordsView, Endpoint: "/api/v1/healthcare/client/records/fetch", IP: "10.0.0.1",
+			Severity: AuditNormal, CreatedAt: time.Date(2024, 5, 1, 10, i, 0, 123000, time.UTC), PrevHash: prev,
+		}
+		entry.Hash = auditHash(entry)
+		prev = entry.Hash
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestVerifyAuditChain(t *testing.T) {
+	entries := auditChain(4)
+	head, err := verifyAuditChain(auditGenesis, entries)
+	if err != nil || head != entries[3].Hash {
+		t.Fatalf("intact chain: head %s, err %v", head, err)
+	}
+
+	tests := map[string]struct {
+		tamper func([]*AuditEntry) []*AuditEntry
+		id     int64
+	}{
+		"changed field": {func(e []*AuditEntry) []*AuditEntry { e[1].HealthID = "patient-2"; return e }, 2},
+		"changed time":  {func(e []*AuditEntry) []*AuditEntry { e[2].CreatedAt = e[2].CreatedAt.Add(time.Second); return e }, 3},
+		"removed entry": {func(e []*AuditEntry) []*AuditEntry { return append(e[:1], e[2:]...) }, 3},
+		"moved characters between fields": {func(e []*AuditEntry) []*AuditEntry {
+			e[0].Actor, e[0].HealthcareID = "dr.raoh", "ip-1"
+			return e
+		}, 1},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := verifyAuditChain(auditGenesis, test.tamper(auditChain(4)))
+			var tampered *AuditTamperedError
+			if !errors.As(err, &tampered) || tampered.ID != test.id {
+				t.Fatalf("got %v, want tampering at %d", err, test.id)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package databases
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"vaibhavyadav-dev/healthcareServer/events"
+)
+
+// how long a break-glass access opens the patient's data
+const BreakGlassDuration = 4 * time.Hour
+
+var (
+	ErrBreakGlassNotFound  = errors.New("break-glass access not found")
+	ErrBreakGlassReviewed  = errors.New("break-glass access was already signed off")
+	ErrBreakGlassOwnAccess = errors.New("break-glass access can't be signed off by the person who opened it")
+)
+
+const breakGlassColumns = `id, health_id, healthcare_id, actor, scope, reason, opened_at, expires_at,
+	reviewed_by, reviewed_at, review_note`
+
+func scanBreakGlass(row rowScanner) (*BreakGlass, error) {
+	var access BreakGlass
+	var reviewedBy sql.NullString
+	var reviewedAt sql.NullTime
+	err := row.Scan(&access.ID, &access.HealthID, &access.HealthcareID, &access.Actor, &access.Scope, &access.Reason,
+		&access.OpenedAt, &access.ExpiresAt, &reviewedBy, &reviewedAt, &access.ReviewNote)
+	if err != nil {
+		return nil, err
+	}
+	if reviewedBy.Valid {
+		access.ReviewedBy = &reviewedBy.String
+	}
+	if reviewedAt.Valid {
+		access.ReviewedAt = &reviewedAt.Time
+	}
+	return &access, nil
+}
+
+// OpenBreakGlass records an emergency access, every use gets its own row so each
+// reason is reviewed. The BreakGlassAccessed event announcing it to the patient and
+// the reviewer is written in the same transaction once the row has its id.
+func (s *PostgresStore) OpenBreakGlass(access *BreakGlass, healthcareName, correlationID string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRow(`INSERT INTO break_glass_access (health_id, healthcare_id, actor, scope, reason, expires_at)
+	VALUES ($1, $2, $3, $4, $5, NOW() + $6 * INTERVAL '1 second') RETURNING `+breakGlassColumns,
+		access.HealthID, access.HealthcareID, access.Actor, access.Scope, access.Reason, int64(BreakGlassDuration/time.Second))
+	stored, err := scanBreakGlass(row)
+	if err != nil {
+		return fmt.Errorf("failed to open break-glass access: %w", err)
+	}
+	*access = *stored
+	accessed, err := NewEvent(correlationID, events.BreakGlassAccessed{
+		Healthcare: events.Healthcare{HealthcareID: access.HealthcareID, HealthcareName: healthcareName},
+		AccessID:   access.ID,
+		HealthID:   access.HealthID,
+		Actor:      access.Actor,
+		Scope:      access.Scope,
+		Reason:     access.Reason,
+		Severity:   "high",
+		ExpiresAt:  access.ExpiresAt,
+	})
+	if err != nil {
+		return err
+	}
+	if err := insertOutbox(tx, []*OutboxEvent{accessed}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ListBreakGlass returns the emergency accesses of a healthcare newest first,
+// pending keeps only those nobody signed off yet
+func (s *PostgresStore) ListBreakGlass(healthcare_id string, pending bool) ([]*BreakGlass, error) {
+	rows, err := s.db.Query(`SELECT `+breakGlassColumns+` FROM break_glass_access
+	WHERE healthcare_id = $1 AND (NOT $2 OR reviewed_at IS NULL) ORDER BY opened_at DESC, id DESC LIMIT 200`, healthcare_id, pending)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	accesses := []*BreakGlass{}
+	for rows.Next() {
+		access, err := scanBreakGlass(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		accesses = append(accesses, access)
+	}
+	return accesses, rows.Err()
+}
+
+// ReviewBreakGlass signs off an emergency access, a signed off access can't be reviewed
+// again and nobody signs off an access they opened themselves
+func (s *PostgresStore) ReviewBreakGlass(healthcare_id string, id int64, reviewer, note string) (*BreakGlass, error) {
+	row := s.db.QueryRow(`UPDATE break_glass_access SET reviewed_by = $1, reviewed_at = NOW(), review_note = $2
+	WHERE id = $3 AND healthcare_id = $4 AND reviewed_at IS NULL AND actor <> $1 RETURNING `+breakGlassColumns,
+		reviewer, note, id, healthcare_id)
+	access, err := scanBreakGlass(row)
+	if err != sql.ErrNoRows {
+		return access, err
+	}
+	var actor string
+	var reviewed bool
+	err = s.db.QueryRow(`SELECT actor, reviewed_at IS NOT NULL FROM break_glass_access WHERE id = $1 AND healthcare_id = $2`,
+		id, healthcare_id).Scan(&actor, &reviewed)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, ErrBreakGlassNotFound
+	case err != nil:
+		return nil, err
+	case reviewed:
+		return nil, ErrBreakGlassReviewed
+	case actor == reviewer:
+		return nil, ErrBreakGlassOwnAccess
+	}
+	return nil, ErrBreakGlassNotFound
+}
@@ -1,8 +1,10 @@
 package databases
 
 import (
+	"context"
 	"fmt"
 	"time"
+	"vaibhavyadav-dev/healthcareServer/events"
 	mq "vaibhavyadav-dev/healthcareServer/rabbitmq"
 	rd "vaibhavyadav-dev/healthcareServer/redis"
 
@@ -14,6 +16,9 @@ type CombinedStore struct {
 	mongodb   *MongoStore
 	rabbitmq  *mq.Rabbitmq
 	redisconn *rd.Redisconn
+
+	// nudges RunOutboxRelay after something was written to the outbox
+	outboxWake chan struct{}
 }
 
 // redis will contain url, limit -> no request allowed in window time
@@ -47,10 +52,11 @@ func Combinedstore(redisURL string, limit int64, window time.Duration, rabbitMqU
 	}
 
 	return &CombinedStore{
-		postgres:  postgres,
-		mongodb:   mongodb,
-		rabbitmq:  rabbitmqconn,
-		redisconn: redisconn,
+		postgres:   postgres,
+		mongodb:    mongodb,
+		rabbitmq:   rabbitmqconn,
+		redisconn:  redisconn,
+		outboxWake: make(chan struct{}, 1),
 	}, nil
 }
 
@@ -58,22 +64,36 @@ func Combinedstore(redisURL string, limit int64, window time.Duration, rabbitMqU
 // Since we have two database each one of have it's own methods
 // This allows us to add more databases sequentially
 
-func (s *CombinedStore) SignUpAccount(hipinfo *HIPInfo) (int64, error) {
-	return s.postgres.SignUpAccount(hipinfo)
+func (s *CombinedStore) SignUpAccount(hipinfo *HIPInfo, events ...*OutboxEvent) (int64, error) {
+	defer s.wakeRelay()
+	return s.postgres.SignUpAccount(hipinfo, events...)
 }
 
 func (s *CombinedStore) LoginUser(login *Login) (*HIPInfo, error) {
 	return s.postgres.LoginUser(login)
 }
 
-func (s *CombinedStore) ChangePreferance(id string, pref map[string]interface{}) error {
-	return s.postgres.ChangePreferance(id, pref)
+func (s *CombinedStore) ChangePreferance(id string, pref map[string]interface{}, events ...*OutboxEvent) error {
+	defer s.wakeRelay()
+	return s.postgres.ChangePreferance(id, pref, events...)
 }
 
 func (s *CombinedStore) GetPreferance(id string) (*Preferance, error) {
 	return s.postgres.GetPreferance(id)
 }
 
+func (s *CombinedStore) UpdatePassword(healthcare_id, passwordHash string) error {
+	return s.postgres.UpdatePassword(healthcare_id, passwordHash)
+}
+
+func (s *CombinedStore) SetAccountLocked(healthcare_id string, locked bool) error {
+	return s.postgres.SetAccountLocked(healthcare_id, locked)
+}
+
+func (s *CombinedStore) IsAccountLocked(healthcare_id string) (bool, error) {
+	return s.postgres.IsAccountLocked(healthcare_id)
+}
+
 func (s *CombinedStore) GetTotalRequestCount(healthcare_id string) (int, error) {
 	return s.postgres.GetTotalRequestCount(healthcare_id)
 }
@@ -81,20 +101,146 @@ func (s *CombinedStore) GetTotalRequestCount(healthcare_id string) (int, error)
 func (s *CombinedStore) CreateClient_stats(health_id string) error {
 	return s.postgres.CreateClient_stats(health_id)
 }
-func (s *CombinedStore) GetAppointments_postgres(health_id string, offset, limit int64) ([]*Appointments, error) {
-	return s.postgres.GetAppointments(health_id, offset, limit)
+func (s *CombinedStore) GetAppointments_postgres(healthcare_id string, filter *AppointmentFilter) ([]*Appointments, int64, error) {
+	return s.postgres.GetAppointments(healthcare_id, filter)
+}
+func (s *CombinedStore) CreateAppointment(appointment *Appointments, actor string) error {
+	return s.postgres.CreateAppointment(appointment, actor)
+}
+
+func (s *CombinedStore) GetAppointment(healthcare_id string, id int64) (*Appointments, error) {
+	return s.postgres.GetAppointment(healthcare_id, id)
+}
+
+func (s *CombinedStore) TransitionAppointment(healthcare_id string, id int64, status, actor, reason string, events ...*OutboxEvent) (*Appointments, error) {
+	appointment, err := s.postgres.TransitionAppointment(healthcare_id, id, status, actor, reason, events...)
+	if err != nil {
+		return nil, err
+	}
+	s.wakeRelay()
+	return appointment, nil
+}
+
+func (s *CombinedStore) RequestConsent(consent *Consent, token, tokenHash, healthcareName, correlationID string) error {
+	if err := s.postgres.RequestConsent(consent, token, tokenHash, healthcareName, correlationID); err != nil {
+		return err
+	}
+	s.wakeRelay()
+	return nil
 }
-func (s *CombinedStore) SetAppointments_postgres(healthcare_id, health_id, status string, id int64) (int64, error) {
-	return s.postgres.SetAppointments(healthcare_id, health_id, status, id)
+
+func (s *CombinedStore) DecideConsent(tokenHash string, approve bool) (*Consent, error) {
+	return s.postgres.DecideConsent(tokenHash, approve)
+}
+
+func (s *CombinedStore) RevokeConsentByToken(tokenHash string) (*Consent, error) {
+	return s.postgres.RevokeConsentByToken(tokenHash)
+}
+
+func (s *CombinedStore) RevokeConsent(healthcare_id string, id int64) (*Consent, error) {
+	return s.postgres.RevokeConsent(healthcare_id, id)
+}
+
+func (s *CombinedStore) ListConsents(healthcare_id, health_id string) ([]*Consent, error) {
+	return s.postgres.ListConsents(healthcare_id, health_id)
+}
+
+func (s *CombinedStore) HasConsent(healthcare_id, health_id, scope string, breakGlass bool) (bool, error) {
+	return s.postgres.HasConsent(healthcare_id, health_id, scope, breakGlass)
+}
+
+func (s *CombinedStore) OpenBreakGlass(access *BreakGlass, healthcareName, correlationID string) error {
+	if err := s.postgres.OpenBreakGlass(access, healthcareName, correlationID); err != nil {
+		return err
+	}
+	s.wakeRelay()
+	return nil
+}
+
+func (s *CombinedStore) ListBreakGlass(healthcare_id string, pending bool) ([]*BreakGlass, error) {
+	return s.postgres.ListBreakGlass(healthcare_id, pending)
+}
+
+func (s *CombinedStore) ReviewBreakGlass(healthcare_id string, id int64, reviewer, note string) (*BreakGlass, error) {
+	return s.postgres.ReviewBreakGlass(healthcare_id, id, reviewer, note)
+}
+
+func (s *CombinedStore) AppendAudit(entries ...*AuditEntry) error {
+	return s.postgres.AppendAudit(entries...)
+}
+
+func (s *CombinedStore) QueryAuditLog(q AuditQuery) ([]*AuditEntry, error) {
+	return s.postgres.QueryAuditLog(q)
+}
+
+// EnableFieldEncryption has to run before any patient profile is read or written
+func (s *CombinedStore) EnableFieldEncryption(kms KeyWrapper, indexKey []byte) error {
+	return s.postgres.EnableFieldEncryption(kms, indexKey)
+}
+
+func (s *CombinedStore) FindClientsByAadhaar(healthcareID, aadhaar string) ([]string, error) {
+	return s.postgres.FindClientsByAadhaar(healthcareID, aadhaar)
+}
+
+func (s *CombinedStore) SearchClients(q ClientSearch) ([]*ClientSearchResult, bool, error) {
+	return s.postgres.SearchClients(q)
+}
+
+func (s *CombinedStore) FindDuplicates(healthcare_id, health_id string, minScore float64, limit int) ([]*DuplicateCandidate, error) {
+	return s.postgres.FindDuplicates(healthcare_id, health_id, minScore, limit)
+}
+
+func (s *CombinedStore) DismissDuplicate(healthcare_id, health_id, other_health_id, actor string) error {
+	return s.postgres.DismissDuplicate(healthcare_id, health_id, other_health_id, actor)
+}
+
+// MergePatients merges in postgres first and then moves the records in mongo, when
+// moving them fails the merge is run again.
+func (s *CombinedStore) MergePatients(healthcare_id, health_id, duplicate, actor, reason string) (*PatientMerge, error) {
+	merge, err := s.postgres.MergePatients(healthcare_id, health_id, duplicate, actor, reason)
+	if err != nil {
+		return nil, err
+	}
+	merge.RecordsMoved, err = s.mongodb.RepointPatientRecords(duplicate, health_id)
+	if err != nil {
+		return nil, fmt.Errorf("patients merged but their records were not moved, merge them again: %w", err)
+	}
+	return merge, nil
+}
+
+func (s *CombinedStore) ResolveHealthID(health_id string) (string, error) {
+	return s.postgres.ResolveHealthID(health_id)
+}
+
+func (s *CombinedStore) PatientAccessReport(health_id string, beforeID int64, limit int) ([]*AccessReportEntry, error) {
+	return s.postgres.PatientAccessReport(health_id, beforeID, limit)
+}
+
+func (s *CombinedStore) GetAppointmentHistory(appointmentID int64) ([]*AppointmentStatusChange, error) {
+	return s.postgres.GetAppointmentHistory(appointmentID)
+}
+
+func (s *CombinedStore) BookedSlots(healthcare_id, department, date string) ([]string, error) {
+	return s.postgres.BookedSlots(healthcare_id, department, date)
+}
+
+func (s *CombinedStore) SetAvailability(healthcare_id, department string, windows []*Availability) error {
+	return s.postgres.SetAvailability(healthcare_id, department, windows)
+}
+
+func (s *CombinedStore) GetAvailability(healthcare_id, department string) ([]*Availability, error) {
+	return s.postgres.GetAvailability(healthcare_id, department)
 }
+
 // Get Healthcare_Profile
 func (s *CombinedStore) GetHealthcare_details_postgres(healthcare_id string) (*HIPInfo, error){
 	return s.postgres.GetHealthcare_details(healthcare_id)
 }
 
 // Create Client_Profile
-func (s *CombinedStore) Create_ClientProfile(client *PatientDetails) error {
-	return s.postgres.Create_ClientProfile(client)
+func (s *CombinedStore) Create_ClientProfile(client *PatientDetails, events ...*OutboxEvent) error {
+	defer s.wakeRelay()
+	return s.postgres.Create_ClientProfile(client, events...)
 }
 
 // Get Client_Profile
@@ -103,10 +249,73 @@ func (s *CombinedStore) Get_ClientProfile(health_id string) (*PatientDetails, er
 }
 
 // Update Client_Profile
-func (s *CombinedStore) Update_clientProfile(health_id string, update map[string]interface{}) (*PatientDetails, error){
-	return s.postgres.UpdateClientProfile(health_id, update);
+func (s *CombinedStore) Update_clientProfile(health_id, actor string, patch *ProfilePatch, events ...*OutboxEvent) (*PatientDetails, error){
+	defer s.wakeRelay()
+	return s.postgres.UpdateClientProfile(health_id, actor, patch, events...);
+}
+
+// Client_Profile versions
+func (s *CombinedStore) ListProfileVersions(health_id string) ([]*ProfileVersion, error) {
+	return s.postgres.ListProfileVersions(health_id)
+}
+
+func (s *CombinedStore) ClientProfileAt(health_id string, at time.Time) (*PatientDetails, error) {
+	return s.postgres.ClientProfileAt(health_id, at)
+}
+
+func (s *CombinedStore) RevertClientProfile(health_id string, version int, actor string, events ...*OutboxEvent) (*PatientDetails, int, error) {
+	defer s.wakeRelay()
+	return s.postgres.RevertClientProfile(health_id, version, actor, events...)
+}
+
+// Staff accounts
+func (s *CombinedStore) CreateStaff(staff *Staff) error {
+	return s.postgres.CreateStaff(staff)
+}
+
+func (s *CombinedStore) GetStaff(staffID string) (*Staff, error) {
+	return s.postgres.GetStaff(staffID)
+}
+
+func (s *CombinedStore) ListStaff(healthcare_id string) ([]*Staff, error) {
+	return s.postgres.ListStaff(healthcare_id)
+}
+
+func (s *CombinedStore) UpdateStaffRole(healthcare_id, staffID, role string) error {
+	return s.postgres.UpdateStaffRole(healthcare_id, staffID, role)
+}
+
+func (s *CombinedStore) SetStaffLocked(staffID string, locked bool) error {
+	return s.postgres.SetStaffLocked(staffID, locked)
+}
+
+func (s *CombinedStore) UpdateStaffPassword(staffID, passwordHash string) error {
+	return s.postgres.UpdateStaffPassword(staffID, passwordHash)
+}
+
+func (s *CombinedStore) DeleteStaff(healthcare_id, staffID string) error {
+	return s.postgres.DeleteStaff(healthcare_id, staffID)
+}
+// Two factor authentication
+func (s *CombinedStore) SaveTwoFactorSecret(healthcare_id, secret string) error {
+	return s.postgres.SaveTwoFactorSecret(healthcare_id, secret)
+}
+
+func (s *CombinedStore) GetTwoFactor(healthcare_id string) (*TwoFactor, error) {
+	return s.postgres.GetTwoFactor(healthcare_id)
 }
 
+func (s *CombinedStore) EnableTwoFactor(healthcare_id string, recoveryCodeHashes []string) error {
+	return s.postgres.EnableTwoFactor(healthcare_id, recoveryCodeHashes)
+}
+
+func (s *CombinedStore) DisableTwoFactor(healthcare_id string) error {
+	return s.postgres.DisableTwoFactor(healthcare_id)
+}
+
+func (s *CombinedStore) UseRecoveryCode(healthcare_id, code string) (bool, error) {
+	return s.postgres.UseRecoveryCode(healthcare_id, code)
+}
 
 // mongodb methods goes here.....
 func (s *CombinedStore) GetAppointments(id string, list int64) ([]*Appointments, error) {
@@ -130,6 +339,12 @@ func (s *CombinedStore) GetHealthcare_details(id string) (*HIPInfo, error) {
 }
 
 func (s *CombinedStore) CreatepatientRecords(healthID string, records *PatientRecords) (*PatientRecords, error) {
+	// a record queued before its patient was merged still lands on the surviving health id
+	resolved, err := s.postgres.ResolveHealthID(records.HealthID)
+	if err != nil {
+		return nil, err
+	}
+	records.HealthID = resolved
 	return s.mongodb.CreatepatientRecords(healthID, records)
 }
 
@@ -163,22 +378,27 @@ func (s *CombinedStore) CreateHealthcare_details(healthcare_info *HIPInfo) (*HIP
 ///////////////////////////////////////////////////////
 
 // rabbitmq implementation goes here
-func (s *CombinedStore) Push_counters(category, healthcare_id string) error {
-	return s.rabbitmq.Push_counters(category, healthcare_id)
-}
-func (s *CombinedStore) Push_logs(category, name, email, health_id, healthcare_name, healthcare_id interface{}) error {
-	return s.rabbitmq.Push_logs(category, name, email, health_id, healthcare_name, healthcare_id)
-}
-func (s *CombinedStore) Push_update_appointment(appointment map[string]interface{}) error {
-	return s.rabbitmq.Push_update_appointment(appointment)
+// Every Push_* goes through the outbox, RunOutboxRelay does the actual publishing
+// so a broker outage delays messages instead of losing them
+func (s *CombinedStore) EnqueueEvents(events ...*OutboxEvent) error {
+	if err := s.postgres.EnqueueEvents(events...); err != nil {
+		return err
+	}
+	s.wakeRelay()
+	return nil
 }
 
-func (s *CombinedStore) Push_patient_records(record map[string]interface{}) error {
-	return s.rabbitmq.Push_patient_records(record)
+// Consume hands messages of queue to handle, see rabbitmq.Consume
+func (s *CombinedStore) Consume(ctx context.Context, queue string, prefetch int, handle mq.Handler) error {
+	return s.rabbitmq.Consume(ctx, queue, prefetch, handle)
 }
 
-func (s *CombinedStore) Push_patientbiodata(biodata map[string]interface{}) error {
-	return s.rabbitmq.Push_patientbiodata(biodata)
+func (s *CombinedStore) Push_event(correlationID string, event events.Event) error {
+	outboxEvent, err := NewEvent(correlationID, event)
+	if err != nil {
+		return err
+	}
+	return s.EnqueueEvents(outboxEvent)
 }
 
 // Redis implementation
@@ -190,6 +410,26 @@ func (s *CombinedStore) Get(key string) (interface{}, error) {
 	return s.redisconn.Get(key)
 }
 
+func (s *CombinedStore) GetDel(key string) (string, error) {
+	return s.redisconn.GetDel(key)
+}
+
+func (s *CombinedStore) SetWithTTL(key, value string, ttl time.Duration) error {
+	return s.redisconn.SetWithTTL(key, value, ttl)
+}
+
+func (s *CombinedStore) Exists(key string) (bool, error) {
+	return s.redisconn.Exists(key)
+}
+
+func (s *CombinedStore) Del(key string) error {
+	return s.redisconn.Del(key)
+}
+
+func (s *CombinedStore) SetNX(key string, value interface{}, ttl time.Duration) (bool, error) {
+	return s.redisconn.SetNX(key, value, ttl)
+}
+
 //	RATE LIMITER GOES HERE...
 //
 // this one is for rate limiting (rate limiter)
@@ -201,6 +441,44 @@ func (s *CombinedStore) IsAllowed_leaky_bucket(healthcare_id string) (bool, erro
 	return s.redisconn.IsAllowed_leaky_bucket(healthcare_id)
 }
 
+// login brute force protection
+func (s *CombinedStore) LoginBackoff(healthcare_id, ip string) (time.Duration, error) {
+	return s.redisconn.LoginBackoff(healthcare_id, ip)
+}
+
+func (s *CombinedStore) RegisterLoginFailure(healthcare_id, ip string) (int64, int64, error) {
+	return s.redisconn.RegisterLoginFailure(healthcare_id, ip)
+}
+
+func (s *CombinedStore) ResetLoginFailures(healthcare_id string) error {
+	return s.redisconn.ResetLoginFailures(healthcare_id)
+}
+
+// sessions and token revocation
+func (s *CombinedStore) CreateSession(sessionID, owner, refreshHash string, data interface{}, ttl time.Duration) error {
+	return s.redisconn.CreateSession(sessionID, owner, refreshHash, data, ttl)
+}
+
+func (s *CombinedStore) RotateSession(sessionID, refreshHash, newRefreshHash string, ttl time.Duration) (string, error) {
+	return s.redisconn.RotateSession(sessionID, refreshHash, newRefreshHash, ttl)
+}
+
+func (s *CombinedStore) RevokeSession(sessionID string) error {
+	return s.redisconn.RevokeSession(sessionID)
+}
+
+func (s *CombinedStore) RevokeAllSessions(owner string) error {
+	return s.redisconn.RevokeAllSessions(owner)
+}
+
+func (s *CombinedStore) RevokeToken(jti string, ttl time.Duration) error {
+	return s.redisconn.RevokeToken(jti, ttl)
+}
+
+func (s *CombinedStore) IsTokenRevoked(jti, sessionID string) (bool, error) {
+	return s.redisconn.IsTokenRevoked(jti, sessionID)
+}
+
 func (s *CombinedStore) Close() error {
 	return s.redisconn.Close()
 }
@@ -0,0 +1,197 @@
+package databases
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"vaibhavyadav-dev/healthcareServer/events"
+)
+
+// what a consent gives access to
+const (
+	ConsentProfile      = "profile"
+	ConsentRecords      = "records"
+	ConsentAppointments = "appointments"
+)
+
+const (
+	ConsentRequested = "requested"
+	ConsentGranted   = "granted"
+	ConsentRejected  = "rejected"
+	ConsentRevoked   = "revoked"
+)
+
+// a request the patient didn't answer in time can't be approved anymore
+const ConsentRequestExpiry = 7 * 24 * time.Hour
+
+var (
+	ErrConsentNotFound   = errors.New("consent not found")
+	ErrConsentNotPending = errors.New("consent request was already answered or has expired")
+	ErrConsentClosed     = errors.New("consent was already rejected or revoked")
+)
+
+func IsConsentScope(scope string) bool {
+	switch scope {
+	case ConsentProfile, ConsentRecords, ConsentAppointments:
+		return true
+	}
+	return false
+}
+
+const consentColumns = `id, health_id, healthcare_id, scope, status, duration_days, reason, requested_by,
+	requested_at, decided_at, expires_at, revoked_at`
+
+func scanConsent(row rowScanner) (*Consent, error) {
+	var consent Consent
+	var decidedAt, expiresAt, revokedAt sql.NullTime
+	err := row.Scan(&consent.ID, &consent.HealthID, &consent.HealthcareID, &consent.Scope, &consent.Status,
+		&consent.DurationDays, &consent.Reason, &consent.RequestedBy, &consent.RequestedAt, &decidedAt, &expiresAt, &revokedAt)
+	if err != nil {
+		return nil, err
+	}
+	for _, column := range []struct {
+		value sql.NullTime
+		field **time.Time
+	}{{decidedAt, &consent.DecidedAt}, {expiresAt, &consent.ExpiresAt}, {revokedAt, &consent.RevokedAt}} {
+		if column.value.Valid {
+			t := column.value.Time
+			*column.field = &t
+		}
+	}
+	return &consent, nil
+}
+
+// RequestConsent stores a pending request, only the hash of the token is kept. The
+// ConsentRequested event carrying the token to the patient is written in the same
+// transaction once the consent has its id.
+func (s *PostgresStore) RequestConsent(consent *Consent, token, tokenHash, healthcareName, correlationID string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRow(`INSERT INTO patient_consents (health_id, healthcare_id, scope, duration_days, reason, token_hash, requested_by)
+	VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING `+consentColumns,
+		consent.HealthID, consent.HealthcareID, consent.Scope, consent.DurationDays, consent.Reason, tokenHash, consent.RequestedBy)
+	stored, err := scanConsent(row)
+	if err != nil {
+		return fmt.Errorf("failed to request consent: %w", err)
+	}
+	*consent = *stored
+	requested, err := NewEvent(correlationID, events.ConsentRequested{
+		Healthcare:   events.Healthcare{HealthcareID: consent.HealthcareID, HealthcareName: healthcareName},
+		ConsentID:    consent.ID,
+		HealthID:     consent.HealthID,
+		Scope:        consent.Scope,
+		DurationDays: consent.DurationDays,
+		Reason:       consent.Reason,
+		Token:        token,
+	})
+	if err != nil {
+		return err
+	}
+	if err := insertOutbox(tx, []*OutboxEvent{requested}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DecideConsent answers a pending request with the patient's token, an approved
+// consent is valid for its duration from now on
+func (s *PostgresStore) DecideConsent(tokenHash string, approve bool) (*Consent, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	consent, err := scanConsent(tx.QueryRow(`SELECT `+consentColumns+` FROM patient_consents WHERE token_hash = $1 FOR UPDATE`, tokenHash))
+	if err == sql.ErrNoRows {
+		return nil, ErrConsentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if consent.Status != ConsentRequested || time.Since(consent.RequestedAt) > ConsentRequestExpiry {
+		return nil, ErrConsentNotPending
+	}
+
+	query := `UPDATE patient_consents SET status = $1, decided_at = NOW() WHERE id = $2 RETURNING ` + consentColumns
+	status := ConsentRejected
+	if approve {
+		query = `UPDATE patient_consents SET status = $1, decided_at = NOW(), expires_at = NOW() + duration_days * INTERVAL '1 day'
+		WHERE id = $2 RETURNING ` + consentColumns
+		status = ConsentGranted
+	}
+	consent, err = scanConsent(tx.QueryRow(query, status, consent.ID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to update consent: %w", err)
+	}
+	return consent, tx.Commit()
+}
+
+// RevokeConsentByToken is the patient withdrawing a consent or a pending request
+func (s *PostgresStore) RevokeConsentByToken(tokenHash string) (*Consent, error) {
+	return s.revokeConsent(`token_hash = $1`, tokenHash)
+}
+
+// RevokeConsent is the healthcare giving up a consent it holds
+func (s *PostgresStore) RevokeConsent(healthcare_id string, id int64) (*Consent, error) {
+	return s.revokeConsent(`id = $1 AND healthcare_id = $2`, id, healthcare_id)
+}
+
+func (s *PostgresStore) revokeConsent(where string, args ...interface{}) (*Consent, error) {
+	row := s.db.QueryRow(`UPDATE patient_consents SET status = 'revoked', revoked_at = NOW()
+	WHERE `+where+` AND status IN ('requested', 'granted') RETURNING `+consentColumns, args...)
+	consent, err := scanConsent(row)
+	if err != sql.ErrNoRows {
+		return consent, err
+	}
+	// tell a missing consent from one that is already closed
+	var exists bool
+	if err := s.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM patient_consents WHERE `+where+`)`, args...).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, ErrConsentClosed
+	}
+	return nil, ErrConsentNotFound
+}
+
+// ListConsents returns the consents of a healthcare newest first, health_id narrows them to one patient
+func (s *PostgresStore) ListConsents(healthcare_id, health_id string) ([]*Consent, error) {
+	rows, err := s.db.Query(`SELECT `+consentColumns+` FROM patient_consents
+	WHERE healthcare_id = $1 AND ($2 = '' OR health_id = $2) ORDER BY requested_at DESC, id DESC LIMIT 200`, healthcare_id, health_id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	consents := []*Consent{}
+	for rows.Next() {
+		consent, err := scanConsent(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		consents = append(consents, consent)
+	}
+	return consents, rows.Err()
+}
+
+// HasConsent reports whether the healthcare may access scope of the patient: it
+// created the patient, holds a granted consent that hasn't expired or, when
+// breakGlass is set, broke the glass for that scope recently. Writes pass
+// breakGlass as false, emergency access is read only
+func (s *PostgresStore) HasConsent(healthcare_id, health_id, scope string, breakGlass bool) (bool, error) {
+	var allowed bool
+	err := s.db.QueryRow(`SELECT
+		EXISTS (SELECT 1 FROM client_profile WHERE health_id = $1 AND healthcare_id = $2)
+		OR EXISTS (SELECT 1 FROM patient_consents WHERE health_id = $1 AND healthcare_id = $2 AND scope = $3
+			AND status = 'granted' AND expires_at > NOW())
+		OR ($4 AND EXISTS (SELECT 1 FROM break_glass_access WHERE health_id = $1 AND healthcare_id = $2
+			AND scope = $3 AND expires_at > NOW()))`, health_id, healthcare_id, scope, breakGlass).Scan(&allowed)
+	return allowed, err
+}
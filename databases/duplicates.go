@@ -0,0 +1,234 @@
+package databases
+
+import (
+	"database/sql"
+	"errors"
+	"math"
+)
+
+var ErrAlreadyMerged = errors.New("patient was already merged into another health id")
+
+// weight of each signal in the duplicate score, they add up to 1
+const (
+	weightAadhaar = 0.5
+	weightDOB     = 0.2
+	weightName    = 0.2
+	weightMobile  = 0.1
+)
+
+const (
+	// DefaultDuplicateScore is the lowest score listed unless asked otherwise
+	DefaultDuplicateScore = 0.5
+	// names at least this similar count as matching
+	nameMatchSimilarity = 0.6
+	maxDuplicatePage    = 100
+)
+
+type duplicateSignals struct {
+	aadhaar         bool
+	aadhaarConflict bool
+	mobile          bool
+	dob             bool
+	name            float64
+}
+
+// scoreDuplicate weighs what two profiles have in common. Two different Aadhaar
+// numbers halve the score, a typo is possible but it is usually two people.
+// FindDuplicates computes the same score in SQL to order and limit the pairs.
+func scoreDuplicate(sig duplicateSignals) (float64, []string) {
+	score := sig.name * weightName
+	matched := []string{}
+	if sig.aadhaar {
+		score += weightAadhaar
+		matched = append(matched, "aadhaar")
+	}
+	if sig.mobile {
+		score += weightMobile
+		matched = append(matched, "mobile")
+	}
+	if sig.dob {
+		score += weightDOB
+		matched = append(matched, "dob")
+	}
+	if sig.name >= nameMatchSimilarity {
+		matched = append(matched, "name")
+	}
+	if sig.aadhaarConflict {
+		score /= 2
+	}
+	return math.Round(score*1000) / 1000, matched
+}
+
+// FindDuplicates returns the pairs of the healthcare's own patients that may be the
+// same person, best match first. A pair shares an Aadhaar or mobile number, or a
+// date of birth and a similar name. healthID narrows it to the pairs of one patient.
+func (s *PostgresStore) FindDuplicates(healthcare_id, healthID string, minScore float64, limit int) ([]*DuplicateCandidate, error) {
+	if limit <= 0 || limit > maxDuplicatePage {
+		limit = maxDuplicatePage
+	}
+	// the score is computed here as well so the best pairs are the ones the limit keeps
+	rows, err := s.db.Query(`WITH pairs AS (
+		SELECT a.id AS a_id, b.id AS b_id FROM client_profile a
+		JOIN client_profile b ON b.healthcare_id = a.healthcare_id AND b.aadhaar_bidx = a.aadhaar_bidx AND b.id > a.id
+		WHERE a.healthcare_id = $1 AND a.aadhaar_bidx <> ''
+		UNION
+		SELECT a.id, b.id FROM client_profile a
+		JOIN client_profile b ON b.healthcare_id = a.healthcare_id AND b.mobile_bidx = a.mobile_bidx AND b.id > a.id
+		WHERE a.healthcare_id = $1 AND a.mobile_bidx <> ''
+		UNION
+		SELECT a.id, b.id FROM client_profile a
+		JOIN client_profile b ON b.healthcare_id = a.healthcare_id AND b.dob = a.dob AND b.id > a.id
+		WHERE a.healthcare_id = $1 AND `+clientName("a")+` % `+clientName("b")+`
+	), signals AS (
+		SELECT p.a_id, p.b_id,
+			a.aadhaar_bidx <> '' AND a.aadhaar_bidx = b.aadhaar_bidx AS aadhaar,
+			a.aadhaar_bidx <> '' AND b.aadhaar_bidx <> '' AND a.aadhaar_bidx <> b.aadhaar_bidx AS aadhaar_conflict,
+			a.mobile_bidx <> '' AND a.mobile_bidx = b.mobile_bidx AS mobile,
+			a.dob = b.dob AS dob,
+			similarity(`+clientName("a")+`, `+clientName("b")+`) AS name
+		FROM pairs p JOIN client_profile a ON a.id = p.a_id JOIN client_profile b ON b.id = p.b_id
+		WHERE ($2 = '' OR a.health_id = $2 OR b.health_id = $2)
+			AND NOT EXISTS (SELECT 1 FROM patient_duplicate_dismissals d WHERE d.healthcare_id = $1
+				AND d.health_id_a = LEAST(a.health_id, b.health_id) AND d.health_id_b = GREATEST(a.health_id, b.health_id))
+	), scored AS (
+		SELECT *, (aadhaar::int * $5::float8 + dob::int * $6::float8 + name * $7::float8 + mobile::int * $8::float8)
+			* CASE WHEN aadhaar_conflict THEN 0.5 ELSE 1 END AS score
+		FROM signals
+	)
+	SELECT a.health_id, a.first_name, COALESCE(a.middle_name, ''), a.last_name, a.sex, a.dob, a.created_at,
+		b.health_id, b.first_name, COALESCE(b.middle_name, ''), b.last_name, b.sex, b.dob, b.created_at,
+		s.aadhaar, s.aadhaar_conflict, s.mobile, s.dob, s.name
+	FROM scored s JOIN client_profile a ON a.id = s.a_id JOIN client_profile b ON b.id = s.b_id
+	WHERE s.score >= $3
+	ORDER BY s.score DESC, s.a_id, s.b_id
+	LIMIT $4`, healthcare_id, healthID, minScore, limit, weightAadhaar, weightDOB, weightName, weightMobile)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	candidates := []*DuplicateCandidate{}
+	for rows.Next() {
+		var a, b DuplicatePatient
+		var sig duplicateSignals
+		if err := rows.Scan(&a.HealthID, &a.FirstName, &a.MiddleName, &a.LastName, &a.Sex, &a.DOB, &a.CreatedAt,
+			&b.HealthID, &b.FirstName, &b.MiddleName, &b.LastName, &b.Sex, &b.DOB, &b.CreatedAt,
+			&sig.aadhaar, &sig.aadhaarConflict, &sig.mobile, &sig.dob, &sig.name); err != nil {
+			return nil, err
+		}
+		score, matched := scoreDuplicate(sig)
+		candidates = append(candidates, &DuplicateCandidate{Patient: &a, Duplicate: &b, Score: score, Matched: matched})
+	}
+	return candidates, rows.Err()
+}
+
+// DismissDuplicate keeps a pair a reviewer found to be two people off the duplicate list
+func (s *PostgresStore) DismissDuplicate(healthcare_id, healthID, otherHealthID, actor string) error {
+	if otherHealthID < healthID {
+		healthID, otherHealthID = otherHealthID, healthID
+	}
+	_, err := s.db.Exec(`INSERT INTO patient_duplicate_dismissals (healthcare_id, health_id_a, health_id_b, dismissed_by)
+	VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING`, healthcare_id, healthID, otherHealthID, actor)
+	return err
+}
+
+// MergePatients folds duplicate into healthID, both registered by the healthcare.
+// Appointments, consents, break-glass accesses and client_stats move to healthID,
+// the duplicate's profile is kept in patient_aliases and its health id resolves to
+// healthID from then on. The records in mongo are left to the caller. Merging a pair
+// again returns the first merge, so a merge whose records failed to move can be retried.
+func (s *PostgresStore) MergePatients(healthcare_id, healthID, duplicate, actor, reason string) (*PatientMerge, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	merge := &PatientMerge{HealthID: healthID, Alias: duplicate}
+	var mergedInto string
+	err = tx.QueryRow(`SELECT health_id, merged_by, merged_at FROM patient_aliases WHERE alias_health_id = $1 AND healthcare_id = $2`,
+		duplicate, healthcare_id).Scan(&mergedInto, &merge.MergedBy, &merge.MergedAt)
+	switch {
+	case err == nil && mergedInto == healthID:
+		return merge, nil
+	case err == nil:
+		return nil, ErrAlreadyMerged
+	case err != sql.ErrNoRows:
+		return nil, err
+	}
+
+	var found int
+	if err := tx.QueryRow(`SELECT COUNT(DISTINCT health_id) FROM (SELECT health_id FROM client_profile
+		WHERE healthcare_id = $1 AND health_id IN ($2, $3) FOR UPDATE) locked`, healthcare_id, healthID, duplicate).Scan(&found); err != nil {
+		return nil, err
+	}
+	if found != 2 {
+		return nil, ErrClientNotFound
+	}
+
+	if err := tx.QueryRow(`INSERT INTO patient_aliases (alias_health_id, health_id, healthcare_id, merged_by, reason, profile)
+	SELECT c.health_id, $2, c.healthcare_id, $3, $4, to_jsonb(c) FROM client_profile c WHERE c.health_id = $1
+	RETURNING merged_by, merged_at`, duplicate, healthID, actor, reason).Scan(&merge.MergedBy, &merge.MergedAt); err != nil {
+		return nil, err
+	}
+	// patients merged into the duplicate earlier now resolve to the survivor directly
+	if _, err := tx.Exec(`UPDATE patient_aliases SET health_id = $1 WHERE health_id = $2`, healthID, duplicate); err != nil {
+		return nil, err
+	}
+
+	result, err := tx.Exec(`UPDATE appointments SET health_id = $1 WHERE health_id = $2`, healthID, duplicate)
+	if err != nil {
+		return nil, err
+	}
+	if merge.AppointmentsMoved, err = result.RowsAffected(); err != nil {
+		return nil, err
+	}
+	for _, query := range []string{
+		`UPDATE patient_consents SET health_id = $1 WHERE health_id = $2`,
+		`UPDATE break_glass_access SET health_id = $1 WHERE health_id = $2`,
+		// the duplicate's history follows it, numbered after the survivor's versions. Its
+		// values stay bound to the duplicate's health id and are never undone on the survivor.
+		`UPDATE client_profile_versions SET health_id = $1, merged_from = COALESCE(merged_from, $2),
+			version = version + (SELECT COALESCE(MAX(version), 0) FROM client_profile_versions WHERE health_id = $1)
+		WHERE health_id = $2`,
+		// the counters add up, the account keeps the survivor's plan and balance
+		`INSERT INTO client_stats (health_id, account_status, available_money, profile_viewed, profile_updated, records_viewed, records_created)
+		SELECT $1, account_status, available_money, profile_viewed, profile_updated, records_viewed, records_created
+		FROM client_stats WHERE health_id = $2
+		ON CONFLICT (health_id) DO UPDATE SET
+			profile_viewed = client_stats.profile_viewed + EXCLUDED.profile_viewed,
+			profile_updated = client_stats.profile_updated + EXCLUDED.profile_updated,
+			records_viewed = client_stats.records_viewed + EXCLUDED.records_viewed,
+			records_created = client_stats.records_created + EXCLUDED.records_created`,
+	} {
+		if _, err := tx.Exec(query, healthID, duplicate); err != nil {
+			return nil, err
+		}
+	}
+	for _, query := range []string{
+		`DELETE FROM client_stats WHERE health_id = $1`,
+		`DELETE FROM client_profile WHERE health_id = $1`,
+	} {
+		if _, err := tx.Exec(query, duplicate); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return merge, nil
+}
+
+// ResolveHealthID returns the health id a merged patient lives under now, any
+// other health id comes back as it is
+func (s *PostgresStore) ResolveHealthID(health_id string) (string, error) {
+	var resolved string
+	err := s.db.QueryRow(`SELECT health_id FROM patient_aliases WHERE alias_health_id = $1`, health_id).Scan(&resolved)
+	if err == sql.ErrNoRows {
+		return health_id, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return resolved, nil
+}
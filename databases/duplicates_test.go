@@ -0,0 +1,29 @@
+package databases
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestScoreDuplicate(t *testing.T) {
+	tests := []struct {
+		name    string
+		sig     duplicateSignals
+		score   float64
+		matched []string
+	}{
+		{name: "same person", sig: duplicateSignals{aadhaar: true, mobile: true, dob: true, name: 1}, score: 1, matched: []string{"aadhaar", "mobile", "dob", "name"}},
+		{name: "aadhaar only", sig: duplicateSignals{aadhaar: true, name: 0.2}, score: 0.54, matched: []string{"aadhaar"}},
+		{name: "dob and similar name", sig: duplicateSignals{dob: true, name: 0.75}, score: 0.35, matched: []string{"dob", "name"}},
+		{name: "family sharing a phone", sig: duplicateSignals{mobile: true, name: 0.4}, score: 0.18, matched: []string{"mobile"}},
+		{name: "different aadhaar", sig: duplicateSignals{aadhaarConflict: true, mobile: true, dob: true, name: 1}, score: 0.25, matched: []string{"mobile", "dob", "name"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			score, matched := scoreDuplicate(tt.sig)
+			if score != tt.score || !reflect.DeepEqual(matched, tt.matched) {
+				t.Fatalf("got %v %v, want %v %v", score, matched, tt.score, tt.matched)
+			}
+		})
+	}
+}
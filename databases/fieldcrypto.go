@@ -0,0 +1,299 @@
+package databases
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// The identifiers of a patient are stored encrypted with a data key, data keys
+// are stored wrapped by a master key that never touches the database:
+//
+//	client_profile.aadhaar_number = enc:v1:<data key id>:<base64 nonce+ciphertext>
+//	data_keys.wrapped_key         = AES-GCM(master key, data key)
+//
+// The column and health id are authenticated with every value, a ciphertext
+// copied to another row or column doesn't decrypt.
+const ciphertextPrefix = "enc:v1:"
+
+// encryptedProfileColumns are the client_profile columns stored encrypted
+var encryptedProfileColumns = []string{
+	"email", "mobile_number", "aadhaar_number", "father_name", "mother_name", "emergency_number",
+}
+
+// blindIndexColumns maps an encrypted column to the column holding its blind index
+var blindIndexColumns = map[string]string{
+	"aadhaar_number": "aadhaar_bidx",
+	"mobile_number":  "mobile_bidx",
+}
+
+var ErrFieldKeysMissing = errors.New("field encryption is not configured")
+
+func isEncryptedColumn(column string) bool {
+	for _, encrypted := range encryptedProfileColumns {
+		if column == encrypted {
+			return true
+		}
+	}
+	return false
+}
+
+// KeyWrapper protects data keys, LocalKMS stands in for a real KMS
+type KeyWrapper interface {
+	// Wrap encrypts a data key with the active master key and names that key
+	Wrap(dataKey []byte) (masterKeyID string, wrapped []byte, err error)
+	Unwrap(masterKeyID string, wrapped []byte) ([]byte, error)
+	ActiveKeyID() string
+}
+
+// LocalKMS keeps the master keys in memory. They are configured through
+// FIELD_KEYS as a comma separated list of kid:source entries, the source is
+// 32 base64 encoded bytes or file:<path> holding them, e.g.
+//
+//	FIELD_KEYS=2024-11:file:/keys/field-2024-11,2024-12:q83vEjRWeJq83vEjRWeJq83vEjRWeJq83vEjRWeJq80=
+//	FIELD_ACTIVE_KEY=2024-12
+type LocalKMS struct {
+	active string
+	keys   map[string]cipher.AEAD
+}
+
+func ParseLocalKMS(spec, active string) (*LocalKMS, error) {
+	kms := &LocalKMS{active: strings.TrimSpace(active), keys: map[string]cipher.AEAD{}}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid master key entry, expected kid:source")
+		}
+		key, err := LoadKeyMaterial(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("master key %s: %w", parts[0], err)
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, fmt.Errorf("master key %s: %w", parts[0], err)
+		}
+		if _, exists := kms.keys[parts[0]]; exists {
+			return nil, fmt.Errorf("duplicate master key id %s", parts[0])
+		}
+		kms.keys[parts[0]] = aead
+	}
+	if len(kms.keys) == 0 {
+		return nil, fmt.Errorf("no master keys configured")
+	}
+	if _, ok := kms.keys[kms.active]; !ok {
+		return nil, fmt.Errorf("active master key %q is not present in the key list", kms.active)
+	}
+	return kms, nil
+}
+
+// LoadKeyMaterial decodes 32 base64 bytes, or reads them from file:<path>
+func LoadKeyMaterial(source string) ([]byte, error) {
+	source = strings.TrimSpace(source)
+	if path, ok := strings.CutPrefix(source, "file:"); ok {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		source = strings.TrimSpace(string(content))
+	}
+	key, err := base64.StdEncoding.DecodeString(source)
+	if err != nil {
+		return nil, fmt.Errorf("key is not valid base64: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("key must be 32 bytes, got %d", len(key))
+	}
+	return key, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal returns nonce+ciphertext
+func seal(aead cipher.AEAD, plaintext, additional []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additional), nil
+}
+
+func open(aead cipher.AEAD, sealed, additional []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], additional)
+}
+
+func (k *LocalKMS) ActiveKeyID() string { return k.active }
+
+func (k *LocalKMS) Wrap(dataKey []byte) (string, []byte, error) {
+	wrapped, err := seal(k.keys[k.active], dataKey, []byte("data-key:"+k.active))
+	return k.active, wrapped, err
+}
+
+func (k *LocalKMS) Unwrap(masterKeyID string, wrapped []byte) ([]byte, error) {
+	aead, ok := k.keys[masterKeyID]
+	if !ok {
+		return nil, fmt.Errorf("master key %q is not configured", masterKeyID)
+	}
+	dataKey, err := open(aead, wrapped, []byte("data-key:"+masterKeyID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key with master key %q: %w", masterKeyID, err)
+	}
+	return dataKey, nil
+}
+
+// fieldCipher encrypts profile fields with the unwrapped data keys, the
+// newest data key encrypts and every known one decrypts
+type fieldCipher struct {
+	kms      KeyWrapper
+	indexKey []byte
+
+	mu     sync.RWMutex
+	active int64
+	keys   map[int64]cipher.AEAD
+}
+
+func newFieldCipher(kms KeyWrapper, indexKey []byte) *fieldCipher {
+	return &fieldCipher{kms: kms, indexKey: indexKey, keys: map[int64]cipher.AEAD{}}
+}
+
+func (c *fieldCipher) addKey(id int64, dataKey []byte) error {
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.keys[id] = aead
+	if id > c.active {
+		c.active = id
+	}
+	return nil
+}
+
+func fieldAdditionalData(column, healthID string) []byte {
+	return []byte(column + "\x00" + healthID)
+}
+
+func (c *fieldCipher) encrypt(column, healthID, plaintext string) (string, error) {
+	c.mu.RLock()
+	id, aead := c.active, c.keys[c.active]
+	c.mu.RUnlock()
+	if aead == nil {
+		return "", ErrFieldKeysMissing
+	}
+	sealed, err := seal(aead, []byte(plaintext), fieldAdditionalData(column, healthID))
+	if err != nil {
+		return "", err
+	}
+	return ciphertextPrefix + strconv.FormatInt(id, 10) + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// decrypt returns values written before encryption was enabled unchanged, the
+// reencrypt command encrypts them
+func (c *fieldCipher) decrypt(column, healthID, stored string) (string, error) {
+	id, sealed, ok := parseCiphertext(stored)
+	if !ok {
+		return stored, nil
+	}
+	c.mu.RLock()
+	aead := c.keys[id]
+	c.mu.RUnlock()
+	if aead == nil {
+		return "", fmt.Errorf("%s: %w %d", column, errUnknownDataKey, id)
+	}
+	plaintext, err := open(aead, sealed, fieldAdditionalData(column, healthID))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt %s: %w", column, err)
+	}
+	return string(plaintext), nil
+}
+
+// encryptStored encrypts a value read from a row the reencrypt command hasn't
+// rewritten yet, values that are already encrypted are returned as they are
+func (c *fieldCipher) encryptStored(column, healthID, stored string) (string, error) {
+	if stored == "" {
+		return stored, nil
+	}
+	if _, _, ok := parseCiphertext(stored); ok {
+		return stored, nil
+	}
+	return c.encrypt(column, healthID, stored)
+}
+
+// parseCiphertext reports ok false for a plaintext value
+func parseCiphertext(stored string) (int64, []byte, bool) {
+	rest, ok := strings.CutPrefix(stored, ciphertextPrefix)
+	if !ok {
+		return 0, nil, false
+	}
+	idPart, encoded, ok := strings.Cut(rest, ":")
+	if !ok {
+		return 0, nil, false
+	}
+	id, err := strconv.ParseInt(idPart, 10, 64)
+	if err != nil {
+		return 0, nil, false
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil {
+		return 0, nil, false
+	}
+	return id, sealed, true
+}
+
+// needsReencryption is true for plaintext and values under an older data key
+func (c *fieldCipher) needsReencryption(stored string) bool {
+	if stored == "" {
+		return false
+	}
+	id, _, ok := parseCiphertext(stored)
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return !ok || id != c.active
+}
+
+// normalizeIdentifier keeps the characters that make two identifiers equal,
+// "1234 5678 9012" and "1234-5678-9012" are the same Aadhaar
+func normalizeIdentifier(value string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsDigit(r) || unicode.IsLetter(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, value)
+}
+
+// blindIndex is a keyed hash that allows exact match lookup without decrypting,
+// the column is part of it so equal values in different columns don't match
+func (c *fieldCipher) blindIndex(column, value string) string {
+	normalized := normalizeIdentifier(value)
+	if normalized == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, c.indexKey)
+	mac.Write([]byte(column + "\x00" + normalized))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,116 @@
+package databases
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func testKMS(t *testing.T, spec, active string) *LocalKMS {
+	t.Helper()
+	kms, err := ParseLocalKMS(spec, active)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kms
+}
+
+func key(b byte) string {
+	return base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(b), 32)))
+}
+
+func TestLocalKMSRotation(t *testing.T) {
+	old := testKMS(t, "m1:"+key('a'), "m1")
+	masterKeyID, wrapped, err := old.Wrap([]byte("data key"))
+	if err != nil || masterKeyID != "m1" {
+		t.Fatalf("wrap: %s %v", masterKeyID, err)
+	}
+
+	// m2 is active, m1 still unwraps what it wrapped
+	rotated := testKMS(t, "m1:"+key('a')+",m2:"+key('b'), "m2")
+	dataKey, err := rotated.Unwrap(masterKeyID, wrapped)
+	if err != nil || string(dataKey) != "data key" {
+		t.Fatalf("unwrap: %q %v", dataKey, err)
+	}
+	if _, err := rotated.Unwrap("m2", wrapped); err == nil {
+		t.Fatal("unwrapped with the wrong master key")
+	}
+	if _, err := ParseLocalKMS("m1:"+base64.StdEncoding.EncodeToString([]byte("short")), "m1"); err == nil {
+		t.Fatal("accepted a short master key")
+	}
+}
+
+func TestFieldCipher(t *testing.T) {
+	c := newFieldCipher(testKMS(t, "m1:"+key('a'), "m1"), []byte("index key"))
+	if _, err := c.encrypt("aadhaar_number", "HID1", "1234 5678 9012"); !errors.Is(err, ErrFieldKeysMissing) {
+		t.Fatalf("encrypted without a data key: %v", err)
+	}
+	if err := c.addKey(1, []byte(strings.Repeat("k", 32))); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := c.encrypt("aadhaar_number", "HID1", "1234 5678 9012")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(stored, "enc:v1:1:") || strings.Contains(stored, "1234") {
+		t.Fatalf("unexpected ciphertext %q", stored)
+	}
+	if plaintext, err := c.decrypt("aadhaar_number", "HID1", stored); err != nil || plaintext != "1234 5678 9012" {
+		t.Fatalf("decrypt: %q %v", plaintext, err)
+	}
+	// bound to its row and column
+	if _, err := c.decrypt("aadhaar_number", "HID2", stored); err == nil {
+		t.Fatal("decrypted a value copied to another patient")
+	}
+	if _, err := c.decrypt("mobile_number", "HID1", stored); err == nil {
+		t.Fatal("decrypted a value copied to another column")
+	}
+	// rows written before encryption are read as they are
+	if plaintext, err := c.decrypt("email", "HID1", "asha@example.com"); err != nil || plaintext != "asha@example.com" {
+		t.Fatalf("legacy value: %q %v", plaintext, err)
+	}
+
+	// old values copied into a profile version get encrypted, ciphertexts stay as they are
+	sealed, err := c.encryptStored("email", "HID1", "asha@example.com")
+	if err != nil || !strings.HasPrefix(sealed, "enc:v1:1:") {
+		t.Fatalf("plaintext kept by encryptStored: %q %v", sealed, err)
+	}
+	if plaintext, err := c.decrypt("email", "HID1", sealed); err != nil || plaintext != "asha@example.com" {
+		t.Fatalf("decrypt encryptStored: %q %v", plaintext, err)
+	}
+	if again, err := c.encryptStored("aadhaar_number", "HID1", stored); err != nil || again != stored {
+		t.Fatalf("encryptStored changed a ciphertext: %q %v", again, err)
+	}
+
+	if !c.needsReencryption("asha@example.com") || c.needsReencryption(stored) {
+		t.Fatal("wrong reencryption decision before rotation")
+	}
+	if err := c.addKey(2, []byte(strings.Repeat("n", 32))); err != nil {
+		t.Fatal(err)
+	}
+	if !c.needsReencryption(stored) {
+		t.Fatal("value under the old data key isn't reencrypted")
+	}
+	if _, err := c.decrypt("aadhaar_number", "HID1", "enc:v1:9:"+strings.Repeat("A", 40)); !errors.Is(err, errUnknownDataKey) {
+		t.Fatalf("unknown data key: %v", err)
+	}
+}
+
+func TestBlindIndex(t *testing.T) {
+	c := newFieldCipher(nil, []byte("index key"))
+	a := c.blindIndex("aadhaar_number", "1234 5678 9012")
+	if a == "" || a != c.blindIndex("aadhaar_number", "1234-5678-9012") {
+		t.Fatal("formatting changed the blind index")
+	}
+	if a == c.blindIndex("mobile_number", "123456789012") {
+		t.Fatal("equal values in different columns share an index")
+	}
+	if a == newFieldCipher(nil, []byte("other key")).blindIndex("aadhaar_number", "123456789012") {
+		t.Fatal("blind index doesn't depend on the key")
+	}
+	if c.blindIndex("aadhaar_number", " - ") != "" {
+		t.Fatal("empty value got an index")
+	}
+}
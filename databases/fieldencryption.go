@@ -0,0 +1,304 @@
+package databases
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+const reencryptBatchSize = 200
+
+var errUnknownDataKey = errors.New("unknown data key")
+
+// encryptedFields points at the encrypted columns of a profile
+func encryptedFields(client *PatientDetails) map[string]*string {
+	return map[string]*string{
+		"email":            &client.Email,
+		"mobile_number":    &client.MobileNumber,
+		"aadhaar_number":   &client.AadhaarNumber,
+		"father_name":      &client.FatherName,
+		"mother_name":      &client.MotherName,
+		"emergency_number": &client.EmergencyNumber,
+	}
+}
+
+// EnableFieldEncryption loads every data key through kms and creates the first
+// one on a fresh database. indexKey keys the blind indexes, changing it breaks
+// lookups until reencrypt recomputed them.
+func (s *PostgresStore) EnableFieldEncryption(kms KeyWrapper, indexKey []byte) error {
+	s.fields = newFieldCipher(kms, indexKey)
+	count, err := s.loadDataKeys()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		_, err = s.RotateDataKey()
+	}
+	return err
+}
+
+func (s *PostgresStore) loadDataKeys() (int, error) {
+	rows, err := s.db.Query(`SELECT id, master_key_id, wrapped_key FROM data_keys ORDER BY id`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read data keys: %w", err)
+	}
+	defer rows.Close()
+
+	count := 0
+	for rows.Next() {
+		var id int64
+		var masterKeyID string
+		var wrapped []byte
+		if err := rows.Scan(&id, &masterKeyID, &wrapped); err != nil {
+			return count, fmt.Errorf("failed to scan row: %w", err)
+		}
+		dataKey, err := s.fields.kms.Unwrap(masterKeyID, wrapped)
+		if err != nil {
+			return count, fmt.Errorf("data key %d: %w", id, err)
+		}
+		if err := s.fields.addKey(id, dataKey); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, rows.Err()
+}
+
+// RotateDataKey creates a data key that encrypts everything written from now on,
+// other running servers pick it up when they first read a value encrypted with it
+func (s *PostgresStore) RotateDataKey() (int64, error) {
+	if s.fields == nil {
+		return 0, ErrFieldKeysMissing
+	}
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return 0, err
+	}
+	masterKeyID, wrapped, err := s.fields.kms.Wrap(dataKey)
+	if err != nil {
+		return 0, err
+	}
+	var id int64
+	err = s.db.QueryRow(`INSERT INTO data_keys (master_key_id, wrapped_key) VALUES ($1, $2) RETURNING id`,
+		masterKeyID, wrapped).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to store data key: %w", err)
+	}
+	return id, s.fields.addKey(id, dataKey)
+}
+
+// RewrapDataKeys wraps every data key with the active master key, afterwards
+// the retired master keys can be removed from the configuration
+func (s *PostgresStore) RewrapDataKeys() (int, error) {
+	if s.fields == nil {
+		return 0, ErrFieldKeysMissing
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT id, master_key_id, wrapped_key FROM data_keys WHERE master_key_id <> $1 FOR UPDATE`,
+		s.fields.kms.ActiveKeyID())
+	if err != nil {
+		return 0, fmt.Errorf("failed to read data keys: %w", err)
+	}
+	type rewrapped struct {
+		id          int64
+		masterKeyID string
+		wrapped     []byte
+	}
+	pending := []rewrapped{}
+	for rows.Next() {
+		var key rewrapped
+		var oldMaster string
+		var oldWrapped []byte
+		if err := rows.Scan(&key.id, &oldMaster, &oldWrapped); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan row: %w", err)
+		}
+		dataKey, err := s.fields.kms.Unwrap(oldMaster, oldWrapped)
+		if err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("data key %d: %w", key.id, err)
+		}
+		if key.masterKeyID, key.wrapped, err = s.fields.kms.Wrap(dataKey); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		pending = append(pending, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, key := range pending {
+		if _, err := tx.Exec(`UPDATE data_keys SET master_key_id = $1, wrapped_key = $2 WHERE id = $3`,
+			key.masterKeyID, key.wrapped, key.id); err != nil {
+			return 0, fmt.Errorf("failed to update data key %d: %w", key.id, err)
+		}
+	}
+	return len(pending), tx.Commit()
+}
+
+func (s *PostgresStore) encryptProfile(client *PatientDetails) error {
+	if s.fields == nil {
+		return ErrFieldKeysMissing
+	}
+	for column, field := range encryptedFields(client) {
+		encrypted, err := s.fields.encrypt(column, client.HealthID, *field)
+		if err != nil {
+			return err
+		}
+		*field = encrypted
+	}
+	return nil
+}
+
+func (s *PostgresStore) decryptProfile(client *PatientDetails) error {
+	if s.fields == nil {
+		return ErrFieldKeysMissing
+	}
+	for column, field := range encryptedFields(client) {
+		plaintext, err := s.decryptField(column, client.HealthID, *field)
+		if err != nil {
+			return err
+		}
+		*field = plaintext
+	}
+	return nil
+}
+
+// decryptField reloads the data keys once when a value uses one created after
+// this server started (a rotation by reencrypt)
+func (s *PostgresStore) decryptField(column, healthID, stored string) (string, error) {
+	plaintext, err := s.fields.decrypt(column, healthID, stored)
+	if errors.Is(err, errUnknownDataKey) {
+		if _, err := s.loadDataKeys(); err != nil {
+			return "", err
+		}
+		plaintext, err = s.fields.decrypt(column, healthID, stored)
+	}
+	return plaintext, err
+}
+
+// ReencryptProfiles rewrites every profile whose fields are plaintext or use an
+// older data key, and recomputes the blind indexes. Rows are locked batch by
+// batch so it can run next to the servers.
+func (s *PostgresStore) ReencryptProfiles() (int, error) {
+	if s.fields == nil {
+		return 0, ErrFieldKeysMissing
+	}
+	var lastID int64
+	rewritten := 0
+	for {
+		n, last, err := s.reencryptBatch(lastID)
+		rewritten += n
+		if err != nil || last == 0 {
+			return rewritten, err
+		}
+		lastID = last
+	}
+}
+
+// reencryptBatch returns the id of the last row it looked at, 0 when there was none
+func (s *PostgresStore) reencryptBatch(afterID int64) (int, int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT id, health_id, email, mobile_number, aadhaar_number, father_name, mother_name,
+		emergency_number, aadhaar_bidx, mobile_bidx
+	FROM client_profile WHERE id > $1 ORDER BY id LIMIT $2 FOR UPDATE`, afterID, reencryptBatchSize)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read profiles: %w", err)
+	}
+	type profileRow struct {
+		client       PatientDetails
+		aadhaarIndex string
+		mobileIndex  string
+	}
+	batch := []*profileRow{}
+	for rows.Next() {
+		var row profileRow
+		c := &row.client
+		if err := rows.Scan(&c.ID, &c.HealthID, &c.Email, &c.MobileNumber, &c.AadhaarNumber, &c.FatherName,
+			&c.MotherName, &c.EmergencyNumber, &row.aadhaarIndex, &row.mobileIndex); err != nil {
+			rows.Close()
+			return 0, 0, fmt.Errorf("failed to scan row: %w", err)
+		}
+		batch = append(batch, &row)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+	if len(batch) == 0 {
+		return 0, 0, nil
+	}
+
+	rewritten := 0
+	for _, row := range batch {
+		c := &row.client
+		stale := false
+		for _, field := range encryptedFields(c) {
+			stale = stale || s.fields.needsReencryption(*field)
+		}
+		if err := s.decryptProfile(c); err != nil {
+			return rewritten, 0, fmt.Errorf("profile %s: %w", c.HealthID, err)
+		}
+		aadhaarIndex := s.fields.blindIndex("aadhaar_number", c.AadhaarNumber)
+		mobileIndex := s.fields.blindIndex("mobile_number", c.MobileNumber)
+		if !stale && aadhaarIndex == row.aadhaarIndex && mobileIndex == row.mobileIndex {
+			continue
+		}
+		if err := s.encryptProfile(c); err != nil {
+			return rewritten, 0, err
+		}
+		_, err := tx.Exec(`UPDATE client_profile SET email = $1, mobile_number = $2, aadhaar_number = $3, father_name = $4,
+			mother_name = $5, emergency_number = $6, aadhaar_bidx = $7, mobile_bidx = $8 WHERE id = $9`,
+			c.Email, c.MobileNumber, c.AadhaarNumber, c.FatherName, c.MotherName, c.EmergencyNumber,
+			aadhaarIndex, mobileIndex, c.ID)
+		if err != nil {
+			return rewritten, 0, fmt.Errorf("failed to update profile %s: %w", c.HealthID, err)
+		}
+		rewritten++
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, 0, err
+	}
+	return rewritten, int64(batch[len(batch)-1].client.ID), nil
+}
+
+// FindClientsByAadhaar looks a patient up by Aadhaar through its blind index,
+// only among the profiles the healthcare can see (see SearchClients)
+func (s *PostgresStore) FindClientsByAadhaar(healthcareID, aadhaar string) ([]string, error) {
+	if s.fields == nil {
+		return nil, ErrFieldKeysMissing
+	}
+	index := s.fields.blindIndex("aadhaar_number", aadhaar)
+	if index == "" {
+		return []string{}, nil
+	}
+	rows, err := s.db.Query(`SELECT c.health_id FROM client_profile c
+	WHERE c.aadhaar_bidx = $2 AND `+visibleClient("c", "$1")+`
+	ORDER BY c.id`, healthcareID, index)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	healthIDs := []string{}
+	for rows.Next() {
+		var healthID string
+		if err := rows.Scan(&healthID); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		healthIDs = append(healthIDs, healthID)
+	}
+	return healthIDs, rows.Err()
+}
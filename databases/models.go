@@ -91,31 +91,268 @@ func SignUpAccount(hip *HIPInfo) (*HIPInfo, error) {
 	}, nil
 }
 
+// Staff accounts belong to one healthcare, the healthcare's own login acts as its admin
+type Staff struct {
+	StaffID      string    `json:"staff_id"`
+	HealthcareID string    `json:"healthcare_id"`
+	Name         string    `json:"name" validate:"required,min=3,max=60"`
+	Email        string    `json:"email" validate:"required,email,max=100"`
+	Role         string    `json:"role" validate:"required,oneof=admin doctor receptionist auditor"`
+	Password     string    `json:"password,omitempty" validate:"required,min=8"`
+	Locked       bool      `json:"locked"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+type StaffLogin struct {
+	StaffID  string `json:"staff_id" validate:"required"`
+	Password string `json:"password" validate:"required"`
+}
+
+func CreateStaffAccount(healthcare_id string, staff *Staff) (*Staff, error) {
+	validate := validator.New()
+	newStaff := &Staff{
+		StaffID:      "STF" + uuid.New().String()[:20],
+		HealthcareID: healthcare_id,
+		Name:         strings.TrimSpace(staff.Name),
+		Email:        strings.TrimSpace(staff.Email),
+		Role:         strings.TrimSpace(staff.Role),
+		Password:     staff.Password,
+		CreatedAt:    time.Now(),
+	}
+	if err := validate.Struct(newStaff); err != nil {
+		return nil, fmt.Errorf("validation failed: %s", err.Error())
+	}
+
+	encpw, err := bcrypt.GenerateFromPassword([]byte(newStaff.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	newStaff.Password = string(encpw)
+	return newStaff, nil
+}
+
+type TwoFactor struct {
+	HealthcareID string
+	Secret       string
+	Enabled      bool
+}
+
 type Appointments struct {
 	ID              int64  `bson:"_id,omitempty" json:"id"`
 	HealthcareID    string `json:"-" bson:"healthcare_id" validate:"required"`
 	AppointmentDate string `json:"appointment_date" bson:"appointment_date"`
 	AppointmentTime string `json:"appointment_time" bson:"appointment_time"`
-	HealthID        string `json:"health_id" bson:"health_id" validate:"required,min=10,max=10"`
+	HealthID        string `json:"health_id" bson:"health_id" validate:"required,min=5,max=30"`
 	Department      string `json:"department" bson:"department"`
 	Note            string `json:"note" bson:"note" validate:"max=500"`
 	FullName        string `json:"fullname" bson:"fullname" validate:"required,min=3,max=50"`
 	Status          string `json:"status" bson:"status" validate:"required"`
-	HealthcareName  string `json:"-" bson:"-" validate:"required,min=5,max=50"`
+	HealthcareName  string `json:"-" bson:"-" validate:"required,max=50"`
+}
+
+// Availability is one weekly window of a department, weekday follows time.Weekday (0 is Sunday)
+type Availability struct {
+	Department  string `json:"department,omitempty"`
+	Weekday     int    `json:"weekday" validate:"min=0,max=6"`
+	StartTime   string `json:"start_time" validate:"required"`
+	EndTime     string `json:"end_time" validate:"required"`
+	SlotMinutes int    `json:"slot_minutes" validate:"required,min=5,max=480"`
 }
 
 type UpdateAppointment struct {
-	ID           int64  `bson:"_id, omitempty" json:"id"`
+	ID           int64  `bson:"_id, omitempty" json:"id" validate:"required"`
 	HealthID     string `json:"health_id" bson:"health_id" validate:"required,min=10,max=30"`
 	HealthcareID string `json:"healthcare_id" bson:"healthcare_id" validate:"required,min=10,max=30"`
 	Status       string `json:"status" bson:"status" validate:"required"`
+	Reason       string `json:"reason" bson:"reason" validate:"max=300"`
+	Actor        string `json:"actor" bson:"actor"`
+}
+
+// AppointmentFilter narrows GetAppointments, empty fields don't filter.
+// SortBy is "date" (appointment_date, id) or "time" (appointment_date, appointment_time, id)
+type AppointmentFilter struct {
+	Status     string
+	Department string
+	HealthID   string
+	From       string
+	To         string
+	SortBy     string
+	Descending bool
+	Limit      int64
+	After      *AppointmentCursor
+}
+
+// AppointmentCursor is the sort key of the last row of the previous page
+type AppointmentCursor struct {
+	SortBy string `json:"s"`
+	Date   string `json:"d"`
+	Time   string `json:"t,omitempty"`
+	ID     int64  `json:"id"`
+}
+
+// AppointmentStatusChange is one entry of an appointment timeline
+type AppointmentStatusChange struct {
+	FromStatus string    `json:"from_status"`
+	ToStatus   string    `json:"to_status"`
+	Actor      string    `json:"actor"`
+	Reason     string    `json:"reason"`
+	ChangedAt  time.Time `json:"changed_at"`
+}
+
+// Consent is access to one scope of a patient's data the patient gave a healthcare,
+// ExpiresAt is set once it is granted
+type Consent struct {
+	ID           int64      `json:"id"`
+	HealthID     string     `json:"health_id"`
+	HealthcareID string     `json:"healthcare_id"`
+	Scope        string     `json:"scope"`
+	Status       string     `json:"status"`
+	DurationDays int        `json:"duration_days"`
+	Reason       string     `json:"reason"`
+	RequestedBy  string     `json:"requested_by"`
+	RequestedAt  time.Time  `json:"requested_at"`
+	DecidedAt    *time.Time `json:"decided_at,omitempty"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	RevokedAt    *time.Time `json:"revoked_at,omitempty"`
+}
+
+// BreakGlass is emergency access to a patient without consent, it opens reads of its
+// scope until ExpiresAt and stays on the review list until another admin signs it off
+type BreakGlass struct {
+	ID           int64      `json:"id"`
+	HealthID     string     `json:"health_id"`
+	HealthcareID string     `json:"healthcare_id"`
+	Actor        string     `json:"actor"`
+	Scope        string     `json:"scope"`
+	Reason       string     `json:"reason"`
+	OpenedAt     time.Time  `json:"opened_at"`
+	ExpiresAt    time.Time  `json:"expires_at"`
+	ReviewedBy   *string    `json:"reviewed_by,omitempty"`
+	ReviewedAt   *time.Time `json:"reviewed_at,omitempty"`
+	ReviewNote   string     `json:"review_note"`
+}
+
+// AuditEntry is one access to a patient's data. Hash covers every other field and
+// the previous entry's hash, changing or removing an entry breaks the chain after it.
+type AuditEntry struct {
+	ID           int64     `json:"id"`
+	Actor        string    `json:"actor"`
+	HealthcareID string    `json:"healthcare_id"`
+	HealthID     string    `json:"health_id"`
+	Action       string    `json:"action"`
+	Endpoint     string    `json:"endpoint"`
+	IP           string    `json:"ip"`
+	Severity     string    `json:"severity"`
+	CreatedAt    time.Time `json:"created_at"`
+	PrevHash     string    `json:"prev_hash"`
+	Hash         string    `json:"hash"`
+}
+
+// AuditQuery filters the audit log of one healthcare, zero values don't filter.
+// Entries come newest first, BeforeID continues after the last one of a page.
+type AuditQuery struct {
+	HealthcareID string
+	HealthID     string
+	Actor        string
+	From         time.Time
+	To           time.Time
+	BeforeID     int64
+	Limit        int
+}
+
+// AccessReportEntry is an audit entry as the patient sees it, without the staff
+// member and IP behind it
+type AccessReportEntry struct {
+	ID             int64     `json:"id"`
+	HealthcareID   string    `json:"healthcare_id"`
+	HealthcareName string    `json:"healthcare_name"`
+	Action         string    `json:"action"`
+	AccessedAt     time.Time `json:"accessed_at"`
+}
+
+// ClientSearch finds patients a healthcare may see, empty fields don't filter.
+// Name is matched fuzzily, the rest exactly.
+type ClientSearch struct {
+	HealthcareID  string
+	Name          string
+	DOB           string
+	MobileNumber  string
+	AadhaarNumber string
+	Sex           string
+	BloodGroup    string
+	Page          int
+	PageSize      int
+}
+
+// ClientSearchResult leaves the encrypted identifiers out, Score is 1 for a
+// search without a name and the name similarity (0 to 1) otherwise
+type ClientSearchResult struct {
+	HealthID   string  `json:"health_id"`
+	FirstName  string  `json:"fname"`
+	MiddleName string  `json:"middlename"`
+	LastName   string  `json:"lname"`
+	Sex        string  `json:"sex"`
+	DOB        string  `json:"dob"`
+	BloodGroup string  `json:"bloodgrp"`
+	Score      float64 `json:"score"`
+}
+
+// DuplicatePatient is the part of a profile a reviewer needs to tell two patients apart
+type DuplicatePatient struct {
+	HealthID   string    `json:"health_id"`
+	FirstName  string    `json:"fname"`
+	MiddleName string    `json:"middlename"`
+	LastName   string    `json:"lname"`
+	Sex        string    `json:"sex"`
+	DOB        string    `json:"dob"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// DuplicateCandidate is a pair of profiles that may be the same person. Score goes
+// from 0 to 1, Matched lists what agreed: aadhaar, mobile, dob and name.
+type DuplicateCandidate struct {
+	Patient   *DuplicatePatient `json:"patient"`
+	Duplicate *DuplicatePatient `json:"duplicate"`
+	Score     float64           `json:"score"`
+	Matched   []string          `json:"matched"`
+}
+
+// PatientMerge is the outcome of merging Alias into HealthID, the moved counts
+// are zero when a merge that was already done is run again
+type PatientMerge struct {
+	HealthID          string    `json:"health_id"`
+	Alias             string    `json:"merged_health_id"`
+	MergedBy          string    `json:"merged_by"`
+	MergedAt          time.Time `json:"merged_at"`
+	AppointmentsMoved int64     `json:"appointments_moved"`
+	RecordsMoved      int64     `json:"records_moved"`
+}
+
+// ProfileVersion is one change of a patient profile, RevertedTo is set when the
+// change put the profile back as it was at an earlier version. MergedFrom is set
+// on the changes of a duplicate merged into the patient, they aren't undone.
+type ProfileVersion struct {
+	Version    int            `json:"version"`
+	HealthID   string         `json:"health_id"`
+	MergedFrom string         `json:"merged_from,omitempty"`
+	ChangedBy  string         `json:"changed_by"`
+	RevertedTo *int           `json:"reverted_to,omitempty"`
+	Changes    []*FieldChange `json:"changes"`
+	CreatedAt  time.Time      `json:"created_at"`
+}
+
+// FieldChange is a field a version changed, named like in FieldError
+type FieldChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
 }
 
 type PatientDetails struct {
 	ID              int       `bson:"_id,omitempty" json:"-"`
 	HealthID        string    `bson:"health_id" json:"health_id" validate:"required,min=5,max=30"`
 	FirstName       string    `bson:"fname" json:"fname" validate:"required,min=3,max=60"`
-	MiddleName      string    `bson:"middlename" json:"middlename" validate:"min=3,max=60"`
+	MiddleName      string    `bson:"middlename" json:"middlename" validate:"omitempty,min=3,max=60"`
 	LastName        string    `bson:"lname" json:"lname" validate:"required,min=3,max=60"`
 	Sex             string    `bson:"sex" json:"sex" validate:"required,min=1,max=9"`
 	HealthcareID    string    `bson:"healthcare_id" json:"healthcare_id" validate:"required,min=5,max=30"`
@@ -152,9 +389,7 @@ func validateAadhaar(fl validator.FieldLevel) bool {
 }
 
 func Create_clientProfile(HealthcareID string, patient *PatientDetails) (*PatientDetails, error) {
-	validate := validator.New()
-	validate.RegisterValidation("phone", validatePhoneNumber)
-	validate.RegisterValidation("aadhaar", validateAadhaar)
+	validate := profileValidator()
 
 	uniquehealthID := uuid.New().String()[:20]
 	newPatient := &PatientDetails{
@@ -222,6 +457,9 @@ func CreatePatientRecords(healthcare_id string, patientRecords *PatientRecords)
 	validate := validator.New()
 
 	new_records := &PatientRecords{
+		// kept so a caller can choose the id, e.g. to make a retried insert fail as a duplicate
+		ID:              patientRecords.ID,
+		CreatedAt:       patientRecords.CreatedAt,
 		Issue:           strings.TrimSpace(patientRecords.Issue),
 		Createdby_:      strings.TrimSpace(healthcare_id),
 		Description:     strings.TrimSpace(patientRecords.Description),
@@ -263,4 +501,5 @@ type Preferance struct {
 	Profile_viewed     int32  `json:"profile_viewed"`
 	Records_created    int32  `json:"records_created"`
 	Records_viewed     int32  `json:"records_viewed"`
+	EmailNotifications bool   `json:"email_notifications"`
 }
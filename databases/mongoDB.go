@@ -2,6 +2,7 @@ package databases
 
 import (
 	"context"
+	"errors"
 	"fmt"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -10,6 +11,9 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// ErrRecordExists is returned when a record with the same id was stored before
+var ErrRecordExists = errors.New("patient record already exists")
+
 type MongoStore struct {
 	db         *mongo.Client
 	database   string
@@ -190,6 +194,9 @@ func (m *MongoStore) CreatepatientRecords(healthcare_id string, patientrecords *
 		return nil, err
 	}
 	id, err := coll.InsertOne(context.TODO(), patientrecords)
+	if mongo.IsDuplicateKeyError(err) {
+		return nil, ErrRecordExists
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -222,6 +229,18 @@ func (m *MongoStore) GetPatientRecords(health_id, severity string, list int) (*[
 	return &patientRecords, nil
 }
 
+// RepointPatientRecords moves the records of a merged health id to the one it was merged into
+func (m *MongoStore) RepointPatientRecords(from, to string) (int64, error) {
+	coll := m.db.Database(m.database).Collection("patient_records")
+	filter := bson.D{{Key: "health_id", Value: from}}
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "health_id", Value: to}}}}
+	result, err := coll.UpdateMany(context.TODO(), filter, update)
+	if err != nil {
+		return 0, fmt.Errorf("error moving patient records: %w", err)
+	}
+	return result.ModifiedCount, nil
+}
+
 func (m *MongoStore) UpdatePatientBioData(healthID string, updates map[string]interface{}) (*PatientDetails, error) {
 	coll := m.db.Database(m.database).Collection("patient_details")
 
@@ -0,0 +1,216 @@
+package databases
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+	"vaibhavyadav-dev/healthcareServer/events"
+	mq "vaibhavyadav-dev/healthcareServer/rabbitmq"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// how many pending messages one dispatch publishes at most
+	outboxBatchSize = 100
+	// how long a claimed batch belongs to its relay, longer than publishing a full
+	// batch at outboxPublishWait per message takes. A relay that died mid batch
+	// leaves it to be published again once the claim ran out.
+	outboxClaimLease = 10 * time.Minute
+	// any constant works, it only has to be the same for every relay
+	outboxClaimLock = 7_411_023
+	// a message still failing after this many publishes is parked (dead_at set) so
+	// the ones behind it go out, it stays in the table until someone requeues it
+	maxOutboxAttempts = 20
+	// sent messages are deleted after this, their payloads carry tokens and patient details
+	outboxRetention = 24 * time.Hour
+)
+
+// OutboxEvent is a message written in the same transaction as the change it
+// announces, it is published only once that transaction committed
+type OutboxEvent struct {
+	ID      int64
+	Queue   string
+	Payload []byte
+
+	attempts int
+}
+
+// NewEvent wraps event in its envelope and addresses it to the queue of its type
+func NewEvent(correlationID string, event events.Event) (*OutboxEvent, error) {
+	payload, err := events.Encode(event, correlationID)
+	if err != nil {
+		return nil, err
+	}
+	return &OutboxEvent{Queue: event.Queue(), Payload: payload}, nil
+}
+
+func insertOutbox(tx *sql.Tx, events []*OutboxEvent) error {
+	for _, event := range events {
+		if err := tx.QueryRow(`INSERT INTO event_outbox (queue, payload) VALUES ($1, $2) RETURNING id`,
+			event.Queue, event.Payload).Scan(&event.ID); err != nil {
+			return fmt.Errorf("failed to write outbox: %w", err)
+		}
+	}
+	return nil
+}
+
+// EnqueueEvents writes events that don't belong to a postgres change of their own
+func (s *PostgresStore) EnqueueEvents(events ...*OutboxEvent) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := insertOutbox(tx, events); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// OutboxLag reports how many messages wait to be published, how many were parked
+// and the age of the oldest waiting one
+func (s *PostgresStore) OutboxLag() (int64, int64, time.Duration, error) {
+	var pending, parked int64
+	var oldest float64
+	err := s.db.QueryRow(`SELECT COUNT(*) FILTER (WHERE dead_at IS NULL), COUNT(*) FILTER (WHERE dead_at IS NOT NULL),
+		COALESCE(EXTRACT(EPOCH FROM NOW() - MIN(created_at) FILTER (WHERE dead_at IS NULL)), 0)
+	FROM event_outbox WHERE sent_at IS NULL`).Scan(&pending, &parked, &oldest)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return pending, parked, time.Duration(oldest * float64(time.Second)), nil
+}
+
+// PruneOutbox deletes the messages sent longer than outboxRetention ago
+func (s *PostgresStore) PruneOutbox() (int64, error) {
+	result, err := s.db.Exec(`DELETE FROM event_outbox WHERE sent_at < NOW() - $1 * INTERVAL '1 second'`,
+		int64(outboxRetention/time.Second))
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune outbox: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// shouldPark reports whether a message that failed its attempts-th publish with err
+// is given up on. A broker that is down isn't the message's fault, it waits for it.
+func shouldPark(attempts int, err error) bool {
+	return attempts >= maxOutboxAttempts && !errors.Is(err, mq.ErrNotConnected)
+}
+
+// claimOutbox marks the oldest pending messages as claimed and commits, so they are
+// published without holding row locks. There is one claim at a time: while another
+// relay holds one nothing is returned, which keeps the messages in order.
+func (s *PostgresStore) claimOutbox() ([]*OutboxEvent, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var claimable bool
+	err = tx.QueryRow(`SELECT pg_try_advisory_xact_lock($1) AND NOT EXISTS (SELECT 1 FROM event_outbox
+		WHERE sent_at IS NULL AND claimed_until > NOW())`, outboxClaimLock).Scan(&claimable)
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim outbox: %w", err)
+	}
+	if !claimable {
+		return nil, nil
+	}
+
+	rows, err := tx.Query(`UPDATE event_outbox SET claimed_until = NOW() + $1 * INTERVAL '1 second'
+	WHERE id IN (SELECT id FROM event_outbox WHERE sent_at IS NULL AND dead_at IS NULL ORDER BY id LIMIT $2)
+	RETURNING id, queue, payload, attempts`, int64(outboxClaimLease/time.Second), outboxBatchSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim outbox: %w", err)
+	}
+	pending := []*OutboxEvent{}
+	for rows.Next() {
+		var event OutboxEvent
+		if err := rows.Scan(&event.ID, &event.Queue, &event.Payload, &event.attempts); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		pending = append(pending, &event)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// RETURNING doesn't keep the subquery's order
+	sort.Slice(pending, func(i, j int) bool { return pending[i].ID < pending[j].ID })
+	return pending, tx.Commit()
+}
+
+// DispatchOutbox publishes pending messages oldest first and marks them sent.
+// It stops at the first failure so messages keep their order, the failed one
+// stays pending with its error recorded and the rest of the claim is released.
+// A message that used up its attempts is parked instead and the batch goes on.
+func (s *PostgresStore) DispatchOutbox(publish func(queue string, payload []byte) error) (int, error) {
+	pending, err := s.claimOutbox()
+	if err != nil || len(pending) == 0 {
+		return 0, err
+	}
+
+	sentIDs := []int64{}
+	parked := map[int64]string{}
+	var publishErr error
+	var failed *OutboxEvent
+	for _, event := range pending {
+		err := publish(event.Queue, event.Payload)
+		if err == nil {
+			sentIDs = append(sentIDs, event.ID)
+			continue
+		}
+		if shouldPark(event.attempts+1, err) {
+			log.Printf("outbox relay: parking message %d for %s after %d attempts: %v", event.ID, event.Queue, event.attempts+1, err)
+			parked[event.ID] = err.Error()
+			continue
+		}
+		publishErr, failed = err, event
+		break
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE event_outbox SET sent_at = NOW(), attempts = attempts + 1, claimed_until = NULL
+	WHERE id = ANY($1)`, pq.Array(sentIDs)); err != nil {
+		return 0, err
+	}
+	for id, lastError := range parked {
+		if _, err := tx.Exec(`UPDATE event_outbox SET dead_at = NOW(), attempts = attempts + 1, last_error = $1, claimed_until = NULL
+		WHERE id = $2`, lastError, id); err != nil {
+			return 0, err
+		}
+	}
+	if failed != nil {
+		if _, err := tx.Exec(`UPDATE event_outbox SET attempts = attempts + 1, last_error = $1 WHERE id = $2`,
+			publishErr.Error(), failed.ID); err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec(`UPDATE event_outbox SET claimed_until = NULL WHERE id = ANY($1) AND sent_at IS NULL`,
+			pq.Array(claimedIDs(pending))); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(sentIDs), publishErr
+}
+
+func claimedIDs(events []*OutboxEvent) []int64 {
+	ids := make([]int64, 0, len(events))
+	for _, event := range events {
+		ids = append(ids, event.ID)
+	}
+	return ids
+}
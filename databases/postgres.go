@@ -2,14 +2,19 @@ package databases
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"strings"
 
 	_ "github.com/lib/pq"
 )
 
+var ErrClientNotFound = errors.New("no client found")
+
 type PostgresStore struct {
 	db *sql.DB
+	// nil until EnableFieldEncryption, patient profiles can't be read or written without it
+	fields *fieldCipher
 }
 
 func ConnectToPostgreSQL(url string) (*PostgresStore, error) {
@@ -108,6 +113,244 @@ func (s *PostgresStore) CreateTable() error {
 			state VARCHAR(150) NOT NULL, 
 			landmark VARCHAR(150) NOT NULL
 		);`,
+
+		// staff accounts under a healthcare
+		`CREATE TABLE IF NOT EXISTS hip_staff (
+			id SERIAL PRIMARY KEY,
+			staff_id TEXT NOT NULL UNIQUE,
+			healthcare_id TEXT NOT NULL,
+			name VARCHAR(60) NOT NULL,
+			email VARCHAR(100) NOT NULL UNIQUE,
+			role VARCHAR(20) NOT NULL CHECK (role IN ('admin', 'doctor', 'receptionist', 'auditor')),
+			password TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+			FOREIGN KEY (healthcare_id) REFERENCES HIP_TABLE(healthcare_id) ON DELETE CASCADE
+		);`,
+
+		// TOTP two factor authentication
+		`CREATE TABLE IF NOT EXISTS hip_two_factor (
+			healthcare_id TEXT PRIMARY KEY,
+			secret TEXT NOT NULL,
+			enabled BOOLEAN NOT NULL DEFAULT FALSE,
+			enrolled_at TIMESTAMP NOT NULL DEFAULT NOW(),
+			enabled_at TIMESTAMP,
+			FOREIGN KEY (healthcare_id) REFERENCES HIP_TABLE(healthcare_id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS hip_recovery_codes (
+			id SERIAL PRIMARY KEY,
+			healthcare_id TEXT NOT NULL,
+			code_hash TEXT NOT NULL,
+			used_at TIMESTAMP,
+			FOREIGN KEY (healthcare_id) REFERENCES HIP_TABLE(healthcare_id) ON DELETE CASCADE
+		);`,
+
+		// appointments are owned by this service, a slot can only be held by one
+		// active appointment, the partial unique index is what stops double booking
+		`CREATE TABLE IF NOT EXISTS appointments (
+			id BIGSERIAL PRIMARY KEY,
+			health_id VARCHAR(150) NOT NULL,
+			healthcare_id TEXT NOT NULL,
+			healthcare_name TEXT NOT NULL,
+			fullname VARCHAR(60) NOT NULL,
+			department VARCHAR(60) NOT NULL,
+			appointment_date DATE NOT NULL,
+			appointment_time TIME NOT NULL,
+			status VARCHAR(20) NOT NULL DEFAULT 'Pending',
+			note VARCHAR(500) NOT NULL DEFAULT '',
+			created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+			FOREIGN KEY (healthcare_id) REFERENCES HIP_TABLE(healthcare_id) ON DELETE CASCADE
+		);`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS appointments_active_slot
+			ON appointments (healthcare_id, department, appointment_date, appointment_time)
+			WHERE status IN ('Pending', 'Confirmed');`,
+		`CREATE INDEX IF NOT EXISTS appointments_healthcare_page
+			ON appointments (healthcare_id, appointment_date, appointment_time, id);`,
+
+		// every status an appointment went through, from_status is NULL for the booking itself
+		`CREATE TABLE IF NOT EXISTS appointment_status_history (
+			id BIGSERIAL PRIMARY KEY,
+			appointment_id BIGINT NOT NULL,
+			from_status VARCHAR(20),
+			to_status VARCHAR(20) NOT NULL,
+			actor TEXT NOT NULL,
+			reason VARCHAR(300) NOT NULL DEFAULT '',
+			changed_at TIMESTAMP NOT NULL DEFAULT NOW(),
+			FOREIGN KEY (appointment_id) REFERENCES appointments(id) ON DELETE CASCADE
+		);`,
+		`CREATE INDEX IF NOT EXISTS appointment_status_history_appointment
+			ON appointment_status_history (appointment_id, changed_at);`,
+
+		// messages waiting to be published, written in the same transaction as the change
+		`CREATE TABLE IF NOT EXISTS event_outbox (
+			id BIGSERIAL PRIMARY KEY,
+			queue TEXT NOT NULL,
+			payload BYTEA NOT NULL,
+			created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+			sent_at TIMESTAMP,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			last_error TEXT
+		);`,
+		`CREATE INDEX IF NOT EXISTS event_outbox_pending ON event_outbox (id) WHERE sent_at IS NULL;`,
+		// a relay claims a batch until then, publishes it outside any transaction and marks it sent
+		`ALTER TABLE event_outbox ADD COLUMN IF NOT EXISTS claimed_until TIMESTAMP;`,
+		// set once a message used up its attempts, the relay skips it from then on
+		`ALTER TABLE event_outbox ADD COLUMN IF NOT EXISTS dead_at TIMESTAMP;`,
+
+		// false stops every notification email except security ones (lockout, password reset)
+		`ALTER TABLE HealthCare_pref ADD COLUMN IF NOT EXISTS email_notifications BOOLEAN NOT NULL DEFAULT TRUE;`,
+
+		// staff logins lock like the healthcare's own, until the mailed unlock link is used
+		`ALTER TABLE hip_staff ADD COLUMN IF NOT EXISTS locked BOOLEAN NOT NULL DEFAULT FALSE;`,
+
+		// data keys of the profile field encryption, wrapped by a master key kept outside the database
+		`CREATE TABLE IF NOT EXISTS data_keys (
+			id BIGSERIAL PRIMARY KEY,
+			master_key_id TEXT NOT NULL,
+			wrapped_key BYTEA NOT NULL,
+			created_at TIMESTAMP NOT NULL DEFAULT NOW()
+		);`,
+		// ciphertexts don't fit the old VARCHAR(150), the blind indexes allow exact match lookups
+		`ALTER TABLE client_profile
+			ALTER COLUMN email TYPE TEXT,
+			ALTER COLUMN mobile_number TYPE TEXT,
+			ALTER COLUMN aadhaar_number TYPE TEXT,
+			ALTER COLUMN father_name TYPE TEXT,
+			ALTER COLUMN mother_name TYPE TEXT,
+			ALTER COLUMN emergency_number TYPE TEXT,
+			ADD COLUMN IF NOT EXISTS aadhaar_bidx TEXT NOT NULL DEFAULT '',
+			ADD COLUMN IF NOT EXISTS mobile_bidx TEXT NOT NULL DEFAULT '';`,
+		`CREATE INDEX IF NOT EXISTS client_profile_aadhaar_bidx ON client_profile (aadhaar_bidx) WHERE aadhaar_bidx <> '';`,
+		`CREATE INDEX IF NOT EXISTS client_profile_mobile_bidx ON client_profile (mobile_bidx) WHERE mobile_bidx <> '';`,
+
+		// fuzzy patient search by name, the expression must match clientName
+		`CREATE EXTENSION IF NOT EXISTS pg_trgm;`,
+		`CREATE INDEX IF NOT EXISTS client_profile_name_trgm ON client_profile
+			USING gin ((first_name || ' ' || COALESCE(middle_name, '') || ' ' || last_name) gin_trgm_ops);`,
+		`CREATE INDEX IF NOT EXISTS client_profile_healthcare_dob ON client_profile (healthcare_id, dob);`,
+
+		// access a patient gave a healthcare, token_hash belongs to the single token the
+		// patient got by email to approve, reject or later revoke the consent
+		`CREATE TABLE IF NOT EXISTS patient_consents (
+			id BIGSERIAL PRIMARY KEY,
+			health_id TEXT NOT NULL,
+			healthcare_id TEXT NOT NULL,
+			scope VARCHAR(20) NOT NULL CHECK (scope IN ('profile', 'records', 'appointments')),
+			status VARCHAR(20) NOT NULL DEFAULT 'requested' CHECK (status IN ('requested', 'granted', 'rejected', 'revoked')),
+			duration_days INTEGER NOT NULL CHECK (duration_days BETWEEN 1 AND 365),
+			reason VARCHAR(300) NOT NULL DEFAULT '',
+			token_hash TEXT NOT NULL UNIQUE,
+			requested_by TEXT NOT NULL,
+			requested_at TIMESTAMP NOT NULL DEFAULT NOW(),
+			decided_at TIMESTAMP,
+			expires_at TIMESTAMP,
+			revoked_at TIMESTAMP,
+			FOREIGN KEY (healthcare_id) REFERENCES HIP_TABLE(healthcare_id) ON DELETE CASCADE
+		);`,
+		`CREATE INDEX IF NOT EXISTS patient_consents_granted
+			ON patient_consents (health_id, healthcare_id, scope) WHERE status = 'granted';`,
+
+		// emergency access without consent, every row waits for an admin to sign it off
+		`CREATE TABLE IF NOT EXISTS break_glass_access (
+			id BIGSERIAL PRIMARY KEY,
+			health_id TEXT NOT NULL,
+			healthcare_id TEXT NOT NULL,
+			actor TEXT NOT NULL,
+			scope VARCHAR(20) NOT NULL CHECK (scope IN ('profile', 'records')),
+			reason VARCHAR(500) NOT NULL CHECK (LENGTH(reason) >= 20),
+			opened_at TIMESTAMP NOT NULL DEFAULT NOW(),
+			expires_at TIMESTAMP NOT NULL,
+			reviewed_by TEXT,
+			reviewed_at TIMESTAMP,
+			review_note VARCHAR(500) NOT NULL DEFAULT '',
+			FOREIGN KEY (healthcare_id) REFERENCES HIP_TABLE(healthcare_id) ON DELETE CASCADE
+		);`,
+		`CREATE INDEX IF NOT EXISTS break_glass_access_active
+			ON break_glass_access (health_id, healthcare_id, expires_at);`,
+		`CREATE INDEX IF NOT EXISTS break_glass_access_pending
+			ON break_glass_access (healthcare_id, opened_at) WHERE reviewed_at IS NULL;`,
+
+		// who touched which patient's data, hash chained and append-only. No foreign
+		// key: the trail has to outlive a deleted healthcare.
+		`CREATE TABLE IF NOT EXISTS phi_audit_log (
+			id BIGSERIAL PRIMARY KEY,
+			actor TEXT NOT NULL,
+			healthcare_id TEXT NOT NULL,
+			health_id TEXT NOT NULL,
+			action VARCHAR(40) NOT NULL,
+			endpoint TEXT NOT NULL,
+			ip TEXT NOT NULL,
+			severity VARCHAR(10) NOT NULL CHECK (severity IN ('normal', 'high')),
+			created_at TIMESTAMP NOT NULL,
+			prev_hash CHAR(64) NOT NULL,
+			hash CHAR(64) NOT NULL UNIQUE
+		);`,
+		`CREATE INDEX IF NOT EXISTS phi_audit_log_patient ON phi_audit_log (healthcare_id, health_id, created_at);`,
+		`CREATE INDEX IF NOT EXISTS phi_audit_log_actor ON phi_audit_log (healthcare_id, actor, created_at);`,
+		`CREATE OR REPLACE FUNCTION phi_audit_log_append_only() RETURNS trigger AS $$
+		BEGIN
+			RAISE EXCEPTION 'phi_audit_log is append-only';
+		END;
+		$$ LANGUAGE plpgsql;`,
+		`DO $$ BEGIN
+			IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = 'phi_audit_log_no_change') THEN
+				CREATE TRIGGER phi_audit_log_no_change BEFORE UPDATE OR DELETE ON phi_audit_log
+					FOR EACH ROW EXECUTE FUNCTION phi_audit_log_append_only();
+			END IF;
+			IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = 'phi_audit_log_no_truncate') THEN
+				CREATE TRIGGER phi_audit_log_no_truncate BEFORE TRUNCATE ON phi_audit_log
+					FOR EACH STATEMENT EXECUTE FUNCTION phi_audit_log_append_only();
+			END IF;
+		END $$;`,
+
+		// every change of a profile, changes holds the columns as stored so encrypted
+		// values stay encrypted. Version 0 is the profile before its first recorded change.
+		`CREATE TABLE IF NOT EXISTS client_profile_versions (
+			id BIGSERIAL PRIMARY KEY,
+			health_id TEXT NOT NULL,
+			version INTEGER NOT NULL CHECK (version > 0),
+			changed_by TEXT NOT NULL,
+			reverted_to INTEGER,
+			changes JSONB NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			UNIQUE (health_id, version)
+		);`,
+		`CREATE INDEX IF NOT EXISTS client_profile_versions_time ON client_profile_versions (health_id, created_at);`,
+		// set on the versions of a patient merged into this one, they are history only
+		`ALTER TABLE client_profile_versions ADD COLUMN IF NOT EXISTS merged_from TEXT;`,
+
+		// health ids merged into another patient, profile is the merged row as it was stored
+		`CREATE TABLE IF NOT EXISTS patient_aliases (
+			alias_health_id TEXT PRIMARY KEY,
+			health_id TEXT NOT NULL,
+			healthcare_id TEXT NOT NULL,
+			merged_by TEXT NOT NULL,
+			reason VARCHAR(300) NOT NULL DEFAULT '',
+			profile JSONB NOT NULL,
+			merged_at TIMESTAMP NOT NULL DEFAULT NOW()
+		);`,
+		`CREATE INDEX IF NOT EXISTS patient_aliases_health_id ON patient_aliases (health_id);`,
+		// pairs a reviewer decided are different people, health_id_a sorts before health_id_b
+		`CREATE TABLE IF NOT EXISTS patient_duplicate_dismissals (
+			healthcare_id TEXT NOT NULL,
+			health_id_a TEXT NOT NULL,
+			health_id_b TEXT NOT NULL,
+			dismissed_by TEXT NOT NULL,
+			dismissed_at TIMESTAMP NOT NULL DEFAULT NOW(),
+			PRIMARY KEY (healthcare_id, health_id_a, health_id_b)
+		);`,
+
+		// weekly schedule, a department can have several windows on the same weekday
+		`CREATE TABLE IF NOT EXISTS department_availability (
+			id SERIAL PRIMARY KEY,
+			healthcare_id TEXT NOT NULL,
+			department VARCHAR(60) NOT NULL,
+			weekday SMALLINT NOT NULL CHECK (weekday BETWEEN 0 AND 6),
+			start_time TIME NOT NULL,
+			end_time TIME NOT NULL,
+			slot_minutes INTEGER NOT NULL CHECK (slot_minutes > 0),
+			CHECK (end_time > start_time),
+			FOREIGN KEY (healthcare_id) REFERENCES HIP_TABLE(healthcare_id) ON DELETE CASCADE
+		);`,
 	}
 	for _, query := range queries {
 		_, err := s.db.Exec(query)
@@ -118,7 +361,7 @@ func (s *PostgresStore) CreateTable() error {
 	return nil
 }
 
-func (s *PostgresStore) SignUpAccount(hip *HIPInfo) (int64, error) {
+func (s *PostgresStore) SignUpAccount(hip *HIPInfo, events ...*OutboxEvent) (int64, error) {
 	query := `INSERT INTO HIP_TABLE (healthcare_id, healthcare_license, 
 		healthcare_name, email, availability, total_facilities, 
 		total_mbbs_doc, total_worker, no_of_beds, password, about, country, 
@@ -139,18 +382,30 @@ func (s *PostgresStore) SignUpAccount(hip *HIPInfo) (int64, error) {
 		return 0, fmt.Errorf("email %s already exists", hip.Email)
 	}
 
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
 	// Insert into HIP_TABLE and get the generated healthcare_id
 	var healthcareID string
-	err = s.db.QueryRow(query, hip.HealthcareID, hip.HealthcareLicense, hip.HealthcareName, hip.Email, hip.Availability, hip.TotalFacilities, hip.TotalMBBSDoc, hip.TotalWorker, hip.NoOfBeds, hip.Password, hip.About, hip.Address.Country, hip.Address.State, hip.Address.City, hip.Address.Landmark).Scan(&healthcareID)
+	err = tx.QueryRow(query, hip.HealthcareID, hip.HealthcareLicense, hip.HealthcareName, hip.Email, hip.Availability, hip.TotalFacilities, hip.TotalMBBSDoc, hip.TotalWorker, hip.NoOfBeds, hip.Password, hip.About, hip.Address.Country, hip.Address.State, hip.Address.City, hip.Address.Landmark).Scan(&healthcareID)
 	if err != nil {
 		return 0, err
 	}
 
 	// Insert into HealthCare_Logs using the healthcare_id
-	Id, err := s.db.Exec(query1, healthcareID, "false", 0, 0, "false", 0, 0, 100, 100, "true")
+	Id, err := tx.Exec(query1, healthcareID, "false", 0, 0, "false", 0, 0, 100, 100, "true")
 	if err != nil {
 		return 0, err
 	}
+	if err := insertOutbox(tx, events); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
 	Inserted_id, _ := Id.LastInsertId()
 	return Inserted_id, nil
 }
@@ -167,10 +422,16 @@ func (s *PostgresStore) LoginUser(acc *Login) (*HIPInfo, error) {
 	return &hip, nil
 }
 
-func (s *PostgresStore) ChangePreferance(healthcareId string, preferance map[string]interface{}) error {
+func (s *PostgresStore) ChangePreferance(healthcareId string, preferance map[string]interface{}, events ...*OutboxEvent) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
 	for key, value := range preferance {
 		if key == "email" && value != "" {
-			_, err := s.db.Exec("UPDATE HIP_TABLE set email = $1 WHERE healthcare_id = $2", value, healthcareId)
+			_, err := tx.Exec("UPDATE HIP_TABLE set email = $1 WHERE healthcare_id = $2", value, healthcareId)
 			if err != nil {
 				return err
 			}
@@ -178,7 +439,15 @@ func (s *PostgresStore) ChangePreferance(healthcareId string, preferance map[str
 	}
 	for key, value := range preferance {
 		if key == "scheduled_deletion" && value != "" {
-			_, err := s.db.Exec("UPDATE HealthCare_pref set scheduled_deletion = $1 WHERE healthcare_id = $2", value, healthcareId)
+			_, err := tx.Exec("UPDATE HealthCare_pref set scheduled_deletion = $1 WHERE healthcare_id = $2", value, healthcareId)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for key, value := range preferance {
+		if key == "email_notifications" {
+			_, err := tx.Exec("UPDATE HealthCare_pref set email_notifications = $1 WHERE healthcare_id = $2", value, healthcareId)
 			if err != nil {
 				return err
 			}
@@ -186,13 +455,16 @@ func (s *PostgresStore) ChangePreferance(healthcareId string, preferance map[str
 	}
 	for key, value := range preferance {
 		if key == "isAvailable" && value != "" {
-			_, err := s.db.Exec("UPDATE HealthCare_pref set isAvailable = $1 WHERE healthcare_id = $2", value, healthcareId)
+			_, err := tx.Exec("UPDATE HealthCare_pref set isAvailable = $1 WHERE healthcare_id = $2", value, healthcareId)
 			if err != nil {
 				return err
 			}
 		}
 	}
-	return nil
+	if err := insertOutbox(tx, events); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 func (s *PostgresStore) GetPreferance(healthcareId string) (*Preferance, error) {
@@ -204,7 +476,8 @@ func (s *PostgresStore) GetPreferance(healthcareId string) (*Preferance, error)
 				HealthCare_pref.profile_updated, 
 				HealthCare_pref.profile_viewed, 
 				HealthCare_pref.records_created, 
-				HealthCare_pref.records_viewed 
+				HealthCare_pref.records_viewed, 
+				HealthCare_pref.email_notifications 
 			FROM 
 				HIP_TABLE 
 			INNER JOIN 
@@ -216,7 +489,7 @@ func (s *PostgresStore) GetPreferance(healthcareId string) (*Preferance, error)
 		`
 
 	preferance := &Preferance{}
-	err := s.db.QueryRow(query, healthcareId).Scan(&preferance.Email, &preferance.IsAvailable, &preferance.Scheduled_deletion, &preferance.Profile_updated, &preferance.Profile_viewed, &preferance.Records_created, &preferance.Records_viewed)
+	err := s.db.QueryRow(query, healthcareId).Scan(&preferance.Email, &preferance.IsAvailable, &preferance.Scheduled_deletion, &preferance.Profile_updated, &preferance.Profile_viewed, &preferance.Records_created, &preferance.Records_viewed, &preferance.EmailNotifications)
 	if err != nil {
 		return nil, err
 	}
@@ -250,112 +523,170 @@ func (s *PostgresStore) GetHealthcare_details(healthcare_id string) (*HIPInfo, e
 }
 
 // create client_profile
-func (s *PostgresStore) Create_ClientProfile(client *PatientDetails) error {
+func (s *PostgresStore) Create_ClientProfile(client *PatientDetails, events ...*OutboxEvent) error {
 	query := `INSERT INTO client_profile (
 		health_id, first_name, middle_name, last_name, sex, healthcare_id, 
 		dob, blood_group, bmi, marriage_status, weight, email, 
 		mobile_number, aadhaar_number, primary_location, sibling, twin, 
-		father_name, mother_name, emergency_number, created_at, updated_at, country, city, state, landmark
+		father_name, mother_name, emergency_number, created_at, updated_at, country, city, state, landmark,
+		aadhaar_bidx, mobile_bidx
 	) VALUES (
 		$1, $2, $3, $4, $5, $6, 
 		$7, $8, $9, $10, $11, $12, 
 		$13, $14, $15, $16, $17, 
-		$18, $19, $20, $21, $22, $23, $24, $25, $26
+		$18, $19, $20, $21, $22, $23, $24, $25, $26,
+		$27, $28
 	);`
 
-	_, err := s.db.Exec(query, client.HealthID, client.FirstName, client.MiddleName, client.LastName, client.Sex,
-		client.HealthcareID, client.DOB, client.BloodGroup, client.BMI,
-		client.MarriageStatus, client.Weight, client.Email, client.MobileNumber,
-		client.AadhaarNumber, client.PrimaryLocation, client.Sibling, client.Twin,
-		client.FatherName, client.MotherName, client.EmergencyNumber, client.CreatedAt, client.UpdatedAt,
-		client.Address.Country, client.Address.City, client.Address.State, client.Address.Landmark)
-	if err != nil {
+	// the caller keeps its plaintext copy
+	stored := *client
+	if err := s.encryptProfile(&stored); err != nil {
 		return err
 	}
 
-	return nil
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(query, stored.HealthID, stored.FirstName, stored.MiddleName, stored.LastName, stored.Sex,
+		stored.HealthcareID, stored.DOB, stored.BloodGroup, stored.BMI,
+		stored.MarriageStatus, stored.Weight, stored.Email, stored.MobileNumber,
+		stored.AadhaarNumber, stored.PrimaryLocation, stored.Sibling, stored.Twin,
+		stored.FatherName, stored.MotherName, stored.EmergencyNumber, stored.CreatedAt, stored.UpdatedAt,
+		stored.Address.Country, stored.Address.City, stored.Address.State, stored.Address.Landmark,
+		s.fields.blindIndex("aadhaar_number", client.AadhaarNumber), s.fields.blindIndex("mobile_number", client.MobileNumber))
+	if err != nil {
+		return err
+	}
+	if err := insertOutbox(tx, events); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
-func (s *PostgresStore) Get_ClientProfile(health_id string) (*PatientDetails, error) {
-	query := `SELECT health_id, first_name, middle_name, last_name, sex, healthcare_id, 
+const clientProfileColumns = `id, health_id, first_name, middle_name, last_name, sex, healthcare_id, 
 	dob, blood_group, bmi, marriage_status, weight, email, 
 	mobile_number, aadhaar_number, primary_location, sibling, twin, 
-	father_name, mother_name, emergency_number, created_at, updated_at, country, city, state, landmark
-	FROM client_profile
-	WHERE health_id = $1;`
-
-	row := s.db.QueryRow(query, health_id)
+	father_name, mother_name, emergency_number, created_at, updated_at, country, city, state, landmark`
 
+func scanClientProfile(row rowScanner) (*PatientDetails, error) {
 	var client PatientDetails
 	err := row.Scan(
-		&client.HealthID, &client.FirstName, &client.MiddleName, &client.LastName, &client.Sex, &client.HealthcareID,
+		&client.ID, &client.HealthID, &client.FirstName, &client.MiddleName, &client.LastName, &client.Sex, &client.HealthcareID,
 		&client.DOB, &client.BloodGroup, &client.BMI, &client.MarriageStatus, &client.Weight, &client.Email,
 		&client.MobileNumber, &client.AadhaarNumber, &client.PrimaryLocation, &client.Sibling, &client.Twin,
 		&client.FatherName, &client.MotherName, &client.EmergencyNumber, &client.CreatedAt, &client.UpdatedAt,
 		&client.Address.Country, &client.Address.City, &client.Address.State, &client.Address.Landmark,
 	)
-
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("no client found with health ID: %s", health_id)
-		}
 		return nil, err
 	}
 	return &client, nil
 }
 
-func (s *PostgresStore) UpdateClientProfile(healthID string, updates map[string]interface{}) (*PatientDetails, error) {
-	setClause := []string{}
-	values := []interface{}{}
-	counter := 1
-
-	// Iterate over the updates map to prepare the SET clause
-	for key, value := range updates {
-		if value != "" && value != "N/A" && key != "healthcare_id" && key != "health_id" {
-			setClause = append(setClause, fmt.Sprintf("%s = $%d", key, counter))
-			values = append(values, value)
-			counter++
+func (s *PostgresStore) Get_ClientProfile(health_id string) (*PatientDetails, error) {
+	row := s.db.QueryRow(`SELECT `+clientProfileColumns+` FROM client_profile WHERE health_id = $1;`, health_id)
+	client, err := scanClientProfile(row)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("%w with health ID: %s", ErrClientNotFound, health_id)
 		}
+		return nil, err
 	}
+	if err := s.decryptProfile(client); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
 
-	// If no valid fields to update, return an error
-	if len(setClause) == 0 {
+// UpdateClientProfile writes the columns a patch changed and records them as a new
+// version, see ApplyProfilePatch. Column names come from profilePatchFields only.
+func (s *PostgresStore) UpdateClientProfile(healthID, actor string, patch *ProfilePatch, events ...*OutboxEvent) (*PatientDetails, error) {
+	if len(patch.Columns) == 0 {
 		return nil, fmt.Errorf("no valid fields to update")
 	}
+	if s.fields == nil {
+		return nil, ErrFieldKeysMissing
+	}
 
-	// Append the updated_at field to always update the timestamp
-	setClause = append(setClause, fmt.Sprintf("updated_at = NOW()"))
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
 
-	// Add the health_id as the last parameter for the WHERE clause
-	values = append(values, healthID)
+	stored, err := lockClientProfile(tx, healthID)
+	if err != nil {
+		return nil, err
+	}
+	changes := []profileChange{}
+	indexes := map[string]string{}
+	for _, column := range patch.Columns {
+		field, ok := profileFieldByColumn(column)
+		if !ok {
+			return nil, fmt.Errorf("column %q can not be patched", column)
+		}
+		value, old := *field.value(patch.Profile), *field.value(stored)
+		if isEncryptedColumn(column) {
+			if _, ok := blindIndexColumns[column]; ok {
+				indexes[column] = s.fields.blindIndex(column, value)
+			}
+			if value, err = s.fields.encrypt(column, healthID, value); err != nil {
+				return nil, err
+			}
+			// the version row keeps the old value, it mustn't be plaintext there
+			if old, err = s.fields.encryptStored(column, healthID, old); err != nil {
+				return nil, err
+			}
+		}
+		changes = append(changes, profileChange{Column: column, Old: old, New: value})
+	}
 
-	// Construct the final SQL query
-	query := fmt.Sprintf(`
-		UPDATE client_profile
-		SET %s
-		WHERE health_id = $%d
-		RETURNING *;
-	`, strings.Join(setClause, ", "), counter)
+	updatedClient, _, err := writeProfileChanges(tx, healthID, actor, nil, changes, indexes)
+	if err != nil {
+		return nil, err
+	}
+	if err := insertOutbox(tx, events); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	if err := s.decryptProfile(updatedClient); err != nil {
+		return nil, err
+	}
+	return updatedClient, nil
+}
 
-	// Execute the update query
-	row := s.db.QueryRow(query, values...)
-	var updatedClient PatientDetails
-	err := row.Scan(
-		&updatedClient.ID, &updatedClient.HealthID, &updatedClient.FirstName, &updatedClient.MiddleName,
-		&updatedClient.LastName, &updatedClient.Sex, &updatedClient.HealthcareID, &updatedClient.DOB,
-		&updatedClient.BloodGroup, &updatedClient.BMI, &updatedClient.MarriageStatus, &updatedClient.Weight,
-		&updatedClient.Email, &updatedClient.MobileNumber, &updatedClient.AadhaarNumber, &updatedClient.PrimaryLocation,
-		&updatedClient.Sibling, &updatedClient.Twin, &updatedClient.FatherName, &updatedClient.MotherName,
-		&updatedClient.EmergencyNumber, &updatedClient.CreatedAt, &updatedClient.UpdatedAt, &updatedClient.Address.Country,
-		&updatedClient.Address.City, &updatedClient.Address.State, &updatedClient.Address.Landmark)
+func (s *PostgresStore) UpdatePassword(healthcare_id, passwordHash string) error {
+	result, err := s.db.Exec("UPDATE HIP_TABLE SET password = $1 WHERE healthcare_id = $2", passwordHash, healthcare_id)
+	if err != nil {
+		return fmt.Errorf("failed to update password: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return fmt.Errorf("no healthcare provider found with ID: %s", healthcare_id)
+	}
+	return nil
+}
 
+// account_locked is stored as 'true'/'false' like the other preference flags
+func (s *PostgresStore) SetAccountLocked(healthcare_id string, locked bool) error {
+	_, err := s.db.Exec("UPDATE HealthCare_pref SET account_locked = $1 WHERE healthcare_id = $2", fmt.Sprint(locked), healthcare_id)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("no client profile found with health_id %s", healthID)
-		}
-		return nil, err
+		return fmt.Errorf("failed to update account_locked: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresStore) IsAccountLocked(healthcare_id string) (bool, error) {
+	var locked string
+	err := s.db.QueryRow("SELECT account_locked FROM HealthCare_pref WHERE healthcare_id = $1", healthcare_id).Scan(&locked)
+	if err != nil {
+		return false, fmt.Errorf("failed to retrieve account_locked: %w", err)
 	}
-	return &updatedClient, nil
+	return locked == "true", nil
 }
 
 // Get totalRequest from database
@@ -385,56 +716,174 @@ func (s *PostgresStore) CreateClient_stats(health_id string) error {
 	return nil
 }
 
-// get and set appointments for user
-func (s *PostgresStore) GetAppointments(healthcare_id string, offset, limit int64) ([]*Appointments, error) {
-	query := `SELECT id, health_id, status, appointment_date, appointment_time, healthcare_id, department, note, fullname, healthcare_name 
-              FROM appointments WHERE healthcare_id = $1 `
+// GetAppointments returns one page of appointments plus the number of rows matching the
+// filter, the page is fetched with keyset pagination so deep pages stay cheap
+func (s *PostgresStore) GetAppointments(healthcare_id string, filter *AppointmentFilter) ([]*Appointments, int64, error) {
+	where := []string{"healthcare_id = $1"}
+	args := []interface{}{healthcare_id}
+	add := func(clause string, value interface{}) {
+		args = append(args, value)
+		where = append(where, fmt.Sprintf(clause, len(args)))
+	}
+	if filter.Status != "" {
+		add("status = $%d", filter.Status)
+	}
+	if filter.Department != "" {
+		add("department = $%d", filter.Department)
+	}
+	if filter.HealthID != "" {
+		add("health_id = $%d", filter.HealthID)
+	}
+	if filter.From != "" {
+		add("appointment_date >= $%d", filter.From)
+	}
+	if filter.To != "" {
+		add("appointment_date <= $%d", filter.To)
+	}
+
+	var total int64
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM appointments WHERE `+strings.Join(where, " AND "), args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("failed to count appointments: %w", err)
+	}
+
+	keys := []string{"appointment_date", "id"}
+	if filter.SortBy == "time" {
+		keys = []string{"appointment_date", "appointment_time", "id"}
+	}
+	direction, compare := "ASC", ">"
+	if filter.Descending {
+		direction, compare = "DESC", "<"
+	}
+	if filter.After != nil {
+		values := []interface{}{filter.After.Date}
+		if filter.SortBy == "time" {
+			values = append(values, filter.After.Time)
+		}
+		values = append(values, filter.After.ID)
+		placeholders := make([]string, len(values))
+		for i, value := range values {
+			args = append(args, value)
+			placeholders[i] = fmt.Sprintf("$%d", len(args))
+		}
+		where = append(where, fmt.Sprintf("(%s) %s (%s)", strings.Join(keys, ", "), compare, strings.Join(placeholders, ", ")))
+	}
+	order := make([]string, len(keys))
+	for i, key := range keys {
+		order[i] = key + " " + direction
+	}
+	args = append(args, filter.Limit)
+	query := fmt.Sprintf(`SELECT %s FROM appointments WHERE %s ORDER BY %s LIMIT $%d`,
+		appointmentColumns, strings.Join(where, " AND "), strings.Join(order, ", "), len(args))
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	appointments := []*Appointments{}
+	for rows.Next() {
+		appointment, err := scanAppointment(rows)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to scan row: %w", err)
+		}
+		appointments = append(appointments, appointment)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	return appointments, total, nil
+}
+
+// Staff accounts
+func (s *PostgresStore) CreateStaff(staff *Staff) error {
+	query := `INSERT INTO hip_staff (staff_id, healthcare_id, name, email, role, password, created_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	_, err := s.db.Exec(query, staff.StaffID, staff.HealthcareID, staff.Name, staff.Email, staff.Role, staff.Password, staff.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to create staff: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresStore) GetStaff(staffID string) (*Staff, error) {
+	query := `SELECT staff_id, healthcare_id, name, email, role, password, locked, created_at
+	FROM hip_staff WHERE staff_id = $1`
+	var staff Staff
+	err := s.db.QueryRow(query, staffID).Scan(&staff.StaffID, &staff.HealthcareID, &staff.Name, &staff.Email, &staff.Role, &staff.Password, &staff.Locked, &staff.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("no staff found with ID: %s", staffID)
+		}
+		return nil, err
+	}
+	return &staff, nil
+}
+
+func (s *PostgresStore) ListStaff(healthcare_id string) ([]*Staff, error) {
+	query := `SELECT staff_id, healthcare_id, name, email, role, locked, created_at
+	FROM hip_staff WHERE healthcare_id = $1 ORDER BY created_at`
 	rows, err := s.db.Query(query, healthcare_id)
 	if err != nil {
 		return nil, fmt.Errorf("failed to execute query: %w", err)
 	}
 	defer rows.Close()
 
-	var appointments []*Appointments
+	staff := []*Staff{}
 	for rows.Next() {
-		var appointment Appointments
-		err := rows.Scan(
-			&appointment.ID,
-			&appointment.HealthID,
-			&appointment.Status,
-			&appointment.AppointmentDate,
-			&appointment.AppointmentTime,
-			&appointment.HealthcareID,
-			&appointment.Department,
-			&appointment.Note,
-			&appointment.FullName,
-			&appointment.HealthcareName,
-		)
-		if err != nil {
+		var member Staff
+		if err := rows.Scan(&member.StaffID, &member.HealthcareID, &member.Name, &member.Email, &member.Role, &member.Locked, &member.CreatedAt); err != nil {
 			return nil, fmt.Errorf("failed to scan row: %w", err)
 		}
-		appointments = append(appointments, &appointment)
+		staff = append(staff, &member)
 	}
+	return staff, rows.Err()
+}
 
-	if err = rows.Err(); err != nil {
-		return nil, fmt.Errorf("error iterating rows: %w", err)
+func (s *PostgresStore) UpdateStaffRole(healthcare_id, staffID, role string) error {
+	result, err := s.db.Exec(`UPDATE hip_staff SET role = $1 WHERE staff_id = $2 AND healthcare_id = $3`, role, staffID, healthcare_id)
+	if err != nil {
+		return fmt.Errorf("failed to update staff role: %w", err)
 	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return fmt.Errorf("no staff found with ID: %s", staffID)
+	}
+	return nil
+}
 
-	return appointments, nil
+func (s *PostgresStore) SetStaffLocked(staffID string, locked bool) error {
+	result, err := s.db.Exec(`UPDATE hip_staff SET locked = $1 WHERE staff_id = $2`, locked, staffID)
+	if err != nil {
+		return fmt.Errorf("failed to update staff lock: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return fmt.Errorf("no staff found with ID: %s", staffID)
+	}
+	return nil
 }
 
-// Update appointment Status
-func (s *PostgresStore) SetAppointments(healthcare_id, healthID, status string, id int64) (int64, error) {
-	query := `UPDATE appointments SET status = $1 WHERE health_id = $2 AND healthcare_id = $3`
-	result, err := s.db.Exec(query, status, healthcare_id, healthID)
+func (s *PostgresStore) UpdateStaffPassword(staffID, passwordHash string) error {
+	result, err := s.db.Exec(`UPDATE hip_staff SET password = $1 WHERE staff_id = $2`, passwordHash, staffID)
 	if err != nil {
-		return 0, fmt.Errorf("failed to update appointments: %w", err)
+		return fmt.Errorf("failed to update staff password: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return fmt.Errorf("no staff found with ID: %s", staffID)
 	}
-	rowsAffected, err := result.RowsAffected()
+	return nil
+}
+
+func (s *PostgresStore) DeleteStaff(healthcare_id, staffID string) error {
+	result, err := s.db.Exec(`DELETE FROM hip_staff WHERE staff_id = $1 AND healthcare_id = $2`, staffID, healthcare_id)
 	if err != nil {
-		return 0, fmt.Errorf("failed to fetch rows affected: %w", err)
+		return fmt.Errorf("failed to delete staff: %w", err)
 	}
-	return rowsAffected, nil
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return fmt.Errorf("no staff found with ID: %s", staffID)
+	}
+	return nil
 }
 
 // Utility Functions
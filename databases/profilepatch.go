@@ -0,0 +1,221 @@
+package databases
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// ErrMalformedPatch is a patch body that isn't a JSON object
+var ErrMalformedPatch = errors.New("patch must be a JSON object")
+
+// FieldError is one field a patch could not be applied to, Field is the JSON
+// name of the field, address fields are written as address.city
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// FieldErrors are returned when a patch is rejected, every bad field is listed
+type FieldErrors []FieldError
+
+func (e FieldErrors) Error() string {
+	fields := make([]string, 0, len(e))
+	for _, field := range e {
+		fields = append(fields, field.Field+" "+field.Message)
+	}
+	return "invalid profile patch: " + strings.Join(fields, "; ")
+}
+
+// profileField is a profile field a patch may change. json is its name in the
+// API, path its Go name as the validator reports it.
+type profileField struct {
+	json   string
+	column string
+	path   string
+	value  func(*PatientDetails) *string
+}
+
+// profilePatchFields are the only columns a patch can reach, the SET clause of an
+// update is built from this list and never from the request
+var profilePatchFields = []profileField{
+	{"fname", "first_name", "FirstName", func(p *PatientDetails) *string { return &p.FirstName }},
+	{"middlename", "middle_name", "MiddleName", func(p *PatientDetails) *string { return &p.MiddleName }},
+	{"lname", "last_name", "LastName", func(p *PatientDetails) *string { return &p.LastName }},
+	{"sex", "sex", "Sex", func(p *PatientDetails) *string { return &p.Sex }},
+	{"dob", "dob", "DOB", func(p *PatientDetails) *string { return &p.DOB }},
+	{"bloodgrp", "blood_group", "BloodGroup", func(p *PatientDetails) *string { return &p.BloodGroup }},
+	{"bmi", "bmi", "BMI", func(p *PatientDetails) *string { return &p.BMI }},
+	{"marriage_status", "marriage_status", "MarriageStatus", func(p *PatientDetails) *string { return &p.MarriageStatus }},
+	{"weight", "weight", "Weight", func(p *PatientDetails) *string { return &p.Weight }},
+	{"email", "email", "Email", func(p *PatientDetails) *string { return &p.Email }},
+	{"mobilenumber", "mobile_number", "MobileNumber", func(p *PatientDetails) *string { return &p.MobileNumber }},
+	{"aadhar_number", "aadhaar_number", "AadhaarNumber", func(p *PatientDetails) *string { return &p.AadhaarNumber }},
+	{"primary_location", "primary_location", "PrimaryLocation", func(p *PatientDetails) *string { return &p.PrimaryLocation }},
+	{"sibling", "sibling", "Sibling", func(p *PatientDetails) *string { return &p.Sibling }},
+	{"twin", "twin", "Twin", func(p *PatientDetails) *string { return &p.Twin }},
+	{"fathername", "father_name", "FatherName", func(p *PatientDetails) *string { return &p.FatherName }},
+	{"mothername", "mother_name", "MotherName", func(p *PatientDetails) *string { return &p.MotherName }},
+	{"emergencynumber", "emergency_number", "EmergencyNumber", func(p *PatientDetails) *string { return &p.EmergencyNumber }},
+	{"address.country", "country", "Address.Country", func(p *PatientDetails) *string { return &p.Address.Country }},
+	{"address.state", "state", "Address.State", func(p *PatientDetails) *string { return &p.Address.State }},
+	{"address.city", "city", "Address.City", func(p *PatientDetails) *string { return &p.Address.City }},
+	{"address.landmark", "landmark", "Address.Landmark", func(p *PatientDetails) *string { return &p.Address.Landmark }},
+}
+
+// fields of the profile that are set by the server
+var readOnlyProfileFields = map[string]bool{
+	"health_id": true, "healthcare_id": true, "created_at": true, "updated_at": true,
+}
+
+func profileFieldByJSON(name string) (profileField, bool) {
+	for _, field := range profilePatchFields {
+		if field.json == name {
+			return field, true
+		}
+	}
+	return profileField{}, false
+}
+
+func profileFieldByColumn(column string) (profileField, bool) {
+	for _, field := range profilePatchFields {
+		if field.column == column {
+			return field, true
+		}
+	}
+	return profileField{}, false
+}
+
+// profileValidator checks profiles the same way on create and update
+func profileValidator() *validator.Validate {
+	validate := validator.New()
+	validate.RegisterValidation("phone", validatePhoneNumber)
+	validate.RegisterValidation("aadhaar", validateAadhaar)
+	return validate
+}
+
+// ProfilePatch is a patch applied to a profile and validated, Profile is the whole
+// profile after the patch and Columns the columns whose value changed
+type ProfilePatch struct {
+	Profile *PatientDetails
+	Columns []string
+}
+
+// ApplyProfilePatch applies a JSON Merge Patch (RFC 7396) to a copy of current.
+// A string replaces the field and null clears it, address is patched field by
+// field. Unknown and read-only fields are rejected and the patched fields have to
+// pass the validation of a new profile. Every problem comes back in FieldErrors.
+func ApplyProfilePatch(current *PatientDetails, patch []byte) (*ProfilePatch, error) {
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(patch, &members); err != nil || members == nil {
+		return nil, ErrMalformedPatch
+	}
+
+	patched := *current
+	var fieldErrors FieldErrors
+	changed := map[string]bool{}
+	var apply func(prefix string, members map[string]json.RawMessage)
+	apply = func(prefix string, members map[string]json.RawMessage) {
+		for name, raw := range members {
+			name = prefix + name
+			if name == "address" {
+				var address map[string]json.RawMessage
+				if bytes.Equal(bytes.TrimSpace(raw), []byte("null")) {
+					// removing the address clears each of its fields
+					address = map[string]json.RawMessage{}
+					for _, field := range profilePatchFields {
+						if after, ok := strings.CutPrefix(field.json, "address."); ok {
+							address[after] = raw
+						}
+					}
+				} else if err := json.Unmarshal(raw, &address); err != nil {
+					fieldErrors = append(fieldErrors, FieldError{Field: name, Rule: "type", Message: "must be an object or null"})
+					continue
+				}
+				apply("address.", address)
+				continue
+			}
+
+			field, ok := profileFieldByJSON(name)
+			if !ok {
+				if readOnlyProfileFields[name] {
+					fieldErrors = append(fieldErrors, FieldError{Field: name, Rule: "readonly", Message: "can not be changed"})
+				} else {
+					fieldErrors = append(fieldErrors, FieldError{Field: name, Rule: "unknown", Message: "is not a profile field"})
+				}
+				continue
+			}
+			var value *string
+			if err := json.Unmarshal(raw, &value); err != nil {
+				fieldErrors = append(fieldErrors, FieldError{Field: name, Rule: "type", Message: "must be a string or null"})
+				continue
+			}
+			next := ""
+			if value != nil {
+				next = strings.TrimSpace(*value)
+			}
+			if target := field.value(&patched); *target != next {
+				*target = next
+				changed[field.column] = true
+			}
+		}
+	}
+	apply("", members)
+
+	// only the fields the patch touched are validated, a profile created before a
+	// rule was tightened can still be patched elsewhere
+	if err := profileValidator().Struct(&patched); err != nil {
+		var validationErrors validator.ValidationErrors
+		if !errors.As(err, &validationErrors) {
+			return nil, fmt.Errorf("validation error: %v", err)
+		}
+		for _, validationError := range validationErrors {
+			path := strings.TrimPrefix(validationError.StructNamespace(), "PatientDetails.")
+			for _, field := range profilePatchFields {
+				if field.path == path && changed[field.column] {
+					fieldErrors = append(fieldErrors, FieldError{
+						Field:   field.json,
+						Rule:    validationError.Tag(),
+						Message: ruleMessage(validationError),
+					})
+				}
+			}
+		}
+	}
+	if len(fieldErrors) > 0 {
+		sort.SliceStable(fieldErrors, func(i, j int) bool { return fieldErrors[i].Field < fieldErrors[j].Field })
+		return nil, fieldErrors
+	}
+
+	result := &ProfilePatch{Profile: &patched}
+	for _, field := range profilePatchFields {
+		if changed[field.column] {
+			result.Columns = append(result.Columns, field.column)
+		}
+	}
+	return result, nil
+}
+
+func ruleMessage(err validator.FieldError) string {
+	switch err.Tag() {
+	case "required":
+		return "is required"
+	case "min":
+		return "must be at least " + err.Param() + " characters"
+	case "max":
+		return "must be at most " + err.Param() + " characters"
+	case "email":
+		return "must be a valid email address"
+	case "phone":
+		return "must be a 10 digit phone number"
+	case "aadhaar":
+		return "must be a 12 digit Aadhaar number"
+	}
+	return "failed the " + err.Tag() + " rule"
+}
@@ -0,0 +1,85 @@
+package databases
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func patchTarget() *PatientDetails {
+	return &PatientDetails{
+		HealthID: "HID0123456789", FirstName: "Asha", MiddleName: "Kumari", LastName: "Rao", Sex: "F",
+		HealthcareID: "hip-00001", DOB: "1990-04-12", BloodGroup: "O+", BMI: "22", MarriageStatus: "Single",
+		Weight: "55", Email: "asha@example.com", MobileNumber: "9876543210", AadhaarNumber: "123456789012",
+		PrimaryLocation: "Pune", Sibling: "1", Twin: "No", FatherName: "Ravi Rao", MotherName: "Meera Rao",
+		EmergencyNumber: "9876500000",
+		Address:         Address{Country: "India", State: "MH", City: "Pune", Landmark: "Near the station"},
+	}
+}
+
+func TestApplyProfilePatch(t *testing.T) {
+	current := patchTarget()
+	patch, err := ApplyProfilePatch(current, []byte(`{"fname": " Asha ", "lname": "Deshpande", "mobilenumber": "9123456780", "address": {"city": "Mumbai"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"last_name", "mobile_number", "city"}; !reflect.DeepEqual(patch.Columns, want) {
+		t.Fatalf("columns %v, want %v", patch.Columns, want)
+	}
+	if patch.Profile.LastName != "Deshpande" || patch.Profile.Address.City != "Mumbai" || patch.Profile.Address.State != "MH" {
+		t.Fatalf("patched profile %+v", patch.Profile)
+	}
+	if current.LastName != "Rao" {
+		t.Fatal("the patch changed the current profile")
+	}
+
+	patch, err = ApplyProfilePatch(current, []byte(`{}`))
+	if err != nil || len(patch.Columns) != 0 {
+		t.Fatalf("empty patch: %v %v", patch, err)
+	}
+
+	// the middle name is optional, null clears it
+	patch, err = ApplyProfilePatch(current, []byte(`{"middlename": null}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(patch.Columns, []string{"middle_name"}) || patch.Profile.MiddleName != "" {
+		t.Fatalf("clearing middlename: columns %v, middlename %q", patch.Columns, patch.Profile.MiddleName)
+	}
+}
+
+func TestApplyProfilePatchRejects(t *testing.T) {
+	_, err := ApplyProfilePatch(patchTarget(), []byte(`{"health_id": "HIDother", "first_name = 'x'; --": "x",
+		"email": "not-an-email", "weight": 55, "middlename": "Al", "address": null}`))
+	var fieldErrors FieldErrors
+	if !errors.As(err, &fieldErrors) {
+		t.Fatalf("got %v, want FieldErrors", err)
+	}
+	got := map[string]string{}
+	for _, fieldError := range fieldErrors {
+		got[fieldError.Field] = fieldError.Rule
+	}
+	want := map[string]string{
+		"health_id": "readonly", "first_name = 'x'; --": "unknown", "email": "email", "weight": "type",
+		"middlename": "min", "address.country": "required", "address.state": "required",
+		"address.city": "required", "address.landmark": "required",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("field errors %v, want %v", got, want)
+	}
+
+	for _, body := range []string{`[]`, `"fname"`, `null`, `{"fname":`} {
+		if _, err := ApplyProfilePatch(patchTarget(), []byte(body)); !errors.Is(err, ErrMalformedPatch) {
+			t.Fatalf("%s: got %v, want ErrMalformedPatch", body, err)
+		}
+	}
+}
+
+func TestApplyProfilePatchKeepsLegacyFields(t *testing.T) {
+	// a profile stored before the rules existed can still be patched elsewhere
+	current := patchTarget()
+	current.MiddleName = ""
+	if _, err := ApplyProfilePatch(current, []byte(`{"bloodgrp": "A+"}`)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,303 @@
+package databases
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var ErrVersionNotFound = errors.New("profile version not found")
+
+const maxProfileVersions = 200
+
+// profileChange is a column of a version as stored, Old and New of an encrypted
+// column are ciphertexts
+type profileChange struct {
+	Column string `json:"column"`
+	Old    string `json:"old"`
+	New    string `json:"new"`
+}
+
+// undoChanges puts the columns of changes back to their old value
+func undoChanges(profile *PatientDetails, changes []profileChange) error {
+	for _, change := range changes {
+		field, ok := profileFieldByColumn(change.Column)
+		if !ok {
+			return fmt.Errorf("profile version changed unknown column %q", change.Column)
+		}
+		*field.value(profile) = change.Old
+	}
+	return nil
+}
+
+// lockClientProfile reads the profile as stored and locks it until tx ends, which
+// also serializes the version numbers of the patient
+func lockClientProfile(tx *sql.Tx, healthID string) (*PatientDetails, error) {
+	stored, err := scanClientProfile(tx.QueryRow(`SELECT `+clientProfileColumns+` FROM client_profile WHERE health_id = $1 FOR UPDATE`, healthID))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w with health ID: %s", ErrClientNotFound, healthID)
+	}
+	return stored, err
+}
+
+// writeProfileChanges updates the locked profile and records the changes as its
+// next version. indexes holds the new blind index of the identifiers that changed.
+func writeProfileChanges(tx *sql.Tx, healthID, actor string, revertedTo *int, changes []profileChange, indexes map[string]string) (*PatientDetails, int, error) {
+	setClause := []string{}
+	values := []interface{}{}
+	set := func(column string, value interface{}) {
+		values = append(values, value)
+		setClause = append(setClause, fmt.Sprintf("%s = $%d", column, len(values)))
+	}
+	for _, change := range changes {
+		if _, ok := profileFieldByColumn(change.Column); !ok {
+			return nil, 0, fmt.Errorf("column %q can not be patched", change.Column)
+		}
+		set(change.Column, change.New)
+		if index, ok := indexes[change.Column]; ok {
+			set(blindIndexColumns[change.Column], index)
+		}
+	}
+	setClause = append(setClause, "updated_at = NOW()")
+	values = append(values, healthID)
+
+	updated, err := scanClientProfile(tx.QueryRow(fmt.Sprintf(`UPDATE client_profile SET %s WHERE health_id = $%d RETURNING %s`,
+		strings.Join(setClause, ", "), len(values), clientProfileColumns), values...))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	encoded, err := json.Marshal(changes)
+	if err != nil {
+		return nil, 0, err
+	}
+	var version int
+	err = tx.QueryRow(`INSERT INTO client_profile_versions (health_id, version, changed_by, reverted_to, changes, created_at)
+	SELECT $1, COALESCE(MAX(version), 0) + 1, $2, $3, $4, $5 FROM client_profile_versions WHERE health_id = $1
+	RETURNING version`, healthID, actor, revertedTo, encoded, time.Now().UTC()).Scan(&version)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to record profile version: %w", err)
+	}
+	return updated, version, nil
+}
+
+// querier is a *sql.DB or a *sql.Tx
+type querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// storedChanges returns the changes of the patient's versions matching where, newest
+// first. Versions of a merged patient changed another profile and are left out.
+func storedChanges(q querier, healthID, where string, arg interface{}) ([][]profileChange, error) {
+	rows, err := q.Query(`SELECT changes FROM client_profile_versions WHERE health_id = $1 AND merged_from IS NULL AND `+where+`
+	ORDER BY version DESC`, healthID, arg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	versions := [][]profileChange{}
+	for rows.Next() {
+		var encoded []byte
+		var changes []profileChange
+		if err := rows.Scan(&encoded); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		if err := json.Unmarshal(encoded, &changes); err != nil {
+			return nil, err
+		}
+		versions = append(versions, changes)
+	}
+	return versions, rows.Err()
+}
+
+// ListProfileVersions returns the latest versions of a profile newest first, with
+// the encrypted values decrypted
+func (s *PostgresStore) ListProfileVersions(healthID string) ([]*ProfileVersion, error) {
+	if s.fields == nil {
+		return nil, ErrFieldKeysMissing
+	}
+	rows, err := s.db.Query(`SELECT version, health_id, COALESCE(merged_from, ''), changed_by, reverted_to, changes, created_at
+	FROM client_profile_versions WHERE health_id = $1 ORDER BY version DESC LIMIT $2`, healthID, maxProfileVersions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	versions := []*ProfileVersion{}
+	for rows.Next() {
+		var version ProfileVersion
+		var revertedTo sql.NullInt64
+		var encoded []byte
+		if err := rows.Scan(&version.Version, &version.HealthID, &version.MergedFrom, &version.ChangedBy, &revertedTo, &encoded, &version.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		if revertedTo.Valid {
+			to := int(revertedTo.Int64)
+			version.RevertedTo = &to
+		}
+		var changes []profileChange
+		if err := json.Unmarshal(encoded, &changes); err != nil {
+			return nil, err
+		}
+		// values are encrypted for the profile they were written to
+		owner := healthID
+		if version.MergedFrom != "" {
+			owner = version.MergedFrom
+		}
+		for _, change := range changes {
+			field, ok := profileFieldByColumn(change.Column)
+			if !ok {
+				return nil, fmt.Errorf("profile version changed unknown column %q", change.Column)
+			}
+			if isEncryptedColumn(change.Column) {
+				if change.Old, err = s.decryptField(change.Column, owner, change.Old); err != nil {
+					return nil, err
+				}
+				if change.New, err = s.decryptField(change.Column, owner, change.New); err != nil {
+					return nil, err
+				}
+			}
+			version.Changes = append(version.Changes, &FieldChange{Field: field.json, Old: change.Old, New: change.New})
+		}
+		versions = append(versions, &version)
+	}
+	return versions, rows.Err()
+}
+
+// ClientProfileAt returns the profile as it was at a point in time by undoing the
+// versions recorded after it. Changes made before versions were recorded are not
+// known, the view only goes back to the first version.
+func (s *PostgresStore) ClientProfileAt(healthID string, at time.Time) (*PatientDetails, error) {
+	if s.fields == nil {
+		return nil, ErrFieldKeysMissing
+	}
+	profile, err := scanClientProfile(s.db.QueryRow(`SELECT `+clientProfileColumns+` FROM client_profile WHERE health_id = $1`, healthID))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w with health ID: %s", ErrClientNotFound, healthID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if at.Before(profile.CreatedAt) {
+		return nil, fmt.Errorf("%w at %s, it was created later", ErrClientNotFound, at.Format(time.RFC3339))
+	}
+
+	at = at.UTC()
+	later, err := storedChanges(s.db, healthID, "created_at > $2", at)
+	if err != nil {
+		return nil, err
+	}
+	for _, changes := range later {
+		if err := undoChanges(profile, changes); err != nil {
+			return nil, err
+		}
+	}
+	if len(later) > 0 {
+		var updatedAt sql.NullTime
+		if err := s.db.QueryRow(`SELECT MAX(created_at) FROM client_profile_versions WHERE health_id = $1 AND merged_from IS NULL
+			AND created_at <= $2`,
+			healthID, at).Scan(&updatedAt); err != nil {
+			return nil, err
+		}
+		profile.UpdatedAt = profile.CreatedAt
+		if updatedAt.Valid {
+			profile.UpdatedAt = updatedAt.Time
+		}
+	}
+	if err := s.decryptProfile(profile); err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+// RevertClientProfile puts the profile back as it was right after version (0 is
+// before the first recorded change). The revert is recorded as a new version, the
+// returned version is 0 when the profile already matched and nothing was written.
+func (s *PostgresStore) RevertClientProfile(healthID string, version int, actor string, events ...*OutboxEvent) (*PatientDetails, int, error) {
+	if s.fields == nil {
+		return nil, 0, ErrFieldKeysMissing
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tx.Rollback()
+
+	current, err := lockClientProfile(tx, healthID)
+	if err != nil {
+		return nil, 0, err
+	}
+	var latest int
+	if err := tx.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM client_profile_versions WHERE health_id = $1`, healthID).Scan(&latest); err != nil {
+		return nil, 0, err
+	}
+	if version < 0 || version > latest {
+		return nil, 0, ErrVersionNotFound
+	}
+
+	later, err := storedChanges(tx, healthID, "version > $2", version)
+	if err != nil {
+		return nil, 0, err
+	}
+	target := *current
+	for _, changes := range later {
+		if err := undoChanges(&target, changes); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	changes := []profileChange{}
+	indexes := map[string]string{}
+	for _, field := range profilePatchFields {
+		from, to := *field.value(current), *field.value(&target)
+		if from == to {
+			continue
+		}
+		if isEncryptedColumn(field.column) {
+			// the same value encrypts differently every time, compare the plaintexts
+			fromPlain, err := s.decryptField(field.column, healthID, from)
+			if err != nil {
+				return nil, 0, err
+			}
+			toPlain, err := s.decryptField(field.column, healthID, to)
+			if err != nil {
+				return nil, 0, err
+			}
+			if fromPlain == toPlain {
+				continue
+			}
+			if _, ok := blindIndexColumns[field.column]; ok {
+				indexes[field.column] = s.fields.blindIndex(field.column, toPlain)
+			}
+			// rows the reencrypt command hasn't reached hold plaintext
+			if from, err = s.fields.encryptStored(field.column, healthID, from); err != nil {
+				return nil, 0, err
+			}
+			if to, err = s.fields.encryptStored(field.column, healthID, to); err != nil {
+				return nil, 0, err
+			}
+		}
+		changes = append(changes, profileChange{Column: field.column, Old: from, New: to})
+	}
+
+	written := 0
+	if len(changes) > 0 {
+		if current, written, err = writeProfileChanges(tx, healthID, actor, &version, changes, indexes); err != nil {
+			return nil, 0, err
+		}
+		if err := insertOutbox(tx, events); err != nil {
+			return nil, 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, 0, err
+	}
+	if err := s.decryptProfile(current); err != nil {
+		return nil, 0, err
+	}
+	return current, written, nil
+}
@@ -0,0 +1,28 @@
+package databases
+
+import "testing"
+
+func TestUndoChanges(t *testing.T) {
+	// newest first: version 3 set the blood group back and moved the patient to
+	// Pune, version 2 undid both, version 1 fixed the blood group
+	profile := patchTarget()
+	profile.BloodGroup = "B+"
+	versions := [][]profileChange{
+		{{Column: "blood_group", Old: "AB+", New: "B+"}, {Column: "city", Old: "Mumbai", New: "Pune"}},
+		{{Column: "blood_group", Old: "B+", New: "AB+"}, {Column: "city", Old: "Pune", New: "Mumbai"}},
+		{{Column: "blood_group", Old: "A+", New: "B+"}},
+	}
+
+	for i, want := range []struct{ bloodGroup, city string }{{"AB+", "Mumbai"}, {"B+", "Pune"}, {"A+", "Pune"}} {
+		if err := undoChanges(profile, versions[i]); err != nil {
+			t.Fatal(err)
+		}
+		if profile.BloodGroup != want.bloodGroup || profile.Address.City != want.city {
+			t.Fatalf("before version %d: %s in %s, want %s in %s", 3-i, profile.BloodGroup, profile.Address.City, want.bloodGroup, want.city)
+		}
+	}
+
+	if err := undoChanges(profile, []profileChange{{Column: "healthcare_id", Old: "hip-2"}}); err == nil {
+		t.Fatal("undoing a column that can't be patched should fail")
+	}
+}
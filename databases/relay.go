@@ -0,0 +1,93 @@
+package databases
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+const (
+	outboxPollInterval = 2 * time.Second
+	outboxPublishWait  = 5 * time.Second
+	maxRelayBackoff    = time.Minute
+	outboxPruneEvery   = time.Hour
+)
+
+// relayBackoff doubles the wait after every failed dispatch in a row (1s, 2s, 4s, ... capped)
+func relayBackoff(failures int) time.Duration {
+	if failures <= 0 {
+		return 0
+	}
+	if failures > 6 {
+		return maxRelayBackoff
+	}
+	backoff := time.Duration(1<<(failures-1)) * time.Second
+	if backoff > maxRelayBackoff {
+		return maxRelayBackoff
+	}
+	return backoff
+}
+
+// wakeRelay asks the relay to run now instead of waiting for the next poll
+func (s *CombinedStore) wakeRelay() {
+	select {
+	case s.outboxWake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *CombinedStore) publishConfirmed(queue string, payload []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), outboxPublishWait)
+	defer cancel()
+	return s.rabbitmq.PublishConfirmed(ctx, queue, payload)
+}
+
+// RunOutboxRelay publishes outbox messages until ctx is done. Every message waits for
+// the broker ack before it is marked sent, failures are retried with backoff.
+// report is called after every round with the current outbox lag. Sent messages
+// are pruned once an hour.
+func (s *CombinedStore) RunOutboxRelay(ctx context.Context, report func(pending, parked int64, oldest time.Duration)) {
+	failures := 0
+	var pruned time.Time
+	for {
+		sent, err := s.postgres.DispatchOutbox(s.publishConfirmed)
+		if err != nil {
+			failures++
+			log.Printf("outbox relay: %d published, retrying in %s: %v", sent, relayBackoff(failures), err)
+		} else {
+			failures = 0
+		}
+		if pending, parked, oldest, err := s.postgres.OutboxLag(); err == nil && report != nil {
+			report(pending, parked, oldest)
+		}
+		if time.Since(pruned) > outboxPruneEvery {
+			if _, err := s.postgres.PruneOutbox(); err != nil {
+				log.Printf("outbox relay: %v", err)
+			}
+			pruned = time.Now()
+		}
+
+		wait := outboxPollInterval
+		switch {
+		case failures > 0:
+			wait = relayBackoff(failures)
+		case sent == outboxBatchSize:
+			// a full batch probably left more behind
+			wait = 0
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.outboxWake:
+			if failures > 0 {
+				// don't let a burst of requests hammer a broker that is down
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(wait):
+				}
+			}
+		case <-time.After(wait):
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package databases
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+	mq "vaibhavyadav-dev/healthcareServer/rabbitmq"
+)
+
+func TestRelayBackoff(t *testing.T) {
+	tests := map[int]time.Duration{
+		0:  0,
+		1:  time.Second,
+		2:  2 * time.Second,
+		4:  8 * time.Second,
+		6:  32 * time.Second,
+		7:  maxRelayBackoff,
+		50: maxRelayBackoff,
+	}
+	for failures, want := range tests {
+		if got := relayBackoff(failures); got != want {
+			t.Errorf("relayBackoff(%d) = %s, want %s", failures, got, want)
+		}
+	}
+}
+
+func TestShouldPark(t *testing.T) {
+	unroutable := fmt.Errorf("%w: logs (NO_ROUTE)", mq.ErrUnroutable)
+	tests := []struct {
+		attempts int
+		err      error
+		want     bool
+	}{
+		{attempts: 1, err: unroutable, want: false},
+		{attempts: maxOutboxAttempts - 1, err: unroutable, want: false},
+		{attempts: maxOutboxAttempts, err: unroutable, want: true},
+		{attempts: maxOutboxAttempts + 5, err: errors.New("no confirmation from broker"), want: true},
+		{attempts: maxOutboxAttempts + 5, err: mq.ErrNotConnected, want: false},
+	}
+	for _, tt := range tests {
+		if got := shouldPark(tt.attempts, tt.err); got != tt.want {
+			t.Errorf("shouldPark(%d, %v) = %v, want %v", tt.attempts, tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package databases
+
+import (
+	"fmt"
+	"strings"
+)
+
+const maxSearchPageSize = 50
+
+// clientName is the indexed full name of the profile aliased as alias, see client_profile_name_trgm
+func clientName(alias string) string {
+	return fmt.Sprintf(`(%[1]s.first_name || ' ' || COALESCE(%[1]s.middle_name, '') || ' ' || %[1]s.last_name)`, alias)
+}
+
+// visibleClient limits the profile aliased as alias to the ones the healthcare
+// in param registered or holds a live profile consent for
+func visibleClient(alias, param string) string {
+	return fmt.Sprintf(`(%[1]s.healthcare_id = %[2]s OR EXISTS (SELECT 1 FROM patient_consents pc WHERE pc.health_id = %[1]s.health_id
+			AND pc.healthcare_id = %[2]s AND pc.scope = 'profile' AND pc.status = 'granted' AND pc.expires_at > NOW()))`, alias, param)
+}
+
+// SearchClients returns one page of the patients matching q that the healthcare
+// registered or holds a profile consent for, best match first. More reports
+// whether another page follows.
+func (s *PostgresStore) SearchClients(q ClientSearch) (results []*ClientSearchResult, more bool, err error) {
+	if q.PageSize <= 0 || q.PageSize > maxSearchPageSize {
+		q.PageSize = maxSearchPageSize
+	}
+	if q.Page < 1 {
+		q.Page = 1
+	}
+	var mobileIndex, aadhaarIndex string
+	if q.MobileNumber != "" || q.AadhaarNumber != "" {
+		if s.fields == nil {
+			return nil, false, ErrFieldKeysMissing
+		}
+		// an identifier that normalizes to nothing must not turn into "no filter"
+		mobileIndex = s.fields.blindIndex("mobile_number", q.MobileNumber)
+		aadhaarIndex = s.fields.blindIndex("aadhaar_number", q.AadhaarNumber)
+		if (q.MobileNumber != "" && mobileIndex == "") || (q.AadhaarNumber != "" && aadhaarIndex == "") {
+			return []*ClientSearchResult{}, false, nil
+		}
+	}
+
+	// word_similarity lets "asha" match "Asha Kumari Rao", <% is the indexed form of it
+	rows, err := s.db.Query(`SELECT c.health_id, c.first_name, COALESCE(c.middle_name, ''), c.last_name, c.sex, c.dob, c.blood_group,
+		CASE WHEN $2 = '' THEN 1 ELSE word_similarity($2, `+clientName("c")+`) END AS score
+	FROM client_profile c
+	WHERE `+visibleClient("c", "$1")+`
+		AND ($2 = '' OR $2 <% `+clientName("c")+`)
+		AND ($3 = '' OR c.dob = $3)
+		AND ($4 = '' OR c.mobile_bidx = $4)
+		AND ($5 = '' OR c.aadhaar_bidx = $5)
+		AND ($6 = '' OR LOWER(c.sex) = LOWER($6))
+		AND ($7 = '' OR UPPER(c.blood_group) = UPPER($7))
+	ORDER BY score DESC, c.id
+	LIMIT $8 OFFSET $9`,
+		q.HealthcareID, strings.TrimSpace(q.Name), strings.TrimSpace(q.DOB), mobileIndex, aadhaarIndex,
+		strings.TrimSpace(q.Sex), strings.TrimSpace(q.BloodGroup), q.PageSize+1, (q.Page-1)*q.PageSize)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	results = []*ClientSearchResult{}
+	for rows.Next() {
+		var result ClientSearchResult
+		if err := rows.Scan(&result.HealthID, &result.FirstName, &result.MiddleName, &result.LastName, &result.Sex,
+			&result.DOB, &result.BloodGroup, &result.Score); err != nil {
+			return nil, false, fmt.Errorf("failed to scan row: %w", err)
+		}
+		results = append(results, &result)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+	if len(results) > q.PageSize {
+		return results[:q.PageSize], true, nil
+	}
+	return results, false, nil
+}
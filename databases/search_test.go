@@ -0,0 +1,24 @@
+package databases
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSearchClientsEmptyIndex(t *testing.T) {
+	// the store has no database, a search that reaches the query panics
+	s := &PostgresStore{fields: newFieldCipher(nil, []byte("index key"))}
+	for _, q := range []ClientSearch{
+		{HealthcareID: "hip-00001", MobileNumber: " - "},
+		{HealthcareID: "hip-00001", Name: "Asha", AadhaarNumber: "()"},
+	} {
+		results, more, err := s.SearchClients(q)
+		if err != nil || more || results == nil || len(results) != 0 {
+			t.Fatalf("%+v: got %v %v %v, want no results", q, results, more, err)
+		}
+	}
+
+	if _, _, err := (&PostgresStore{}).SearchClients(ClientSearch{MobileNumber: "9876543210"}); !errors.Is(err, ErrFieldKeysMissing) {
+		t.Fatalf("searched an identifier without field keys: %v", err)
+	}
+}
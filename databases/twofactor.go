@@ -0,0 +1,181 @@
+package databases
+
+import (
+	"database/sql"
+	"fmt"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// the TOTP secret is encrypted like the profile identifiers, bound to this name
+// and the healthcare id
+const twoFactorSecretColumn = "totp_secret"
+
+// SaveTwoFactorSecret starts (or restarts) an enrollment, the secret only
+// becomes active once a code generated from it has been verified
+func (s *PostgresStore) SaveTwoFactorSecret(healthcare_id, secret string) error {
+	if s.fields == nil {
+		return ErrFieldKeysMissing
+	}
+	secret, err := s.fields.encrypt(twoFactorSecretColumn, healthcare_id, secret)
+	if err != nil {
+		return err
+	}
+	query := `INSERT INTO hip_two_factor (healthcare_id, secret, enabled, enrolled_at)
+	VALUES ($1, $2, FALSE, NOW())
+	ON CONFLICT (healthcare_id) DO UPDATE SET secret = EXCLUDED.secret, enrolled_at = NOW()
+	WHERE hip_two_factor.enabled = FALSE`
+	result, err := s.db.Exec(query, healthcare_id, secret)
+	if err != nil {
+		return fmt.Errorf("failed to save two factor secret: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return fmt.Errorf("two factor authentication is already enabled")
+	}
+	return nil
+}
+
+// GetTwoFactor never fails for accounts that did not enroll, it returns a disabled entry
+func (s *PostgresStore) GetTwoFactor(healthcare_id string) (*TwoFactor, error) {
+	tf := &TwoFactor{HealthcareID: healthcare_id}
+	err := s.db.QueryRow(`SELECT secret, enabled FROM hip_two_factor WHERE healthcare_id = $1`, healthcare_id).Scan(&tf.Secret, &tf.Enabled)
+	if err == sql.ErrNoRows {
+		return tf, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.fields == nil {
+		return nil, ErrFieldKeysMissing
+	}
+	if tf.Secret, err = s.decryptField(twoFactorSecretColumn, healthcare_id, tf.Secret); err != nil {
+		return nil, err
+	}
+	return tf, nil
+}
+
+// ReencryptTwoFactorSecrets rewrites the TOTP secrets stored in plaintext or under
+// an older data key, the reencrypt command runs it next to ReencryptProfiles
+func (s *PostgresStore) ReencryptTwoFactorSecrets() (int, error) {
+	if s.fields == nil {
+		return 0, ErrFieldKeysMissing
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT healthcare_id, secret FROM hip_two_factor FOR UPDATE`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read two factor secrets: %w", err)
+	}
+	stale := map[string]string{}
+	for rows.Next() {
+		var healthcareID, secret string
+		if err := rows.Scan(&healthcareID, &secret); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan row: %w", err)
+		}
+		if s.fields.needsReencryption(secret) {
+			stale[healthcareID] = secret
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for healthcareID, secret := range stale {
+		plaintext, err := s.decryptField(twoFactorSecretColumn, healthcareID, secret)
+		if err != nil {
+			return 0, fmt.Errorf("two factor secret of %s: %w", healthcareID, err)
+		}
+		encrypted, err := s.fields.encrypt(twoFactorSecretColumn, healthcareID, plaintext)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec(`UPDATE hip_two_factor SET secret = $1 WHERE healthcare_id = $2`, encrypted, healthcareID); err != nil {
+			return 0, fmt.Errorf("failed to update two factor secret of %s: %w", healthcareID, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(stale), nil
+}
+
+// EnableTwoFactor switches 2FA on and replaces any previous recovery codes
+func (s *PostgresStore) EnableTwoFactor(healthcare_id string, recoveryCodeHashes []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE hip_two_factor SET enabled = TRUE, enabled_at = NOW() WHERE healthcare_id = $1`, healthcare_id); err != nil {
+		return fmt.Errorf("failed to enable two factor: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM hip_recovery_codes WHERE healthcare_id = $1`, healthcare_id); err != nil {
+		return err
+	}
+	for _, hash := range recoveryCodeHashes {
+		if _, err := tx.Exec(`INSERT INTO hip_recovery_codes (healthcare_id, code_hash) VALUES ($1, $2)`, healthcare_id, hash); err != nil {
+			return fmt.Errorf("failed to store recovery codes: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *PostgresStore) DisableTwoFactor(healthcare_id string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM hip_two_factor WHERE healthcare_id = $1`, healthcare_id); err != nil {
+		return fmt.Errorf("failed to disable two factor: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM hip_recovery_codes WHERE healthcare_id = $1`, healthcare_id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UseRecoveryCode burns the matching unused recovery code, the rows are
+// locked so the same code can't be redeemed twice concurrently
+func (s *PostgresStore) UseRecoveryCode(healthcare_id, code string) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT id, code_hash FROM hip_recovery_codes
+	WHERE healthcare_id = $1 AND used_at IS NULL FOR UPDATE`, healthcare_id)
+	if err != nil {
+		return false, err
+	}
+	matched := int64(0)
+	for rows.Next() {
+		var id int64
+		var hash string
+		if err := rows.Scan(&id, &hash); err != nil {
+			rows.Close()
+			return false, err
+		}
+		if matched == 0 && bcrypt.CompareHashAndPassword([]byte(hash), []byte(code)) == nil {
+			matched = id
+		}
+	}
+	rows.Close()
+	if matched == 0 {
+		return false, nil
+	}
+
+	if _, err := tx.Exec(`UPDATE hip_recovery_codes SET used_at = NOW() WHERE id = $1`, matched); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
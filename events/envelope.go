@@ -0,0 +1,86 @@
+// Package events defines every message the server publishes. Each event is a
+// struct of its own wrapped in a common Envelope, the JSON Schema documents in
+// schemas/ are generated from these structs (go generate ./events).
+package events
+
+//go:generate go run ../cmd/eventschema -out schemas
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Producer names this service in every envelope
+const Producer = "healthcareServer"
+
+// Event is implemented by every event type of this package
+type Event interface {
+	// Type is the name consumers dispatch on, it never changes for an event
+	Type() string
+	// Version is bumped whenever a field is removed or changes its meaning
+	Version() int
+	// Queue is the queue the event is routed to
+	Queue() string
+}
+
+type Envelope struct {
+	EventID       string    `json:"event_id"`
+	Type          string    `json:"type"`
+	SchemaVersion int       `json:"schema_version"`
+	OccurredAt    time.Time `json:"occurred_at"`
+	CorrelationID string    `json:"correlation_id,omitempty"`
+	Producer      string    `json:"producer"`
+}
+
+// Message is a decoded envelope whose data has not been bound to its event yet
+type Message struct {
+	Envelope
+	Data json.RawMessage `json:"data"`
+}
+
+// Encode wraps event in a new envelope, correlationID ties together every event
+// caused by the same request and may be empty
+func Encode(event Event, correlationID string) ([]byte, error) {
+	return json.Marshal(struct {
+		Envelope
+		Data Event `json:"data"`
+	}{
+		Envelope: Envelope{
+			EventID:       uuid.NewString(),
+			Type:          event.Type(),
+			SchemaVersion: event.Version(),
+			// whole seconds in UTC so it is written as plain RFC3339
+			OccurredAt:    time.Now().UTC().Truncate(time.Second),
+			CorrelationID: correlationID,
+			Producer:      Producer,
+		},
+		Data: event,
+	})
+}
+
+// Decode reads the envelope of a message, bind the data with Message.Bind
+func Decode(body []byte) (*Message, error) {
+	var msg Message
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return nil, fmt.Errorf("malformed event: %w", err)
+	}
+	if msg.EventID == "" || msg.Type == "" {
+		return nil, fmt.Errorf("malformed event: missing event_id or type")
+	}
+	return &msg, nil
+}
+
+// Bind decodes the data into event, it fails if the message is of another type
+// or was written with a schema version newer than this build knows
+func (m *Message) Bind(event Event) error {
+	if m.Type != event.Type() {
+		return fmt.Errorf("event %s is of type %s, not %s", m.EventID, m.Type, event.Type())
+	}
+	if m.SchemaVersion > event.Version() {
+		return fmt.Errorf("event %s has schema version %d, only %d is supported", m.EventID, m.SchemaVersion, event.Version())
+	}
+	return json.Unmarshal(m.Data, event)
+}
@@ -0,0 +1,79 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	sent := RecordsViewed{
+		Healthcare: Healthcare{HealthcareID: "hip-1", HealthcareName: "City Hospital"},
+		HealthID:   "patient-1",
+	}
+	body, err := Encode(sent, "req-42")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var raw map[string]interface{}
+	if err := json.Unmarshal(body, &raw); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := time.Parse(time.RFC3339, raw["occurred_at"].(string)); err != nil {
+		t.Fatalf("occurred_at is not RFC3339: %v", raw["occurred_at"])
+	}
+
+	msg, err := Decode(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != "records_viewed" || msg.SchemaVersion != 1 || msg.CorrelationID != "req-42" || msg.Producer != Producer || msg.EventID == "" {
+		t.Fatalf("unexpected envelope %+v", msg.Envelope)
+	}
+	var received RecordsViewed
+	if err := msg.Bind(&received); err != nil {
+		t.Fatal(err)
+	}
+	if received != sent {
+		t.Fatalf("got %+v, want %+v", received, sent)
+	}
+
+	// a message of another type must not be bound
+	if err := msg.Bind(&RecordsCreated{}); err == nil {
+		t.Fatal("bound records_viewed to RecordsCreated")
+	}
+	msg.SchemaVersion = 2
+	if err := msg.Bind(&received); err == nil {
+		t.Fatal("bound a newer schema version")
+	}
+	if _, err := Decode([]byte(`{"data":{}}`)); err == nil {
+		t.Fatal("decoded a message without envelope")
+	}
+}
+
+// the committed schemas must match the events, run go generate ./events after a change
+func TestSchemasUpToDate(t *testing.T) {
+	seen := map[string]bool{}
+	for _, event := range All {
+		if seen[event.Type()] {
+			t.Fatalf("event type %s is used twice", event.Type())
+		}
+		seen[event.Type()] = true
+
+		want, err := MarshalSchema(event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.ReadFile(filepath.Join("schemas", SchemaFile(event)))
+		if err != nil {
+			t.Fatalf("%s: %v, run go generate ./events", event.Type(), err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("schemas/%s is stale, run go generate ./events", SchemaFile(event))
+		}
+	}
+}
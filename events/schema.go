@@ -0,0 +1,99 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// SchemaFile is the file name of the schema document of event
+func SchemaFile(event Event) string {
+	return fmt.Sprintf("%s.v%d.schema.json", event.Type(), event.Version())
+}
+
+// Schema returns the JSON Schema (draft 2020-12) of a whole message carrying event
+func Schema(event Event) map[string]interface{} {
+	return map[string]interface{}{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"title":   reflect.TypeOf(event).Name(),
+		"type":    "object",
+		"properties": map[string]interface{}{
+			"event_id":       map[string]interface{}{"type": "string", "format": "uuid"},
+			"type":           map[string]interface{}{"const": event.Type()},
+			"schema_version": map[string]interface{}{"const": event.Version()},
+			"occurred_at":    map[string]interface{}{"type": "string", "format": "date-time"},
+			"correlation_id": map[string]interface{}{"type": "string"},
+			"producer":       map[string]interface{}{"type": "string"},
+			"data":           typeSchema(reflect.TypeOf(event)),
+		},
+		"required": []string{"event_id", "type", "schema_version", "occurred_at", "producer", "data"},
+	}
+}
+
+// MarshalSchema is Schema as an indented document
+func MarshalSchema(event Event) ([]byte, error) {
+	doc, err := json.MarshalIndent(Schema(event), "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(doc, '\n'), nil
+}
+
+func typeSchema(t reflect.Type) map[string]interface{} {
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem())}
+	case reflect.Ptr:
+		return typeSchema(t.Elem())
+	case reflect.Struct:
+		properties := map[string]interface{}{}
+		required := []string{}
+		addFields(t, properties, &required)
+		return map[string]interface{}{"type": "object", "properties": properties, "required": required}
+	}
+	panic(fmt.Sprintf("events: no schema for %s", t))
+}
+
+// addFields walks the fields like encoding/json does, embedded structs are flattened
+func addFields(t reflect.Type, properties map[string]interface{}, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" || (!field.IsExported() && !field.Anonymous) {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			addFields(field.Type, properties, required)
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		schema := typeSchema(field.Type)
+		if enum := field.Tag.Get("enum"); enum != "" {
+			schema["enum"] = strings.Split(enum, ",")
+		}
+		properties[name] = schema
+		if !strings.Contains(options, "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package events
+
+import "time"
+
+const (
+	logsQueue              = "logs"
+	patientRecordsQueue    = "patient_records"
+	appointmentUpdateQueue = "appointment_update"
+	countersQueue          = "hip:counters"
+)
+
+// Healthcare identifies the healthcare an event happened at
+type Healthcare struct {
+	HealthcareID   string `json:"healthcare_id"`
+	HealthcareName string `json:"healthcare_name"`
+}
+
+// AccountCreated is sent once a healthcare signed up
+type AccountCreated struct {
+	Healthcare
+	Email     string `json:"hip_email"`
+	IPAddress string `json:"hip_ipaddress"`
+}
+
+func (AccountCreated) Type() string  { return "hip_accountCreated" }
+func (AccountCreated) Version() int  { return 1 }
+func (AccountCreated) Queue() string { return logsQueue }
+
+// AccountLogin is sent on every successful login
+type AccountLogin struct {
+	Healthcare
+	Email     string `json:"hip_email"`
+	IPAddress string `json:"hip_ipaddress"`
+}
+
+func (AccountLogin) Type() string  { return "hip_accountLogin" }
+func (AccountLogin) Version() int  { return 1 }
+func (AccountLogin) Queue() string { return logsQueue }
+
+// AccountDeletionScheduled is sent when a healthcare asked to delete its account
+type AccountDeletionScheduled struct {
+	Healthcare
+	Email string `json:"hip_email"`
+}
+
+func (AccountDeletionScheduled) Type() string  { return "hip_deleteAccount" }
+func (AccountDeletionScheduled) Version() int  { return 1 }
+func (AccountDeletionScheduled) Queue() string { return logsQueue }
+
+// AccountLocked is sent when too many failed logins locked the account,
+// UnlockToken is the single use token for the unlock link
+type AccountLocked struct {
+	Healthcare
+	Email       string `json:"hip_email"`
+	UnlockToken string `json:"unlock_token"`
+}
+
+func (AccountLocked) Type() string  { return "hip_request_blocked" }
+func (AccountLocked) Version() int  { return 1 }
+func (AccountLocked) Queue() string { return logsQueue }
+
+// PasswordResetRequested carries the single use token for the reset link
+type PasswordResetRequested struct {
+	Healthcare
+	Email      string `json:"hip_email"`
+	ResetToken string `json:"reset_token"`
+}
+
+func (PasswordResetRequested) Type() string  { return "password_reset" }
+func (PasswordResetRequested) Version() int  { return 1 }
+func (PasswordResetRequested) Queue() string { return logsQueue }
+
+// PatientSignInRequested carries the single use token a patient signs in with
+type PatientSignInRequested struct {
+	HealthID string `json:"health_id"`
+	Email    string `json:"email"`
+	Name     string `json:"name"`
+	Token    string `json:"token"`
+}
+
+func (PatientSignInRequested) Type() string  { return "patient_sign_in" }
+func (PatientSignInRequested) Version() int  { return 1 }
+func (PatientSignInRequested) Queue() string { return logsQueue }
+
+// RecordsCreated tells the patient a healthcare added to their records
+type RecordsCreated struct {
+	Healthcare
+	HealthID string `json:"health_id"`
+}
+
+func (RecordsCreated) Type() string  { return "records_created" }
+func (RecordsCreated) Version() int  { return 1 }
+func (RecordsCreated) Queue() string { return logsQueue }
+
+// RecordsViewed tells the patient a healthcare read their records
+type RecordsViewed struct {
+	Healthcare
+	HealthID string `json:"health_id"`
+}
+
+func (RecordsViewed) Type() string  { return "records_viewed" }
+func (RecordsViewed) Version() int  { return 1 }
+func (RecordsViewed) Queue() string { return logsQueue }
+
+// AppointmentUpdated is sent once a status change of an appointment is committed
+type AppointmentUpdated struct {
+	Healthcare
+	AppointmentID int64  `json:"appointment_id"`
+	HealthID      string `json:"health_id"`
+	Name          string `json:"name"`
+	Status        string `json:"status"`
+}
+
+func (AppointmentUpdated) Type() string  { return "appointmentUpdate" }
+func (AppointmentUpdated) Version() int  { return 1 }
+func (AppointmentUpdated) Queue() string { return logsQueue }
+
+// ProfileCreated is sent when a healthcare registered a patient
+type ProfileCreated struct {
+	Healthcare
+	HealthID    string `json:"health_id"`
+	PatientName string `json:"patient_name"`
+	Email       string `json:"patient_email"`
+}
+
+func (ProfileCreated) Type() string  { return "profile_created" }
+func (ProfileCreated) Version() int  { return 1 }
+func (ProfileCreated) Queue() string { return logsQueue }
+
+// ProfileViewed is sent when a healthcare read a patient profile
+type ProfileViewed struct {
+	Healthcare
+	HealthID    string `json:"health_id"`
+	PatientName string `json:"patient_name"`
+	Email       string `json:"patient_email"`
+}
+
+func (ProfileViewed) Type() string  { return "profile_viewed" }
+func (ProfileViewed) Version() int  { return 1 }
+func (ProfileViewed) Queue() string { return logsQueue }
+
+// ProfileUpdated is sent to the details on file before the update
+type ProfileUpdated struct {
+	Healthcare
+	HealthID    string `json:"health_id"`
+	PatientName string `json:"patient_name"`
+	Email       string `json:"patient_email"`
+}
+
+func (ProfileUpdated) Type() string  { return "profile_updated" }
+func (ProfileUpdated) Version() int  { return 1 }
+func (ProfileUpdated) Queue() string { return logsQueue }
+
+// ConsentRequested asks the patient to approve access, Token is the single
+// token the patient approves, rejects and later revokes the consent with
+type ConsentRequested struct {
+	Healthcare
+	ConsentID    int64  `json:"consent_id"`
+	HealthID     string `json:"health_id"`
+	Scope        string `json:"scope" enum:"profile,records,appointments"`
+	DurationDays int    `json:"duration_days"`
+	Reason       string `json:"reason"`
+	Token        string `json:"token"`
+}
+
+func (ConsentRequested) Type() string  { return "consent_requested" }
+func (ConsentRequested) Version() int  { return 1 }
+func (ConsentRequested) Queue() string { return logsQueue }
+
+// BreakGlassAccessed is an emergency access without consent, it is always high
+// severity and goes to the patient and to the compliance reviewer
+type BreakGlassAccessed struct {
+	Healthcare
+	AccessID  int64     `json:"access_id"`
+	HealthID  string    `json:"health_id"`
+	Actor     string    `json:"actor"`
+	Scope     string    `json:"scope" enum:"profile,records"`
+	Reason    string    `json:"reason"`
+	Severity  string    `json:"severity" enum:"high"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (BreakGlassAccessed) Type() string  { return "break_glass_accessed" }
+func (BreakGlassAccessed) Version() int  { return 1 }
+func (BreakGlassAccessed) Queue() string { return logsQueue }
+
+// PatientRecordSubmitted asks the consumer to store a validated record
+type PatientRecordSubmitted struct {
+	Healthcare
+	HealthID        string    `json:"health_id"`
+	Issue           string    `json:"issue"`
+	Description     string    `json:"description"`
+	MedicalSeverity string    `json:"medical_severity"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+func (PatientRecordSubmitted) Type() string  { return "patient_record_submitted" }
+func (PatientRecordSubmitted) Version() int  { return 1 }
+func (PatientRecordSubmitted) Queue() string { return patientRecordsQueue }
+
+// AppointmentUpdateRequested asks the consumer to apply a status change
+type AppointmentUpdateRequested struct {
+	Healthcare
+	AppointmentID int64  `json:"appointment_id"`
+	HealthID      string `json:"health_id"`
+	Status        string `json:"status"`
+	Reason        string `json:"reason,omitempty"`
+	Actor         string `json:"actor,omitempty"`
+}
+
+func (AppointmentUpdateRequested) Type() string  { return "appointment_update_requested" }
+func (AppointmentUpdateRequested) Version() int  { return 1 }
+func (AppointmentUpdateRequested) Queue() string { return appointmentUpdateQueue }
+
+// Counter names a usage counter of a healthcare
+type Counter string
+
+const (
+	RequestCounter               Counter = "hip:requestcounter"
+	RecordsViewedCounter         Counter = "hip:recordsviewed_counter"
+	RecordsCreatedCounter        Counter = "hip:recordscreated_counter"
+	PatientBiodataCreatedCounter Counter = "hip:patientbiodata_created_counter"
+	PatientBiodataViewedCounter  Counter = "hip:patientbiodata_viewed_counter"
+)
+
+// CounterIncremented bumps one usage counter of a healthcare by one
+type CounterIncremented struct {
+	HealthcareID string  `json:"healthcare_id"`
+	Counter      Counter `json:"counter" enum:"hip:requestcounter,hip:recordsviewed_counter,hip:recordscreated_counter,hip:patientbiodata_created_counter,hip:patientbiodata_viewed_counter"`
+}
+
+func (CounterIncremented) Type() string  { return "counter_incremented" }
+func (CounterIncremented) Version() int  { return 1 }
+func (CounterIncremented) Queue() string { return countersQueue }
+
+// All lists one value of every event type, it drives the schema generator
+var All = []Event{
+	AccountCreated{},
+	AccountLogin{},
+	AccountDeletionScheduled{},
+	AccountLocked{},
+	PasswordResetRequested{},
+	PatientSignInRequested{},
+	RecordsCreated{},
+	RecordsViewed{},
+	AppointmentUpdated{},
+	ProfileCreated{},
+	ProfileViewed{},
+	ProfileUpdated{},
+	ConsentRequested{},
+	BreakGlassAccessed{},
+	PatientRecordSubmitted{},
+	AppointmentUpdateRequested{},
+	CounterIncremented{},
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// KeyRegistry holds every key a token may have been signed with.
+// New tokens are always signed with the active key, older (retired) keys
+// are kept around only for verification until the tokens they signed expire.
+//
+// Keys are configured through JWT_KEYS as a comma separated list of
+// kid:alg:source entries, e.g.
+//
+//	JWT_KEYS=2024-11:HS256:some-long-secret,2024-12:RS256:/keys/2024-12.pem
+//	JWT_ACTIVE_KID=2024-12
+//
+// For HS256 the source is the secret itself (or file:<path> to read it from disk),
+// for RS256/ES256 it is the path to a PEM file. A private key can sign and verify,
+// a public key alone can only verify.
+type KeyRegistry struct {
+	active string
+	keys   map[string]*signingKey
+}
+
+type signingKey struct {
+	kid       string
+	method    jwt.SigningMethod
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+func LoadKeyRegistry(spec, activeKid string) (*KeyRegistry, error) {
+	registry := &KeyRegistry{
+		active: strings.TrimSpace(activeKid),
+		keys:   map[string]*signingKey{},
+	}
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) != 3 || parts[0] == "" || parts[2] == "" {
+			return nil, fmt.Errorf("invalid key entry %q, expected kid:alg:source", entry)
+		}
+		key, err := loadSigningKey(parts[0], strings.ToUpper(parts[1]), parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", parts[0], err)
+		}
+		if _, exists := registry.keys[key.kid]; exists {
+			return nil, fmt.Errorf("duplicate key id %s", key.kid)
+		}
+		registry.keys[key.kid] = key
+	}
+
+	if len(registry.keys) == 0 {
+		return nil, fmt.Errorf("no signing keys configured")
+	}
+	active, ok := registry.keys[registry.active]
+	if !ok {
+		return nil, fmt.Errorf("active key %q is not present in the key list", registry.active)
+	}
+	if active.signKey == nil {
+		return nil, fmt.Errorf("active key %q has no private key to sign with", registry.active)
+	}
+	return registry, nil
+}
+
+func loadSigningKey(kid, alg, source string) (*signingKey, error) {
+	switch alg {
+	case "HS256":
+		secret := source
+		if strings.HasPrefix(source, "file:") {
+			raw, err := os.ReadFile(strings.TrimPrefix(source, "file:"))
+			if err != nil {
+				return nil, err
+			}
+			secret = strings.TrimSpace(string(raw))
+		}
+		if len(secret) < 32 {
+			return nil, fmt.Errorf("HMAC secret must be at least 32 characters")
+		}
+		return &signingKey{kid: kid, method: jwt.SigningMethodHS256, signKey: []byte(secret), verifyKey: []byte(secret)}, nil
+
+	case "RS256", "ES256":
+		raw, err := os.ReadFile(source)
+		if err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode(raw)
+		if block == nil {
+			return nil, fmt.Errorf("no PEM block found in %s", source)
+		}
+		if alg == "RS256" {
+			return parseRSAKey(kid, block)
+		}
+		return parseECKey(kid, block)
+	}
+	return nil, fmt.Errorf("unsupported algorithm %s", alg)
+}
+
+func parseRSAKey(kid string, block *pem.Block) (*signingKey, error) {
+	key := &signingKey{kid: kid, method: jwt.SigningMethodRS256}
+	if block.Type == "PUBLIC KEY" {
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		rsaPub, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("public key is not an RSA key")
+		}
+		key.verifyKey = rsaPub
+		return key, nil
+	}
+
+	var private *rsa.PrivateKey
+	if parsed, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		private = parsed
+	} else {
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		rsaKey, ok := parsed.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("private key is not an RSA key")
+		}
+		private = rsaKey
+	}
+	key.signKey = private
+	key.verifyKey = &private.PublicKey
+	return key, nil
+}
+
+func parseECKey(kid string, block *pem.Block) (*signingKey, error) {
+	key := &signingKey{kid: kid, method: jwt.SigningMethodES256}
+	if block.Type == "PUBLIC KEY" {
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		ecPub, ok := pub.(*ecdsa.PublicKey)
+		if !ok || ecPub.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("public key is not a P-256 key")
+		}
+		key.verifyKey = ecPub
+		return key, nil
+	}
+
+	var private *ecdsa.PrivateKey
+	if parsed, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		private = parsed
+	} else {
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		ecKey, ok := parsed.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("private key is not an ECDSA key")
+		}
+		private = ecKey
+	}
+	if private.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("ES256 requires a P-256 key")
+	}
+	key.signKey = private
+	key.verifyKey = &private.PublicKey
+	return key, nil
+}
+
+// Sign signs the claims with the active key and stamps its kid into the header
+func (k *KeyRegistry) Sign(claims jwt.Claims) (string, error) {
+	key := k.keys[k.active]
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.kid
+	return token.SignedString(key.signKey)
+}
+
+// Parse verifies the token against the key named in its kid header,
+// the algorithm must match the one configured for that key.
+func (k *KeyRegistry) Parse(tokenString string, claims jwt.Claims) (*jwt.Token, error) {
+	return jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, ok := k.keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+		if token.Method.Alg() != key.method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return key.verifyKey, nil
+	}, jwt.WithValidMethods([]string{"HS256", "RS256", "ES256"}))
+}
+
+// JWKS returns the public half of every asymmetric key so other services
+// can verify our tokens, HMAC keys are never published.
+func (k *KeyRegistry) JWKS() map[string]interface{} {
+	keys := []map[string]string{}
+	for _, key := range k.keys {
+		switch pub := key.verifyKey.(type) {
+		case *rsa.PublicKey:
+			keys = append(keys, map[string]string{
+				"kty": "RSA",
+				"use": "sig",
+				"alg": key.method.Alg(),
+				"kid": key.kid,
+				"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+			})
+		case *ecdsa.PublicKey:
+			keys = append(keys, map[string]string{
+				"kty": "EC",
+				"use": "sig",
+				"alg": key.method.Alg(),
+				"kid": key.kid,
+				"crv": "P-256",
+				"x":   base64.RawURLEncoding.EncodeToString(pub.X.FillBytes(make([]byte, 32))),
+				"y":   base64.RawURLEncoding.EncodeToString(pub.Y.FillBytes(make([]byte, 32))),
+			})
+		}
+	}
+	return map[string]interface{}{"keys": keys}
+}
+
+func (s *APIServer) GetJWKS(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error": r.Method + " method not allowed",
+		})
+	}
+	return writeJSON(w, http.StatusOK, s.keys.JWKS())
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+const testSecret = "0123456789abcdef0123456789abcdef"
+
+func writePEM(t *testing.T, name, blockType string, der []byte) string {
+	path := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600)
+	assert.NoError(t, err)
+	return path
+}
+
+func TestKeyRegistryRotation(t *testing.T) {
+	claims := jwt.MapClaims{"healthcareID": "HCID1", "exp": time.Now().Add(time.Hour).Unix()}
+
+	old, err := LoadKeyRegistry("k1:HS256:"+testSecret, "k1")
+	assert.NoError(t, err)
+	oldToken, err := old.Sign(claims)
+	assert.NoError(t, err)
+
+	// k2 becomes active, k1 is retired but still verifies
+	rotated, err := LoadKeyRegistry("k1:HS256:"+testSecret+",k2:HS256:"+testSecret+"-rotated", "k2")
+	assert.NoError(t, err)
+	token, err := rotated.Parse(oldToken, jwt.MapClaims{})
+	assert.NoError(t, err)
+	assert.True(t, token.Valid)
+
+	newToken, err := rotated.Sign(claims)
+	assert.NoError(t, err)
+	token, err = rotated.Parse(newToken, jwt.MapClaims{})
+	assert.NoError(t, err)
+	assert.Equal(t, "k2", token.Header["kid"])
+
+	// once k1 is removed its tokens are rejected
+	removed, err := LoadKeyRegistry("k2:HS256:"+testSecret+"-rotated", "k2")
+	assert.NoError(t, err)
+	_, err = removed.Parse(oldToken, jwt.MapClaims{})
+	assert.Error(t, err)
+}
+
+func TestKeyRegistryAsymmetricKeys(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	ecDER, err := x509.MarshalECPrivateKey(ecKey)
+	assert.NoError(t, err)
+	rsaPubDER, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	assert.NoError(t, err)
+
+	rsaPath := writePEM(t, "rsa.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey))
+	rsaPubPath := writePEM(t, "rsa.pub.pem", "PUBLIC KEY", rsaPubDER)
+	ecPath := writePEM(t, "ec.pem", "EC PRIVATE KEY", ecDER)
+
+	claims := jwt.MapClaims{"healthcareID": "HCID1"}
+	for _, tt := range []struct {
+		name   string
+		spec   string
+		active string
+	}{
+		{name: "RS256", spec: "r1:RS256:" + rsaPath, active: "r1"},
+		{name: "ES256", spec: "e1:ES256:" + ecPath, active: "e1"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			registry, err := LoadKeyRegistry(tt.spec, tt.active)
+			assert.NoError(t, err)
+			signed, err := registry.Sign(claims)
+			assert.NoError(t, err)
+			token, err := registry.Parse(signed, jwt.MapClaims{})
+			assert.NoError(t, err)
+			assert.Equal(t, tt.name, token.Method.Alg())
+			assert.Len(t, registry.JWKS()["keys"], 1)
+		})
+	}
+
+	// a public key alone verifies but can never be the active signing key
+	signer, err := LoadKeyRegistry("r1:RS256:"+rsaPath, "r1")
+	assert.NoError(t, err)
+	signed, err := signer.Sign(claims)
+	assert.NoError(t, err)
+
+	verifier, err := LoadKeyRegistry("h1:HS256:"+testSecret+",r1:RS256:"+rsaPubPath, "h1")
+	assert.NoError(t, err)
+	_, err = verifier.Parse(signed, jwt.MapClaims{})
+	assert.NoError(t, err)
+
+	_, err = LoadKeyRegistry("r1:RS256:"+rsaPubPath, "r1")
+	assert.Error(t, err)
+}
+
+func TestKeyRegistryRejectsAlgorithmMismatch(t *testing.T) {
+	registry, err := LoadKeyRegistry("k1:HS256:"+testSecret, "k1")
+	assert.NoError(t, err)
+
+	// token claims kid k1 but is signed with a different algorithm
+	token := jwt.NewWithClaims(jwt.SigningMethodHS384, jwt.MapClaims{"healthcareID": "HCID1"})
+	token.Header["kid"] = "k1"
+	signed, err := token.SignedString([]byte(testSecret))
+	assert.NoError(t, err)
+
+	_, err = registry.Parse(signed, jwt.MapClaims{})
+	assert.Error(t, err)
+
+	_, err = LoadKeyRegistry("k1:HS256:short", "k1")
+	assert.Error(t, err)
+	_, err = LoadKeyRegistry("k1:HS256:"+testSecret, "missing")
+	assert.Error(t, err)
+}
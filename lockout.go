@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	mod "vaibhavyadav-dev/healthcareServer/databases"
+	"vaibhavyadav-dev/healthcareServer/events"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// failed attempts within the failure window before the account is locked
+	maxLoginFailures  = 5
+	unlockTokenExpiry = 24 * time.Hour
+)
+
+// staff failures and unlock tokens are kept under this prefix, a staff id can't
+// share the counters of a healthcare id
+const staffLockoutPrefix = "staff:"
+
+// lockoutTarget is the account a failed login counts against
+type lockoutTarget struct {
+	// key of the failure counters and the value of the unlock token
+	id         string
+	healthcare events.Healthcare
+	email      string
+	lock       func() error
+}
+
+func healthcareLockout(s *APIServer, hip *mod.HIPInfo) *lockoutTarget {
+	return &lockoutTarget{
+		id:         hip.HealthcareID,
+		healthcare: events.Healthcare{HealthcareID: hip.HealthcareID, HealthcareName: hip.HealthcareName},
+		email:      hip.Email,
+		lock:       func() error { return s.store.SetAccountLocked(hip.HealthcareID, true) },
+	}
+}
+
+func staffLockout(s *APIServer, staff *mod.Staff, hip *mod.HIPInfo) *lockoutTarget {
+	return &lockoutTarget{
+		id:         staffLockoutPrefix + staff.StaffID,
+		healthcare: events.Healthcare{HealthcareID: hip.HealthcareID, HealthcareName: hip.HealthcareName},
+		email:      staff.Email,
+		lock:       func() error { return s.store.SetStaffLocked(staff.StaffID, true) },
+	}
+}
+
+// loginFailed records a wrong password and locks the account once it crossed
+// maxLoginFailures, the owner gets an email with a single use unlock token
+func (s *APIServer) loginFailed(w http.ResponseWriter, r *http.Request, target *lockoutTarget, ip string) error {
+	failures, _, err := s.store.RegisterLoginFailure(target.id, ip)
+	if err != nil {
+		return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"message": "Something went wrong from our side",
+		})
+	}
+	if failures < maxLoginFailures {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"message": "password mismatched",
+		})
+	}
+
+	if err := target.lock(); err != nil {
+		return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"message": "Something went wrong from our side",
+		})
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return err
+	}
+	unlockToken := base64.RawURLEncoding.EncodeToString(raw)
+	if err := s.store.SetWithTTL("hip:unlock:"+hashToken(unlockToken), target.id, unlockTokenExpiry); err != nil {
+		return err
+	}
+	locked := events.AccountLocked{
+		Healthcare:  target.healthcare,
+		Email:       target.email,
+		UnlockToken: unlockToken,
+	}
+	if err := s.store.Push_event(correlationID(r), locked); err != nil {
+		log.Println("failed to push hip_request_blocked:", err)
+	}
+
+	return writeJSON(w, http.StatusLocked, map[string]interface{}{
+		"status":  "Account Locked",
+		"message": "Too many failed login attempts, use the unlock link sent to your email",
+	})
+}
+
+// UnlockAccount redeems the token mailed when the account got locked
+func (s *APIServer) UnlockAccount(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return writeJSON(w, http.StatusNotAcceptable, map[string]interface{}{
+			"message": "Method Not Allowed",
+		})
+	}
+
+	req := struct {
+		Token string `json:"token"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"message": "could not process your request please check your schema",
+		})
+	}
+
+	lockedID, err := s.store.GetDel("hip:unlock:" + hashToken(req.Token))
+	if err == redis.Nil {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"message": "unlock token is invalid or has expired",
+		})
+	}
+	if err != nil {
+		return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"message": "Something went wrong from our side",
+		})
+	}
+
+	if err := s.store.ResetLoginFailures(lockedID); err != nil {
+		return err
+	}
+	if staffID, ok := strings.CutPrefix(lockedID, staffLockoutPrefix); ok {
+		if err := s.store.SetStaffLocked(staffID, false); err != nil {
+			return err
+		}
+		return writeJSON(w, http.StatusOK, map[string]interface{}{
+			"status":   "Account unlocked",
+			"staff_id": staffID,
+		})
+	}
+	if err := s.store.SetAccountLocked(lockedID, false); err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":        "Account unlocked",
+		"healthcare_id": lockedID,
+	})
+}
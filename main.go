@@ -1,10 +1,20 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"log"
+	"net"
+	"net/smtp"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 	db "vaibhavyadav-dev/healthcareServer/databases"
+	"vaibhavyadav-dev/healthcareServer/notify"
+	"vaibhavyadav-dev/healthcareServer/rabbitmq"
+	"vaibhavyadav-dev/healthcareServer/worker"
 
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
@@ -27,6 +37,28 @@ func main() {
 	psqlInfo := os.Getenv("POSTGRES")
 	mongoURI := os.Getenv("MONGOURL") 
 
+	// `fs smtp-sink` catches the mails of a local setup, it needs none of the stores
+	if len(os.Args) > 1 && os.Args[1] == "smtp-sink" {
+		runSMTPSink(os.Args[2:])
+		return
+	}
+
+	// `fs audit-verify` checks the hash chain of the audit log, it only needs postgres
+	if len(os.Args) > 1 && os.Args[1] == "audit-verify" {
+		runAuditVerify(psqlInfo)
+		return
+	}
+	// `fs reencrypt` rotates the field encryption keys, it only needs postgres
+	if len(os.Args) > 1 && os.Args[1] == "reencrypt" {
+		runReencrypt(psqlInfo, os.Args[2:])
+		return
+	}
+	// `fs migrate-queues` replaces the old non durable queues, the store can't connect before
+	if len(os.Args) > 1 && os.Args[1] == "migrate-queues" {
+		runMigrateQueues(rabbitMqURL, os.Args[2:])
+		return
+	}
+
 	// first one is redis url, second one is limit, and third one is time.Second
 	// limit -> 10
 	// window -> per 5 second
@@ -35,7 +67,179 @@ func main() {
 	if err != nil {
 		log.Fatal("Failed to initialize store:", err)
 	}
+	kms, indexKey := fieldKeys()
+	if err := store.EnableFieldEncryption(kms, indexKey); err != nil {
+		log.Fatal("Failed to load field encryption keys:", err)
+	}
+	// publishes everything handlers wrote to the outbox
+	go store.RunOutboxRelay(context.Background(), reportOutboxLag)
+
+	// `fs worker` consumes the queued records and appointment updates instead of serving the API
+	if len(os.Args) > 1 && os.Args[1] == "worker" {
+		runWorker(store, os.Args[2:])
+		return
+	}
+
+	// JWT signing keys, the active one signs new tokens and the rest
+	// are only kept to verify tokens issued before a rotation
+	keys, err := LoadKeyRegistry(os.Getenv("JWT_KEYS"), os.Getenv("JWT_ACTIVE_KID"))
+	if err != nil {
+		log.Fatal("Failed to load JWT keys:", err)
+	}
+
+	// only these peers may set X-Forwarded-For, everyone else is logged by address
+	trustedProxies, err := ParseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		log.Fatal("Failed to parse TRUSTED_PROXIES:", err)
+	}
+
 	PORT := os.Getenv("PORT")
-	server := NewAPIServer(PORT, store)
+	server := NewAPIServer(PORT, store, keys, trustedProxies)
 	server.Run()
 }
+
+// runAuditVerify exits non zero when an entry was changed or removed. The printed
+// head hash should be kept somewhere else, a later run must still contain it.
+func runAuditVerify(psqlInfo string) {
+	postgres, err := db.ConnectToPostgreSQL(psqlInfo)
+	if err != nil {
+		log.Fatal("Failed to connect to postgres:", err)
+	}
+	checked, head, err := postgres.VerifyAuditLog()
+	if err != nil {
+		log.Fatalf("audit log verification failed after %d entries: %v", checked, err)
+	}
+	log.Printf("audit log intact: %d entries, head %s", checked, head)
+}
+
+// fieldKeys reads the master keys (FIELD_KEYS, FIELD_ACTIVE_KEY) and the blind
+// index key (FIELD_INDEX_KEY) that protect the identifiers in patient profiles
+func fieldKeys() (*db.LocalKMS, []byte) {
+	kms, err := db.ParseLocalKMS(os.Getenv("FIELD_KEYS"), os.Getenv("FIELD_ACTIVE_KEY"))
+	if err != nil {
+		log.Fatal("Failed to load FIELD_KEYS:", err)
+	}
+	indexKey, err := db.LoadKeyMaterial(os.Getenv("FIELD_INDEX_KEY"))
+	if err != nil {
+		log.Fatal("Failed to load FIELD_INDEX_KEY:", err)
+	}
+	return kms, indexKey
+}
+
+// runReencrypt wraps every data key with the active master key, optionally
+// starts a new data key, and rewrites the profiles and TOTP secrets that don't use the newest one
+func runReencrypt(psqlInfo string, args []string) {
+	flags := flag.NewFlagSet("reencrypt", flag.ExitOnError)
+	rotate := flags.Bool("rotate-data-key", false, "create a new data key before reencrypting")
+	flags.Parse(args)
+
+	postgres, err := db.ConnectToPostgreSQL(psqlInfo)
+	if err != nil {
+		log.Fatal("Failed to connect to postgres:", err)
+	}
+	if err := postgres.Init(); err != nil {
+		log.Fatal("Failed to init postgres:", err)
+	}
+	kms, indexKey := fieldKeys()
+	if err := postgres.EnableFieldEncryption(kms, indexKey); err != nil {
+		log.Fatal("Failed to load field encryption keys:", err)
+	}
+
+	rewrapped, err := postgres.RewrapDataKeys()
+	if err != nil {
+		log.Fatal("Failed to rewrap data keys:", err)
+	}
+	log.Printf("rewrapped %d data keys with master key %s", rewrapped, kms.ActiveKeyID())
+	if *rotate {
+		id, err := postgres.RotateDataKey()
+		if err != nil {
+			log.Fatal("Failed to create data key:", err)
+		}
+		log.Printf("created data key %d", id)
+	}
+	rewritten, err := postgres.ReencryptProfiles()
+	if err != nil {
+		log.Fatalf("reencryption stopped after %d profiles: %v", rewritten, err)
+	}
+	log.Printf("reencrypted %d profiles", rewritten)
+	secrets, err := postgres.ReencryptTwoFactorSecrets()
+	if err != nil {
+		log.Fatal("Failed to reencrypt two factor secrets:", err)
+	}
+	log.Printf("reencrypted %d two factor secrets", secrets)
+}
+
+// runMigrateQueues deletes the queues declared with other arguments than the
+// topology's and declares them again, stop the servers and workers first
+func runMigrateQueues(rabbitMqURL string, args []string) {
+	flags := flag.NewFlagSet("migrate-queues", flag.ExitOnError)
+	force := flags.Bool("force", false, "delete old queues that still hold messages")
+	flags.Parse(args)
+
+	migrated, err := rabbitmq.MigrateLegacyQueues(rabbitMqURL, *force)
+	if err != nil {
+		log.Fatalf("queue migration stopped after %v: %v", migrated, err)
+	}
+	log.Printf("re-declared %d old queues %v", len(migrated), migrated)
+}
+
+func runWorker(store *db.CombinedStore, args []string) {
+	flags := flag.NewFlagSet("worker", flag.ExitOnError)
+	prefetch := flags.Int("prefetch", 10, "messages handled at the same time per queue")
+	only := flags.String("queues", "", "comma separated queues to consume, all of them when empty")
+	flags.Parse(args)
+
+	// finish the messages in hand on shutdown, the rest stays in the queue
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	w := worker.New(store, *prefetch)
+	notifier, err := notify.New(store, mailSender(), notify.Config{
+		From:       envOr("MAIL_FROM", "Healthcare Server <no-reply@localhost>"),
+		AppURL:     os.Getenv("MAIL_APP_URL"),
+		Compliance: os.Getenv("MAIL_COMPLIANCE"),
+	})
+	if err != nil {
+		log.Fatal("Failed to load mail templates:", err)
+	}
+	notifier.Register(w)
+
+	var queues []string
+	if *only != "" {
+		queues = strings.Split(*only, ",")
+	}
+	if err := w.Run(ctx, queues...); err != nil {
+		log.Fatal("worker stopped:", err)
+	}
+}
+
+// mailSender sends through MAIL_SMTP when it is set and writes to the MAIL_DIR
+// mailbox otherwise, so a local setup never mails real people
+func mailSender() notify.Sender {
+	addr := os.Getenv("MAIL_SMTP")
+	if addr == "" {
+		return &notify.Mailbox{Dir: envOr("MAIL_DIR", "mailbox")}
+	}
+	var auth smtp.Auth
+	if user := os.Getenv("MAIL_USER"); user != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		auth = smtp.PlainAuth("", user, os.Getenv("MAIL_PASSWORD"), host)
+	}
+	return &notify.Retrying{Sender: &notify.SMTPSender{Addr: addr, Auth: auth}, Attempts: 3, Backoff: 2 * time.Second}
+}
+
+func runSMTPSink(args []string) {
+	flags := flag.NewFlagSet("smtp-sink", flag.ExitOnError)
+	addr := flags.String("addr", "127.0.0.1:2525", "address to listen on")
+	dir := flags.String("dir", "mailbox", "directory the received mails are written to")
+	flags.Parse(args)
+
+	sink := &notify.Sink{Dir: *dir}
+	log.Fatal(sink.ListenAndServe(*addr))
+}
+
+func envOr(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	mod "vaibhavyadav-dev/healthcareServer/databases"
+)
+
+// resolveHealthID follows the alias of a patient merged into another one, so
+// requests made with the old health id keep working
+func (s *APIServer) resolveHealthID(w http.ResponseWriter, healthID string) (string, bool, error) {
+	resolved, err := s.store.ResolveHealthID(healthID)
+	if err != nil {
+		log.Printf("resolving health id %s failed: %v", healthID, err)
+		return "", false, writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"message": "Something went wrong from our side",
+		})
+	}
+	return resolved, true, nil
+}
+
+// ListDuplicates is the review list of patients registered twice, best match first.
+// ?health_id= narrows it to one patient, ?min_score= (0 to 1) and ?limit= (at most 100)
+func (s *APIServer) ListDuplicates(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error": r.Method + " method not allowed",
+		})
+	}
+	healthcareID, ok := r.Context().Value(contextKeyHealthCareID).(string)
+	if !ok {
+		return writeJSON(w, http.StatusUnauthorized, map[string]string{"message": "StatusUnauthorized"})
+	}
+
+	query := r.URL.Query()
+	minScore := mod.DefaultDuplicateScore
+	if raw := query.Get("min_score"); raw != "" {
+		parsed, err := strconv.ParseFloat(raw, 64)
+		if err != nil || parsed < 0 || parsed > 1 {
+			return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"message": "min_score must be a number between 0 and 1",
+			})
+		}
+		minScore = parsed
+	}
+	limit := 0
+	if raw := query.Get("limit"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed < 1 {
+			return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"message": "limit must be a positive number",
+			})
+		}
+		limit = parsed
+	}
+
+	candidates, err := s.store.FindDuplicates(healthcareID, query.Get("health_id"), minScore, limit)
+	if err != nil {
+		return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"message": "Something went wrong from our side",
+		})
+	}
+
+	healthIDs := make([]string, 0, 2*len(candidates))
+	for _, candidate := range candidates {
+		healthIDs = append(healthIDs, candidate.Patient.HealthID, candidate.Duplicate.HealthID)
+	}
+	if audited, err := s.auditAccess(w, r, mod.AuditDuplicateReview, mod.AuditNormal, healthIDs...); !audited {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, map[string]interface{}{
+		"duplicates": candidates,
+		"min_score":  minScore,
+	})
+}
+
+// DismissDuplicate takes a pair the reviewer found to be two people off the list
+func (s *APIServer) DismissDuplicate(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error": r.Method + " method not allowed",
+		})
+	}
+	healthcareID, ok := r.Context().Value(contextKeyHealthCareID).(string)
+	if !ok {
+		return writeJSON(w, http.StatusUnauthorized, map[string]string{"message": "StatusUnauthorized"})
+	}
+
+	req := struct {
+		HealthID          string `json:"health_id"`
+		DuplicateHealthID string `json:"duplicate_health_id"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.HealthID == "" || req.DuplicateHealthID == "" ||
+		req.HealthID == req.DuplicateHealthID {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"message": "could not process your request please check your schema",
+		})
+	}
+
+	if err := s.store.DismissDuplicate(healthcareID, req.HealthID, req.DuplicateHealthID, requestActor(r)); err != nil {
+		return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"message": "Something went wrong from our side",
+		})
+	}
+	return writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":  "Dismissed",
+		"message": "the pair won't be listed as duplicates again",
+	})
+}
+
+// MergePatients folds duplicate_health_id into health_id. The duplicate's
+// appointments, records, consents and stats move over and its health id keeps
+// resolving to health_id. The surviving profile is left as it is.
+func (s *APIServer) MergePatients(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error": r.Method + " method not allowed",
+		})
+	}
+	healthcareID, ok := r.Context().Value(contextKeyHealthCareID).(string)
+	if !ok {
+		return writeJSON(w, http.StatusUnauthorized, map[string]string{"message": "StatusUnauthorized"})
+	}
+
+	req := struct {
+		HealthID          string `json:"health_id"`
+		DuplicateHealthID string `json:"duplicate_health_id"`
+		Reason            string `json:"reason"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.HealthID == "" || req.DuplicateHealthID == "" {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"message": "could not process your request please check your schema",
+		})
+	}
+	if req.HealthID == req.DuplicateHealthID || len(req.Reason) > 300 {
+		return writeJSON(w, http.StatusNotAcceptable, map[string]interface{}{
+			"status":  "Constraints Violeted",
+			"message": "health_id and duplicate_health_id must differ and reason be at most 300 characters",
+		})
+	}
+
+	// the survivor may itself have been merged away since the review list was loaded
+	healthID, resolved, err := s.resolveHealthID(w, req.HealthID)
+	if !resolved {
+		return err
+	}
+	if healthID == req.DuplicateHealthID {
+		return writeJSON(w, http.StatusConflict, map[string]interface{}{
+			"message": "health_id was merged into duplicate_health_id already",
+		})
+	}
+	merge, err := s.store.MergePatients(healthcareID, healthID, req.DuplicateHealthID, requestActor(r), req.Reason)
+	switch {
+	case errors.Is(err, mod.ErrClientNotFound):
+		return writeJSON(w, http.StatusNotFound, map[string]interface{}{
+			"message": "both patients must be registered by this healthcare",
+		})
+	case errors.Is(err, mod.ErrAlreadyMerged):
+		return writeJSON(w, http.StatusConflict, map[string]interface{}{
+			"message": err.Error(),
+		})
+	case err != nil:
+		log.Printf("merging %s into %s failed: %v", req.DuplicateHealthID, healthID, err)
+		return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"message": "Something went wrong from our side",
+		})
+	}
+	// only a merge that happened is logged as one
+	if audited, err := s.auditAccess(w, r, mod.AuditProfileMerge, mod.AuditNormal, healthID, req.DuplicateHealthID); !audited {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status": "Merged",
+		"merge":  merge,
+	})
+}
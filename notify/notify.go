@@ -0,0 +1,203 @@
+// Package notify turns the events of the logs queue into emails. Every event
+// type has a text and an html template in templates/, the text one also defines
+// the subject. Mails go out through a Sender: SMTP in production, the Mailbox
+// or the Sink during development.
+package notify
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	mod "vaibhavyadav-dev/healthcareServer/databases"
+	"vaibhavyadav-dev/healthcareServer/events"
+	"vaibhavyadav-dev/healthcareServer/worker"
+)
+
+const sendTimeout = time.Minute
+
+// Store is what the notifier reads to address a mail
+type Store interface {
+	GetPreferance(healthcare_id string) (*mod.Preferance, error)
+	Get_ClientProfile(health_id string) (*mod.PatientDetails, error)
+}
+
+type Config struct {
+	From string
+	// base of the links in unlock and reset mails, the token is shown on its own without it
+	AppURL string
+	// gets a blind copy of every break-glass access, nobody is copied when empty
+	Compliance string
+}
+
+type notification struct {
+	event func() events.Event
+	// security mails are sent even when the healthcare turned notifications off
+	security bool
+	// the compliance reviewer is copied
+	compliance bool
+}
+
+var notifications = map[string]notification{
+	events.AccountCreated{}.Type():           {event: func() events.Event { return &events.AccountCreated{} }},
+	events.AccountLogin{}.Type():             {event: func() events.Event { return &events.AccountLogin{} }},
+	events.AccountDeletionScheduled{}.Type(): {event: func() events.Event { return &events.AccountDeletionScheduled{} }},
+	events.AccountLocked{}.Type():            {event: func() events.Event { return &events.AccountLocked{} }, security: true},
+	events.PasswordResetRequested{}.Type():   {event: func() events.Event { return &events.PasswordResetRequested{} }, security: true},
+	events.PatientSignInRequested{}.Type():   {event: func() events.Event { return &events.PatientSignInRequested{} }, security: true},
+	events.RecordsCreated{}.Type():           {event: func() events.Event { return &events.RecordsCreated{} }},
+	events.RecordsViewed{}.Type():            {event: func() events.Event { return &events.RecordsViewed{} }},
+	events.AppointmentUpdated{}.Type():       {event: func() events.Event { return &events.AppointmentUpdated{} }},
+	events.ProfileCreated{}.Type():           {event: func() events.Event { return &events.ProfileCreated{} }},
+	events.ProfileViewed{}.Type():            {event: func() events.Event { return &events.ProfileViewed{} }},
+	events.ProfileUpdated{}.Type():           {event: func() events.Event { return &events.ProfileUpdated{} }},
+	// without it the patient has no way to answer the request
+	events.ConsentRequested{}.Type(): {event: func() events.Event { return &events.ConsentRequested{} }, security: true},
+	events.BreakGlassAccessed{}.Type(): {
+		event:    func() events.Event { return &events.BreakGlassAccessed{} },
+		security: true, compliance: true,
+	},
+}
+
+type Notifier struct {
+	store     Store
+	sender    Sender
+	config    Config
+	templates map[string]*mailTemplate
+}
+
+func New(store Store, sender Sender, config Config) (*Notifier, error) {
+	types := make([]string, 0, len(notifications))
+	for eventType := range notifications {
+		types = append(types, eventType)
+	}
+	templates, err := parseTemplates(types)
+	if err != nil {
+		return nil, err
+	}
+	return &Notifier{store: store, sender: sender, config: config, templates: templates}, nil
+}
+
+// Register makes w send the mails of every notification event
+func (n *Notifier) Register(w *worker.Worker) {
+	for _, kind := range notifications {
+		w.On(kind.event(), n.Handle)
+	}
+}
+
+// recipient is who gets the mail of an event and the healthcare whose preference applies
+type recipient struct {
+	healthcareID string
+	email        string
+	name         string
+	// the patient is looked up by health id when the event carries no address
+	healthID string
+}
+
+func recipientOf(event events.Event) recipient {
+	switch e := event.(type) {
+	case *events.AccountCreated:
+		return recipient{healthcareID: e.HealthcareID, email: e.Email, name: e.HealthcareName}
+	case *events.AccountLogin:
+		return recipient{healthcareID: e.HealthcareID, email: e.Email, name: e.HealthcareName}
+	case *events.AccountDeletionScheduled:
+		return recipient{healthcareID: e.HealthcareID, email: e.Email, name: e.HealthcareName}
+	case *events.AccountLocked:
+		return recipient{healthcareID: e.HealthcareID, email: e.Email, name: e.HealthcareName}
+	case *events.PasswordResetRequested:
+		return recipient{healthcareID: e.HealthcareID, email: e.Email, name: e.HealthcareName}
+	case *events.PatientSignInRequested:
+		return recipient{email: e.Email, name: e.Name}
+	case *events.RecordsCreated:
+		return recipient{healthcareID: e.HealthcareID, healthID: e.HealthID}
+	case *events.RecordsViewed:
+		return recipient{healthcareID: e.HealthcareID, healthID: e.HealthID}
+	case *events.AppointmentUpdated:
+		return recipient{healthcareID: e.HealthcareID, healthID: e.HealthID, name: e.Name}
+	case *events.ProfileCreated:
+		return recipient{healthcareID: e.HealthcareID, email: e.Email, name: e.PatientName}
+	case *events.ProfileViewed:
+		return recipient{healthcareID: e.HealthcareID, email: e.Email, name: e.PatientName}
+	case *events.ProfileUpdated:
+		return recipient{healthcareID: e.HealthcareID, email: e.Email, name: e.PatientName}
+	case *events.ConsentRequested:
+		return recipient{healthcareID: e.HealthcareID, healthID: e.HealthID}
+	case *events.BreakGlassAccessed:
+		return recipient{healthcareID: e.HealthcareID, healthID: e.HealthID}
+	}
+	return recipient{}
+}
+
+// Handle renders and sends the mail of one event, events nobody should be
+// mailed about are acked without sending
+func (n *Notifier) Handle(ctx context.Context, msg *events.Message) error {
+	kind, ok := notifications[msg.Type]
+	if !ok {
+		return worker.Permanent(fmt.Errorf("no notification for %s", msg.Type))
+	}
+	event := kind.event()
+	if err := msg.Bind(event); err != nil {
+		return worker.Permanent(err)
+	}
+	to := recipientOf(event)
+
+	if !kind.security {
+		pref, err := n.store.GetPreferance(to.healthcareID)
+		if errors.Is(err, sql.ErrNoRows) {
+			// the healthcare is gone
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !pref.EmailNotifications {
+			return nil
+		}
+	}
+
+	if to.email == "" && to.healthID != "" {
+		patient, err := n.store.Get_ClientProfile(to.healthID)
+		if errors.Is(err, mod.ErrClientNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		to.email = patient.Email
+		if to.name == "" {
+			to.name = patient.FirstName
+		}
+	}
+	var bcc []string
+	if kind.compliance && n.config.Compliance != "" {
+		if to.email == "" {
+			// the reviewer still has to hear about it
+			to.email = n.config.Compliance
+		} else {
+			bcc = []string{n.config.Compliance}
+		}
+	}
+	if to.email == "" {
+		log.Printf("notify: no address for %s event %s", msg.Type, msg.EventID)
+		return nil
+	}
+
+	mail := &Mail{From: n.config.From, To: to.email, Bcc: bcc, ID: msg.EventID, Date: msg.OccurredAt}
+	data := &templateData{Event: event, Name: to.name, AppURL: n.config.AppURL, OccurredAt: msg.OccurredAt}
+	if err := n.templates[msg.Type].render(mail, data); err != nil {
+		return worker.Permanent(err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, sendTimeout)
+	defer cancel()
+	if err := n.sender.Send(ctx, mail); err != nil {
+		if isPermanentSMTPError(err) {
+			return worker.Permanent(err)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	mod "vaibhavyadav-dev/healthcareServer/databases"
+	"vaibhavyadav-dev/healthcareServer/events"
+)
+
+type fakeStore struct {
+	pref     map[string]*mod.Preferance
+	patients map[string]*mod.PatientDetails
+}
+
+func (f *fakeStore) GetPreferance(healthcare_id string) (*mod.Preferance, error) {
+	pref, ok := f.pref[healthcare_id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return pref, nil
+}
+
+func (f *fakeStore) Get_ClientProfile(health_id string) (*mod.PatientDetails, error) {
+	patient, ok := f.patients[health_id]
+	if !ok {
+		return nil, mod.ErrClientNotFound
+	}
+	return patient, nil
+}
+
+type recorder struct {
+	mails []*Mail
+}
+
+func (r *recorder) Send(ctx context.Context, mail *Mail) error {
+	r.mails = append(r.mails, mail)
+	return nil
+}
+
+func message(t *testing.T, event events.Event) *events.Message {
+	t.Helper()
+	body, err := events.Encode(event, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := events.Decode(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// every event of the logs queue needs a mail, New fails if a template is missing
+func TestEveryLogEventHasTemplates(t *testing.T) {
+	for _, event := range events.All {
+		if event.Queue() != "logs" {
+			continue
+		}
+		if _, ok := notifications[event.Type()]; !ok {
+			t.Errorf("no notification for %s", event.Type())
+		}
+	}
+	if _, err := New(&fakeStore{}, &recorder{}, Config{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandle(t *testing.T) {
+	store := &fakeStore{
+		pref: map[string]*mod.Preferance{
+			"hip-on":  {EmailNotifications: true},
+			"hip-off": {EmailNotifications: false},
+		},
+		patients: map[string]*mod.PatientDetails{
+			"patient-1": {FirstName: "Asha", Email: "asha@example.com"},
+		},
+	}
+	sent := &recorder{}
+	n, err := New(store, sent, Config{From: "Healthcare Server <no-reply@example.com>", AppURL: "https://app.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	on := events.Healthcare{HealthcareID: "hip-on", HealthcareName: "<City> Hospital"}
+	off := events.Healthcare{HealthcareID: "hip-off", HealthcareName: "Quiet Clinic"}
+
+	// the address comes from the patient profile
+	if err := n.Handle(context.Background(), message(t, events.RecordsViewed{Healthcare: on, HealthID: "patient-1"})); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent.mails) != 1 {
+		t.Fatalf("sent %d mails, want 1", len(sent.mails))
+	}
+	mail := sent.mails[0]
+	if mail.To != "asha@example.com" || mail.Subject != "<City> Hospital viewed your medical records" {
+		t.Fatalf("unexpected mail %+v", mail)
+	}
+	if !strings.Contains(mail.HTML, "&lt;City&gt; Hospital") || !strings.Contains(mail.Text, "Hello Asha") {
+		t.Fatalf("unexpected bodies:\n%s\n%s", mail.Text, mail.HTML)
+	}
+
+	// turned off, only security mails go out
+	if err := n.Handle(context.Background(), message(t, events.AccountLogin{Healthcare: off, Email: "quiet@example.com"})); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent.mails) != 1 {
+		t.Fatal("mailed a healthcare that turned notifications off")
+	}
+	if err := n.Handle(context.Background(), message(t, events.PasswordResetRequested{Healthcare: off, Email: "quiet@example.com", ResetToken: "tok"})); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent.mails) != 2 || !strings.Contains(sent.mails[1].Text, "https://app.example.com/reset-password?token=tok") {
+		t.Fatalf("password reset mail missing or without link: %+v", sent.mails)
+	}
+
+	// unknown patients and deleted healthcares are skipped, not retried
+	if err := n.Handle(context.Background(), message(t, events.RecordsCreated{Healthcare: on, HealthID: "patient-2"})); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Handle(context.Background(), message(t, events.AccountLogin{Healthcare: events.Healthcare{HealthcareID: "gone"}, Email: "x@example.com"})); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent.mails) != 2 {
+		t.Fatalf("sent %d mails, want 2", len(sent.mails))
+	}
+}
+
+// the compliance reviewer gets a blind copy, or the mail itself when the patient has no address
+func TestBreakGlassCopiesCompliance(t *testing.T) {
+	store := &fakeStore{
+		patients: map[string]*mod.PatientDetails{
+			"patient-1": {FirstName: "Asha", Email: "asha@example.com"},
+			"patient-2": {FirstName: "Ravi"},
+		},
+	}
+	sent := &recorder{}
+	n, err := New(store, sent, Config{From: "no-reply@example.com", Compliance: "compliance@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hip := events.Healthcare{HealthcareID: "hip-off", HealthcareName: "Quiet Clinic"}
+	for _, healthID := range []string{"patient-1", "patient-2"} {
+		event := events.BreakGlassAccessed{Healthcare: hip, HealthID: healthID, Actor: "dr.rao", Scope: "records",
+			Reason: "unconscious patient in the emergency room", Severity: "high"}
+		if err := n.Handle(context.Background(), message(t, event)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(sent.mails) != 2 {
+		t.Fatalf("sent %d mails, want 2", len(sent.mails))
+	}
+	if mail := sent.mails[0]; mail.To != "asha@example.com" || len(mail.Bcc) != 1 || mail.Bcc[0] != "compliance@example.com" {
+		t.Fatalf("unexpected recipients %q %q", mail.To, mail.Bcc)
+	}
+	if mail := sent.mails[1]; mail.To != "compliance@example.com" || len(mail.Bcc) != 0 {
+		t.Fatalf("unexpected recipients %q %q", mail.To, mail.Bcc)
+	}
+	if !strings.Contains(sent.mails[0].Text, "unconscious patient in the emergency room") {
+		t.Fatalf("reason missing:\n%s", sent.mails[0].Text)
+	}
+}
+
+func TestSMTPSenderWithSink(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	sink := &Sink{}
+	go sink.Serve(l)
+
+	sender := &SMTPSender{Addr: l.Addr().String()}
+	mail := &Mail{From: "Healthcare Server <no-reply@example.com>", To: "asha@example.com", Subject: "Hello", Text: "plain\n.\nbody", HTML: "<p>hi</p>", ID: "event-1"}
+	if err := sender.Send(context.Background(), mail); err != nil {
+		t.Fatal(err)
+	}
+	mails := sink.Mails()
+	if len(mails) != 1 {
+		t.Fatalf("sink got %d mails, want 1", len(mails))
+	}
+	for _, want := range []string{"To: asha@example.com", "Subject: Hello", "Message-ID: <event-1@healthcareserver>", "<p>hi</p>"} {
+		if !bytes.Contains(mails[0], []byte(want)) {
+			t.Fatalf("mail lacks %q:\n%s", want, mails[0])
+		}
+	}
+}
+
+func TestMailbox(t *testing.T) {
+	dir := t.TempDir()
+	mailbox := &Mailbox{Dir: dir}
+	if err := mailbox.Send(context.Background(), &Mail{From: "a@example.com", To: "b@example.com", Subject: "Hi", ID: "event-2"}); err != nil {
+		t.Fatal(err)
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil || len(files) != 1 || !strings.HasSuffix(files[0].Name(), ".eml") {
+		t.Fatalf("mailbox holds %v (%v)", files, err)
+	}
+}
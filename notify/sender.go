@@ -0,0 +1,169 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	netmail "net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type Mail struct {
+	From    string
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+	// blind copies, they are only in the envelope
+	Bcc []string
+	// the event id, a redelivered event keeps its Message-ID
+	ID   string
+	Date time.Time
+}
+
+// Sender delivers a rendered mail
+type Sender interface {
+	Send(ctx context.Context, mail *Mail) error
+}
+
+// Bytes encodes mail as a multipart/alternative RFC 5322 message
+func (m *Mail) Bytes() ([]byte, error) {
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+	for _, part := range []struct {
+		contentType string
+		content     string
+	}{
+		{"text/plain; charset=utf-8", m.Text},
+		{"text/html; charset=utf-8", m.HTML},
+	} {
+		w, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write([]byte(part.content)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+
+	var msg bytes.Buffer
+	headers := [][2]string{
+		{"From", m.From},
+		{"To", m.To},
+		{"Subject", mime.QEncoding.Encode("utf-8", m.Subject)},
+		{"Date", m.Date.Format(time.RFC1123Z)},
+		{"Message-ID", "<" + m.ID + "@healthcareserver>"},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "multipart/alternative; boundary=" + parts.Boundary()},
+	}
+	for _, header := range headers {
+		fmt.Fprintf(&msg, "%s: %s\r\n", header[0], header[1])
+	}
+	msg.WriteString("\r\n")
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
+
+// SMTPSender sends through an SMTP server, Auth may be nil for a local relay or the sink
+type SMTPSender struct {
+	Addr string
+	Auth smtp.Auth
+}
+
+func (s *SMTPSender) Send(ctx context.Context, mail *Mail) error {
+	msg, err := mail.Bytes()
+	if err != nil {
+		return err
+	}
+	// the envelope takes bare addresses, the headers keep the display names
+	from, err := netmail.ParseAddress(mail.From)
+	if err != nil {
+		return err
+	}
+	recipients := []string{}
+	for _, address := range append([]string{mail.To}, mail.Bcc...) {
+		to, err := netmail.ParseAddress(address)
+		if err != nil {
+			return err
+		}
+		recipients = append(recipients, to.Address)
+	}
+	done := make(chan error, 1)
+	go func() { done <- smtp.SendMail(s.Addr, s.Auth, from.Address, recipients, msg) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Mailbox writes every mail as an .eml file into Dir, for development and tests
+type Mailbox struct {
+	Dir string
+}
+
+func (m *Mailbox) Send(ctx context.Context, mail *Mail) error {
+	msg, err := mail.Bytes()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(m.Dir, 0o755); err != nil {
+		return err
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405"), hex.EncodeToString(suffix))
+	return os.WriteFile(filepath.Join(m.Dir, name), msg, 0o644)
+}
+
+// Retrying tries a failed send again a few times before the message goes back to the queue
+type Retrying struct {
+	Sender   Sender
+	Attempts int
+	Backoff  time.Duration
+}
+
+func (r *Retrying) Send(ctx context.Context, mail *Mail) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = r.Sender.Send(ctx, mail); err == nil || attempt >= r.Attempts || isPermanentSMTPError(err) {
+			return err
+		}
+		log.Printf("notify: sending %s failed (attempt %d): %v", mail.ID, attempt, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(r.Backoff * time.Duration(attempt)):
+		}
+	}
+}
+
+// 5xx replies (unknown mailbox, rejected content) won't change on a retry
+func isPermanentSMTPError(err error) bool {
+	var protoErr *textproto.Error
+	return errors.As(err, &protoErr) && protoErr.Code >= 500
+}
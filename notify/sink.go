@@ -0,0 +1,112 @@
+package notify
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sink is a tiny SMTP server that accepts every mail and keeps it, point
+// MAIL_SMTP at it during development instead of a real relay (`fs smtp-sink`)
+type Sink struct {
+	// mails are also written here as .eml files when set
+	Dir string
+
+	mu    sync.Mutex
+	mails [][]byte
+}
+
+// Mails returns the raw messages received so far
+func (s *Sink) Mails() [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][]byte(nil), s.mails...)
+}
+
+func (s *Sink) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("smtp sink listening on %s", l.Addr())
+	return s.Serve(l)
+}
+
+// Serve accepts connections until l is closed
+func (s *Sink) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.session(conn)
+	}
+}
+
+func (s *Sink) session(conn net.Conn) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	reply := func(code int, msg string) bool {
+		conn.SetWriteDeadline(time.Now().Add(time.Minute))
+		return text.PrintfLine("%d %s", code, msg) == nil
+	}
+
+	if !reply(220, "healthcare smtp sink ready") {
+		return
+	}
+	for {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Minute))
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, _, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			reply(250, "healthcare smtp sink")
+		case "MAIL", "RCPT", "RSET", "NOOP":
+			reply(250, "OK")
+		case "DATA":
+			if !reply(354, "end data with <CR><LF>.<CR><LF>") {
+				return
+			}
+			data, err := io.ReadAll(text.DotReader())
+			if err != nil {
+				return
+			}
+			if err := s.store(data); err != nil {
+				reply(451, "could not store message")
+				continue
+			}
+			reply(250, "OK queued")
+		case "QUIT":
+			reply(221, "bye")
+			return
+		default:
+			reply(502, "command not implemented")
+		}
+	}
+}
+
+func (s *Sink) store(data []byte) error {
+	s.mu.Lock()
+	s.mails = append(s.mails, data)
+	n := len(s.mails)
+	s.mu.Unlock()
+
+	if s.Dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(s.Dir, 0o755); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%04d.eml", time.Now().UTC().Format("20060102T150405"), n)
+	return os.WriteFile(filepath.Join(s.Dir, name), data, 0o644)
+}
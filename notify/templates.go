@@ -0,0 +1,79 @@
+package notify
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"vaibhavyadav-dev/healthcareServer/events"
+)
+
+//go:embed templates
+var templateFS embed.FS
+
+// templateData is what every template sees
+type templateData struct {
+	Event      events.Event
+	Name       string
+	Subject    string
+	AppURL     string
+	OccurredAt time.Time
+}
+
+type mailTemplate struct {
+	text *texttemplate.Template
+	html *htmltemplate.Template
+}
+
+// parseTemplates loads the text and html template of every event type,
+// text/<type>.txt also defines the subject
+func parseTemplates(types []string) (map[string]*mailTemplate, error) {
+	layout, err := htmltemplate.ParseFS(templateFS, "templates/html/layout.html")
+	if err != nil {
+		return nil, err
+	}
+	templates := map[string]*mailTemplate{}
+	for _, eventType := range types {
+		text, err := texttemplate.ParseFS(templateFS, "templates/text/"+eventType+".txt")
+		if err != nil {
+			return nil, fmt.Errorf("text template of %s: %w", eventType, err)
+		}
+		if text.Lookup("subject") == nil {
+			return nil, fmt.Errorf("text template of %s defines no subject", eventType)
+		}
+		html, err := htmltemplate.Must(layout.Clone()).ParseFS(templateFS, "templates/html/"+eventType+".html")
+		if err != nil {
+			return nil, fmt.Errorf("html template of %s: %w", eventType, err)
+		}
+		templates[eventType] = &mailTemplate{text: text, html: html}
+	}
+	return templates, nil
+}
+
+// render fills in subject, text and html body of mail
+func (t *mailTemplate) render(mail *Mail, data *templateData) error {
+	var buf bytes.Buffer
+	if err := t.text.ExecuteTemplate(&buf, "subject", data); err != nil {
+		return err
+	}
+	// a header can't span lines
+	mail.Subject = strings.Join(strings.Fields(buf.String()), " ")
+	data.Subject = mail.Subject
+
+	buf.Reset()
+	if err := t.text.Execute(&buf, data); err != nil {
+		return err
+	}
+	mail.Text = strings.TrimSpace(buf.String()) + "\n"
+
+	buf.Reset()
+	if err := t.html.ExecuteTemplate(&buf, "layout", data); err != nil {
+		return err
+	}
+	mail.HTML = buf.String()
+	return nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"vaibhavyadav-dev/healthcareServer/events"
+
+	"github.com/go-redis/redis/v8"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const passwordResetExpiry = 30 * time.Minute
+
+// bcrypt silently ignores everything after 72 bytes
+func validatePassword(password string) error {
+	if len(password) < 8 {
+		return fmt.Errorf("password must be at least 8 characters")
+	}
+	if len(password) > 72 {
+		return fmt.Errorf("password must be at most 72 characters")
+	}
+	return nil
+}
+
+// ForgotPassword always answers the same way so it can't be used to find out
+// which healthcare_id/email pairs exist
+func (s *APIServer) ForgotPassword(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return writeJSON(w, http.StatusNotAcceptable, map[string]interface{}{
+			"message": "Method Not Allowed",
+		})
+	}
+
+	req := struct {
+		HealthcareID string `json:"healthcare_id"`
+		Email        string `json:"email"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.HealthcareID == "" || req.Email == "" {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"message": "could not process your request please check your schema",
+		})
+	}
+
+	response := map[string]interface{}{
+		"status":  "Reset requested",
+		"message": "if the account exists a reset link has been sent to its email",
+	}
+
+	allowed, err := s.store.IsAllowed(req.HealthcareID)
+	if err != nil {
+		return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"message": "Something went wrong from our side",
+		})
+	}
+	if !allowed {
+		return writeJSON(w, http.StatusTooManyRequests, map[string]interface{}{
+			"status":  "Request Blocked",
+			"message": "Too many request from your side",
+		})
+	}
+
+	hip, err := s.store.GetHealthcare_details_postgres(req.HealthcareID)
+	if err != nil || !strings.EqualFold(hip.Email, strings.TrimSpace(req.Email)) {
+		return writeJSON(w, http.StatusOK, response)
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return err
+	}
+	resetToken := base64.RawURLEncoding.EncodeToString(raw)
+	if err := s.store.SetWithTTL("hip:pwreset:"+hashToken(resetToken), hip.HealthcareID, passwordResetExpiry); err != nil {
+		return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"message": "Something went wrong from our side",
+		})
+	}
+	reset := events.PasswordResetRequested{
+		Healthcare: events.Healthcare{HealthcareID: hip.HealthcareID, HealthcareName: hip.HealthcareName},
+		Email:      hip.Email,
+		ResetToken: resetToken,
+	}
+	if err := s.store.Push_event(correlationID(r), reset); err != nil {
+		return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"message": "Something went wrong from our side",
+		})
+	}
+
+	return writeJSON(w, http.StatusOK, response)
+}
+
+// ResetPassword redeems the emailed token, sets the new password and logs out every session
+func (s *APIServer) ResetPassword(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return writeJSON(w, http.StatusNotAcceptable, map[string]interface{}{
+			"message": "Method Not Allowed",
+		})
+	}
+
+	req := struct {
+		Token       string `json:"token"`
+		NewPassword string `json:"new_password"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"message": "could not process your request please check your schema",
+		})
+	}
+	// checked before the token is consumed so a weak password doesn't burn it
+	if err := validatePassword(req.NewPassword); err != nil {
+		return writeJSON(w, http.StatusNotAcceptable, map[string]interface{}{
+			"message": err.Error(),
+		})
+	}
+
+	healthcareID, err := s.store.GetDel("hip:pwreset:" + hashToken(req.Token))
+	if err == redis.Nil {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"message": "reset token is invalid or has expired",
+		})
+	}
+	if err != nil {
+		return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"message": "Something went wrong from our side",
+		})
+	}
+
+	encpw, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	if err := s.store.UpdatePassword(healthcareID, string(encpw)); err != nil {
+		return err
+	}
+	if err := s.store.RevokeAllSessions(healthcareID); err != nil {
+		return err
+	}
+	// proving access to the mailbox is as good as the unlock link
+	if err := s.store.SetAccountLocked(healthcareID, false); err != nil {
+		log.Println("failed to unlock account after password reset:", err)
+	}
+	if err := s.store.ResetLoginFailures(healthcareID); err != nil {
+		log.Println("failed to reset login failures after password reset:", err)
+	}
+
+	return writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":  "Password updated",
+		"message": "all sessions have been logged out, please login again",
+	})
+}
+
+// ChangePassword works for the healthcare login and for staff, each changes its own password.
+// Every other session is logged out and the caller gets a fresh token pair.
+func (s *APIServer) ChangePassword(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPatch {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error": r.Method + " method not allowed",
+		})
+	}
+	claims, ok := r.Context().Value(contextKeyTokenClaims).(*accessClaims)
+	if !ok {
+		return writeJSON(w, http.StatusUnauthorized, map[string]string{"message": "StatusUnauthorized"})
+	}
+
+	req := struct {
+		OldPassword string `json:"old_password"`
+		NewPassword string `json:"new_password"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"message": "could not process your request please check your schema",
+		})
+	}
+	if err := validatePassword(req.NewPassword); err != nil {
+		return writeJSON(w, http.StatusNotAcceptable, map[string]interface{}{
+			"message": err.Error(),
+		})
+	}
+
+	var current string
+	if claims.StaffID != "" {
+		staff, err := s.store.GetStaff(claims.StaffID)
+		if err != nil {
+			return writeJSON(w, http.StatusNotFound, map[string]interface{}{"message": "No user Found!"})
+		}
+		current = staff.Password
+	} else {
+		hip, err := s.store.GetHealthcare_details_postgres(claims.HealthcareID)
+		if err != nil {
+			return writeJSON(w, http.StatusNotFound, map[string]interface{}{"message": "No user Found!"})
+		}
+		current = hip.Password
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(current), []byte(req.OldPassword)); err != nil {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"message": "password mismatched",
+		})
+	}
+
+	encpw, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	if claims.StaffID != "" {
+		err = s.store.UpdateStaffPassword(claims.StaffID, string(encpw))
+	} else {
+		err = s.store.UpdatePassword(claims.HealthcareID, string(encpw))
+	}
+	if err != nil {
+		return err
+	}
+	if err := s.store.RevokeAllSessions(claims.Subject); err != nil {
+		return err
+	}
+
+	tokens, err := s.startSession(&sessionIdentity{
+		HealthcareID: claims.HealthcareID,
+		Email:        claims.Email,
+		Name:         claims.Name,
+		Role:         claims.Role,
+		StaffID:      claims.StaffID,
+	})
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":        "Password updated",
+		"message":       "all other sessions have been logged out",
+		"Expires In":    tokens.ExpiresIn,
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+	})
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	mod "vaibhavyadav-dev/healthcareServer/databases"
+	"vaibhavyadav-dev/healthcareServer/events"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+const (
+	patientSignInExpiry  = 15 * time.Minute
+	patientTokenLifetime = 30 * time.Minute
+	// patient tokens carry this audience, healthcare tokens carry none
+	patientAudience = "patient"
+
+	accessReportPage = 50
+)
+
+// patientClaims only ever let a patient read about their own health id
+type patientClaims struct {
+	HealthID string `json:"health_id"`
+	jwt.RegisteredClaims
+}
+
+// PatientSignInLink mails a single use sign-in token to the address on the
+// patient's profile, it answers the same way whether the pair exists or not
+func (s *APIServer) PatientSignInLink(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return writeJSON(w, http.StatusNotAcceptable, map[string]interface{}{
+			"message": "Method Not Allowed",
+		})
+	}
+
+	req := struct {
+		HealthID string `json:"health_id"`
+		Email    string `json:"email"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.HealthID == "" || req.Email == "" {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"message": "could not process your request please check your schema",
+		})
+	}
+
+	response := map[string]interface{}{
+		"status":  "Sign-in requested",
+		"message": "if the health id and email match a sign-in token has been sent to that email",
+	}
+
+	allowed, err := s.store.IsAllowed("patient:" + req.HealthID)
+	if err != nil {
+		return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"message": "Something went wrong from our side",
+		})
+	}
+	if !allowed {
+		return writeJSON(w, http.StatusTooManyRequests, map[string]interface{}{
+			"status":  "Request Blocked",
+			"message": "Too many request from your side",
+		})
+	}
+
+	healthID, resolved, err := s.resolveHealthID(w, req.HealthID)
+	if !resolved {
+		return err
+	}
+	patient, err := s.store.Get_ClientProfile(healthID)
+	if err != nil || patient.Email == "" || !strings.EqualFold(patient.Email, strings.TrimSpace(req.Email)) {
+		return writeJSON(w, http.StatusOK, response)
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	if err := s.store.SetWithTTL("hip:patient:signin:"+hashToken(token), patient.HealthID, patientSignInExpiry); err != nil {
+		return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"message": "Something went wrong from our side",
+		})
+	}
+	signIn := events.PatientSignInRequested{
+		HealthID: patient.HealthID,
+		Email:    patient.Email,
+		Name:     patient.FirstName,
+		Token:    token,
+	}
+	if err := s.store.Push_event(correlationID(r), signIn); err != nil {
+		return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"message": "Something went wrong from our side",
+		})
+	}
+
+	return writeJSON(w, http.StatusOK, response)
+}
+
+// PatientSignIn redeems the emailed token for a short lived patient token
+func (s *APIServer) PatientSignIn(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return writeJSON(w, http.StatusNotAcceptable, map[string]interface{}{
+			"message": "Method Not Allowed",
+		})
+	}
+
+	req := struct {
+		Token string `json:"token"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"message": "could not process your request please check your schema",
+		})
+	}
+
+	healthID, err := s.store.GetDel("hip:patient:signin:" + hashToken(req.Token))
+	if err == redis.Nil {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"message": "sign-in token is invalid or has expired",
+		})
+	}
+	if err != nil {
+		return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"message": "Something went wrong from our side",
+		})
+	}
+
+	now := time.Now()
+	token, err := s.keys.Sign(&patientClaims{
+		HealthID: healthID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
+			Subject:   healthID,
+			Audience:  jwt.ClaimStrings{patientAudience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(patientTokenLifetime)),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": token,
+		"expires_in":   patientTokenLifetime.String(),
+	})
+}
+
+// withPatientAuth accepts patient tokens only, the health id of the token is
+// the only one the handler may read about
+func (s *APIServer) withPatientAuth(handlerFunc http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tokenString := r.Header.Get("Authorization")
+		if len(tokenString) < 7 || tokenString[:7] != "Bearer " {
+			writeJSON(w, http.StatusNotAcceptable, apiError{Error: "Authorization header format must be Bearer <token>"})
+			return
+		}
+		claims := &patientClaims{}
+		token, err := s.keys.Parse(tokenString[7:], claims)
+		if err != nil {
+			writeJSON(w, http.StatusNotAcceptable, apiError{Error: fmt.Sprintf("Token Not Valid: %v", err)})
+			return
+		}
+		if !token.Valid || claims.HealthID == "" || claims.ExpiresAt == nil || !isPatientAudience(claims.Audience) {
+			writeJSON(w, http.StatusForbidden, apiError{Error: "Invalid token"})
+			return
+		}
+		ctx := context.WithValue(r.Context(), contextKeyPatientHealthID, claims.HealthID)
+		handlerFunc(w, r.WithContext(ctx))
+	}
+}
+
+func isPatientAudience(audience jwt.ClaimStrings) bool {
+	for _, aud := range audience {
+		if aud == patientAudience {
+			return true
+		}
+	}
+	return false
+}
+
+// GetAccessReport pages through every access to the patient's data newest
+// first, ?before_id= takes the next_before_id of the previous page
+func (s *APIServer) GetAccessReport(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error": r.Method + " method not allowed",
+		})
+	}
+	healthID, ok := r.Context().Value(contextKeyPatientHealthID).(string)
+	if !ok {
+		return writeJSON(w, http.StatusUnauthorized, map[string]string{"message": "StatusUnauthorized"})
+	}
+
+	query := r.URL.Query()
+	var beforeID int64
+	var err error
+	if value := query.Get("before_id"); value != "" {
+		if beforeID, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"message": "before_id must be a number",
+			})
+		}
+	}
+	limit := accessReportPage
+	if value := query.Get("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 {
+			return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"message": "limit must be a positive number",
+			})
+		}
+	}
+
+	entries, err := s.store.PatientAccessReport(healthID, beforeID, limit)
+	if err != nil {
+		return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"message": "Something went wrong from our side",
+		})
+	}
+	response := map[string]interface{}{
+		"health_id": healthID,
+		"accesses":  entries,
+	}
+	if len(entries) > 0 {
+		response["next_before_id"] = entries[len(entries)-1].ID
+	}
+	return writeJSON(w, http.StatusOK, response)
+}
+
+// ExportAccessReport downloads the whole history, ?format=csv or json (default)
+func (s *APIServer) ExportAccessReport(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error": r.Method + " method not allowed",
+		})
+	}
+	healthID, ok := r.Context().Value(contextKeyPatientHealthID).(string)
+	if !ok {
+		return writeJSON(w, http.StatusUnauthorized, map[string]string{"message": "StatusUnauthorized"})
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "csv" {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"message": "format must be csv or json",
+		})
+	}
+
+	// read everything first so a failure is still a proper error response
+	entries := []*mod.AccessReportEntry{}
+	var beforeID int64
+	for {
+		page, err := s.store.PatientAccessReport(healthID, beforeID, 0)
+		if err != nil {
+			return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+				"message": "Something went wrong from our side",
+			})
+		}
+		if len(page) == 0 {
+			break
+		}
+		entries = append(entries, page...)
+		beforeID = page[len(page)-1].ID
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="access-report-%s.%s"`, sanitizeFilename(healthID), format))
+	if format == "json" {
+		return writeJSON(w, http.StatusOK, map[string]interface{}{
+			"health_id": healthID,
+			"accesses":  entries,
+		})
+	}
+	w.Header().Set("content-type", "text/csv; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	return writeAccessReportCSV(w, entries)
+}
+
+func writeAccessReportCSV(w http.ResponseWriter, entries []*mod.AccessReportEntry) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"accessed_at", "healthcare_id", "healthcare_name", "action"})
+	for _, entry := range entries {
+		out.Write([]string{entry.AccessedAt.Format(time.RFC3339), csvCell(entry.HealthcareID), csvCell(entry.HealthcareName), csvCell(entry.Action)})
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// csvCell keeps a spreadsheet from running a cell as a formula, healthcare
+// names are picked by whoever registered the healthcare
+func csvCell(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+// sanitizeFilename keeps a header value safe whatever a health id contains
+func sanitizeFilename(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == '_' || (r >= '0' && r <= '9') || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') {
+			return r
+		}
+		return '_'
+	}, name)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/csv"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	mod "vaibhavyadav-dev/healthcareServer/databases"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// a healthcare token must never open the patient endpoints and the other way round
+func TestWithPatientAuth(t *testing.T) {
+	keys, err := LoadKeyRegistry("k1:HS256:"+testSecret, "k1")
+	assert.NoError(t, err)
+	s := &APIServer{keys: keys}
+	expires := jwt.NewNumericDate(time.Now().Add(time.Minute))
+
+	patientToken, err := keys.Sign(&patientClaims{
+		HealthID:         "patient-1",
+		RegisteredClaims: jwt.RegisteredClaims{ID: uuid.NewString(), Audience: jwt.ClaimStrings{patientAudience}, ExpiresAt: expires},
+	})
+	assert.NoError(t, err)
+	withoutAudience, err := keys.Sign(&patientClaims{
+		HealthID:         "patient-1",
+		RegisteredClaims: jwt.RegisteredClaims{ID: uuid.NewString(), ExpiresAt: expires},
+	})
+	assert.NoError(t, err)
+	healthcareToken, err := keys.Sign(&accessClaims{
+		HealthcareID: "HCID1", Email: "hip@example.com", Name: "City Hospital", Role: RoleAdmin, SessionID: "sid",
+		RegisteredClaims: jwt.RegisteredClaims{ID: uuid.NewString(), ExpiresAt: expires},
+	})
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name           string
+		token          string
+		expectedStatus int
+	}{
+		{name: "patient token", token: patientToken, expectedStatus: http.StatusOK},
+		{name: "patient token without audience", token: withoutAudience, expectedStatus: http.StatusForbidden},
+		{name: "healthcare token", token: healthcareToken, expectedStatus: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var seen string
+			handler := s.withPatientAuth(func(w http.ResponseWriter, r *http.Request) {
+				seen, _ = r.Context().Value(contextKeyPatientHealthID).(string)
+			})
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/client/access-report", nil)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			rr := httptest.NewRecorder()
+			handler(rr, req)
+			assert.Equal(t, tt.expectedStatus, rr.Code)
+			if tt.expectedStatus == http.StatusOK {
+				assert.Equal(t, "patient-1", seen)
+			}
+		})
+	}
+
+	// and the healthcare middleware refuses the patient token
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/healthcare/client/records/fetch", nil)
+	req.Header.Set("Authorization", "Bearer "+patientToken)
+	s.withJWTAuth(func(w http.ResponseWriter, r *http.Request) { t.Fatal("patient token reached a healthcare handler") })(rr, req)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+}
+
+func TestWriteAccessReportCSV(t *testing.T) {
+	at := time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC)
+	entries := []*mod.AccessReportEntry{
+		{AccessedAt: at, HealthcareID: "hip-00001", HealthcareName: "City Hospital", Action: mod.AuditProfileView},
+		{AccessedAt: at, HealthcareID: "hip-00002", HealthcareName: `=HYPERLINK("http://evil.example","x")`, Action: mod.AuditRecordsView},
+		{AccessedAt: at, HealthcareID: "hip-00003", HealthcareName: "+1 Clinic", Action: mod.AuditRecordsView},
+		{AccessedAt: at, HealthcareID: "hip-00004", HealthcareName: "-Care", Action: mod.AuditRecordsView},
+		{AccessedAt: at, HealthcareID: "hip-00005", HealthcareName: "@SUM(A1)", Action: mod.AuditRecordsView},
+	}
+	rr := httptest.NewRecorder()
+	assert.NoError(t, writeAccessReportCSV(rr, entries))
+
+	rows, err := csv.NewReader(rr.Body).ReadAll()
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{
+		{"accessed_at", "healthcare_id", "healthcare_name", "action"},
+		{"2024-05-01T10:30:00Z", "hip-00001", "City Hospital", "profile.view"},
+		{"2024-05-01T10:30:00Z", "hip-00002", `'=HYPERLINK("http://evil.example","x")`, "records.view"},
+		{"2024-05-01T10:30:00Z", "hip-00003", "'+1 Clinic", "records.view"},
+		{"2024-05-01T10:30:00Z", "hip-00004", "'-Care", "records.view"},
+		{"2024-05-01T10:30:00Z", "hip-00005", "'@SUM(A1)", "records.view"},
+	}, rows)
+}
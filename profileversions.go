@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	mod "vaibhavyadav-dev/healthcareServer/databases"
+	"vaibhavyadav-dev/healthcareServer/events"
+)
+
+// profileHealthID follows a merge and checks the profile consent, write leaves
+// break-glass access out of it
+func (s *APIServer) profileHealthID(w http.ResponseWriter, r *http.Request, healthID string, write bool) (string, bool, error) {
+	healthcareID, ok := r.Context().Value(contextKeyHealthCareID).(string)
+	if !ok {
+		return "", false, writeJSON(w, http.StatusUnauthorized, map[string]string{"message": "StatusUnauthorized"})
+	}
+	if healthID == "" {
+		return "", false, writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"message": "Provide health Id",
+		})
+	}
+	healthID, resolved, err := s.resolveHealthID(w, healthID)
+	if !resolved {
+		return "", false, err
+	}
+	if allowed, err := s.checkConsent(w, healthcareID, healthID, mod.ConsentProfile, !write); !allowed {
+		return "", false, err
+	}
+	return healthID, true, nil
+}
+
+// ListProfileVersions lists the changes of a profile newest first: who made them,
+// the fields and their old and new values
+func (s *APIServer) ListProfileVersions(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error": r.Method + " method not allowed",
+		})
+	}
+	healthID, ok, err := s.profileHealthID(w, r, r.URL.Query().Get("healthID"), false)
+	if !ok {
+		return err
+	}
+
+	versions, err := s.store.ListProfileVersions(healthID)
+	if err != nil {
+		return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"message": "Something went wrong from our side",
+		})
+	}
+	if audited, err := s.auditAccess(w, r, mod.AuditProfileHistory, mod.AuditNormal, healthID); !audited {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, map[string]interface{}{
+		"health_id": healthID,
+		"versions":  versions,
+	})
+}
+
+// GetClientProfileAt shows the profile as it was at ?at= (RFC 3339)
+func (s *APIServer) GetClientProfileAt(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error": r.Method + " method not allowed",
+		})
+	}
+	at, err := time.Parse(time.RFC3339, r.URL.Query().Get("at"))
+	if err != nil {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"message": "at must be an RFC 3339 time like 2024-05-01T00:00:00Z",
+		})
+	}
+	healthID, ok, err := s.profileHealthID(w, r, r.URL.Query().Get("healthID"), false)
+	if !ok {
+		return err
+	}
+
+	patientDetails, err := s.store.ClientProfileAt(healthID, at)
+	switch {
+	case errors.Is(err, mod.ErrClientNotFound):
+		return writeJSON(w, http.StatusNotFound, map[string]interface{}{
+			"message": "No Patient Found :(",
+		})
+	case err != nil:
+		return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"message": "Something went wrong from our side",
+		})
+	}
+	if audited, err := s.auditAccess(w, r, mod.AuditProfileHistory, mod.AuditNormal, healthID); !audited {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, map[string]interface{}{
+		"at":             at,
+		"client_profile": patientDetails,
+	})
+}
+
+// RevertClientProfile puts a profile back as it was at an earlier version, the
+// revert shows up in the history as a version of its own
+func (s *APIServer) RevertClientProfile(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error": r.Method + " method not allowed",
+		})
+	}
+	healthcareID, _ := r.Context().Value(contextKeyHealthCareID).(string)
+	healthcareName, _ := r.Context().Value(contextKeyHealthCareName).(string)
+
+	req := struct {
+		HealthID string `json:"health_id"`
+		Version  *int   `json:"version"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Version == nil {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"message": "could not process your request please check your schema",
+		})
+	}
+	healthID, ok, err := s.profileHealthID(w, r, req.HealthID, true)
+	if !ok {
+		return err
+	}
+
+	// like an update the notification goes to the details on file before the revert
+	current, err := s.store.Get_ClientProfile(healthID)
+	if err != nil {
+		return writeJSON(w, http.StatusNotFound, map[string]interface{}{
+			"message": "No Patient Found :(",
+		})
+	}
+	updated, err := mod.NewEvent(correlationID(r), events.ProfileUpdated{
+		Healthcare:  events.Healthcare{HealthcareID: healthcareID, HealthcareName: healthcareName},
+		HealthID:    current.HealthID,
+		PatientName: current.FirstName,
+		Email:       current.Email,
+	})
+	if err != nil {
+		return err
+	}
+	if audited, err := s.auditAccess(w, r, mod.AuditProfileRevert, mod.AuditNormal, healthID); !audited {
+		return err
+	}
+
+	patientDetails, version, err := s.store.RevertClientProfile(healthID, *req.Version, requestActor(r), updated)
+	switch {
+	case errors.Is(err, mod.ErrVersionNotFound):
+		return writeJSON(w, http.StatusNotFound, map[string]interface{}{
+			"message": err.Error(),
+		})
+	case err != nil:
+		log.Printf("reverting the profile of %s to version %d failed: %v", healthID, *req.Version, err)
+		return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"message": "Something went wrong from our side",
+		})
+	}
+	if version == 0 {
+		return writeJSON(w, http.StatusOK, map[string]interface{}{
+			"status":          "Unchanged",
+			"message":         "the profile already matches that version",
+			"updated_details": patientDetails,
+		})
+	}
+	return writeJSON(w, http.StatusAccepted, map[string]interface{}{
+		"status":          "Reverted",
+		"version":         version,
+		"updated_details": patientDetails,
+	})
+}
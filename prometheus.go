@@ -51,8 +51,33 @@ var (
 		},
 		[]string{"method", "endpoint", "error"},
 	)
+
+	// Outbox messages not yet confirmed by the broker
+	outboxPending = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "outbox_pending_messages",
+		Help: "Number of outbox messages waiting to be published.",
+	})
+
+	// Outbox messages the relay gave up on
+	outboxParked = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "outbox_parked_messages",
+		Help: "Number of outbox messages parked after too many failed publishes.",
+	})
+
+	// Age of the oldest unpublished outbox message
+	outboxLag = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "outbox_lag_seconds",
+		Help: "Age in seconds of the oldest outbox message waiting to be published.",
+	})
 )
 
+// reportOutboxLag is handed to the outbox relay which calls it after every round
+func reportOutboxLag(pending, parked int64, oldest time.Duration) {
+	outboxPending.Set(float64(pending))
+	outboxParked.Set(float64(parked))
+	outboxLag.Set(oldest.Seconds())
+}
+
 // PrometheusMiddleware implements mux.MiddlewareFunc
 func PrometheusMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
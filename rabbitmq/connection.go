@@ -1,20 +1,52 @@
 package rabbitmq
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	amqp "github.com/rabbitmq/amqp091-go"
 	"log"
+	"math/rand"
+	"sync"
+	"time"
 )
 
+const (
+	// confirm mode channels shared by every publisher, a publish holds one
+	// channel until its ack arrived so this is also the publish concurrency
+	channelPoolSize = 8
+
+	reconnectBaseDelay = 500 * time.Millisecond
+	reconnectMaxDelay  = 30 * time.Second
+)
+
+var ErrNotConnected = errors.New("rabbitmq connection is down, reconnecting")
+
 func failOnError(err error, msg string) {
 	if err != nil {
 		log.Fatalf("%s: %s", msg, err)
 	}
 }
 
+// pooledChannel keeps the returns of its channel, a channel serves one publish
+// at a time so a return seen before the ack belongs to that publish
+type pooledChannel struct {
+	ch      *amqp.Channel
+	returns chan amqp.Return
+}
+
+// Rabbitmq owns the broker connection, when the broker closes it (restart,
+// network loss) it is re-dialed in the background and the channel pool refilled
 type Rabbitmq struct {
+	url string
+
+	mu   sync.RWMutex
 	conn *amqp.Connection
-	ch   *amqp.Channel
+
+	// a slot holds an open channel or nil when one has to be opened
+	pool chan *pooledChannel
+
+	done chan struct{}
 }
 
 func Connect2rabbitmq(URL string) (*Rabbitmq, error) {
@@ -22,21 +54,157 @@ func Connect2rabbitmq(URL string) (*Rabbitmq, error) {
 	if err != nil {
 		return nil, err
 	}
-	// defer conn.Close()
+
+	// Ping to check server connection
 	ch, err := conn.Channel()
 	if err != nil {
 		return nil, err
 	}
-
-	// Ping to check server connection
 	if err := ch.ExchangeDeclarePassive("amq.direct", "direct", true, false, false, false, nil); err != nil {
 		return nil, fmt.Errorf("failed to connect RabbitMQ server: %w", err)
 	}
+	if err := DeclareTopology(ch); err != nil {
+		return nil, err
+	}
+	ch.Close()
 
-	log.Printf("Successfully Connected to RabbitMq server... :)")
-	return &Rabbitmq{
+	c := &Rabbitmq{
+		url:  URL,
 		conn: conn,
-		ch:   ch,
-	}, nil
+		pool: make(chan *pooledChannel, channelPoolSize),
+		done: make(chan struct{}),
+	}
+	for i := 0; i < channelPoolSize; i++ {
+		c.pool <- nil
+	}
+	go c.watch(conn)
+
+	log.Printf("Successfully Connected to RabbitMq server... :)")
+	return c, nil
+}
+
+// reconnectDelay grows exponentially with the attempt and keeps a random half
+// of it so a fleet of servers doesn't hit a restarted broker at the same moment
+func reconnectDelay(attempt int) time.Duration {
+	delay := reconnectMaxDelay
+	if attempt < 16 {
+		delay = reconnectBaseDelay << attempt
+		if delay > reconnectMaxDelay {
+			delay = reconnectMaxDelay
+		}
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
 }
 
+// dialWithTopology connects and makes sure the topology exists, a broker that
+// lost its definitions (fresh node, reset) gets them back on reconnect
+func dialWithTopology(url string) (*amqp.Connection, error) {
+	conn, err := amqp.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+	ch, err := conn.Channel()
+	if err == nil {
+		err = DeclareTopology(ch)
+		ch.Close()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// watch waits for the connection to drop and dials until it is back
+func (c *Rabbitmq) watch(conn *amqp.Connection) {
+	for {
+		closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+		select {
+		case <-c.done:
+			return
+		case reason, ok := <-closed:
+			if !ok || reason == nil {
+				// closed by us
+				return
+			}
+			log.Printf("rabbitmq connection lost: %v", reason)
+		}
+
+		c.mu.Lock()
+		c.conn = nil
+		c.mu.Unlock()
+
+		for attempt := 0; ; attempt++ {
+			select {
+			case <-c.done:
+				return
+			case <-time.After(reconnectDelay(attempt)):
+			}
+			fresh, err := dialWithTopology(c.url)
+			if err != nil {
+				log.Printf("rabbitmq reconnect attempt %d failed: %v", attempt+1, err)
+				continue
+			}
+			conn = fresh
+			break
+		}
+
+		c.mu.Lock()
+		c.conn = conn
+		c.mu.Unlock()
+		log.Printf("Reconnected to RabbitMq server... :)")
+	}
+}
+
+// acquire takes a pool slot, opening a confirm mode channel if the slot is
+// empty or its channel died with the old connection
+func (c *Rabbitmq) acquire(ctx context.Context) (*pooledChannel, error) {
+	var pc *pooledChannel
+	select {
+	case pc = <-c.pool:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if pc != nil && !pc.ch.IsClosed() {
+		return pc, nil
+	}
+
+	c.mu.RLock()
+	conn := c.conn
+	c.mu.RUnlock()
+	if conn == nil || conn.IsClosed() {
+		c.pool <- nil
+		return nil, ErrNotConnected
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		c.pool <- nil
+		return nil, err
+	}
+	if err := ch.Confirm(false); err != nil {
+		ch.Close()
+		c.pool <- nil
+		return nil, fmt.Errorf("failed to put channel in confirm mode: %w", err)
+	}
+	return &pooledChannel{ch: ch, returns: ch.NotifyReturn(make(chan amqp.Return, 1))}, nil
+}
+
+// release hands the slot back, a channel that failed is dropped
+func (c *Rabbitmq) release(pc *pooledChannel, failed bool) {
+	if failed && pc != nil {
+		pc.ch.Close()
+		pc = nil
+	}
+	c.pool <- pc
+}
+
+// Close stops reconnecting and closes the connection
+func (c *Rabbitmq) Close() error {
+	close(c.done)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.Close()
+}
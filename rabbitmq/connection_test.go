@@ -0,0 +1,68 @@
+package rabbitmq
+
+import (
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestReconnectDelay(t *testing.T) {
+	for attempt := 0; attempt < 40; attempt++ {
+		ceiling := reconnectMaxDelay
+		if attempt < 16 && reconnectBaseDelay<<attempt < reconnectMaxDelay {
+			ceiling = reconnectBaseDelay << attempt
+		}
+		for i := 0; i < 20; i++ {
+			delay := reconnectDelay(attempt)
+			if delay < ceiling/2 || delay > ceiling {
+				t.Fatalf("attempt %d: delay %s outside [%s, %s]", attempt, delay, ceiling/2, ceiling)
+			}
+		}
+	}
+	if reconnectDelay(100) > reconnectMaxDelay {
+		t.Fatal("delay must be capped")
+	}
+}
+
+func TestQueueArguments(t *testing.T) {
+	spec, ok := LookupQueue("logs")
+	if !ok {
+		t.Fatal("logs must be part of the topology")
+	}
+	main, retry, _ := queueArguments(spec)
+	if main["x-dead-letter-exchange"] != DeadLetterExchange || main["x-message-ttl"] != millis(spec.MessageTTL) {
+		t.Fatalf("unexpected main queue arguments %v", main)
+	}
+	// retry queues send messages back to the main queue once the delay is over
+	if retry["x-dead-letter-exchange"] != EventsExchange || retry["x-dead-letter-routing-key"] != "logs" {
+		t.Fatalf("unexpected retry queue arguments %v", retry)
+	}
+
+	spec, _ = LookupQueue("patient_records")
+	main, _, _ = queueArguments(spec)
+	if _, ok := main["x-message-ttl"]; ok {
+		t.Fatal("patient_records must not expire")
+	}
+	if _, ok := LookupQueue("unknown"); ok {
+		t.Fatal("unknown queue found")
+	}
+}
+
+func TestDeliveryAttempts(t *testing.T) {
+	cases := []struct {
+		headers amqp.Table
+		want    int
+	}{
+		{nil, 0},
+		{amqp.Table{}, 0},
+		{amqp.Table{attemptsHeader: int32(3)}, 3},
+		// the broker may hand integers back with another width
+		{amqp.Table{attemptsHeader: int64(4)}, 4},
+		{amqp.Table{attemptsHeader: "2"}, 0},
+	}
+	for _, c := range cases {
+		if got := deliveryAttempts(c.headers); got != c.want {
+			t.Fatalf("deliveryAttempts(%v) = %d, want %d", c.headers, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// a message that failed this many times is parked in <queue>.dead
+const MaxDeliveryAttempts = 5
+
+// counts the failed attempts of a message that went through <queue>.retry
+const attemptsHeader = "x-attempts"
+
+// Outcome tells Consume how to settle a delivery
+type Outcome int
+
+const (
+	// Ack removes the message, it was handled or was a duplicate
+	Ack Outcome = iota
+	// Retry sends the message through <queue>.retry, it is delivered again after
+	// the retry delay until MaxDeliveryAttempts is reached
+	Retry
+	// Reject parks a message that can never succeed in <queue>.dead
+	Reject
+)
+
+// Handler handles the body of one delivery
+type Handler func(ctx context.Context, body []byte) Outcome
+
+// Consume hands messages of queue to handle until ctx is done. Deliveries are
+// acked manually and at most prefetch of them are handled at the same time.
+// It subscribes again whenever the connection was lost.
+func (c *Rabbitmq) Consume(ctx context.Context, queue string, prefetch int, handle Handler) error {
+	spec, ok := LookupQueue(queue)
+	if !ok {
+		return fmt.Errorf("queue %s is not part of the topology", queue)
+	}
+	if prefetch < 1 {
+		prefetch = 1
+	}
+
+	for attempt := 0; ; attempt++ {
+		subscribed, err := c.consumeOnce(ctx, spec, prefetch, handle)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if subscribed {
+			attempt = 0
+		}
+		log.Printf("consumer of %s stopped: %v", queue, err)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(reconnectDelay(attempt)):
+		}
+	}
+}
+
+// consumeOnce consumes on one channel until it closes, in flight messages are
+// finished before it returns
+func (c *Rabbitmq) consumeOnce(ctx context.Context, spec QueueSpec, prefetch int, handle Handler) (bool, error) {
+	c.mu.RLock()
+	conn := c.conn
+	c.mu.RUnlock()
+	if conn == nil || conn.IsClosed() {
+		return false, ErrNotConnected
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return false, err
+	}
+	defer ch.Close()
+	if err := ch.Qos(prefetch, 0, false); err != nil {
+		return false, err
+	}
+	tag := fmt.Sprintf("%s-%d", spec.Name, time.Now().UnixNano())
+	deliveries, err := ch.Consume(spec.Name, tag, false, false, false, false, nil)
+	if err != nil {
+		return false, err
+	}
+
+	// cancelling the consumer closes deliveries, the messages being handled are
+	// still settled and the unacked rest goes back to the queue with the channel
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			ch.Cancel(tag, false)
+		case <-stop:
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < prefetch; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for d := range deliveries {
+				c.settle(spec, d, handle(ctx, d.Body))
+			}
+		}()
+	}
+	wg.Wait()
+	return true, errors.New("delivery channel closed")
+}
+
+func (c *Rabbitmq) settle(spec QueueSpec, d amqp.Delivery, outcome Outcome) {
+	var err error
+	switch outcome {
+	case Ack:
+		err = d.Ack(false)
+	case Reject:
+		err = d.Nack(false, false)
+	case Retry:
+		attempts := deliveryAttempts(d.Headers) + 1
+		if attempts >= MaxDeliveryAttempts {
+			log.Printf("%s: giving up on message %s after %d attempts", spec.Name, d.MessageId, attempts)
+			err = d.Nack(false, false)
+			break
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+		publishErr := c.publish(ctx, RetryExchange, spec.Name, amqp.Publishing{
+			Headers:      amqp.Table{attemptsHeader: int32(attempts)},
+			ContentType:  d.ContentType,
+			DeliveryMode: amqp.Persistent,
+			MessageId:    d.MessageId,
+			Timestamp:    d.Timestamp,
+			Body:         d.Body,
+		})
+		cancel()
+		if publishErr != nil {
+			// couldn't park it for later, the broker delivers it again right away
+			log.Printf("%s: failed to schedule retry: %v", spec.Name, publishErr)
+			err = d.Nack(false, true)
+			break
+		}
+		err = d.Ack(false)
+	}
+	if err != nil {
+		log.Printf("%s: failed to settle delivery: %v", spec.Name, err)
+	}
+}
+
+// deliveryAttempts reads how often a message has failed before
+func deliveryAttempts(headers amqp.Table) int {
+	switch n := headers[attemptsHeader].(type) {
+	case int32:
+		return int(n)
+	case int64:
+		return int(n)
+	case int:
+		return n
+	}
+	return 0
+}
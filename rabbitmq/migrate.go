@@ -0,0 +1,79 @@
+package rabbitmq
+
+import (
+	"errors"
+	"fmt"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// MigrateLegacyQueues deletes the queues of Topology that were declared with other
+// arguments (the old non durable ones) and declares the topology again. A legacy
+// queue that still holds messages is left alone unless force is set, its messages
+// would be lost. Publishers have to be stopped while it runs, a publish to a queue
+// that was just deleted is dropped. It returns the queues it re-declared.
+func MigrateLegacyQueues(URL string, force bool) ([]string, error) {
+	conn, err := amqp.Dial(URL)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	migrated := []string{}
+	for _, spec := range Topology {
+		legacy, messages, err := isLegacyQueue(conn, spec)
+		if err != nil {
+			return migrated, err
+		}
+		if !legacy {
+			continue
+		}
+		if messages > 0 && !force {
+			return migrated, fmt.Errorf("queue %s still holds %d messages, let the old workers drain it or force the migration", spec.Name, messages)
+		}
+		ch, err := conn.Channel()
+		if err != nil {
+			return migrated, err
+		}
+		_, err = ch.QueueDelete(spec.Name, false, false, false)
+		ch.Close()
+		if err != nil {
+			return migrated, fmt.Errorf("failed to delete queue %s: %w", spec.Name, err)
+		}
+		migrated = append(migrated, spec.Name)
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return migrated, err
+	}
+	defer ch.Close()
+	return migrated, DeclareTopology(ch)
+}
+
+// isLegacyQueue declares the queue as the topology wants it, the broker refuses
+// with PRECONDITION_FAILED when it exists with other arguments. The refusal closes
+// the channel, so every check gets its own.
+func isLegacyQueue(conn *amqp.Connection, spec QueueSpec) (bool, int, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return false, 0, err
+	}
+	main, _, _ := queueArguments(spec)
+	_, err = ch.QueueDeclare(spec.Name, true, false, false, false, main)
+	var amqpErr *amqp.Error
+	if err == nil || !errors.As(err, &amqpErr) || amqpErr.Code != amqp.PreconditionFailed {
+		ch.Close()
+		return false, 0, err
+	}
+
+	if ch, err = conn.Channel(); err != nil {
+		return false, 0, err
+	}
+	defer ch.Close()
+	queue, err := ch.QueueDeclarePassive(spec.Name, false, false, false, false, nil)
+	if err != nil {
+		return false, 0, fmt.Errorf("failed to inspect queue %s: %w", spec.Name, err)
+	}
+	return true, queue.Messages, nil
+}
@@ -0,0 +1,84 @@
+package rabbitmq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+	"vaibhavyadav-dev/healthcareServer/events"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// how long Publish waits for the broker ack
+const publishTimeout = 5 * time.Second
+
+// ErrUnroutable is returned when the broker bounced a mandatory publish
+var ErrUnroutable = errors.New("message could not be routed to any queue")
+
+// Publish sends an already encoded message to the queue bound to routingKey and
+// waits for the broker ack
+func (c *Rabbitmq) Publish(routingKey string, bodyjson []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+	return c.PublishConfirmed(ctx, routingKey, bodyjson)
+}
+
+// PublishConfirmed publishes a persistent message and waits until the broker acked it,
+// a nack, a bounce or a timeout of ctx is returned as an error so the caller can retry
+func (c *Rabbitmq) PublishConfirmed(ctx context.Context, routingKey string, bodyjson []byte) error {
+	err := c.publish(ctx, EventsExchange, routingKey, amqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		Timestamp:    time.Now(),
+		Body:         bodyjson,
+	})
+	if err != nil {
+		return err
+	}
+	// only the envelope is logged, the data carries tokens and patient details
+	var envelope events.Envelope
+	_ = json.Unmarshal(bodyjson, &envelope)
+	log.Printf("[x] Sent %s %s to %s", envelope.Type, envelope.EventID, routingKey)
+	return nil
+}
+
+// publish sends msg as a mandatory publish and waits for the broker ack
+func (c *Rabbitmq) publish(ctx context.Context, exchange, routingKey string, msg amqp.Publishing) error {
+	pc, err := c.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	failed := true
+	defer func() { c.release(pc, failed) }()
+
+	confirmation, err := pc.ch.PublishWithDeferredConfirmWithContext(ctx,
+		exchange,   // exchange
+		routingKey, // routing key
+		true,       // mandatory
+		false,      // immediate
+		msg)
+	if err != nil {
+		return err
+	}
+	acked, err := confirmation.WaitContext(ctx)
+	if err != nil {
+		// the ack may still arrive later, the channel can't be reused safely
+		return fmt.Errorf("no confirmation from broker: %w", err)
+	}
+	failed = false
+
+	// the broker sends basic.return before the ack of the same message
+	select {
+	case returned := <-pc.returns:
+		log.Printf("rabbitmq returned message for %s: %d %s", routingKey, returned.ReplyCode, returned.ReplyText)
+		return fmt.Errorf("%w: %s (%s)", ErrUnroutable, routingKey, returned.ReplyText)
+	default:
+	}
+	if !acked {
+		return fmt.Errorf("broker rejected message for %s", routingKey)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package rabbitmq
+
+import (
+	"fmt"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Everything is published on one topic exchange with the queue name as routing key.
+// Every queue gets two companions:
+//
+//	<name>.retry  holds a message for RetryDelay, then sends it back to <name>
+//	<name>.dead   parking lot for rejected and expired messages
+const (
+	EventsExchange     = "hip.events"
+	RetryExchange      = "hip.events.retry"
+	DeadLetterExchange = "hip.events.dead"
+)
+
+type QueueSpec struct {
+	Name string
+	// messages older than this are dead-lettered, zero keeps them forever
+	MessageTTL time.Duration
+	RetryDelay time.Duration
+}
+
+func (q QueueSpec) RetryQueue() string { return q.Name + ".retry" }
+func (q QueueSpec) DeadQueue() string  { return q.Name + ".dead" }
+
+// Topology is the single definition of what the broker must look like
+var Topology = []QueueSpec{
+	{Name: "logs", MessageTTL: 7 * 24 * time.Hour, RetryDelay: 30 * time.Second},
+	{Name: "patient_records", RetryDelay: time.Minute},
+	{Name: "appointment_update", MessageTTL: 24 * time.Hour, RetryDelay: 30 * time.Second},
+	{Name: "hip:counters", MessageTTL: time.Hour, RetryDelay: 10 * time.Second},
+	{Name: "patientbiodata", MessageTTL: 24 * time.Hour, RetryDelay: time.Minute},
+}
+
+// LookupQueue returns the spec of a queue in Topology
+func LookupQueue(name string) (QueueSpec, bool) {
+	for _, spec := range Topology {
+		if spec.Name == name {
+			return spec, true
+		}
+	}
+	return QueueSpec{}, false
+}
+
+func millis(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
+}
+
+// queueArguments returns the arguments of the main, retry and dead queue of spec
+func queueArguments(spec QueueSpec) (main, retry, dead amqp.Table) {
+	main = amqp.Table{
+		"x-dead-letter-exchange":    DeadLetterExchange,
+		"x-dead-letter-routing-key": spec.Name,
+	}
+	if spec.MessageTTL > 0 {
+		main["x-message-ttl"] = millis(spec.MessageTTL)
+	}
+	retry = amqp.Table{
+		"x-message-ttl":             millis(spec.RetryDelay),
+		"x-dead-letter-exchange":    EventsExchange,
+		"x-dead-letter-routing-key": spec.Name,
+	}
+	return main, retry, amqp.Table{}
+}
+
+// DeclareTopology declares exchanges, queues and bindings, it is idempotent as
+// long as the definitions don't change. Queues declared with other arguments
+// (like the old non durable ones) are replaced by MigrateLegacyQueues.
+func DeclareTopology(ch *amqp.Channel) error {
+	for _, exchange := range []string{EventsExchange, RetryExchange, DeadLetterExchange} {
+		if err := ch.ExchangeDeclare(exchange, "topic", true, false, false, false, nil); err != nil {
+			return fmt.Errorf("failed to declare exchange %s: %w", exchange, err)
+		}
+	}
+
+	for _, spec := range Topology {
+		main, retry, dead := queueArguments(spec)
+		queues := []struct {
+			name     string
+			exchange string
+			args     amqp.Table
+		}{
+			{spec.Name, EventsExchange, main},
+			{spec.RetryQueue(), RetryExchange, retry},
+			{spec.DeadQueue(), DeadLetterExchange, dead},
+		}
+		for _, q := range queues {
+			if _, err := ch.QueueDeclare(q.name, true, false, false, false, q.args); err != nil {
+				return fmt.Errorf("failed to declare queue %s: %w", q.name, err)
+			}
+			if err := ch.QueueBind(q.name, spec.Name, q.exchange, false, nil); err != nil {
+				return fmt.Errorf("failed to bind queue %s: %w", q.name, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+)
+
+// Roles a login can have, the healthcare's own account is always admin
+const (
+	RoleAdmin        = "admin"
+	RoleDoctor       = "doctor"
+	RoleReceptionist = "receptionist"
+	RoleAuditor      = "auditor"
+)
+
+type Permission string
+
+const (
+	PermPreferanceRead    Permission = "preferance:read"
+	PermPreferanceWrite   Permission = "preferance:write"
+	PermAccountDelete     Permission = "account:delete"
+	PermHealthcareRead    Permission = "healthcare:read"
+	PermAppointmentsRead  Permission = "appointments:read"
+	PermAppointmentsWrite Permission = "appointments:write"
+	PermScheduleManage    Permission = "schedule:manage"
+	PermRecordsRead       Permission = "records:read"
+	PermRecordsWrite      Permission = "records:write"
+	PermProfileRead       Permission = "profile:read"
+	PermProfileWrite      Permission = "profile:write"
+	PermStaffRead         Permission = "staff:read"
+	PermStaffManage       Permission = "staff:manage"
+	PermConsentRead       Permission = "consent:read"
+	PermConsentRequest    Permission = "consent:request"
+	PermBreakGlass        Permission = "breakglass:open"
+	PermBreakGlassReview  Permission = "breakglass:review"
+	PermAuditRead         Permission = "audit:read"
+	PermPatientMerge      Permission = "patient:merge"
+)
+
+var rolePermissions = map[string]map[Permission]bool{
+	RoleAdmin: {
+		PermPreferanceRead: true, PermPreferanceWrite: true, PermAccountDelete: true,
+		PermHealthcareRead: true, PermAppointmentsRead: true, PermAppointmentsWrite: true,
+		PermRecordsRead: true, PermRecordsWrite: true, PermProfileRead: true,
+		PermProfileWrite: true, PermStaffRead: true, PermStaffManage: true, PermScheduleManage: true,
+		PermConsentRead: true, PermConsentRequest: true, PermBreakGlass: true, PermBreakGlassReview: true,
+		PermAuditRead: true, PermPatientMerge: true,
+	},
+	RoleDoctor: {
+		PermHealthcareRead: true, PermAppointmentsRead: true, PermAppointmentsWrite: true,
+		PermRecordsRead: true, PermRecordsWrite: true, PermProfileRead: true, PermProfileWrite: true,
+		PermConsentRead: true, PermConsentRequest: true, PermBreakGlass: true,
+	},
+	// front desk: books appointments and registers patients, never sees records
+	RoleReceptionist: {
+		PermHealthcareRead: true, PermAppointmentsRead: true, PermAppointmentsWrite: true,
+		PermProfileRead: true, PermProfileWrite: true, PermConsentRead: true, PermConsentRequest: true,
+	},
+	// read only access to everything
+	RoleAuditor: {
+		PermPreferanceRead: true, PermHealthcareRead: true, PermAppointmentsRead: true,
+		PermRecordsRead: true, PermProfileRead: true, PermStaffRead: true, PermConsentRead: true,
+		PermAuditRead: true,
+	},
+}
+
+func isValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+func roleHasPermission(role string, permission Permission) bool {
+	return rolePermissions[role][permission]
+}
+
+// Authorize blocks the request unless the role in the token grants the permission,
+// it must run after withJWTAuth.
+func (s *APIServer) Authorize(permission Permission, handlerFunc http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := r.Context().Value(contextKeyTokenClaims).(*accessClaims)
+		if !ok {
+			writeJSON(w, http.StatusForbidden, apiError{Error: "Invalid token"})
+			return
+		}
+		if !roleHasPermission(claims.Role, permission) {
+			writeJSON(w, http.StatusForbidden, map[string]interface{}{
+				"status":  "Forbidden",
+				"message": "role " + claims.Role + " is missing permission " + string(permission),
+			})
+			return
+		}
+		handlerFunc(w, r)
+	}
+}
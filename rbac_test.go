@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthorize(t *testing.T) {
+	s := &APIServer{}
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+
+	tests := []struct {
+		name           string
+		role           string
+		permission     Permission
+		expectedStatus int
+	}{
+		{name: "admin reads records", role: RoleAdmin, permission: PermRecordsRead, expectedStatus: http.StatusOK},
+		{name: "receptionist manages appointments", role: RoleReceptionist, permission: PermAppointmentsWrite, expectedStatus: http.StatusOK},
+		{name: "receptionist cannot read records", role: RoleReceptionist, permission: PermRecordsRead, expectedStatus: http.StatusForbidden},
+		{name: "auditor cannot write records", role: RoleAuditor, permission: PermRecordsWrite, expectedStatus: http.StatusForbidden},
+		{name: "doctor cannot manage staff", role: RoleDoctor, permission: PermStaffManage, expectedStatus: http.StatusForbidden},
+		{name: "auditor reads consents", role: RoleAuditor, permission: PermConsentRead, expectedStatus: http.StatusOK},
+		{name: "auditor cannot request consent", role: RoleAuditor, permission: PermConsentRequest, expectedStatus: http.StatusForbidden},
+		{name: "doctor breaks the glass", role: RoleDoctor, permission: PermBreakGlass, expectedStatus: http.StatusOK},
+		{name: "doctor cannot sign off break-glass", role: RoleDoctor, permission: PermBreakGlassReview, expectedStatus: http.StatusForbidden},
+		{name: "auditor reads the audit log", role: RoleAuditor, permission: PermAuditRead, expectedStatus: http.StatusOK},
+		{name: "doctor cannot read the audit log", role: RoleDoctor, permission: PermAuditRead, expectedStatus: http.StatusForbidden},
+		{name: "admin merges patients", role: RoleAdmin, permission: PermPatientMerge, expectedStatus: http.StatusOK},
+		{name: "receptionist cannot merge patients", role: RoleReceptionist, permission: PermPatientMerge, expectedStatus: http.StatusForbidden},
+		{name: "unknown role", role: "janitor", permission: PermHealthcareRead, expectedStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req = req.WithContext(context.WithValue(req.Context(), contextKeyTokenClaims, &accessClaims{Role: tt.role}))
+			w := httptest.NewRecorder()
+			s.Authorize(tt.permission, ok)(w, req)
+			assert.Equal(t, tt.expectedStatus, w.Code)
+		})
+	}
+}
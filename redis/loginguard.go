@@ -0,0 +1,83 @@
+package redis
+
+import (
+	"fmt"
+	"time"
+)
+
+// failed logins are counted per healthcare_id and per client ip, every failure
+// pushes the next allowed attempt further away (1s, 2s, 4s, ... capped)
+const (
+	loginFailureWindow = time.Hour
+	maxLoginBackoff    = 15 * time.Minute
+)
+
+func loginFailuresKey(kind, id string) string {
+	return fmt.Sprintf("hip:login:failures:%s:%s", kind, id)
+}
+
+func loginBackoffKey(kind, id string) string {
+	return fmt.Sprintf("hip:login:backoff:%s:%s", kind, id)
+}
+
+func backoffFor(failures int64) time.Duration {
+	if failures <= 0 {
+		return 0
+	}
+	if failures > 10 {
+		return maxLoginBackoff
+	}
+	backoff := time.Duration(1<<(failures-1)) * time.Second
+	if backoff > maxLoginBackoff {
+		return maxLoginBackoff
+	}
+	return backoff
+}
+
+// LoginBackoff returns how long the caller still has to wait before trying again
+func (r *Redisconn) LoginBackoff(healthcare_id, ip string) (time.Duration, error) {
+	pipe := r.conn.Pipeline()
+	byID := pipe.PTTL(r.ctx, loginBackoffKey("id", healthcare_id))
+	byIP := pipe.PTTL(r.ctx, loginBackoffKey("ip", ip))
+	if _, err := pipe.Exec(r.ctx); err != nil {
+		return 0, err
+	}
+
+	wait := byID.Val()
+	if byIP.Val() > wait {
+		wait = byIP.Val()
+	}
+	if wait < 0 {
+		return 0, nil
+	}
+	return wait, nil
+}
+
+// RegisterLoginFailure counts a failed attempt and arms the backoff,
+// it returns the failures within the window for the account and the ip
+func (r *Redisconn) RegisterLoginFailure(healthcare_id, ip string) (int64, int64, error) {
+	counts := make([]int64, 2)
+	for i, target := range [][2]string{{"id", healthcare_id}, {"ip", ip}} {
+		key := loginFailuresKey(target[0], target[1])
+		count, err := r.conn.Incr(r.ctx, key).Result()
+		if err != nil {
+			return 0, 0, err
+		}
+		if count == 1 {
+			if err := r.conn.Expire(r.ctx, key, loginFailureWindow).Err(); err != nil {
+				return 0, 0, err
+			}
+		}
+		if err := r.conn.Set(r.ctx, loginBackoffKey(target[0], target[1]), 1, backoffFor(count)).Err(); err != nil {
+			return 0, 0, err
+		}
+		counts[i] = count
+	}
+	return counts[0], counts[1], nil
+}
+
+// ResetLoginFailures clears the account counters after a successful login or an unlock,
+// ip counters are left to expire on their own
+func (r *Redisconn) ResetLoginFailures(healthcare_id string) error {
+	return r.conn.Del(r.ctx, loginFailuresKey("id", healthcare_id), loginBackoffKey("id", healthcare_id)).Err()
+}
@@ -41,6 +41,32 @@ func (r *Redisconn) Get(key string) (interface{}, error) {
 	return response, nil
 }
 
+// SetNX sets the key only if it does not exist yet, returns false when it already did.
+// Handy for anything that must happen once (one time codes, single use tokens)
+func (r *Redisconn) SetNX(key string, value interface{}, ttl time.Duration) (bool, error) {
+	return r.conn.SetNX(r.ctx, key, value, ttl).Result()
+}
+
+// GetDel reads and removes the key in one step, used for single use tokens
+func (r *Redisconn) GetDel(key string) (string, error) {
+	return r.conn.GetDel(r.ctx, key).Result()
+}
+
+// SetWithTTL stores a plain string value, unlike Set it is not serialized and has its own expiry
+func (r *Redisconn) SetWithTTL(key, value string, ttl time.Duration) error {
+	return r.conn.Set(r.ctx, key, value, ttl).Err()
+}
+
+// Exists reports whether the key is set
+func (r *Redisconn) Exists(key string) (bool, error) {
+	n, err := r.conn.Exists(r.ctx, key).Result()
+	return n > 0, err
+}
+
+func (r *Redisconn) Del(key string) error {
+	return r.conn.Del(r.ctx, key).Err()
+}
+
 func (r *Redisconn) Close() error {
 	return r.conn.Close()
 }
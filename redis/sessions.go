@@ -0,0 +1,153 @@
+package redis
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+var (
+	ErrSessionNotFound    = errors.New("session not found or expired")
+	ErrRefreshTokenReused = errors.New("refresh token already used, session revoked")
+)
+
+// a session lives under hip:session:<session_id> as a hash holding the
+// sha256 of the current refresh token, the owner and the identity to put in
+// new access tokens. hip:sessions:<owner> tracks every session of one login
+// (a healthcare or one of its staff) so all of them can be revoked at once.
+func sessionKey(sessionID string) string {
+	return fmt.Sprintf("hip:session:%s", sessionID)
+}
+
+func accountSessionsKey(owner string) string {
+	return fmt.Sprintf("hip:sessions:%s", owner)
+}
+
+func revokedTokenKey(jti string) string {
+	return fmt.Sprintf("hip:revoked:%s", jti)
+}
+
+// Compare the presented refresh token with the stored one and swap it for the new one.
+// A mismatch means an old refresh token was replayed, so the whole session is dropped.
+// KEYS[2] is the owner's session index, it gets the same fresh lifetime as the
+// session or it would expire under a login that keeps refreshing.
+var rotateRefreshScript = redis.NewScript(`
+local stored = redis.call('HGET', KEYS[1], 'refresh')
+if not stored or redis.call('HGET', KEYS[1], 'owner') ~= ARGV[4] then
+	return 0
+end
+if stored ~= ARGV[1] then
+	redis.call('DEL', KEYS[1])
+	redis.call('SREM', KEYS[2], ARGV[3])
+	return -1
+end
+redis.call('HSET', KEYS[1], 'refresh', ARGV[2])
+redis.call('EXPIRE', KEYS[1], ARGV[5])
+redis.call('SADD', KEYS[2], ARGV[3])
+redis.call('EXPIRE', KEYS[2], ARGV[5])
+return redis.call('HGET', KEYS[1], 'data')
+`)
+
+func (r *Redisconn) CreateSession(sessionID, owner, refreshHash string, data interface{}, ttl time.Duration) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to serialize session: %w", err)
+	}
+
+	pipe := r.conn.TxPipeline()
+	pipe.HSet(r.ctx, sessionKey(sessionID), map[string]interface{}{
+		"owner":   owner,
+		"refresh": refreshHash,
+		"data":    payload,
+	})
+	pipe.Expire(r.ctx, sessionKey(sessionID), ttl)
+	pipe.SAdd(r.ctx, accountSessionsKey(owner), sessionID)
+	pipe.Expire(r.ctx, accountSessionsKey(owner), ttl)
+	_, err = pipe.Exec(r.ctx)
+	return err
+}
+
+// RotateSession swaps the refresh token of a session and returns the
+// identity stored with it, the session lifetime restarts from now.
+func (r *Redisconn) RotateSession(sessionID, refreshHash, newRefreshHash string, ttl time.Duration) (string, error) {
+	owner, err := r.conn.HGet(r.ctx, sessionKey(sessionID), "owner").Result()
+	if err == redis.Nil {
+		return "", ErrSessionNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// the script checks the owner again, the session may be gone by now
+	result, err := rotateRefreshScript.Run(r.ctx, r.conn,
+		[]string{sessionKey(sessionID), accountSessionsKey(owner)},
+		refreshHash, newRefreshHash, sessionID, owner, int64(ttl.Seconds()),
+	).Result()
+	if err != nil {
+		return "", err
+	}
+
+	switch value := result.(type) {
+	case string:
+		return value, nil
+	case int64:
+		if value == -1 {
+			return "", ErrRefreshTokenReused
+		}
+	}
+	return "", ErrSessionNotFound
+}
+
+func (r *Redisconn) RevokeSession(sessionID string) error {
+	owner, err := r.conn.HGet(r.ctx, sessionKey(sessionID), "owner").Result()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	pipe := r.conn.TxPipeline()
+	pipe.Del(r.ctx, sessionKey(sessionID))
+	pipe.SRem(r.ctx, accountSessionsKey(owner), sessionID)
+	_, err = pipe.Exec(r.ctx)
+	return err
+}
+
+func (r *Redisconn) RevokeAllSessions(owner string) error {
+	sessions, err := r.conn.SMembers(r.ctx, accountSessionsKey(owner)).Result()
+	if err != nil {
+		return err
+	}
+
+	pipe := r.conn.TxPipeline()
+	for _, sessionID := range sessions {
+		pipe.Del(r.ctx, sessionKey(sessionID))
+	}
+	pipe.Del(r.ctx, accountSessionsKey(owner))
+	_, err = pipe.Exec(r.ctx)
+	return err
+}
+
+// RevokeToken blacklists a single access token until it would have expired anyway
+func (r *Redisconn) RevokeToken(jti string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return nil
+	}
+	return r.conn.Set(r.ctx, revokedTokenKey(jti), 1, ttl).Err()
+}
+
+// IsTokenRevoked reports whether the token itself was revoked or the session
+// it belongs to no longer exists (logout, logout-all, refresh token reuse).
+func (r *Redisconn) IsTokenRevoked(jti, sessionID string) (bool, error) {
+	pipe := r.conn.Pipeline()
+	revoked := pipe.Exists(r.ctx, revokedTokenKey(jti))
+	session := pipe.Exists(r.ctx, sessionKey(sessionID))
+	if _, err := pipe.Exec(r.ctx); err != nil {
+		return false, err
+	}
+	return revoked.Val() > 0 || session.Val() == 0, nil
+}
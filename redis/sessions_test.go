@@ -0,0 +1,55 @@
+package redis
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// these run against a real server, set REDIS_ADDR to a throwaway instance
+func testRedis(t *testing.T) *Redisconn {
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		t.Skip("REDIS_ADDR not set")
+	}
+	r, err := Connect2Redis(addr, 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestRotateSessionRefreshesOwnerIndex(t *testing.T) {
+	r := testRedis(t)
+	owner := "hip-test-rotate"
+	sessionID := "test-rotate-session"
+	t.Cleanup(func() { r.RevokeAllSessions(owner) })
+
+	assert.NoError(t, r.CreateSession(sessionID, owner, "first", map[string]string{"sub": owner}, 10*time.Second))
+
+	data, err := r.RotateSession(sessionID, "first", "second", time.Hour)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"sub":"hip-test-rotate"}`, data)
+
+	// the index has to outlive the session, not the first login
+	for _, key := range []string{sessionKey(sessionID), accountSessionsKey(owner)} {
+		ttl, err := r.conn.TTL(r.ctx, key).Result()
+		assert.NoError(t, err)
+		assert.Greater(t, ttl, time.Minute, key)
+	}
+	member, err := r.conn.SIsMember(r.ctx, accountSessionsKey(owner), sessionID).Result()
+	assert.NoError(t, err)
+	assert.True(t, member)
+
+	// replaying the old token drops the session and its index entry
+	_, err = r.RotateSession(sessionID, "first", "third", time.Hour)
+	assert.ErrorIs(t, err, ErrRefreshTokenReused)
+	member, err = r.conn.SIsMember(r.ctx, accountSessionsKey(owner), sessionID).Result()
+	assert.NoError(t, err)
+	assert.False(t, member)
+
+	_, err = r.RotateSession(sessionID, "second", "third", time.Hour)
+	assert.ErrorIs(t, err, ErrSessionNotFound)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSearchClientsValidation(t *testing.T) {
+	// no store, every request here has to be refused before it is searched
+	s := &APIServer{}
+
+	tests := []struct {
+		name           string
+		method         string
+		body           string
+		expectedStatus int
+	}{
+		{name: "wrong method", method: "GET", body: `{"name": "Asha"}`, expectedStatus: http.StatusBadRequest},
+		{name: "malformed body", method: "POST", body: `{"name":`, expectedStatus: http.StatusBadRequest},
+		{name: "no filter", method: "POST", body: `{"sex": "F", "bloodgrp": "O+"}`, expectedStatus: http.StatusBadRequest},
+		{name: "blank name is no filter", method: "POST", body: `{"name": "   "}`, expectedStatus: http.StatusBadRequest},
+		{name: "name too short", method: "POST", body: `{"name": " As "}`, expectedStatus: http.StatusNotAcceptable},
+		{name: "negative page", method: "POST", body: `{"name": "Asha", "page": -1}`, expectedStatus: http.StatusNotAcceptable},
+		{name: "negative page size", method: "POST", body: `{"dob": "1990-04-12", "page_size": -5}`, expectedStatus: http.StatusNotAcceptable},
+		{name: "page size too large", method: "POST", body: `{"mobilenumber": "9876543210", "page_size": 51}`, expectedStatus: http.StatusNotAcceptable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/api/v1/healthcare/client/search", bytes.NewBufferString(tt.body))
+			req = req.WithContext(context.WithValue(req.Context(), contextKeyHealthCareID, "hip-00001"))
+			rr := httptest.NewRecorder()
+
+			assert.NoError(t, s.SearchClients(rr, req))
+			assert.Equal(t, tt.expectedStatus, rr.Code)
+		})
+	}
+}
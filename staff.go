@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	mod "vaibhavyadav-dev/healthcareServer/databases"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func (s *APIServer) StaffLogin(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return writeJSON(w, http.StatusNotAcceptable, map[string]interface{}{
+			"message": "Method Not Allowed",
+		})
+	}
+
+	login := &mod.StaffLogin{}
+	if err := json.NewDecoder(r.Body).Decode(login); err != nil || login.StaffID == "" {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"message": "could not process your request please check your schema",
+		})
+	}
+
+	// failed attempts back off and lock the staff account like LoginUser does
+	ip := s.clientIP(r)
+	failureID := staffLockoutPrefix + login.StaffID
+	wait, err := s.store.LoginBackoff(failureID, ip)
+	if err != nil {
+		return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"message": "Something went wrong from our side",
+		})
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		return writeJSON(w, http.StatusTooManyRequests, map[string]interface{}{
+			"status":  "Too many failed attempts",
+			"message": fmt.Sprintf("try again in %s", wait.Round(time.Second)),
+		})
+	}
+
+	ok, err := s.store.IsAllowed(login.StaffID)
+	if err != nil {
+		return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"message": "Something went wrong from our side",
+		})
+	}
+	if !ok {
+		return writeJSON(w, http.StatusTooManyRequests, map[string]interface{}{
+			"status":  "Request Blocked",
+			"message": "Too many request from your side",
+		})
+	}
+
+	staff, err := s.store.GetStaff(login.StaffID)
+	if err != nil {
+		if _, _, err := s.store.RegisterLoginFailure(failureID, ip); err != nil {
+			log.Println("failed to register login failure:", err)
+		}
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"message": "No user Found!",
+		})
+	}
+	if staff.Locked {
+		return writeJSON(w, http.StatusLocked, map[string]interface{}{
+			"status":  "Account Locked",
+			"message": "Too many failed login attempts, use the unlock link sent to your email",
+		})
+	}
+
+	hip, err := s.store.GetHealthcare_details_postgres(staff.HealthcareID)
+	if err != nil {
+		return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"message": "Something went wrong from our side",
+		})
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(staff.Password), []byte(login.Password)); err != nil {
+		return s.loginFailed(w, r, staffLockout(s, staff, hip), ip)
+	}
+	if err := s.store.ResetLoginFailures(failureID); err != nil {
+		return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"message": "Something went wrong from our side",
+		})
+	}
+
+	tokens, err := s.startSession(&sessionIdentity{
+		HealthcareID: hip.HealthcareID,
+		Email:        hip.Email,
+		Name:         hip.HealthcareName,
+		Role:         staff.Role,
+		StaffID:      staff.StaffID,
+	})
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, map[string]interface{}{
+		"Expires In":      tokens.ExpiresIn,
+		"token":           tokens.AccessToken,
+		"refresh_token":   tokens.RefreshToken,
+		"staff_id":        staff.StaffID,
+		"role":            staff.Role,
+		"healthcare_id":   hip.HealthcareID,
+		"healthcare_name": hip.HealthcareName,
+	})
+}
+
+func (s *APIServer) CreateStaff(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error": r.Method + " method not allowed",
+		})
+	}
+	healthcareID, ok := r.Context().Value(contextKeyHealthCareID).(string)
+	if !ok {
+		return writeJSON(w, http.StatusUnauthorized, map[string]string{"message": "StatusUnauthorized"})
+	}
+
+	req := &mod.Staff{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"message": "could not process your request please check your schema",
+		})
+	}
+
+	staff, err := mod.CreateStaffAccount(healthcareID, req)
+	if err != nil {
+		return writeJSON(w, http.StatusNotAcceptable, map[string]interface{}{
+			"err":     err.Error(),
+			"message": "Wrong Payload provided by User!",
+		})
+	}
+	if err := s.store.CreateStaff(staff); err != nil {
+		return writeJSON(w, http.StatusNotAcceptable, map[string]interface{}{
+			"err":     err.Error(),
+			"message": "Staff Already exists",
+		})
+	}
+
+	staff.Password = ""
+	return writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"status": "created",
+		"staff":  staff,
+	})
+}
+
+func (s *APIServer) ListStaff(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error": r.Method + " method not allowed",
+		})
+	}
+	healthcareID, ok := r.Context().Value(contextKeyHealthCareID).(string)
+	if !ok {
+		return writeJSON(w, http.StatusUnauthorized, map[string]string{"message": "StatusUnauthorized"})
+	}
+
+	staff, err := s.store.ListStaff(healthcareID)
+	if err != nil {
+		return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"status": "Something went wrong from our side",
+			"error":  "error: " + err.Error(),
+		})
+	}
+	return writeJSON(w, http.StatusOK, map[string]interface{}{
+		"staff":   staff,
+		"fetched": len(staff),
+	})
+}
+
+// UpdateStaffRole changes the role and logs the staff member out everywhere
+// so the new permissions apply to their next login
+func (s *APIServer) UpdateStaffRole(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPatch {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error": r.Method + " method not allowed",
+		})
+	}
+	healthcareID, ok := r.Context().Value(contextKeyHealthCareID).(string)
+	if !ok {
+		return writeJSON(w, http.StatusUnauthorized, map[string]string{"message": "StatusUnauthorized"})
+	}
+
+	req := struct {
+		StaffID string `json:"staff_id"`
+		Role    string `json:"role"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.StaffID == "" {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"message": "could not process your request please check your schema",
+		})
+	}
+	if !isValidRole(req.Role) {
+		return writeJSON(w, http.StatusNotAcceptable, map[string]interface{}{
+			"message": "Invalid role. Role must be one of [\"admin\", \"doctor\", \"receptionist\", \"auditor\"]",
+		})
+	}
+
+	if err := s.store.UpdateStaffRole(healthcareID, req.StaffID, req.Role); err != nil {
+		return writeJSON(w, http.StatusNotFound, map[string]interface{}{
+			"message": err.Error(),
+		})
+	}
+	if err := s.store.RevokeAllSessions(req.StaffID); err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":   "Role updated",
+		"staff_id": req.StaffID,
+		"role":     req.Role,
+	})
+}
+
+func (s *APIServer) DeleteStaff(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "DELETE" {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error": r.Method + " method not allowed",
+		})
+	}
+	healthcareID, ok := r.Context().Value(contextKeyHealthCareID).(string)
+	if !ok {
+		return writeJSON(w, http.StatusUnauthorized, map[string]string{"message": "StatusUnauthorized"})
+	}
+
+	staffID := r.URL.Query().Get("staffID")
+	if staffID == "" {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"message": "Provide staff Id",
+		})
+	}
+	if err := s.store.DeleteStaff(healthcareID, staffID); err != nil {
+		return writeJSON(w, http.StatusNotFound, map[string]interface{}{
+			"message": err.Error(),
+		})
+	}
+	if err := s.store.RevokeAllSessions(staffID); err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":   "Staff removed",
+		"staff_id": staffID,
+	})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTOTPRFC6238Vectors(t *testing.T) {
+	// SHA1 test vectors from RFC 6238 appendix B, truncated to 6 digits
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{unix: 59, code: "287082"},
+		{unix: 1111111109, code: "081804"},
+		{unix: 1234567890, code: "005924"},
+		{unix: 2000000000, code: "279037"},
+	}
+	for _, tt := range tests {
+		code, err := totpCode(secret, tt.unix/totpPeriod)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.code, code)
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	secret, err := generateTOTPSecret()
+	assert.NoError(t, err)
+	now := time.Unix(1700000000, 0)
+
+	code, err := totpCode(secret, now.Unix()/totpPeriod)
+	assert.NoError(t, err)
+	step, ok := verifyTOTP(secret, code, now)
+	assert.True(t, ok)
+	assert.Equal(t, now.Unix()/totpPeriod, step)
+
+	// one step of drift is tolerated, two are not
+	_, ok = verifyTOTP(secret, code, now.Add(totpPeriod*time.Second))
+	assert.True(t, ok)
+	_, ok = verifyTOTP(secret, code, now.Add(2*totpPeriod*time.Second))
+	assert.False(t, ok)
+
+	_, ok = verifyTOTP(secret, "12345", now)
+	assert.False(t, ok)
+}
+
+func TestOtpauthURI(t *testing.T) {
+	uri := otpauthURI("Bharat Seva", "HCID123", "ABCDEF")
+	assert.True(t, strings.HasPrefix(uri, "otpauth://totp/Bharat%20Seva:HCID123?"))
+	assert.Contains(t, uri, "secret=ABCDEF")
+
+	codes, err := generateRecoveryCodes(10)
+	assert.NoError(t, err)
+	assert.Len(t, codes, 10)
+	assert.Len(t, codes[0], 14)
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	challengeTokenLifetime = 5 * time.Minute
+	totpIssuer             = "Bharat Seva"
+	recoveryCodeCount      = 10
+)
+
+// challengeClaims prove the password was right, they carry no email, role or
+// session so withJWTAuth never accepts them as an access token
+type challengeClaims struct {
+	HealthcareID string `json:"healthcareID"`
+	Purpose      string `json:"purpose"`
+	jwt.RegisteredClaims
+}
+
+func (s *APIServer) createChallengeToken(healthcareID string) (string, error) {
+	now := time.Now()
+	return s.keys.Sign(&challengeClaims{
+		HealthcareID: healthcareID,
+		Purpose:      "2fa",
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
+			Subject:   healthcareID,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(challengeTokenLifetime)),
+		},
+	})
+}
+
+// 2FA belongs to the healthcare login, staff accounts can't touch it
+func ownerClaims(r *http.Request) (*accessClaims, bool) {
+	claims, ok := r.Context().Value(contextKeyTokenClaims).(*accessClaims)
+	if !ok || claims.StaffID != "" {
+		return nil, false
+	}
+	return claims, true
+}
+
+// acceptTOTP checks the code and refuses a time step that was already used
+func (s *APIServer) acceptTOTP(healthcareID, secret, code string) (bool, error) {
+	step, ok := verifyTOTP(secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+	return s.store.SetNX(fmt.Sprintf("hip:2fa:step:%s:%d", healthcareID, step), 1, (2*totpSkew+1)*totpPeriod*time.Second)
+}
+
+func (s *APIServer) TwoFactorEnroll(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error": r.Method + " method not allowed",
+		})
+	}
+	claims, ok := ownerClaims(r)
+	if !ok {
+		return writeJSON(w, http.StatusForbidden, map[string]string{"message": "only the healthcare account can manage two factor authentication"})
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return err
+	}
+	if err := s.store.SaveTwoFactorSecret(claims.HealthcareID, secret); err != nil {
+		return writeJSON(w, http.StatusConflict, map[string]interface{}{
+			"message": err.Error(),
+		})
+	}
+
+	return writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":      "pending verification",
+		"message":     "scan the otpauth uri with an authenticator app and verify a code to finish",
+		"secret":      secret,
+		"otpauth_uri": otpauthURI(totpIssuer, claims.HealthcareID, secret),
+	})
+}
+
+func (s *APIServer) TwoFactorVerify(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error": r.Method + " method not allowed",
+		})
+	}
+	claims, ok := ownerClaims(r)
+	if !ok {
+		return writeJSON(w, http.StatusForbidden, map[string]string{"message": "only the healthcare account can manage two factor authentication"})
+	}
+
+	req := struct {
+		Code string `json:"code"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"message": "could not process your request please check your schema",
+		})
+	}
+
+	twoFactor, err := s.store.GetTwoFactor(claims.HealthcareID)
+	if err != nil {
+		return err
+	}
+	if twoFactor.Secret == "" {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"message": "enroll first",
+		})
+	}
+	if twoFactor.Enabled {
+		return writeJSON(w, http.StatusConflict, map[string]interface{}{
+			"message": "two factor authentication is already enabled",
+		})
+	}
+	accepted, err := s.acceptTOTP(claims.HealthcareID, twoFactor.Secret, req.Code)
+	if err != nil {
+		return err
+	}
+	if !accepted {
+		return writeJSON(w, http.StatusUnauthorized, map[string]interface{}{
+			"message": "invalid code",
+		})
+	}
+
+	codes, err := generateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		return err
+	}
+	hashes := make([]string, 0, len(codes))
+	for _, code := range codes {
+		hash, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		hashes = append(hashes, string(hash))
+	}
+	if err := s.store.EnableTwoFactor(claims.HealthcareID, hashes); err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":         "two factor authentication enabled",
+		"message":        "store these recovery codes safely, they will not be shown again",
+		"recovery_codes": codes,
+	})
+}
+
+func (s *APIServer) TwoFactorDisable(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error": r.Method + " method not allowed",
+		})
+	}
+	claims, ok := ownerClaims(r)
+	if !ok {
+		return writeJSON(w, http.StatusForbidden, map[string]string{"message": "only the healthcare account can manage two factor authentication"})
+	}
+
+	req := struct {
+		Code string `json:"code"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"message": "could not process your request please check your schema",
+		})
+	}
+
+	twoFactor, err := s.store.GetTwoFactor(claims.HealthcareID)
+	if err != nil {
+		return err
+	}
+	if !twoFactor.Enabled {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"message": "two factor authentication is not enabled",
+		})
+	}
+	accepted, err := s.acceptTOTP(claims.HealthcareID, twoFactor.Secret, req.Code)
+	if err != nil {
+		return err
+	}
+	if !accepted {
+		return writeJSON(w, http.StatusUnauthorized, map[string]interface{}{
+			"message": "invalid code",
+		})
+	}
+	if err := s.store.DisableTwoFactor(claims.HealthcareID); err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status": "two factor authentication disabled",
+	})
+}
+
+// TwoFactorChallenge trades the login challenge token plus a TOTP
+// (or recovery) code for the real access and refresh tokens
+func (s *APIServer) TwoFactorChallenge(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return writeJSON(w, http.StatusNotAcceptable, map[string]interface{}{
+			"message": "Method Not Allowed",
+		})
+	}
+
+	req := struct {
+		ChallengeToken string `json:"challenge_token"`
+		Code           string `json:"code"`
+		RecoveryCode   string `json:"recovery_code"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"message": "could not process your request please check your schema",
+		})
+	}
+
+	claims := &challengeClaims{}
+	token, err := s.keys.Parse(req.ChallengeToken, claims)
+	if err != nil || !token.Valid || claims.Purpose != "2fa" || claims.HealthcareID == "" || claims.ID == "" {
+		return writeJSON(w, http.StatusUnauthorized, map[string]interface{}{
+			"message": "challenge expired or invalid, please login again",
+		})
+	}
+
+	// wrong codes are throttled the same way as any other request of this account
+	allowed, err := s.store.IsAllowed(claims.HealthcareID)
+	if err != nil {
+		return writeJSON(w, http.StatusInternalServerError, map[string]interface{}{
+			"message": "Something went wrong from our side",
+		})
+	}
+	if !allowed {
+		return writeJSON(w, http.StatusTooManyRequests, map[string]interface{}{
+			"status":  "Request Blocked",
+			"message": "Too many request from your side",
+		})
+	}
+
+	twoFactor, err := s.store.GetTwoFactor(claims.HealthcareID)
+	if err != nil {
+		return err
+	}
+	if !twoFactor.Enabled {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"message": "two factor authentication is not enabled, please login again",
+		})
+	}
+
+	// a challenge can be exchanged only once, it is spent before a code is checked
+	// so a recovery code isn't burned on a challenge that was already used
+	fresh, err := s.store.SetNX("hip:2fa:challenge:"+claims.ID, 1, challengeTokenLifetime)
+	if err != nil {
+		return err
+	}
+	if !fresh {
+		return writeJSON(w, http.StatusUnauthorized, map[string]interface{}{
+			"message": "challenge already used, please login again",
+		})
+	}
+
+	accepted := false
+	if req.RecoveryCode != "" {
+		accepted, err = s.store.UseRecoveryCode(claims.HealthcareID, req.RecoveryCode)
+	} else {
+		accepted, err = s.acceptTOTP(claims.HealthcareID, twoFactor.Secret, req.Code)
+	}
+	if err != nil {
+		return err
+	}
+	if !accepted {
+		return writeJSON(w, http.StatusUnauthorized, map[string]interface{}{
+			"message": "invalid code, please login again",
+		})
+	}
+
+	hip, err := s.store.GetHealthcare_details_postgres(claims.HealthcareID)
+	if err != nil {
+		return writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"message": "No user Found!",
+		})
+	}
+	tokens, err := s.startSession(&sessionIdentity{
+		HealthcareID: hip.HealthcareID,
+		Email:        hip.Email,
+		Name:         hip.HealthcareName,
+		Role:         RoleAdmin,
+	})
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, map[string]interface{}{
+		"Expires In":      tokens.ExpiresIn,
+		"token":           tokens.AccessToken,
+		"refresh_token":   tokens.RefreshToken,
+		"healthcare_id":   hip.HealthcareID,
+		"healthcare_name": hip.HealthcareName,
+	})
+}
@@ -0,0 +1,96 @@
+package worker
+
+import (
+	"context"
+	"errors"
+
+	mod "vaibhavyadav-dev/healthcareServer/databases"
+	"vaibhavyadav-dev/healthcareServer/events"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// recordID derives the mongo id of a record from its event, a redelivered
+// event then fails as a duplicate instead of storing the record twice
+func recordID(eventID string) (primitive.ObjectID, error) {
+	id, err := uuid.Parse(eventID)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	var objectID primitive.ObjectID
+	copy(objectID[:], id[:len(objectID)])
+	return objectID, nil
+}
+
+func (w *Worker) storeRecord(ctx context.Context, msg *events.Message) error {
+	var submitted events.PatientRecordSubmitted
+	if err := msg.Bind(&submitted); err != nil {
+		return Permanent(err)
+	}
+	id, err := recordID(msg.EventID)
+	if err != nil {
+		return Permanent(err)
+	}
+	createdAt := submitted.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = msg.OccurredAt
+	}
+
+	record, err := mod.CreatePatientRecords(submitted.HealthcareID, &mod.PatientRecords{
+		ID:              id,
+		Issue:           submitted.Issue,
+		Description:     submitted.Description,
+		HealthID:        submitted.HealthID,
+		MedicalSeverity: submitted.MedicalSeverity,
+		HealthcareName:  submitted.HealthcareName,
+		CreatedAt:       createdAt,
+	})
+	if err != nil {
+		return Permanent(err)
+	}
+	_, err = w.store.CreatepatientRecords(submitted.HealthcareID, record)
+	if errors.Is(err, mod.ErrRecordExists) {
+		return nil
+	}
+	return err
+}
+
+func (w *Worker) updateAppointment(ctx context.Context, msg *events.Message) error {
+	var requested events.AppointmentUpdateRequested
+	if err := msg.Bind(&requested); err != nil {
+		return Permanent(err)
+	}
+	if !mod.IsAppointmentStatus(requested.Status) {
+		return Permanent(errors.New("invalid status " + requested.Status))
+	}
+
+	current, err := w.store.GetAppointment(requested.HealthcareID, requested.AppointmentID)
+	if errors.Is(err, mod.ErrAppointmentNotFound) || (err == nil && current.HealthID != requested.HealthID) {
+		return Permanent(mod.ErrAppointmentNotFound)
+	}
+	if err != nil {
+		return err
+	}
+	if current.Status == requested.Status {
+		// applied by an earlier delivery
+		return nil
+	}
+
+	notification, err := mod.NewEvent(msg.CorrelationID, events.AppointmentUpdated{
+		Healthcare:    requested.Healthcare,
+		AppointmentID: requested.AppointmentID,
+		HealthID:      current.HealthID,
+		Name:          current.FullName,
+		Status:        requested.Status,
+	})
+	if err != nil {
+		return Permanent(err)
+	}
+	_, err = w.store.TransitionAppointment(requested.HealthcareID, requested.AppointmentID, requested.Status, requested.Actor, requested.Reason, notification)
+	switch {
+	case errors.Is(err, mod.ErrAppointmentNotFound), errors.Is(err, mod.ErrInvalidTransition), errors.Is(err, mod.ErrSlotTaken):
+		return Permanent(err)
+	}
+	return err
+}
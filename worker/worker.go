@@ -0,0 +1,160 @@
+// Package worker applies the messages the API queues, run it with `fs worker`.
+// Records and appointment updates are handled here, other packages add their
+// events with On (notify sends the emails of the logs queue).
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	mod "vaibhavyadav-dev/healthcareServer/databases"
+	"vaibhavyadav-dev/healthcareServer/events"
+	mq "vaibhavyadav-dev/healthcareServer/rabbitmq"
+)
+
+const (
+	// how long a handled event id is remembered, redeliveries later than this
+	// are still caught by the stores (record ids, status transitions)
+	processedTTL = 7 * 24 * time.Hour
+	// a worker that died while handling a message holds the claim this long
+	claimTTL = 5 * time.Minute
+)
+
+// Store is what the worker needs from databases.CombinedStore
+type Store interface {
+	Consume(ctx context.Context, queue string, prefetch int, handle mq.Handler) error
+	CreatepatientRecords(healthID string, records *mod.PatientRecords) (*mod.PatientRecords, error)
+	GetAppointment(healthcare_id string, id int64) (*mod.Appointments, error)
+	TransitionAppointment(healthcare_id string, id int64, status, actor, reason string, events ...*mod.OutboxEvent) (*mod.Appointments, error)
+	SetNX(key string, value interface{}, ttl time.Duration) (bool, error)
+	SetWithTTL(key, value string, ttl time.Duration) error
+	Exists(key string) (bool, error)
+	Del(key string) error
+}
+
+// ErrPermanent marks failures a redelivery can't fix, the message is dead-lettered
+var ErrPermanent = errors.New("permanent failure")
+
+// Permanent wraps err so the message is dead-lettered instead of retried
+func Permanent(err error) error {
+	return fmt.Errorf("%w: %w", ErrPermanent, err)
+}
+
+// HandlerFunc applies one event, the message is acked when it returns nil
+type HandlerFunc func(ctx context.Context, msg *events.Message) error
+
+type Worker struct {
+	store    Store
+	prefetch int
+	queues   []string
+	handlers map[string]HandlerFunc
+}
+
+func New(store Store, prefetch int) *Worker {
+	w := &Worker{store: store, prefetch: prefetch, handlers: map[string]HandlerFunc{}}
+	w.On(events.PatientRecordSubmitted{}, w.storeRecord)
+	w.On(events.AppointmentUpdateRequested{}, w.updateAppointment)
+	return w
+}
+
+// On handles events of the same type as event with handler, Run consumes their queue
+func (w *Worker) On(event events.Event, handler HandlerFunc) {
+	w.handlers[event.Type()] = handler
+	if !w.handles(event.Queue()) {
+		w.queues = append(w.queues, event.Queue())
+	}
+}
+
+// Queues lists the queues that have handlers
+func (w *Worker) Queues() []string {
+	return w.queues
+}
+
+func (w *Worker) handles(queue string) bool {
+	for _, handled := range w.queues {
+		if handled == queue {
+			return true
+		}
+	}
+	return false
+}
+
+// Run consumes queues until ctx is done, all queues with handlers when none are given
+func (w *Worker) Run(ctx context.Context, queues ...string) error {
+	if len(queues) == 0 {
+		queues = w.queues
+	}
+	for _, queue := range queues {
+		// every message of a queue without handlers would be dead-lettered
+		if !w.handles(queue) {
+			return fmt.Errorf("no handlers for queue %s", queue)
+		}
+	}
+	errs := make(chan error, len(queues))
+	var wg sync.WaitGroup
+	for _, queue := range queues {
+		wg.Add(1)
+		go func(queue string) {
+			defer wg.Done()
+			log.Printf("worker: consuming %s", queue)
+			if err := w.store.Consume(ctx, queue, w.prefetch, w.Handle); err != nil {
+				errs <- fmt.Errorf("%s: %w", queue, err)
+			}
+		}(queue)
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+// Handle decodes one message and applies it at most once per event id
+func (w *Worker) Handle(ctx context.Context, body []byte) mq.Outcome {
+	msg, err := events.Decode(body)
+	if err != nil {
+		log.Printf("worker: rejecting message: %v", err)
+		return mq.Reject
+	}
+	handler, ok := w.handlers[msg.Type]
+	if !ok {
+		log.Printf("worker: rejecting event %s of unknown type %s", msg.EventID, msg.Type)
+		return mq.Reject
+	}
+
+	processedKey := "hip:worker:processed:" + msg.EventID
+	if done, err := w.store.Exists(processedKey); err != nil {
+		log.Printf("worker: event %s: %v", msg.EventID, err)
+		return mq.Retry
+	} else if done {
+		return mq.Ack
+	}
+	claimKey := "hip:worker:claim:" + msg.EventID
+	claimed, err := w.store.SetNX(claimKey, "1", claimTTL)
+	if err != nil {
+		log.Printf("worker: event %s: %v", msg.EventID, err)
+		return mq.Retry
+	}
+	if !claimed {
+		// another worker is on it, look again once it is done
+		return mq.Retry
+	}
+	defer w.store.Del(claimKey)
+
+	err = handler(ctx, msg)
+	switch {
+	case err == nil:
+		if err := w.store.SetWithTTL(processedKey, "1", processedTTL); err != nil {
+			log.Printf("worker: event %s handled but not marked: %v", msg.EventID, err)
+		}
+		return mq.Ack
+	case errors.Is(err, ErrPermanent):
+		log.Printf("worker: rejecting event %s (%s): %v", msg.EventID, msg.Type, err)
+		return mq.Reject
+	default:
+		log.Printf("worker: event %s (%s) failed, retrying: %v", msg.EventID, msg.Type, err)
+		return mq.Retry
+	}
+}
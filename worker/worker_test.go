@@ -0,0 +1,191 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	mod "vaibhavyadav-dev/healthcareServer/databases"
+	"vaibhavyadav-dev/healthcareServer/events"
+	mq "vaibhavyadav-dev/healthcareServer/rabbitmq"
+)
+
+type fakeStore struct {
+	keys        map[string]string
+	records     []*mod.PatientRecords
+	recordErr   error
+	appointment *mod.Appointments
+	transitions int
+	transitErr  error
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{keys: map[string]string{}}
+}
+
+func (f *fakeStore) Consume(ctx context.Context, queue string, prefetch int, handle mq.Handler) error {
+	return nil
+}
+
+func (f *fakeStore) CreatepatientRecords(healthID string, records *mod.PatientRecords) (*mod.PatientRecords, error) {
+	if f.recordErr != nil {
+		return nil, f.recordErr
+	}
+	for _, stored := range f.records {
+		if stored.ID == records.ID {
+			return nil, mod.ErrRecordExists
+		}
+	}
+	f.records = append(f.records, records)
+	return records, nil
+}
+
+func (f *fakeStore) GetAppointment(healthcare_id string, id int64) (*mod.Appointments, error) {
+	if f.appointment == nil || f.appointment.ID != id {
+		return nil, mod.ErrAppointmentNotFound
+	}
+	return f.appointment, nil
+}
+
+func (f *fakeStore) TransitionAppointment(healthcare_id string, id int64, status, actor, reason string, outbox ...*mod.OutboxEvent) (*mod.Appointments, error) {
+	if f.transitErr != nil {
+		return nil, f.transitErr
+	}
+	if err := mod.CheckTransition(f.appointment.Status, status); err != nil {
+		return nil, err
+	}
+	f.transitions++
+	f.appointment.Status = status
+	return f.appointment, nil
+}
+
+func (f *fakeStore) SetNX(key string, value interface{}, ttl time.Duration) (bool, error) {
+	if _, ok := f.keys[key]; ok {
+		return false, nil
+	}
+	f.keys[key] = "1"
+	return true, nil
+}
+
+func (f *fakeStore) SetWithTTL(key, value string, ttl time.Duration) error {
+	f.keys[key] = value
+	return nil
+}
+
+func (f *fakeStore) Exists(key string) (bool, error) {
+	_, ok := f.keys[key]
+	return ok, nil
+}
+
+func (f *fakeStore) Del(key string) error {
+	delete(f.keys, key)
+	return nil
+}
+
+func encode(t *testing.T, event events.Event) []byte {
+	t.Helper()
+	body, err := events.Encode(event, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+var healthcare = events.Healthcare{HealthcareID: "hip-0000000001", HealthcareName: "City Hospital"}
+
+func TestHandleRecordOnce(t *testing.T) {
+	store := newFakeStore()
+	w := New(store, 1)
+	body := encode(t, events.PatientRecordSubmitted{
+		Healthcare:      healthcare,
+		HealthID:        "patient-0000000001",
+		Issue:           "fever",
+		Description:     "high fever since monday",
+		MedicalSeverity: "low",
+		CreatedAt:       time.Now(),
+	})
+
+	if got := w.Handle(context.Background(), body); got != mq.Ack {
+		t.Fatalf("first delivery: got %v, want Ack", got)
+	}
+	if got := w.Handle(context.Background(), body); got != mq.Ack {
+		t.Fatalf("redelivery: got %v, want Ack", got)
+	}
+	if len(store.records) != 1 {
+		t.Fatalf("stored %d records, want 1", len(store.records))
+	}
+
+	// a redelivery after the processed mark expired is stopped by the record id
+	store.keys = map[string]string{}
+	if got := w.Handle(context.Background(), body); got != mq.Ack || len(store.records) != 1 {
+		t.Fatalf("late redelivery: got %v with %d records", got, len(store.records))
+	}
+}
+
+func TestHandleFailures(t *testing.T) {
+	store := newFakeStore()
+	w := New(store, 1)
+
+	if got := w.Handle(context.Background(), []byte("not json")); got != mq.Reject {
+		t.Fatalf("malformed message: got %v, want Reject", got)
+	}
+	if got := w.Handle(context.Background(), encode(t, events.RecordsViewed{Healthcare: healthcare})); got != mq.Reject {
+		t.Fatalf("unexpected event type: got %v, want Reject", got)
+	}
+	// fails validation, retrying can't help
+	if got := w.Handle(context.Background(), encode(t, events.PatientRecordSubmitted{Healthcare: healthcare})); got != mq.Reject {
+		t.Fatalf("invalid record: got %v, want Reject", got)
+	}
+
+	store.recordErr = errors.New("mongo is down")
+	body := encode(t, events.PatientRecordSubmitted{
+		Healthcare:      healthcare,
+		HealthID:        "patient-0000000001",
+		Issue:           "fever",
+		Description:     "high fever since monday",
+		MedicalSeverity: "low",
+	})
+	if got := w.Handle(context.Background(), body); got != mq.Retry {
+		t.Fatalf("store down: got %v, want Retry", got)
+	}
+	// the claim is released so the retry can run
+	store.recordErr = nil
+	if got := w.Handle(context.Background(), body); got != mq.Ack {
+		t.Fatalf("retry: got %v, want Ack", got)
+	}
+}
+
+func TestHandleAppointmentUpdate(t *testing.T) {
+	store := newFakeStore()
+	store.appointment = &mod.Appointments{ID: 7, HealthID: "patient-0000000001", Status: mod.StatusPending}
+	w := New(store, 1)
+
+	confirm := events.AppointmentUpdateRequested{Healthcare: healthcare, AppointmentID: 7, HealthID: "patient-0000000001", Status: mod.StatusConfirmed}
+	if got := w.Handle(context.Background(), encode(t, confirm)); got != mq.Ack {
+		t.Fatalf("confirm: got %v, want Ack", got)
+	}
+	// the same change sent again as a new event is already applied
+	if got := w.Handle(context.Background(), encode(t, confirm)); got != mq.Ack || store.transitions != 1 {
+		t.Fatalf("repeated confirm: got %v after %d transitions", got, store.transitions)
+	}
+
+	back := confirm
+	back.Status = mod.StatusPending
+	if got := w.Handle(context.Background(), encode(t, back)); got != mq.Reject {
+		t.Fatalf("invalid transition: got %v, want Reject", got)
+	}
+	other := confirm
+	other.HealthID = "patient-0000000002"
+	other.Status = mod.StatusCompleted
+	if got := w.Handle(context.Background(), encode(t, other)); got != mq.Reject {
+		t.Fatalf("appointment of another patient: got %v, want Reject", got)
+	}
+
+	store.transitErr = errors.New("connection reset")
+	done := confirm
+	done.Status = mod.StatusCompleted
+	if got := w.Handle(context.Background(), encode(t, done)); got != mq.Retry {
+		t.Fatalf("postgres down: got %v, want Retry", got)
+	}
+}